@@ -0,0 +1,379 @@
+// Package alert evaluates the alert rules of users on incoming sensor values and on aggregated data.
+// Fired and resolved alerts are recorded in the database, published on the hub topic of their user and
+// passed to a set of notifiers.
+package alert
+
+import (
+	"fmt"
+	"github.com/mysmartgrid/msg-prototype-2/db"
+	"github.com/mysmartgrid/msg-prototype-2/hub"
+	"github.com/mysmartgrid/msg2api"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// deviationDelay is the time after the end of an hour until its aggregated values are considered complete.
+const deviationDelay = 5 * time.Minute
+
+// Event is published on the hub topic of the user whenever one of the users alerts fires or is resolved.
+type Event struct {
+	Alert db.Alert
+}
+
+type sensorKey struct {
+	user, device, sensor string
+}
+
+type ruleState struct {
+	rule db.AlertRule
+
+	// violatedSince is the time of the first value of the current violation of a threshold rule.
+	violatedSince time.Time
+	// lastSeen is the time the last value of the sensor was observed.
+	lastSeen time.Time
+	// checkedHour is the last hour a deviation rule was evaluated for.
+	checkedHour time.Time
+
+	active *db.Alert
+}
+
+// change is an alert fired or resolved by a rule. Changes are made to the rule state under the engine lock and
+// recorded in the database by Run.
+type change struct {
+	st *ruleState
+	// alert is the active alert of the rule when the change was made. Its ID is set once a fired alert is recorded.
+	alert *db.Alert
+	// resolved is the time a resolved alert was resolved, zero for fired alerts.
+	resolved time.Time
+}
+
+// Engine keeps the state of all alert rules.
+// Values are passed to the engine with Observe, rules depending on time and aggregated data are evaluated by Run.
+// Fired and resolved alerts are recorded and delivered by Run as well, so Observe never waits for the database.
+type Engine struct {
+	Db        db.Db
+	Hub       *hub.Hub
+	Notifiers []Notifier
+
+	mtx      sync.Mutex
+	rules    map[uint64]*ruleState
+	bySensor map[sensorKey][]*ruleState
+	// pending holds the changes not recorded yet in the order they were made.
+	pending []change
+	// wake signals Run that changes are pending.
+	wake chan struct{}
+}
+
+// Reload loads all alert rules and unresolved alerts from the database. The state of rules that were already known
+// is kept, new rules start with their unresolved alert as active alert.
+func (e *Engine) Reload() error {
+	var rules []db.AlertRule
+	var unresolved []db.Alert
+	err := e.Db.View(func(tx db.Tx) error {
+		var err error
+		if rules, err = tx.AlertRules(); err != nil {
+			return err
+		}
+		unresolved, err = tx.UnresolvedAlerts()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	active := make(map[uint64]db.Alert, len(unresolved))
+	for _, a := range unresolved {
+		active[a.RuleID] = a
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	now := time.Now()
+	states := make(map[uint64]*ruleState, len(rules))
+	bySensor := make(map[sensorKey][]*ruleState)
+	for _, rule := range rules {
+		st, ok := e.rules[rule.ID]
+		if !ok {
+			st = &ruleState{rule: rule, lastSeen: now}
+			if a, ok := active[rule.ID]; ok {
+				st.active = &a
+			}
+		}
+		states[rule.ID] = st
+
+		key := sensorKey{rule.User, rule.Device, rule.Sensor}
+		bySensor[key] = append(bySensor[key], st)
+	}
+
+	e.rules = states
+	e.bySensor = bySensor
+	return nil
+}
+
+// Observe evaluates the rules of a sensor for a new value.
+func (e *Engine) Observe(user, device, sensor string, value msg2api.Measurement) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	pending := len(e.pending)
+	now := time.Now()
+	for _, st := range e.bySensor[sensorKey{user, device, sensor}] {
+		st.lastSeen = now
+
+		switch st.rule.Kind {
+		case db.AlertNoData:
+			e.resolve(st, now)
+
+		case db.AlertAbove, db.AlertBelow:
+			violated := value.Value > st.rule.Threshold
+			if st.rule.Kind == db.AlertBelow {
+				violated = value.Value < st.rule.Threshold
+			}
+
+			if !violated {
+				st.violatedSince = time.Time{}
+				e.resolve(st, value.Time)
+				continue
+			}
+
+			if st.violatedSince.IsZero() {
+				st.violatedSince = value.Time
+			}
+			if value.Time.Sub(st.violatedSince) >= st.rule.Duration {
+				e.fire(st, value.Time, value.Value, fmt.Sprintf("%v/%v is %v %v since %v",
+					device, sensor, st.rule.Kind, st.rule.Threshold, st.violatedSince.Format(time.RFC3339)))
+			}
+		}
+	}
+
+	if len(e.pending) > pending {
+		select {
+		case e.wakeup() <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wakeup returns the channel signalling pending changes. It must be called with the engine lock held.
+func (e *Engine) wakeup() chan struct{} {
+	if e.wake == nil {
+		e.wake = make(chan struct{}, 1)
+	}
+	return e.wake
+}
+
+// Run reloads the rules and evaluates rules that do not depend on incoming values every interval, and records the
+// changes made by Observe as they are made. Run does not return.
+func (e *Engine) Run(interval time.Duration) {
+	e.mtx.Lock()
+	wake := e.wakeup()
+	e.mtx.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.Reload(); err != nil {
+			log.Printf("could not load alert rules: %v", err)
+		}
+		e.check(time.Now())
+
+		for checked := false; !checked; {
+			e.record()
+			select {
+			case <-wake:
+			case <-ticker.C:
+				checked = true
+			}
+		}
+	}
+}
+
+func (e *Engine) check(now time.Time) {
+	e.mtx.Lock()
+
+	hour := now.Add(-deviationDelay).Truncate(time.Hour).Add(-time.Hour)
+
+	var deviation []*ruleState
+	for _, st := range e.rules {
+		switch st.rule.Kind {
+		case db.AlertNoData:
+			if silence := now.Sub(st.lastSeen); silence >= st.rule.Duration {
+				e.fire(st, now, silence.Seconds(), fmt.Sprintf("%v/%v sent no data since %v",
+					st.rule.Device, st.rule.Sensor, st.lastSeen.Format(time.RFC3339)))
+			}
+
+		case db.AlertDeviation:
+			if st.checkedHour.Equal(hour) {
+				continue
+			}
+			st.checkedHour = hour
+			deviation = append(deviation, st)
+		}
+	}
+	e.mtx.Unlock()
+
+	for _, st := range deviation {
+		e.checkDeviation(st, hour)
+	}
+}
+
+// checkDeviation compares the hourly average of the sensor of a rule to the average of the same hour one week earlier.
+// The rule is not changed by Reload, so it is read without the engine lock.
+func (e *Engine) checkDeviation(st *ruleState, hour time.Time) {
+	lastWeek := hour.AddDate(0, 0, -7)
+	sensors := map[string][]string{st.rule.Device: {st.rule.Sensor}}
+
+	var current, previous []msg2api.Measurement
+	err := e.Db.View(func(tx db.Tx) error {
+		user := tx.User(st.rule.User)
+		if user == nil {
+			return db.ErrNoUser
+		}
+
+		values, err := user.LoadReadings(hour, hour, "hour", sensors, nil)
+		if err != nil {
+			return err
+		}
+		current = values[st.rule.Device][st.rule.Sensor]
+
+		values, err = user.LoadReadings(lastWeek, lastWeek, "hour", sensors, nil)
+		if err != nil {
+			return err
+		}
+		previous = values[st.rule.Device][st.rule.Sensor]
+		return nil
+	})
+	if err != nil {
+		log.Printf("could not evaluate alert rule %v: %v", st.rule.ID, err)
+		return
+	}
+	if len(current) == 0 || len(previous) == 0 || previous[0].Value == 0 {
+		return
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	deviation := math.Abs(current[0].Value-previous[0].Value) / math.Abs(previous[0].Value)
+	if deviation <= st.rule.Threshold {
+		e.resolve(st, hour)
+	} else {
+		e.fire(st, hour, current[0].Value, fmt.Sprintf("%v/%v deviates by %.0f%% from the same hour last week (%v instead of %v)",
+			st.rule.Device, st.rule.Sensor, deviation*100, current[0].Value, previous[0].Value))
+	}
+}
+
+// fire makes a new alert the active alert of the rule, unless an alert of the rule is already active.
+// It must be called with the engine lock held.
+func (e *Engine) fire(st *ruleState, t time.Time, value float64, message string) {
+	if st.active != nil {
+		return
+	}
+
+	st.active = &db.Alert{
+		RuleID:  st.rule.ID,
+		Device:  st.rule.Device,
+		Sensor:  st.rule.Sensor,
+		Kind:    st.rule.Kind,
+		Fired:   t,
+		Value:   value,
+		Message: message,
+	}
+	e.pending = append(e.pending, change{st: st, alert: st.active})
+}
+
+// resolve resolves the active alert of the rule, if there is one. It must be called with the engine lock held.
+func (e *Engine) resolve(st *ruleState, t time.Time) {
+	if st.active == nil {
+		return
+	}
+
+	e.pending = append(e.pending, change{st: st, alert: st.active, resolved: t})
+	st.active = nil
+}
+
+// record records and delivers the pending changes. Changes that cannot be recorded are undone.
+// It is only called by Run, so changes are recorded in the order they were made.
+func (e *Engine) record() {
+	e.mtx.Lock()
+	changes := e.pending
+	e.pending = nil
+	e.mtx.Unlock()
+
+	for _, c := range changes {
+		e.mtx.Lock()
+		a := *c.alert
+		e.mtx.Unlock()
+
+		rule := c.st.rule
+		if c.resolved.IsZero() {
+			err := e.Db.Update(func(tx db.Tx) error {
+				user := tx.User(rule.User)
+				if user == nil {
+					return db.ErrNoUser
+				}
+
+				var err error
+				a.ID, err = user.AddAlert(a)
+				return err
+			})
+
+			e.mtx.Lock()
+			if err == nil {
+				c.alert.ID = a.ID
+			} else if c.st.active == c.alert {
+				c.st.active = nil
+			}
+			e.mtx.Unlock()
+
+			if err != nil {
+				log.Printf("could not record alert of rule %v: %v", rule.ID, err)
+				continue
+			}
+		} else {
+			// the alert was not recorded if it has no id
+			if a.ID == 0 {
+				continue
+			}
+
+			a.Resolved = &c.resolved
+			err := e.Db.Update(func(tx db.Tx) error {
+				user := tx.User(rule.User)
+				if user == nil {
+					return db.ErrNoUser
+				}
+				return user.ResolveAlert(a.ID, c.resolved)
+			})
+			if err != nil {
+				e.mtx.Lock()
+				if c.st.active == nil {
+					c.st.active = c.alert
+				}
+				e.mtx.Unlock()
+
+				log.Printf("could not resolve alert %v: %v", a.ID, err)
+				continue
+			}
+		}
+
+		e.deliver(rule, a)
+	}
+}
+
+func (e *Engine) deliver(rule db.AlertRule, a db.Alert) {
+	if e.Hub != nil {
+		e.Hub.Publish(rule.User, Event{a})
+	}
+
+	go func() {
+		for _, n := range e.Notifiers {
+			if err := n.Notify(rule, a); err != nil {
+				log.Printf("could not deliver alert %v: %v", a.ID, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,62 @@
+package alert
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mysmartgrid/msg-prototype-2/db"
+	"github.com/mysmartgrid/msg-prototype-2/webhook"
+	"net/smtp"
+	"strings"
+)
+
+// Notifier delivers alerts to the targets configured in their rule.
+type Notifier interface {
+	// Notify delivers a fired or resolved alert of rule.
+	Notify(rule db.AlertRule, a db.Alert) error
+}
+
+// WebhookNotifier delivers alerts as alert events to the webhook of their rule, signed and retried like all
+// webhook events. Alerts are also delivered to all webhooks of the user subscribed to alert events.
+type WebhookNotifier struct {
+	Webhooks *webhook.Dispatcher
+}
+
+// Notify implements Notifier.
+func (n *WebhookNotifier) Notify(rule db.AlertRule, a db.Alert) error {
+	n.Webhooks.EmitTo(rule.User, rule.WebhookURL, db.WebhookAlert, a)
+	return nil
+}
+
+// SMTPNotifier sends alerts by mail to the address of their rule.
+type SMTPNotifier struct {
+	// Addr is the address of the mail server, including the port.
+	Addr string
+	From string
+	// Auth is used to authenticate with the mail server if not nil.
+	Auth smtp.Auth
+}
+
+// Notify implements Notifier.
+func (n *SMTPNotifier) Notify(rule db.AlertRule, a db.Alert) error {
+	if rule.Email == "" {
+		return nil
+	}
+
+	subject := fmt.Sprintf("Alert for %v/%v", a.Device, a.Sensor)
+	if a.Resolved != nil {
+		subject = "Resolved: " + subject
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %v\r\n", headerValue(n.From))
+	fmt.Fprintf(&msg, "To: %v\r\n", headerValue(rule.Email))
+	fmt.Fprintf(&msg, "Subject: %v\r\n", headerValue(subject))
+	fmt.Fprintf(&msg, "\r\n%v\r\n", a.Message)
+
+	return smtp.SendMail(n.Addr, n.Auth, n.From, []string{rule.Email}, msg.Bytes())
+}
+
+// headerValue removes line breaks from a mail header value, so values cannot add headers or end the header.
+func headerValue(v string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(v)
+}
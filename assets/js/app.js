@@ -156,17 +156,20 @@ angular.module("msgp", ['ui.bootstrap'])
     .controller("DeviceListController", ["$scope", "$http", "devices", function ($scope, $http, devices) {
         $scope.devices = devices;
         $scope.addDeviceId = "";
+        $scope.addDeviceCode = "";
         $scope.openAddDeviceModal = function () {
             $scope.addDeviceId = "";
+            $scope.addDeviceCode = "";
             $('#addDeviceDialog').modal();
         };
         $scope.addDevice = function (e) {
             var url = $(e.target).attr("data-add-device-prefix");
             $scope.errorAddingDevice = null;
-            $http.post(url + encodeURIComponent($scope.addDeviceId))
+            $http.post(url + encodeURIComponent($scope.addDeviceId), { code: $scope.addDeviceCode })
                 .success(function (data, status, headers, config) {
                 $scope.devices[$scope.addDeviceId] = data;
                 $scope.addDeviceId = null;
+                $scope.addDeviceCode = null;
                 $("#addDeviceDialog").modal('hide');
             })
                 .error(function (data, status, headers, config) {
@@ -788,6 +791,9 @@ var Socket = (function () {
         this._closeHandlers = [];
         this._errorHandlers = [];
         this._updateHandlers = [];
+        this._alertHandlers = [];
+        this._summaryHandlers = [];
+        this._progressHandlers = [];
         this._metadataHandlers = [];
     }
     ;
@@ -838,6 +844,24 @@ var Socket = (function () {
     Socket.prototype._emitUpdate = function (update) {
         this._callHandlers(this._updateHandlers, update);
     };
+    Socket.prototype.onAlert = function (handler) {
+        this._alertHandlers.push(handler);
+    };
+    Socket.prototype._emitAlert = function (alert) {
+        this._callHandlers(this._alertHandlers, alert);
+    };
+    Socket.prototype.onSummary = function (handler) {
+        this._summaryHandlers.push(handler);
+    };
+    Socket.prototype._emitSummary = function (summary) {
+        this._callHandlers(this._summaryHandlers, summary);
+    };
+    Socket.prototype.onProgress = function (handler) {
+        this._progressHandlers.push(handler);
+    };
+    Socket.prototype._emitProgress = function (progress) {
+        this._callHandlers(this._progressHandlers, progress);
+    };
     Socket.prototype.onMetadata = function (handler) {
         this._metadataHandlers.push(handler);
     };
@@ -848,7 +872,20 @@ var Socket = (function () {
         var data = JSON.parse(msg.data);
         switch (data.cmd) {
             case "update":
-                this._emitUpdate(data.args);
+                if (data.args.resolution === "alert" || data.args.resolution === "alert-resolved") {
+                    this._emitAlert({ resolved: data.args.resolution === "alert-resolved", values: data.args.values });
+                }
+                else if (data.args.resolution.indexOf("summary-") === 0) {
+                    var parts = data.args.resolution.split("-");
+                    this._emitSummary({ kind: parts[1], period: parts[2], values: data.args.values });
+                }
+                else if (data.args.resolution.indexOf("progress-") === 0) {
+                    var value = data.args.values[""][""][0];
+                    this._emitProgress({ resolution: data.args.resolution.substr("progress-".length), until: value[0], progress: value[1] });
+                }
+                else {
+                    this._emitUpdate(data.args);
+                }
                 break;
             case "metadata":
                 this._emitMetadata(data.args);
@@ -910,6 +947,19 @@ var Socket = (function () {
         this._sendUserCommand(cmd);
     };
     ;
+    Socket.prototype.requestSummary = function () {
+        var cmd = {
+            cmd: "getValues",
+            args: {
+                since: 0,
+                until: 0,
+                resolution: "summary",
+                sensors: {}
+            }
+        };
+        this._sendUserCommand(cmd);
+    };
+    ;
     Socket.prototype.requestRealtimeUpdates = function (sensors) {
         var cmd = {
             cmd: "requestRealtimeUpdates",
@@ -172,9 +172,11 @@ angular.module("msgp", ['ui.bootstrap'])
 .controller("DeviceListController", ["$scope", "$http", "devices", function($scope, $http, devices) {
 	$scope.devices = devices;
 	$scope.addDeviceId = "";
+	$scope.addDeviceCode = "";
 
 	$scope.openAddDeviceModal = () : void => {
 		$scope.addDeviceId = "";
+		$scope.addDeviceCode = "";
 		$('#addDeviceDialog').modal();
 	}
 
@@ -182,10 +184,11 @@ angular.module("msgp", ['ui.bootstrap'])
 		var url = $(e.target).attr("data-add-device-prefix");
 		$scope.errorAddingDevice = null;
 
-		$http.post(url + encodeURIComponent($scope.addDeviceId))
+		$http.post(url + encodeURIComponent($scope.addDeviceId), {code: $scope.addDeviceCode})
 			.success(function(data, status, headers, config) {
 				$scope.devices[$scope.addDeviceId] = data;
 				$scope.addDeviceId = null;
+				$scope.addDeviceCode = null;
 				$("#addDeviceDialog").modal('hide');
 			})
 			.error(function(data, status, headers, config) {
@@ -25,6 +25,18 @@ export interface UpdateHandler {
 	(update : UpdateData) : void;
 }
 
+export interface AlertHandler {
+	(alert : AlertData) : void;
+}
+
+export interface SummaryHandler {
+	(summary : SummaryData) : void;
+}
+
+export interface ProgressHandler {
+	(progress : ProgressData) : void;
+}
+
 /*
  * Messages
  */
@@ -34,6 +46,29 @@ export interface UpdateData {
 	values: DeviceSensorMap<[number, number][]>;
 }
 
+// Alerts are sent as updates with a special resolution, the value of the update is the id of the alert.
+export interface AlertData {
+	resolved : boolean;
+	values : DeviceSensorMap<[number, number][]>;
+}
+
+// Summaries are requested with requestSummary and sent as updates with resolution summary-<kind>-<period>.
+// Totals of devices are sent for sensor "", the total of the user for device "" and sensor "".
+export interface SummaryData {
+	kind : string; // "energy" (Wh) or "peak" (W)
+	period : string; // "today", "week", "month" or "year"
+	values : DeviceSensorMap<[number, number][]>;
+}
+
+// Values requested with requestValues are sent in chunks, each followed by an update with resolution
+// progress-<resolution>. Its only value, for device "" and sensor "", is the time of the last value sent and the
+// fraction of the requested timespan sent so far.
+export interface ProgressData {
+	resolution : string;
+	until : number;
+	progress : number;
+}
+
 export interface MetadataUpdate {
 	devices : DeviceMap<DeviceMetadataUpdate>;
 }
@@ -74,6 +109,9 @@ export class Socket {
 		this._closeHandlers = [];
 		this._errorHandlers = [];
 		this._updateHandlers = [];
+		this._alertHandlers = [];
+		this._summaryHandlers = [];
+		this._progressHandlers = [];
 		this._metadataHandlers = [];
 	};
 
@@ -140,6 +178,36 @@ export class Socket {
 		this._callHandlers(this._updateHandlers, update);
 	}
 
+	private _alertHandlers : AlertHandler[];
+
+	public onAlert(handler : AlertHandler) {
+		this._alertHandlers.push(handler);
+	}
+
+	private _emitAlert(alert : AlertData) : void {
+		this._callHandlers(this._alertHandlers, alert);
+	}
+
+	private _summaryHandlers : SummaryHandler[];
+
+	public onSummary(handler : SummaryHandler) {
+		this._summaryHandlers.push(handler);
+	}
+
+	private _emitSummary(summary : SummaryData) : void {
+		this._callHandlers(this._summaryHandlers, summary);
+	}
+
+	private _progressHandlers : ProgressHandler[];
+
+	public onProgress(handler : ProgressHandler) {
+		this._progressHandlers.push(handler);
+	}
+
+	private _emitProgress(progress : ProgressData) : void {
+		this._callHandlers(this._progressHandlers, progress);
+	}
+
 	private _metadataHandlers : MetadataHandler[];
 
 	public onMetadata(handler : MetadataHandler) {
@@ -155,7 +223,17 @@ export class Socket {
 
         switch (data.cmd) {
         case "update":
-            this._emitUpdate(data.args);
+            if (data.args.resolution === "alert" || data.args.resolution === "alert-resolved") {
+                this._emitAlert({resolved: data.args.resolution === "alert-resolved", values: data.args.values});
+            } else if (data.args.resolution.indexOf("summary-") === 0) {
+                var parts = data.args.resolution.split("-");
+                this._emitSummary({kind: parts[1], period: parts[2], values: data.args.values});
+            } else if (data.args.resolution.indexOf("progress-") === 0) {
+                var value = data.args.values[""][""][0];
+                this._emitProgress({resolution: data.args.resolution.substr("progress-".length), until: value[0], progress: value[1]});
+            } else {
+                this._emitUpdate(data.args);
+            }
             break;
 
         case "metadata":
@@ -229,6 +307,19 @@ export class Socket {
         this._sendUserCommand(cmd);
     };
 
+	public requestSummary() : void {
+		var cmd = {
+			cmd: "getValues",
+			args: {
+				since: 0,
+				until: 0,
+				resolution: "summary",
+				sensors: {}
+			}
+		};
+		this._sendUserCommand(cmd);
+	};
+
     public requestRealtimeUpdates(sensors : RequestRealtimeUpdateArgs) : void {
         var cmd = {
             cmd: "requestRealtimeUpdates",
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"hash/fnv"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -25,7 +33,19 @@ type postgresConfig struct {
 type daemonConfig struct {
 	AggregationInterval time.Duration  `toml:"aggregationinterval"`
 	CleanupInterval     time.Duration  `toml:"cleanupinterval"`
+	SummaryInterval     time.Duration  `toml:"summaryinterval"`
+	PartitionInterval   time.Duration  `toml:"partitioninterval"`
 	DbCOnfig            postgresConfig `toml:"postgres"`
+	// Listen is the address the /metrics, /healthz, /readyz and /jobs endpoints are served on, nothing is served if empty.
+	Listen string `toml:"listen"`
+	// MetricsListen is the former name of Listen, used if Listen is empty.
+	MetricsListen string `toml:"metrics-listen"`
+	// Jitter delays every run by a random fraction of the interval of its job up to the given fraction.
+	Jitter float64 `toml:"jitter"`
+	// MaxRetries is the number of times a failed run is retried before waiting for the next interval.
+	MaxRetries int `toml:"max-retries"`
+	// RetryDelay is the delay before the first retry of a failed run in seconds, doubled with every further retry.
+	RetryDelay time.Duration `toml:"retry-delay"`
 }
 
 var configFile = flag.String("config", "", "configuration file")
@@ -33,80 +53,378 @@ var verbose = flag.Bool("v", false, "verbose output")
 var config daemonConfig
 var db *sql.DB
 
-type jobStatus struct {
-	Err      error
-	Duration time.Duration
+// leaderLockKey is the postgres advisory lock held by the msgdbd instance running the jobs.
+const leaderLockKey = 0x6d736764
+
+// historySize is the number of runs kept per job for the status API.
+const historySize = 50
+
+var (
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "msgdbd",
+		Name:      "job_duration_seconds",
+		Help:      "Time taken by job runs.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"job"})
+	jobLastRun = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "msgdbd",
+		Name:      "job_last_run_timestamp_seconds",
+		Help:      "Time the last successful run of a job finished.",
+	}, []string{"job"})
+	jobOverruns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "msgdbd",
+		Name:      "job_overruns_total",
+		Help:      "Number of job runs that took longer than their interval.",
+	}, []string{"job"})
+	jobFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "msgdbd",
+		Name:      "job_failures_total",
+		Help:      "Number of failed job runs, including retries.",
+	}, []string{"job"})
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "msgdbd",
+		Name:      "leader",
+		Help:      "1 if this instance holds the leader lock and runs jobs, 0 otherwise.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(jobDuration, jobLastRun, jobOverruns, jobFailures, isLeader)
+}
+
+// leadership tracks whether this instance holds the leader lock.
+type leadership struct {
+	mtx     sync.Mutex
+	leading bool
+	changed chan struct{}
+}
+
+var leader = leadership{changed: make(chan struct{})}
+
+func (l *leadership) set(leading bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.leading == leading {
+		return
+	}
+	l.leading = leading
+	close(l.changed)
+	l.changed = make(chan struct{})
+
+	if leading {
+		isLeader.Set(1)
+		log.Println("Acquired leader lock, running jobs")
+	} else {
+		isLeader.Set(0)
+		log.Println("Lost leader lock, pausing jobs")
+	}
+}
+
+// get returns whether this instance is leading and a channel that is closed when that changes.
+func (l *leadership) get() (bool, <-chan struct{}) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.leading, l.changed
+}
+
+// elect tries to acquire the leader lock every interval and holds it on a dedicated connection as long as the
+// connection stays alive. Every replica of msgdbd runs elect, only the one holding the lock runs jobs.
+func elect(interval time.Duration) {
+	for {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			log.Printf("Leader election: %v", err)
+			time.Sleep(interval)
+			continue
+		}
+
+		var acquired bool
+		err = conn.QueryRowContext(context.Background(), `SELECT pg_try_advisory_lock($1)`, leaderLockKey).Scan(&acquired)
+		if err != nil || !acquired {
+			if err != nil {
+				log.Printf("Leader election: %v", err)
+			}
+			conn.Close()
+			time.Sleep(interval)
+			continue
+		}
+
+		leader.set(true)
+		for {
+			time.Sleep(interval)
+			if err := conn.PingContext(context.Background()); err != nil {
+				log.Printf("Leader election: lost connection holding the leader lock: %v", err)
+				break
+			}
+		}
+		leader.set(false)
+		conn.Close()
+	}
+}
+
+// jobRun is a single attempt to run a job.
+type jobRun struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Attempt  int           `json:"attempt"`
+	Error    string        `json:"error,omitempty"`
 }
 
 type job struct {
 	Name     string
-	RunJob   func(chan jobStatus)
+	Query    string
 	Interval time.Duration
+	// InitialQuery, if set, replaces Query until it ran successfully once.
+	InitialQuery string
+
+	mtx         sync.Mutex
+	started     time.Time
+	lastSuccess time.Time
+	initialDone bool
+	running     bool
+	next        time.Time
+	history     []jobRun
 }
 
-func (j *job) Run() {
-	ticker := time.NewTicker(j.Interval)
-	status := make(chan jobStatus)
+var jobs []*job
+
+// healthy returns an error if the job has not succeeded within the last three intervals while this instance was leading.
+func (j *job) healthy() error {
+	if leading, _ := leader.get(); !leading {
+		return nil
+	}
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	last := j.lastSuccess
+	if last.Before(j.started) {
+		last = j.started
+	}
+	if since := time.Since(last); since > 3*j.Interval {
+		return fmt.Errorf("no successful run for %v", since)
+	}
+	return nil
+}
+
+// lockKey is the advisory lock held by the transaction of a run, so runs of a job never overlap even if two
+// instances consider themselves leaders during a handover.
+func (j *job) lockKey() int64 {
+	h := fnv.New32a()
+	h.Write([]byte(j.Name))
+	return leaderLockKey<<32 | int64(h.Sum32())
+}
+
+// query returns the query the next run of the job executes.
+func (j *job) query() string {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.InitialQuery != "" && !j.initialDone {
+		return j.InitialQuery
+	}
+	return j.Query
+}
+
+// runOnce runs the query of the job in a transaction. skipped is true if the job is running elsewhere.
+func (j *job) runOnce() (skipped bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow(`SELECT pg_try_advisory_xact_lock($1)`, j.lockKey()).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return true, nil
+	}
+
+	if _, err := tx.Exec(j.query()); err != nil {
+		return false, err
+	}
+	return false, tx.Commit()
+}
+
+func (j *job) record(run jobRun) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	j.history = append(j.history, run)
+	if len(j.history) > historySize {
+		j.history = j.history[len(j.history)-historySize:]
+	}
+	if run.Error == "" {
+		j.lastSuccess = run.Start.Add(run.Duration)
+		j.initialDone = true
+	}
+}
+
+// runWithRetries runs the job, retrying failed runs with exponential backoff.
+func (j *job) runWithRetries() {
+	j.mtx.Lock()
+	j.running = true
+	j.mtx.Unlock()
 	defer func() {
-		ticker.Stop()
-		close(status)
+		j.mtx.Lock()
+		j.running = false
+		j.mtx.Unlock()
 	}()
 
-	handleStatus := func(s jobStatus) {
-		if s.Err != nil {
-			log.Panicf("Error during job '%s': %s", j.Name, s.Err)
-		}
+	delay := config.RetryDelay
+	for attempt := 1; ; attempt++ {
 		if *verbose {
-			log.Printf("Job '%s' took %s", j.Name, s.Duration)
+			log.Printf("Running job '%s' (attempt %d)...", j.Name, attempt)
 		}
-		if s.Duration > config.AggregationInterval {
-			log.Printf("WARNING: Job '%s' took longer than interval (%s)!", j.Name, s.Duration)
+
+		start := time.Now()
+		skipped, err := j.runOnce()
+		run := jobRun{Start: start, Duration: time.Since(start), Attempt: attempt}
+
+		if skipped {
+			if *verbose {
+				log.Printf("Job '%s' is running elsewhere, skipping", j.Name)
+			}
+			return
 		}
-	}
 
-	for {
-		if *verbose {
-			log.Printf("Running job '%s'...", j.Name)
+		if err == nil {
+			j.record(run)
+			jobDuration.WithLabelValues(j.Name).Observe(run.Duration.Seconds())
+			jobLastRun.WithLabelValues(j.Name).SetToCurrentTime()
+			if *verbose {
+				log.Printf("Job '%s' took %s", j.Name, run.Duration)
+			}
+			if run.Duration > j.Interval {
+				jobOverruns.WithLabelValues(j.Name).Inc()
+				log.Printf("WARNING: Job '%s' took longer than interval (%s)!", j.Name, run.Duration)
+			}
+			return
 		}
-		go j.RunJob(status)
 
-		select {
-		case <-ticker.C:
-			s := <-status
-			handleStatus(s)
-		case s := <-status:
-			handleStatus(s)
-			<-ticker.C
+		run.Error = err.Error()
+		j.record(run)
+		jobFailures.WithLabelValues(j.Name).Inc()
+		log.Printf("Error during job '%s' (attempt %d): %s", j.Name, attempt, err)
+
+		if attempt > config.MaxRetries {
+			return
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > j.Interval {
+			delay = j.Interval
 		}
 	}
 }
 
-func newDbFunc(query string) func(chan jobStatus) {
-	return func(state chan jobStatus) {
+// Run runs the job every interval plus jitter while this instance is the leader. Runs never overlap, a run taking
+// longer than the interval delays the next one. Run does not return.
+func (j *job) Run() {
+	j.mtx.Lock()
+	j.started = time.Now()
+	j.mtx.Unlock()
+
+	for {
+		leading, changed := leader.get()
+		if !leading {
+			<-changed
+			j.mtx.Lock()
+			j.started = time.Now()
+			j.mtx.Unlock()
+			continue
+		}
+
 		start := time.Now()
+		j.runWithRetries()
 
-		tx, err := db.Begin()
-		if err != nil {
-			state <- jobStatus{err, time.Since(start)}
-			return
+		next := start.Add(j.Interval + time.Duration(rand.Float64()*config.Jitter*float64(j.Interval)))
+		j.mtx.Lock()
+		j.next = next
+		j.mtx.Unlock()
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-changed:
 		}
+	}
+}
 
-		defer func() {
-			if err != nil {
-				tx.Rollback()
-			}
-		}()
+type jobHealth struct {
+	LastSuccess *time.Time `json:"lastSuccess"`
+	Error       string     `json:"error,omitempty"`
+}
 
-		_, err = tx.Exec(query)
-		if err != nil {
-			_ = tx.Rollback()
-			state <- jobStatus{err, time.Since(start)}
-			return
+// healthz reports the time of the last successful run of every job, with status 503 if any job failed to run
+// successfully within the last three intervals.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	result := make(map[string]jobHealth, len(jobs))
+	for _, j := range jobs {
+		var h jobHealth
+		if err := j.healthy(); err != nil {
+			h.Error = err.Error()
+			status = http.StatusServiceUnavailable
 		}
+		j.mtx.Lock()
+		if !j.lastSuccess.IsZero() {
+			last := j.lastSuccess
+			h.LastSuccess = &last
+		}
+		j.mtx.Unlock()
+		result[j.Name] = h
+	}
+
+	data, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
 
-		state <- jobStatus{tx.Commit(), time.Since(start)}
+// readyz reports whether the database is reachable.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if err := db.Ping(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	w.Write([]byte("ok"))
+}
+
+type jobStatus struct {
+	Name     string        `json:"name"`
+	Interval time.Duration `json:"interval"`
+	Running  bool          `json:"running"`
+	Next     *time.Time    `json:"next"`
+	History  []jobRun      `json:"history"`
+}
+
+// jobsStatus lists all jobs with their recent runs, newest first.
+func jobsStatus(w http.ResponseWriter, r *http.Request) {
+	leading, _ := leader.get()
+	result := struct {
+		Leader bool        `json:"leader"`
+		Jobs   []jobStatus `json:"jobs"`
+	}{Leader: leading}
+
+	for _, j := range jobs {
+		j.mtx.Lock()
+		s := jobStatus{Name: j.Name, Interval: j.Interval, Running: j.running}
+		if !j.next.IsZero() {
+			next := j.next
+			s.Next = &next
+		}
+		for i := len(j.history) - 1; i >= 0; i-- {
+			s.History = append(s.History, j.history[i])
+		}
+		j.mtx.Unlock()
+		result.Jobs = append(result.Jobs, s)
+	}
+
+	data, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
 }
 
 func openDb(sqlAddr, sqlPort, sqlDb, sqlUser, sqlPass string) (*sql.DB, error) {
@@ -133,6 +451,10 @@ func init() {
 		log.Fatal("missing -config")
 	}
 
+	config.Jitter = 0.1
+	config.MaxRetries = 3
+	config.RetryDelay = 10
+
 	configData, err := ioutil.ReadFile(*configFile)
 	if err != nil {
 		log.Fatalf("could not read config file: %v", err.Error())
@@ -140,6 +462,9 @@ func init() {
 	if err := toml.Unmarshal(configData, &config); err != nil {
 		log.Fatalf("could not load config file: %v", err.Error())
 	}
+	if config.Listen == "" {
+		config.Listen = config.MetricsListen
+	}
 
 	if config.DbCOnfig.User == "" || config.DbCOnfig.Address == "" || config.DbCOnfig.Database == "" {
 		log.Fatal("postgres config incomplete")
@@ -147,6 +472,9 @@ func init() {
 
 	config.AggregationInterval = config.AggregationInterval * time.Minute
 	config.CleanupInterval = config.CleanupInterval * time.Minute
+	config.SummaryInterval = config.SummaryInterval * time.Minute
+	config.PartitionInterval = config.PartitionInterval * time.Minute
+	config.RetryDelay = config.RetryDelay * time.Second
 
 	db, err = openDb(config.DbCOnfig.Address, config.DbCOnfig.Port, config.DbCOnfig.Database,
 		config.DbCOnfig.User, config.DbCOnfig.Password)
@@ -158,8 +486,11 @@ func init() {
 func main() {
 	defer db.Close()
 
+	rand.Seed(time.Now().UnixNano())
+
 	if config.AggregationInterval != 0 {
-		aggrJob := job{Name: "Aggregation", RunJob: newDbFunc(`SELECT do_aggregate()`), Interval: config.AggregationInterval}
+		aggrJob := &job{Name: "Aggregation", Query: `SELECT do_aggregate()`, Interval: config.AggregationInterval}
+		jobs = append(jobs, aggrJob)
 		go aggrJob.Run()
 	} else {
 		if *verbose {
@@ -167,13 +498,58 @@ func main() {
 		}
 	}
 	if config.CleanupInterval != 0 {
-		aggrJob := job{Name: "Cleanup", RunJob: newDbFunc(`SELECT do_remove_old_values()`), Interval: config.CleanupInterval}
+		aggrJob := &job{Name: "Cleanup", Query: `SELECT do_remove_old_values()`, Interval: config.CleanupInterval}
+		jobs = append(jobs, aggrJob)
 		go aggrJob.Run()
 	} else {
 		if *verbose {
 			log.Println("Cleanup interval not set or 0, not starting cleanup job.")
 		}
 	}
+	if config.PartitionInterval != 0 {
+		partitionJob := &job{Name: "Partitions", Query: `SELECT do_manage_partitions()`, Interval: config.PartitionInterval}
+		jobs = append(jobs, partitionJob)
+		go partitionJob.Run()
+	} else {
+		if *verbose {
+			log.Println("Partition interval not set or 0, not starting partition job.")
+		}
+	}
+	if config.SummaryInterval != 0 {
+		// values may arrive late, so the previous day is summarized again on every run. The first run summarizes
+		// the whole year, so summaries are complete after upgrades and downtimes.
+		summaryJob := &job{
+			Name:         "Summary",
+			Query:        `SELECT do_summarize(now() - interval '1 day')`,
+			InitialQuery: `SELECT do_summarize(date_trunc('year', now()))`,
+			Interval:     config.SummaryInterval,
+		}
+		jobs = append(jobs, summaryJob)
+		go summaryJob.Run()
+
+		// days backfilled by devices are queued by msgpd and summarized separately
+		backlogJob := &job{Name: "Backfill summary", Query: `SELECT do_summarize_backlog()`, Interval: config.SummaryInterval}
+		jobs = append(jobs, backlogJob)
+		go backlogJob.Run()
+	} else {
+		if *verbose {
+			log.Println("Summary interval not set or 0, not starting summary job.")
+		}
+	}
+
+	go elect(10 * time.Second)
+
+	if config.Listen != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		http.HandleFunc("/healthz", healthz)
+		http.HandleFunc("/readyz", readyz)
+		http.HandleFunc("/jobs", jobsStatus)
+		go func() {
+			if err := http.ListenAndServe(config.Listen, nil); err != nil {
+				log.Fatalf("could not serve http: %v", err)
+			}
+		}()
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
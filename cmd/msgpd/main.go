@@ -1,28 +1,42 @@
 package main
 
 import (
-	"crypto/sha256"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	msgp "github.com/mysmartgrid/msg-prototype-2"
+	"github.com/mysmartgrid/msg-prototype-2/alert"
 	msgpdb "github.com/mysmartgrid/msg-prototype-2/db"
 	"github.com/mysmartgrid/msg-prototype-2/hub"
+	"github.com/mysmartgrid/msg-prototype-2/mail"
+	"github.com/mysmartgrid/msg-prototype-2/metrics"
 	"github.com/mysmartgrid/msg-prototype-2/regdev"
+	"github.com/mysmartgrid/msg-prototype-2/webhook"
 	"github.com/mysmartgrid/msg2api"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/smtp"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -32,6 +46,11 @@ type postgresConfig struct {
 	Address  string `toml:"address"`
 	Port     string `toml:"port"`
 	Database string `toml:"database"`
+	// Migrate applies pending schema migrations on startup, msgpd refuses to start with pending migrations otherwise.
+	Migrate bool `toml:"migrate"`
+	// Durability is "unlogged", "logged" or "wal", see the Durability constants of the db package.
+	Durability string `toml:"durability"`
+	WALDir     string `toml:"wal-dir"`
 }
 
 type tlsConfig struct {
@@ -47,20 +66,93 @@ type benchmarkConfig struct {
 	Duration    time.Duration `toml:"duration"`
 }
 
+type alertsConfig struct {
+	// Interval is the time between evaluations of rules that do not depend on incoming values, in seconds.
+	Interval     int    `toml:"interval"`
+	SMTPAddress  string `toml:"smtp-address"`
+	SMTPFrom     string `toml:"smtp-from"`
+	SMTPUser     string `toml:"smtp-user"`
+	SMTPPassword string `toml:"smtp-password"`
+}
+
+type mailConfig struct {
+	// Sender is "smtp", "log" or "file", password resets are disabled if empty. The log and file senders do not
+	// deliver mails and are meant for testing.
+	Sender      string `toml:"sender"`
+	SMTPAddress string `toml:"smtp-address"`
+	From        string `toml:"from"`
+	User        string `toml:"user"`
+	Password    string `toml:"password"`
+	// Dir is the directory the file sender writes mails to.
+	Dir string `toml:"dir"`
+	// BaseURL is the external URL of msgpd links in mails point to, e.g. https://msgp.example.org.
+	BaseURL string `toml:"base-url"`
+}
+
+type loginConfig struct {
+	// MaxFailures is the number of consecutive failed logins after which an account is locked for Lockout seconds.
+	// The lockout doubles with every further failed login, up to MaxLockout seconds.
+	MaxFailures int `toml:"max-failures"`
+	Lockout     int `toml:"lockout"`
+	MaxLockout  int `toml:"max-lockout"`
+	// IPFailures is the number of failed logins from one address within IPWindow seconds after which further
+	// logins from the address are refused.
+	IPFailures int `toml:"ip-failures"`
+	IPWindow   int `toml:"ip-window"`
+}
+
+// sessionKey is a pair of keys of session cookies, both base64 encoded.
+type sessionKey struct {
+	// Hash is the key of the signature of cookies, 32 or 64 bytes.
+	Hash string `toml:"hash"`
+	// Encrypt is the AES key cookies are encrypted with, 16, 24 or 32 bytes.
+	Encrypt string `toml:"encrypt"`
+}
+
+type sessionsConfig struct {
+	// Keys are the keys of session cookies. New cookies use the first key, cookies of all keys are accepted.
+	// Random keys are used if empty, sessions end when msgpd restarts then.
+	Keys []sessionKey `toml:"keys"`
+	// IdleTimeout and AbsoluteTimeout end sessions not used for or started longer than the given seconds ago.
+	IdleTimeout     int `toml:"idle-timeout"`
+	AbsoluteTimeout int `toml:"absolute-timeout"`
+}
+
+type mqttConfig struct {
+	// Broker is the URL of the broker to connect to, the bridge is disabled if empty.
+	Broker   string `toml:"broker"`
+	ClientID string `toml:"client-id"`
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+	Prefix   string `toml:"prefix"`
+	// Embedded is the address of an embedded broker to start, if not empty.
+	Embedded string `toml:"embedded"`
+}
+
 type serverConfig struct {
-	ListenAddr        string          `toml:"listen"`
-	AssetsDir         string          `toml:"assets-dir"`
-	TemplatesDir      string          `toml:"templates-dir"`
-	DbDir             string          `toml:"db-dir"`
-	Postgres          postgresConfig  `toml:"postgres"`
-	TLS               tlsConfig       `toml:"tls"`
-	DeviceProxyConfig string          `toml:"device-proxy-config"`
-	EnableAdminOps    bool            `toml:"motherlode"`
-	Benchmark         benchmarkConfig `toml:"benchmark"`
+	ListenAddr string `toml:"listen"`
+	// MetricsListen is the address /metrics is served on, separate from the public listener. Nothing is served if
+	// empty.
+	MetricsListen     string         `toml:"metrics-listen"`
+	AssetsDir         string         `toml:"assets-dir"`
+	TemplatesDir      string         `toml:"templates-dir"`
+	DbDir             string         `toml:"db-dir"`
+	Postgres          postgresConfig `toml:"postgres"`
+	TLS               tlsConfig      `toml:"tls"`
+	DeviceProxyConfig string         `toml:"device-proxy-config"`
+	EnableAdminOps    bool           `toml:"motherlode"`
+	// Admins are given the admin role on startup if they exist, e.g. to set up the first administrator.
+	Admins    []string        `toml:"admins"`
+	Benchmark benchmarkConfig `toml:"benchmark"`
+	Alerts    alertsConfig    `toml:"alerts"`
+	Mail      mailConfig      `toml:"mail"`
+	Login     loginConfig     `toml:"login"`
+	Sessions  sessionsConfig  `toml:"sessions"`
+	MQTT      mqttConfig      `toml:"mqtt"`
 }
 
 const (
-	sessionCookieVersion = 1
+	sessionCookieVersion = 2
 )
 
 var configFile = flag.String("config", "", "configuration file")
@@ -68,7 +160,8 @@ var configFile = flag.String("config", "", "configuration file")
 var config serverConfig
 
 var templates *template.Template
-var cookieStore = sessions.NewCookieStore([]byte("test-key"))
+var cookieStore *sessions.CookieStore
+var sessionIdleTimeout, sessionAbsoluteTimeout time.Duration
 var proxyConf struct {
 	PostURL    string
 	CertPath   string
@@ -77,10 +170,25 @@ var proxyConf struct {
 var oldAPIPostClient *http.Client
 var db msgpdb.Db
 var devdb regdev.Db
+var mailer mail.Sender
+var lockoutPolicy msgpdb.LockoutPolicy
+var loginLimits *loginLimiter
+
+// claimLimits refuses device claims of users with too many failed claims, across all devices.
+var claimLimits = &loginLimiter{max: 10, window: time.Hour}
 var h = hub.New()
 
 var apiCtx msgp.WsAPIContext
 
+var errDeviceNotLinked = errors.New("device not linked")
+var errHubNotResponding = errors.New("hub not responding")
+var errBadLogin = errors.New("bad username/password")
+var errAccountDisabled = errors.New("account disabled")
+var errTargetPrivileged = errors.New("user has permissions you lack")
+
+// maxBufferLag is the time after which a value waiting in the value buffer is considered stuck.
+const maxBufferLag = time.Minute
+
 func init() {
 	flag.Parse()
 
@@ -157,6 +265,37 @@ func init() {
 		log.Fatal("tls key missing")
 	}
 
+	var keyPairs [][]byte
+	for i, key := range config.Sessions.Keys {
+		hash, err := base64.StdEncoding.DecodeString(key.Hash)
+		if err != nil || (len(hash) != 32 && len(hash) != 64) {
+			log.Fatalf("bad session hash key %v, need 32 or 64 bytes", i)
+		}
+		encrypt, err := base64.StdEncoding.DecodeString(key.Encrypt)
+		if err != nil || (len(encrypt) != 16 && len(encrypt) != 24 && len(encrypt) != 32) {
+			log.Fatalf("bad session encryption key %v, need 16, 24 or 32 bytes", i)
+		}
+		keyPairs = append(keyPairs, hash, encrypt)
+	}
+	if keyPairs == nil {
+		log.Print("no session keys configured, using random keys")
+		keyPairs = [][]byte{securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)}
+	}
+	if config.Sessions.IdleTimeout <= 0 {
+		config.Sessions.IdleTimeout = 2 * 60 * 60
+	}
+	if config.Sessions.AbsoluteTimeout <= 0 {
+		config.Sessions.AbsoluteTimeout = 7 * 24 * 60 * 60
+	}
+	sessionIdleTimeout = time.Duration(config.Sessions.IdleTimeout) * time.Second
+	sessionAbsoluteTimeout = time.Duration(config.Sessions.AbsoluteTimeout) * time.Second
+
+	cookieStore = sessions.NewCookieStore(keyPairs...)
+	cookieStore.MaxAge(config.Sessions.AbsoluteTimeout)
+	cookieStore.Options.HttpOnly = true
+	cookieStore.Options.Secure = config.TLS.Cert != ""
+	cookieStore.Options.SameSite = http.SameSiteLaxMode
+
 	templates = template.New("")
 
 	templates.Funcs(template.FuncMap{
@@ -195,23 +334,197 @@ func init() {
 	}
 
 	db, err = msgpdb.OpenDb(config.Postgres.Address, config.Postgres.Port, config.Postgres.Database,
-		config.Postgres.User, config.Postgres.Password)
+		config.Postgres.User, config.Postgres.Password, msgpdb.Options{
+			Migrate:    config.Postgres.Migrate,
+			Durability: config.Postgres.Durability,
+			WALDir:     config.Postgres.WALDir,
+		})
 	if err != nil {
 		log.Fatal("error opening user db: ", err)
 	}
 
+	err = db.Update(func(tx msgpdb.Tx) error {
+		for _, id := range config.Admins {
+			user := tx.User(id)
+			if user == nil {
+				log.Printf("admin %v does not exist", id)
+				continue
+			}
+			if err := user.SetAdmin(true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal("error setting up admins: ", err)
+	}
+
 	devdb, err = regdev.Open(config.DbDir + "/devices.db")
 	if err != nil {
 		log.Fatal("error opening device db: ", err)
 	}
 
-	apiCtx = msgp.WsAPIContext{Db: db, Hub: h}
+	webhooks := &webhook.Dispatcher{Db: db}
+
+	alerts := &alert.Engine{
+		Db:        db,
+		Hub:       h,
+		Notifiers: []alert.Notifier{&alert.WebhookNotifier{Webhooks: webhooks}},
+	}
+	if config.Alerts.SMTPAddress != "" {
+		notifier := &alert.SMTPNotifier{Addr: config.Alerts.SMTPAddress, From: config.Alerts.SMTPFrom}
+		if config.Alerts.SMTPUser != "" {
+			host := strings.Split(config.Alerts.SMTPAddress, ":")[0]
+			notifier.Auth = smtp.PlainAuth("", config.Alerts.SMTPUser, config.Alerts.SMTPPassword, host)
+		}
+		alerts.Notifiers = append(alerts.Notifiers, notifier)
+	}
+	if config.Alerts.Interval <= 0 {
+		config.Alerts.Interval = 30
+	}
+
+	switch config.Mail.Sender {
+	case "":
+	case "smtp":
+		sender := &mail.SMTPSender{Addr: config.Mail.SMTPAddress, From: config.Mail.From}
+		if config.Mail.User != "" {
+			host := strings.Split(config.Mail.SMTPAddress, ":")[0]
+			sender.Auth = smtp.PlainAuth("", config.Mail.User, config.Mail.Password, host)
+		}
+		mailer = sender
+	case "log":
+		mailer = mail.LogSender{}
+	case "file":
+		if err := os.MkdirAll(config.Mail.Dir, 0700); err != nil {
+			log.Fatalf("bad mail dir: %v", err)
+		}
+		mailer = &mail.FileSender{Dir: config.Mail.Dir, From: config.Mail.From}
+	default:
+		log.Fatalf("unknown mail sender %v", config.Mail.Sender)
+	}
+	if mailer != nil && config.Mail.BaseURL == "" {
+		log.Fatal("mail base-url missing")
+	}
+
+	orDefaultInt := func(value *int, def int) {
+		if *value <= 0 {
+			*value = def
+		}
+	}
+	orDefaultInt(&config.Login.MaxFailures, 5)
+	orDefaultInt(&config.Login.Lockout, 60)
+	orDefaultInt(&config.Login.MaxLockout, 3600)
+	orDefaultInt(&config.Login.IPFailures, 20)
+	orDefaultInt(&config.Login.IPWindow, 600)
+	lockoutPolicy = msgpdb.LockoutPolicy{
+		MaxFailures: config.Login.MaxFailures,
+		Lockout:     time.Duration(config.Login.Lockout) * time.Second,
+		MaxLockout:  time.Duration(config.Login.MaxLockout) * time.Second,
+	}
+	loginLimits = &loginLimiter{
+		max:    config.Login.IPFailures,
+		window: time.Duration(config.Login.IPWindow) * time.Second,
+	}
+
+	apiCtx = msgp.WsAPIContext{Db: db, Hub: h, Alerts: alerts, Webhooks: webhooks}
+}
+
+// startMQTTBridge connects the bridge to the broker, starting the embedded broker first if configured, and sets it
+// as MQTT of the API context. It must be called before devices connect.
+func startMQTTBridge() {
+	prefix := config.MQTT.Prefix
+	if prefix == "" {
+		prefix = "msgp"
+	}
+	user, password := config.MQTT.User, config.MQTT.Password
+
+	if config.MQTT.Embedded != "" {
+		// the bridge connects with random credentials unless others are configured
+		if user == "" {
+			token, err := randomToken()
+			if err != nil {
+				log.Fatal(err)
+			}
+			user, password = "msgpd", token
+		}
+		auth := &msgp.MQTTAuth{
+			Prefix:         prefix,
+			BridgeUser:     user,
+			BridgePassword: password,
+			Devices:        devdb,
+			CheckUser:      checkMQTTUser,
+		}
+		if _, err := msgp.ServeEmbeddedMQTTBroker(config.MQTT.Embedded, auth); err != nil {
+			log.Fatalf("could not start embedded mqtt broker: %v", err)
+		}
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.MQTT.Broker).
+		SetClientID(config.MQTT.ClientID).
+		SetUsername(user).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetCleanSession(false)
+	if config.MQTT.ClientID == "" {
+		opts.SetClientID("msgpd")
+	}
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalf("could not connect to mqtt broker: %v", token.Error())
+	}
+
+	bridge := &msgp.MQTTBridge{Ctx: &apiCtx, Devices: devdb, Client: client, Prefix: prefix}
+	if err := bridge.Run(); err != nil {
+		log.Fatalf("mqtt bridge failed: %v", err)
+	}
+	apiCtx.MQTT = bridge
+}
+
+// authenticate checks the password of a user logging in. Unknown users, locked users and wrong passwords all fail
+// with errBadLogin after checking a password, so they cannot be told apart. Failures of existing users count towards
+// the lockout of the account, errAccountDisabled is only returned for the right password.
+func authenticate(tx msgpdb.Tx, id, password string) (msgpdb.User, error) {
+	user := tx.User(id)
+	if user == nil || user.LockedUntil().After(time.Now()) {
+		msgpdb.CheckDummyPassword(password)
+		return nil, errBadLogin
+	}
+	if !user.HasPassword(password) {
+		if _, err := user.RecordLoginFailure(lockoutPolicy); err != nil {
+			log.Printf("recording failed login of %v: %v", user.ID(), err)
+		}
+		return nil, errBadLogin
+	}
+	if user.IsDisabled() {
+		return nil, errAccountDisabled
+	}
+	return user, user.ClearLoginFailures()
+}
+
+// checkMQTTUser authenticates users of the embedded mqtt broker with their account password like logins.
+func checkMQTTUser(id, password string) bool {
+	ok := false
+	db.Update(func(tx msgpdb.Tx) error {
+		_, err := authenticate(tx, id, password)
+		ok = err == nil
+		if err == errBadLogin || err == errAccountDisabled {
+			return nil
+		}
+		return err
+	})
+	return ok
 }
 
+// sessionTouchInterval is the interval at which the last use of a session is updated in the database.
+const sessionTouchInterval = time.Minute
+
 func getSession(w http.ResponseWriter, r *http.Request) *sessions.Session {
 	session, _ := cookieStore.Get(r, "msgp-session")
 	version, good := session.Values["-session-version"].(int)
-	if !good || version != sessionCookieVersion {
+	_, hasUser := session.Values["user"]
+	if !good || version != sessionCookieVersion || (hasUser && !checkServerSession(session)) {
 		session.Values = make(map[interface{}]interface{})
 		session.Values["-session-version"] = sessionCookieVersion
 		session.Save(r, w)
@@ -219,6 +532,56 @@ func getSession(w http.ResponseWriter, r *http.Request) *sessions.Session {
 	return session
 }
 
+// checkServerSession returns true if the session of the cookie exists in the database and has not expired.
+func checkServerSession(session *sessions.Session) bool {
+	userID, _ := session.Values["user"].(string)
+	token, _ := session.Values["session"].(string)
+	if token == "" {
+		return false
+	}
+
+	var s *msgpdb.Session
+	err := db.View(func(tx msgpdb.Tx) error {
+		s = tx.Session(token)
+		return nil
+	})
+	if err != nil || s == nil || s.User != userID {
+		return false
+	}
+	if s.Expired(sessionIdleTimeout, sessionAbsoluteTimeout) {
+		db.Update(func(tx msgpdb.Tx) error {
+			return tx.RemoveSession(token)
+		})
+		return false
+	}
+
+	// most requests only read the session, the last use is written once it is stale
+	if time.Since(s.LastSeen) >= sessionTouchInterval {
+		err := db.Update(func(tx msgpdb.Tx) error {
+			return tx.TouchSession(token)
+		})
+		return err == nil
+	}
+	return true
+}
+
+// closeSessionWebsockets closes the websockets opened with sessions of the user, except those of the session
+// identified by token keep, after the sessions were ended.
+func closeSessionWebsockets(userID, keep string) {
+	apiCtx.CloseUserSessions(func(s msgp.UserSession) bool {
+		return s.User == userID && s.Token != keep
+	})
+}
+
+// randomToken returns a random hex encoded token.
+func randomToken() (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
 func defaultHeaders(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -249,6 +612,10 @@ func wsTemplate(name string) func(http.ResponseWriter, *http.Request) {
 			Missing []string
 			User    msgpdb.User
 		}
+		// routes with a user show the page of that user, they must require PermUsersData
+		if target, ok := mux.Vars(r)["user"]; ok {
+			userID = target
+		}
 		db.View(func(tx msgpdb.Tx) error {
 			user := tx.User(userID.(string))
 			if user == nil {
@@ -267,6 +634,7 @@ func staticTemplate(name string) func(http.ResponseWriter, *http.Request) {
 	})
 }
 
+// wsHandlerUser serves the websocket API of a user to the user, or read only to users with PermUsersData.
 func wsHandlerUser(w http.ResponseWriter, r *http.Request) {
 	session := getSession(w, r)
 
@@ -276,11 +644,28 @@ func wsHandlerUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	target := mux.Vars(r)["user"]
+	readOnly := session.Values["user"] != target
+	if readOnly && !sessionHasPermission(session, msgpdb.PermUsersData) {
+		http.Error(w, "forbidden", 403)
+		return
+	}
+
+	ws := msgp.UserSession{User: session.Values["user"].(string), Token: session.Values["session"].(string)}
+	db.View(func(tx msgpdb.Tx) error {
+		if s := tx.Session(ws.Token); s != nil {
+			ws.ID = s.ID
+		}
+		return nil
+	})
+
 	x := msgp.WsUserAPI{
-		Ctx:     &apiCtx,
-		User:    mux.Vars(r)["user"],
-		Writer:  w,
-		Request: r,
+		Ctx:      &apiCtx,
+		User:     target,
+		ReadOnly: readOnly,
+		Session:  ws,
+		Writer:   w,
+		Request:  r,
 	}
 	defer x.Close()
 	x.Run()
@@ -306,8 +691,67 @@ func wsHandlerDevice(w http.ResponseWriter, r *http.Request) {
 	x.Run()
 }
 
+// loginLimiter refuses logins from addresses with too many failed logins within a time window.
+// It also limits failed device claims by user id.
+type loginLimiter struct {
+	sync.Mutex
+	max    int
+	window time.Duration
+
+	failures  map[string][]time.Time
+	lastSweep time.Time
+}
+
+// prune removes the failures of addr that are outside of the window, and returns the remaining ones.
+func (l *loginLimiter) prune(addr string, now time.Time) []time.Time {
+	failures := l.failures[addr]
+	for len(failures) > 0 && now.Sub(failures[0]) >= l.window {
+		failures = failures[1:]
+	}
+	if len(failures) == 0 {
+		delete(l.failures, addr)
+		return nil
+	}
+	l.failures[addr] = failures
+	return failures
+}
+
+// blocked returns true if logins from addr are refused.
+func (l *loginLimiter) blocked(addr string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	return len(l.prune(addr, time.Now())) >= l.max
+}
+
+// fail records a failed login from addr.
+func (l *loginLimiter) fail(addr string) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if l.failures == nil {
+		l.failures = make(map[string][]time.Time)
+	}
+	if now.Sub(l.lastSweep) >= l.window {
+		for a := range l.failures {
+			l.prune(a, now)
+		}
+		l.lastSweep = now
+	}
+	l.failures[addr] = append(l.prune(addr, now), now)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func doLogin(w http.ResponseWriter, r *http.Request) {
-	session, _ := cookieStore.Get(r, "msgp-session")
+	session := getSession(w, r)
 
 	user := r.PostFormValue("user")
 	password := r.PostFormValue("password")
@@ -327,15 +771,47 @@ func doLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db.View(func(tx msgpdb.Tx) error {
-		user := tx.User(user)
-		if user == nil || !user.HasPassword(password) {
-			http.Error(w, "bad username/password", 400)
+	addr := remoteHost(r)
+	if loginLimits.blocked(addr) {
+		http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// failed logins are recorded, so the transaction is committed in all cases
+	db.Update(func(tx msgpdb.Tx) error {
+		user, err := authenticate(tx, user, password)
+		switch err {
+		case nil:
+		case errBadLogin:
+			loginLimits.fail(addr)
+			http.Error(w, err.Error(), 400)
+			return nil
+		case errAccountDisabled:
+			http.Error(w, err.Error(), 403)
 			return nil
+		default:
+			http.Error(w, err.Error(), 500)
+			return err
+		}
+
+		if err := tx.PruneSessions(sessionIdleTimeout, sessionAbsoluteTimeout); err != nil {
+			http.Error(w, err.Error(), 500)
+			return err
+		}
+		token, err := user.AddSession(addr, r.UserAgent())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return err
+		}
+		wsToken, err := randomToken()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return err
 		}
 
-		session.Values["user"] = r.PostFormValue("user")
-		session.Values["wsToken"] = fmt.Sprintf("%x", sha256.Sum256([]byte(time.Now().String())))
+		session.Values["user"] = user.ID()
+		session.Values["session"] = token
+		session.Values["wsToken"] = wsToken
 		session.Save(r, w)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return nil
@@ -343,7 +819,13 @@ func doLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 func doLogout(w http.ResponseWriter, r *http.Request) {
-	session, _ := cookieStore.Get(r, "msgp-session")
+	session := getSession(w, r)
+	if token, ok := session.Values["session"].(string); ok {
+		db.Update(func(tx msgpdb.Tx) error {
+			return tx.RemoveSession(token)
+		})
+		apiCtx.CloseUserSessions(func(s msgp.UserSession) bool { return s.Token == token })
+	}
 	session.Options.MaxAge = -1
 	session.Save(r, w)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -352,6 +834,7 @@ func doLogout(w http.ResponseWriter, r *http.Request) {
 func userRegister(w http.ResponseWriter, r *http.Request) {
 	name := r.FormValue("user")
 	password := r.FormValue("password")
+	email := r.FormValue("email")
 
 	var ctx struct {
 		Missing []string
@@ -369,7 +852,10 @@ func userRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	db.Update(func(tx msgpdb.Tx) error {
-		_, err := tx.AddUser(name, password)
+		user, err := tx.AddUser(name, password)
+		if err == nil && email != "" {
+			err = user.SetEmail(email)
+		}
 		if err != nil {
 			ctx.Error = err.Error()
 			templates.ExecuteTemplate(w, "register", ctx)
@@ -380,158 +866,1118 @@ func userRegister(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func adminHandler(w http.ResponseWriter, r *http.Request) {
-	tstr := `
-<div>Users:</div>
-<ul>
-{{range $name, $user := (.U.Users)}}
-	<li>
-		<div>{{$name}} (is admin: {{$user.IsAdmin}})</div>
-		<ul>
-		{{range $name, $dev := $user.Devices}}
-			<li>
-				<div>{{$dev.Id}}({{$dev.Name}}) key 0x{{$dev.Key | printf "%x"}}</div>
-				<ul>
-				{{range $name, $sens := $dev.Sensors}}
-					<li>{{$sens.Id}} (name: {{$sens.Name}}) (port: {{$sens.Port}}) (unit: {{$sens.Unit}})</li>
-				{{end}}
-				</ul>
-			</li>
-		{{end}}
-		</ul>
-	</li>
-{{end}}
-</ul>
-
-<div>Registered devices:</div>
-<ul>
-{{range $id, $link := .D.Devices}}
-	<li>
-		{{$id}} 0x{{$link.Key | printf "%x"}} -> {{userOfLink $link}}
-		<ul>
-			<li>{{configOf $link}}</li>
-		</ul>
-		{{range $_, $hb := ($link.GetHeartbeats 0)}}
-		<ul>
-			<li>Heartbeat at {{$hb}}</li>
-		</ul>
-		{{end}}
-	</li>
-{{end}}
-</ul>
-<strong>done</strong>
-`
-
-	session := getSession(w, r)
-	userID, found := session.Values["user"]
-	if !found {
+// passwordResetValidity is the time a mailed password reset link can be used.
+const passwordResetValidity = time.Hour
+
+// exportResolution is the resolution of the values in data exports if none is requested.
+const exportResolution = "hour"
+
+type accountCtx struct {
+	Missing []string
+	Error   string
+	Message string
+	Email   string
+	// CanReset is true if password reset links can be mailed.
+	CanReset bool
+	Sessions []msgpdb.Session
+	// Current is the id of the session the page is shown in.
+	Current uint64
+}
+
+// withSessionUser runs fn in a transaction of the given kind (db.View or db.Update) with the user of the session.
+// The session is removed if it has no user.
+func withSessionUser(w http.ResponseWriter, r *http.Request, txn func(func(msgpdb.Tx) error) error, fn func(msgpdb.Tx, msgpdb.User, *sessions.Session) error) error {
+	session := getSession(w, r)
+	userID, ok := session.Values["user"].(string)
+	if !ok {
 		removeSessionAndNotifyUser(w, r, session)
-		return
+		return nil
 	}
 
-	db.View(func(utx msgpdb.Tx) error {
-		user := utx.User(userID.(string))
-		if user == nil || !user.IsAdmin() {
-			http.Error(w, "unauthorized", 401)
+	return txn(func(tx msgpdb.Tx) error {
+		user := tx.User(userID)
+		if user == nil {
+			removeSessionAndNotifyUser(w, r, session)
 			return nil
 		}
-
-		return devdb.View(func(dtx regdev.Tx) error {
-			t := template.New("")
-			t.Funcs(template.FuncMap{
-				"userOfLink": func(link regdev.RegisteredDevice) template.HTML {
-					user, linked := link.UserLink()
-					if linked {
-						return template.HTML(template.HTMLEscapeString(user))
-					}
-					return "<i>none</i>"
-				},
-				"configOf": func(link regdev.RegisteredDevice) string {
-					data, err := json.Marshal(link.GetNetworkConfig())
-					if err != nil {
-						return err.Error()
-					}
-					return string(data)
-				},
-			})
-			_, err := t.Parse(tstr)
-			if err != nil {
-				w.Write([]byte(err.Error()))
-				return nil
-			}
-			type ctx struct {
-				U msgpdb.Tx
-				D regdev.Tx
-			}
-			err = t.Execute(w, ctx{utx, dtx})
-			if err != nil {
-				w.Write([]byte("<br/>" + err.Error()))
-			}
-			return nil
-		})
+		return fn(tx, user, session)
 	})
 }
 
-func adminUserAdd(w http.ResponseWriter, r *http.Request) {
-	user := mux.Vars(r)["user"]
-	password := r.FormValue("password")
+func renderAccount(w http.ResponseWriter, tx msgpdb.Tx, user msgpdb.User, session *sessions.Session, ctx accountCtx) error {
+	ctx.Email = user.Email()
+	ctx.CanReset = mailer != nil
 
-	err := db.Update(func(tx msgpdb.Tx) error {
-		_, err := tx.AddUser(user, password)
-		return err
-	})
+	var err error
+	ctx.Sessions, err = user.Sessions()
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		return err
+	}
+	if current := tx.Session(session.Values["session"].(string)); current != nil {
+		ctx.Current = current.ID
 	}
+	return templates.ExecuteTemplate(w, "user-account", ctx)
 }
 
-func adminUserSet(w http.ResponseWriter, r *http.Request) {
-	userID := mux.Vars(r)["user"]
-	db.Update(func(tx msgpdb.Tx) error {
-		user := tx.User(userID)
-		if user == nil {
-			http.Error(w, "not found", 404)
-			return errors.New("")
-		}
+func userAccount(w http.ResponseWriter, r *http.Request) {
+	withSessionUser(w, r, db.View, func(tx msgpdb.Tx, user msgpdb.User, session *sessions.Session) error {
+		return renderAccount(w, tx, user, session, accountCtx{})
+	})
+}
 
-		switch r.FormValue("isAdmin") {
-		case "":
-		case "true":
-			user.SetAdmin(true)
-		case "false":
-			user.SetAdmin(false)
-		default:
-			http.Error(w, "bad isAdmin", 400)
-			return errors.New("")
+func userAccountPassword(w http.ResponseWriter, r *http.Request) {
+	old := r.PostFormValue("old")
+	password := r.PostFormValue("password")
+
+	var changed string
+	var keep string
+	err := withSessionUser(w, r, db.Update, func(tx msgpdb.Tx, user msgpdb.User, session *sessions.Session) error {
+		var ctx accountCtx
+		if old == "" {
+			ctx.Missing = append(ctx.Missing, "old")
+		}
+		if password == "" {
+			ctx.Missing = append(ctx.Missing, "password")
+		}
+		if ctx.Missing != nil {
+			return renderAccount(w, tx, user, session, ctx)
 		}
 
-		return nil
+		if !user.HasPassword(old) {
+			ctx.Error = "wrong password"
+			return renderAccount(w, tx, user, session, ctx)
+		}
+		if err := user.SetPassword(password); err != nil {
+			ctx.Error = err.Error()
+			renderAccount(w, tx, user, session, ctx)
+			return err
+		}
+		// other sessions may have been started with the old password
+		keep = session.Values["session"].(string)
+		if err := user.RemoveSessions(keep); err != nil {
+			ctx.Error = err.Error()
+			renderAccount(w, tx, user, session, ctx)
+			return err
+		}
+		changed = user.ID()
+		ctx.Message = "Your password has been changed, all other sessions have been logged out."
+		return renderAccount(w, tx, user, session, ctx)
 	})
+	if err == nil && changed != "" {
+		closeSessionWebsockets(changed, keep)
+	}
 }
 
-func loggedInSwitch(in, out func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		session := getSession(w, r)
-		if _, found := session.Values["user"]; found {
-			in(w, r)
-		} else {
-			out(w, r)
+func userAccountEmail(w http.ResponseWriter, r *http.Request) {
+	email := r.PostFormValue("email")
+	password := r.PostFormValue("password")
+
+	withSessionUser(w, r, db.Update, func(tx msgpdb.Tx, user msgpdb.User, session *sessions.Session) error {
+		var ctx accountCtx
+		// the address receives password reset links, so changing it requires the password like changing that
+		if !user.HasPassword(password) {
+			ctx.Missing = []string{"email-password"}
+			ctx.Error = "wrong password"
+			return renderAccount(w, tx, user, session, ctx)
+		}
+		if err := user.SetEmail(email); err != nil {
+			ctx.Error = err.Error()
+			renderAccount(w, tx, user, session, ctx)
+			return err
 		}
+		ctx.Message = "Your email address has been changed."
+		return renderAccount(w, tx, user, session, ctx)
+	})
+}
+
+func writeExport(w http.ResponseWriter, export *msgpdb.UserExport) {
+	data, err := json.Marshal(export)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="msgp-%s.json"`, export.User))
+	w.Write(data)
 }
 
-func userDevices(w http.ResponseWriter, r *http.Request) {
-	session := getSession(w, r)
-	db.View(func(tx msgpdb.Tx) error {
-		if _, ok := session.Values["user"].(string); !ok {
-			removeSessionAndNotifyUser(w, r, session)
-			return nil
-		}
+func userAccountExport(w http.ResponseWriter, r *http.Request) {
+	resolution := r.FormValue("resolution")
+	if resolution == "" {
+		resolution = exportResolution
+	}
 
-		u := tx.User(session.Values["user"].(string))
-		if u == nil {
-			removeSessionAndNotifyUser(w, r, session)
-			return nil
+	withSessionUser(w, r, db.View, func(tx msgpdb.Tx, user msgpdb.User, session *sessions.Session) error {
+		export, err := user.Export(resolution)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return err
+		}
+		writeExport(w, export)
+		return nil
+	})
+}
+
+// userAccountDelete removes the account of the session user along with all devices and their links in the device
+// database, and hands out a data export of the account.
+func userAccountDelete(w http.ResponseWriter, r *http.Request) {
+	password := r.PostFormValue("password")
+
+	var export *msgpdb.UserExport
+	// devices unlinked in the registry with their network configuration, the registry is committed before the
+	// user is removed from the database and the unlinks are reverted if that fails
+	var unlinked map[string]regdev.DeviceConfigNetwork
+	err := withSessionUser(w, r, db.Update, func(tx msgpdb.Tx, user msgpdb.User, session *sessions.Session) error {
+		if !user.HasPassword(password) {
+			return renderAccount(w, tx, user, session, accountCtx{Missing: []string{"delete-password"}, Error: "wrong password"})
+		}
+
+		// the export reads all values of the user, the registry is not locked meanwhile
+		var err error
+		export, err = user.Export(exportResolution)
+		if err != nil {
+			return err
+		}
+
+		links := make(map[string]regdev.DeviceConfigNetwork)
+		err = devdb.Update(func(dtx regdev.Tx) error {
+			for devID := range user.Devices() {
+				dev := dtx.Device(devID)
+				if dev == nil {
+					continue
+				}
+				if linked, ok := dev.UserLink(); ok && linked == user.ID() {
+					links[devID] = dev.GetNetworkConfig()
+					if err := dev.Unlink(); err != nil {
+						return err
+					}
+				}
+			}
+			return tx.RemoveUser(user.ID())
+		})
+		if err == nil {
+			unlinked = links
+		}
+		return err
+	})
+	if err != nil {
+		if len(unlinked) > 0 {
+			err := devdb.Update(func(dtx regdev.Tx) error {
+				for devID, network := range unlinked {
+					dev := dtx.Device(devID)
+					if err := dev.LinkTo(export.User); err != nil {
+						return err
+					}
+					if err := dev.SetNetworkConfig(&network); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.Printf("reverting unlinks of devices of %v: %v", export.User, err)
+			}
+		}
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if export == nil {
+		return
+	}
+	closeSessionWebsockets(export.User, "")
+
+	if err := apiCtx.Alerts.Reload(); err != nil {
+		log.Printf("reloading alert rules: %v", err)
+	}
+	if err := apiCtx.Webhooks.Reload(); err != nil {
+		log.Printf("reloading webhooks: %v", err)
+	}
+
+	session := getSession(w, r)
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+	writeExport(w, export)
+}
+
+func userAccountLogoutSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["session"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var userID string
+	err = withSessionUser(w, r, db.Update, func(tx msgpdb.Tx, user msgpdb.User, session *sessions.Session) error {
+		if err := user.RemoveSession(id); err != nil {
+			renderAccount(w, tx, user, session, accountCtx{Error: err.Error()})
+			return err
+		}
+		userID = user.ID()
+		return renderAccount(w, tx, user, session, accountCtx{Message: "The session has been logged out."})
+	})
+	if err == nil && userID != "" {
+		apiCtx.CloseUserSessions(func(s msgp.UserSession) bool { return s.User == userID && s.ID == id })
+	}
+}
+
+// userAccountLogoutAll ends all sessions of the session user, including the current one.
+func userAccountLogoutAll(w http.ResponseWriter, r *http.Request) {
+	var userID string
+	err := withSessionUser(w, r, db.Update, func(tx msgpdb.Tx, user msgpdb.User, session *sessions.Session) error {
+		if err := user.RemoveSessions(""); err != nil {
+			return err
+		}
+		userID = user.ID()
+		session.Options.MaxAge = -1
+		session.Save(r, w)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if userID != "" {
+		closeSessionWebsockets(userID, "")
+	}
+}
+
+// userResetRequest mails a password reset link to the user with the given name or email address. The response
+// does not tell whether the user exists.
+func userResetRequest(w http.ResponseWriter, r *http.Request) {
+	name := r.PostFormValue("user")
+
+	var ctx accountCtx
+	if mailer == nil {
+		ctx.Error = "Password resets are not available."
+		templates.ExecuteTemplate(w, "user-reset", ctx)
+		return
+	}
+	if name == "" {
+		ctx.Missing = append(ctx.Missing, "user")
+		templates.ExecuteTemplate(w, "user-reset", ctx)
+		return
+	}
+
+	var email, token string
+	err := db.Update(func(tx msgpdb.Tx) error {
+		user := tx.User(name)
+		if user == nil {
+			user = tx.UserByEmail(name)
+		}
+		if user == nil || user.Email() == "" {
+			return nil
+		}
+
+		var err error
+		email = user.Email()
+		token, err = user.CreatePasswordReset(passwordResetValidity)
+		return err
+	})
+	if err != nil {
+		log.Printf("creating password reset: %v", err)
+	} else if token != "" {
+		body := fmt.Sprintf("A new password was requested for your account.\n\n"+
+			"Open %s/user/reset/%s within %v to set a new password.\n\n"+
+			"If you did not request a new password you can ignore this mail.\n",
+			strings.TrimSuffix(config.Mail.BaseURL, "/"), token, passwordResetValidity)
+		if err := mailer.Send(email, "MSGp password reset", body); err != nil {
+			log.Printf("sending password reset: %v", err)
+		}
+	}
+
+	ctx.Message = "If the account exists and has an email address, a link to set a new password has been sent to it."
+	templates.ExecuteTemplate(w, "user-reset", ctx)
+}
+
+func userResetForm(w http.ResponseWriter, r *http.Request) {
+	templates.ExecuteTemplate(w, "user-reset-password", struct {
+		Token   string
+		Missing []string
+		Error   string
+	}{Token: mux.Vars(r)["token"]})
+}
+
+func userResetPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := struct {
+		Token   string
+		Missing []string
+		Error   string
+	}{Token: mux.Vars(r)["token"]}
+
+	password := r.PostFormValue("password")
+	if password == "" {
+		ctx.Missing = append(ctx.Missing, "password")
+		templates.ExecuteTemplate(w, "user-reset-password", ctx)
+		return
+	}
+
+	var userID string
+	err := db.Update(func(tx msgpdb.Tx) error {
+		user, err := tx.ResetPassword(ctx.Token, password)
+		if err != nil {
+			return err
+		}
+		userID = user.ID()
+		return user.RemoveSessions("")
+	})
+	if err != nil {
+		ctx.Error = err.Error()
+		templates.ExecuteTemplate(w, "user-reset-password", ctx)
+		return
+	}
+	closeSessionWebsockets(userID, "")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// permissionCache caches the permissions of users for a short time, so requests are authorized without querying the
+// database every time. Role changes made through msgpd clear it, other changes apply once the entries expire.
+type permissionCache struct {
+	sync.Mutex
+	ttl time.Duration
+
+	users     map[string]cachedPermissions
+	lastSweep time.Time
+}
+
+type cachedPermissions struct {
+	perms  map[string]bool
+	loaded time.Time
+}
+
+// has returns true if the user has the permission, loading the permissions of the user unless they are cached.
+func (c *permissionCache) has(userID, perm string) bool {
+	c.Lock()
+	cached, ok := c.users[userID]
+	c.Unlock()
+	if ok && time.Since(cached.loaded) < c.ttl {
+		return cached.perms[perm]
+	}
+
+	cached = cachedPermissions{perms: make(map[string]bool), loaded: time.Now()}
+	err := db.View(func(tx msgpdb.Tx) error {
+		user := tx.User(userID)
+		if user == nil {
+			return msgpdb.ErrNoUser
+		}
+		perms, err := user.Permissions()
+		for _, p := range perms {
+			cached.perms[p] = true
+		}
+		return err
+	})
+	if err != nil {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.users == nil {
+		c.users = make(map[string]cachedPermissions)
+	}
+	if cached.loaded.Sub(c.lastSweep) >= c.ttl {
+		for id, p := range c.users {
+			if cached.loaded.Sub(p.loaded) >= c.ttl {
+				delete(c.users, id)
+			}
+		}
+		c.lastSweep = cached.loaded
+	}
+	c.users[userID] = cached
+	return cached.perms[perm]
+}
+
+// clear removes all cached permissions, e.g. after roles changed.
+func (c *permissionCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.users = nil
+}
+
+var permissions = &permissionCache{ttl: 10 * time.Second}
+
+// sessionHasPermission returns true if the user of the session has the permission.
+func sessionHasPermission(session *sessions.Session, perm string) bool {
+	userID, ok := session.Values["user"].(string)
+	return ok && permissions.has(userID, perm)
+}
+
+// requirePermission calls fn only if the user of the session has the permission.
+// All handlers of administrative operations must be wrapped by it or by requireGroupPermission.
+func requirePermission(perm string, fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := getSession(w, r)
+		if _, ok := session.Values["user"].(string); !ok {
+			http.Error(w, "not authorized", 401)
+			return
+		}
+		if !sessionHasPermission(session, perm) {
+			http.Error(w, "forbidden", 403)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// requireGroupPermission calls fn only if the user of the session has PermGroupsWrite or is an admin of the group
+// of the route.
+func requireGroupPermission(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return requireAccess(func(user msgpdb.User, r *http.Request) bool {
+		return permissions.has(user.ID(), msgpdb.PermGroupsWrite) || user.IsGroupAdmin(mux.Vars(r)["group"])
+	}, fn)
+}
+
+// requireAccess calls fn only if allowed returns true for the user of the session.
+func requireAccess(allowed func(msgpdb.User, *http.Request) bool, fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := getSession(w, r)
+		userID, ok := session.Values["user"].(string)
+		if !ok {
+			http.Error(w, "not authorized", 401)
+			return
+		}
+
+		ok = false
+		db.View(func(tx msgpdb.Tx) error {
+			if user := tx.User(userID); user != nil {
+				ok = allowed(user, r)
+			}
+			return nil
+		})
+		if !ok {
+			http.Error(w, "forbidden", 403)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// checkAdminTarget returns errTargetPrivileged unless caller holds every permission target or role holds, so
+// administrators cannot take over accounts or grant roles more privileged than their own. role may be empty.
+func checkAdminTarget(tx msgpdb.Tx, caller, target msgpdb.User, role string) error {
+	if caller.IsAdmin() {
+		return nil
+	}
+	if target.IsAdmin() || role == msgpdb.RoleAdmin {
+		return errTargetPrivileged
+	}
+
+	perms, err := target.Permissions()
+	if err != nil {
+		return err
+	}
+	if role != "" {
+		roles, err := tx.Roles()
+		if err != nil {
+			return err
+		}
+		for _, r := range roles {
+			if r.ID == role {
+				perms = append(perms, r.Permissions...)
+			}
+		}
+	}
+	for _, perm := range perms {
+		if !caller.HasPermission(perm) {
+			return errTargetPrivileged
+		}
+	}
+	return nil
+}
+
+func adminUserAdd(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	password := r.FormValue("password")
+
+	err := db.Update(func(tx msgpdb.Tx) error {
+		_, err := tx.AddUser(user, password)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+func adminUserSet(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["user"]
+	db.Update(func(tx msgpdb.Tx) error {
+		user := tx.User(userID)
+		if user == nil {
+			http.Error(w, "not found", 404)
+			return errors.New("")
+		}
+
+		switch r.FormValue("isAdmin") {
+		case "":
+		case "true":
+			user.SetAdmin(true)
+		case "false":
+			user.SetAdmin(false)
+		default:
+			http.Error(w, "bad isAdmin", 400)
+			return errors.New("")
+		}
+
+		return nil
+	})
+}
+
+func adminValidationGet(w http.ResponseWriter, r *http.Request) {
+	db.View(func(tx msgpdb.Tx) error {
+		data, err := json.Marshal(tx.UnitValidationRules())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return err
+		}
+		w.Write(data)
+		return nil
+	})
+}
+
+func adminValidationSet(w http.ResponseWriter, r *http.Request) {
+	unit := mux.Vars(r)["unit"]
+
+	var rule *msgpdb.ValidationRule
+	if r.Method != "DELETE" {
+		rule = new(msgpdb.ValidationRule)
+		if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	err := db.Update(func(tx msgpdb.Tx) error {
+		return tx.SetUnitValidationRule(unit, rule)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+func adminRolesGet(w http.ResponseWriter, r *http.Request) {
+	db.View(func(tx msgpdb.Tx) error {
+		roles, err := tx.Roles()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return err
+		}
+		data, err := json.Marshal(roles)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return err
+		}
+		w.Write(data)
+		return nil
+	})
+}
+
+func adminRoleSet(w http.ResponseWriter, r *http.Request) {
+	var role msgpdb.Role
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	role.ID = mux.Vars(r)["role"]
+
+	err := db.Update(func(tx msgpdb.Tx) error {
+		return tx.SetRole(role)
+	})
+	permissions.clear()
+	if err == msgpdb.ErrPredefinedRole {
+		http.Error(w, err.Error(), 409)
+	} else if err != nil {
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+func adminRoleRemove(w http.ResponseWriter, r *http.Request) {
+	err := db.Update(func(tx msgpdb.Tx) error {
+		return tx.RemoveRole(mux.Vars(r)["role"])
+	})
+	permissions.clear()
+	if err == msgpdb.ErrNoRole {
+		http.Error(w, err.Error(), 404)
+	} else if err == msgpdb.ErrPredefinedRole {
+		http.Error(w, err.Error(), 409)
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func adminUserRolesGet(w http.ResponseWriter, r *http.Request) {
+	db.View(func(tx msgpdb.Tx) error {
+		user := tx.User(mux.Vars(r)["user"])
+		if user == nil {
+			http.Error(w, "not found", 404)
+			return nil
+		}
+
+		roles, err := user.Roles()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return err
+		}
+		data, err := json.Marshal(roles)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return err
+		}
+		w.Write(data)
+		return nil
+	})
+}
+
+func adminUserRoleSet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	role := mux.Vars(r)["role"]
+	err := db.Update(func(tx msgpdb.Tx) error {
+		user := tx.User(mux.Vars(r)["user"])
+		if user == nil {
+			return msgpdb.ErrNoUser
+		}
+		caller := tx.User(session.Values["user"].(string))
+		if caller == nil {
+			return errTargetPrivileged
+		}
+		if err := checkAdminTarget(tx, caller, user, role); err != nil {
+			return err
+		}
+		if r.Method == "DELETE" {
+			return user.RemoveRole(role)
+		}
+		return user.AddRole(role)
+	})
+	permissions.clear()
+	switch err {
+	case nil:
+	case msgpdb.ErrNoUser, msgpdb.ErrNoRole:
+		http.Error(w, err.Error(), 404)
+	case errTargetPrivileged:
+		http.Error(w, err.Error(), 403)
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func apiUserPermissionsGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+
+		roles, err := user.Roles()
+		apiAbortIf(500, err)
+		perms, err := user.Permissions()
+		apiAbortIf(500, err)
+
+		data, err := json.Marshal(map[string][]string{"roles": roles, "permissions": perms})
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+// adminDefaultLimit is the number of entries of a page of the admin API if the request does not specify a limit.
+const adminDefaultLimit = 50
+
+// adminPage is a page of a list of the admin API. Next is passed as the after parameter to get the next page,
+// it is empty on the last page.
+type adminPage struct {
+	Items interface{} `json:"items"`
+	Next  string      `json:"next"`
+}
+
+// adminRegistryEntry describes a device of the device registry. Keys and wifi passphrases are never included.
+type adminRegistryEntry struct {
+	ID            string                     `json:"id"`
+	User          string                     `json:"user"`
+	Network       regdev.DeviceConfigNetwork `json:"network"`
+	LastHeartbeat *time.Time                 `json:"lastHeartbeat"`
+}
+
+func adminListLimit(r *http.Request, max int) int {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return adminDefaultLimit
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 || n > max {
+		apiAbort(400, "bad limit")
+	}
+	return n
+}
+
+func adminListOptions(r *http.Request) msgpdb.ListOptions {
+	return msgpdb.ListOptions{
+		Search: r.URL.Query().Get("search"),
+		After:  r.URL.Query().Get("after"),
+		Limit:  adminListLimit(r, msgpdb.MaxListLimit),
+	}
+}
+
+func adminWritePage(w http.ResponseWriter, items interface{}, next string) {
+	data, err := json.Marshal(adminPage{items, next})
+	apiAbortIf(500, err)
+	w.Write(data)
+}
+
+// apiAbortIfTarget aborts with 403 for errTargetPrivileged and with 500 for other errors of checkAdminTarget.
+func apiAbortIfTarget(err error) {
+	if err == errTargetPrivileged {
+		apiAbort(403, err.Error())
+	}
+	apiAbortIf(500, err)
+}
+
+func adminUser(tx msgpdb.Tx, r *http.Request) msgpdb.User {
+	user := tx.User(mux.Vars(r)["user"])
+	if user == nil {
+		apiAbort(404, "no such user")
+	}
+	return user
+}
+
+// redactNetwork removes the wifi passphrase from a network configuration.
+func redactNetwork(conf regdev.DeviceConfigNetwork) regdev.DeviceConfigNetwork {
+	if conf.Wifi != nil {
+		wifi := *conf.Wifi
+		wifi.PSK = ""
+		conf.Wifi = &wifi
+	}
+	return conf
+}
+
+func apiAdminUsersGet(w http.ResponseWriter, r *http.Request) {
+	db.View(func(tx msgpdb.Tx) error {
+		users, next, err := tx.ListUsers(adminListOptions(r))
+		if err == msgpdb.ErrBadCursor {
+			apiAbort(400, err.Error())
+		}
+		apiAbortIf(500, err)
+		if users == nil {
+			users = []msgpdb.UserInfo{}
+		}
+		adminWritePage(w, users, next)
+		return nil
+	})
+}
+
+func apiAdminUserGet(w http.ResponseWriter, r *http.Request) {
+	db.View(func(tx msgpdb.Tx) error {
+		info, err := adminUser(tx, r).Info()
+		apiAbortIf(500, err)
+		data, err := json.Marshal(info)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+// apiAdminUserDisable disables or enables a user. Disabling a user ends all of its sessions.
+func apiAdminUserDisable(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	disable := strings.HasSuffix(r.URL.Path, "/disable")
+
+	var userID string
+	err := db.Update(func(tx msgpdb.Tx) error {
+		user := adminUser(tx, r)
+		if disable && user.ID() == session.Values["user"] {
+			apiAbort(409, "cannot disable own account")
+		}
+		apiAbortIfTarget(checkAdminTarget(tx, apiSessionUser(tx, session), user, ""))
+		apiAbortIf(500, user.SetDisabled(disable))
+		userID = user.ID()
+		return nil
+	})
+	apiAbortIf(500, err)
+	if disable {
+		closeSessionWebsockets(userID, "")
+	}
+}
+
+// apiAdminUserResetPassword replaces the password of a user by a random one, ends all of its sessions and mails a
+// password reset link to the user. The new password is not handed out to anyone. The mail is sent before the
+// changes are committed, so the user keeps the old password if it cannot be sent.
+func apiAdminUserResetPassword(w http.ResponseWriter, r *http.Request) {
+	if mailer == nil {
+		apiAbort(409, "password resets are not available")
+	}
+
+	session := getSession(w, r)
+	var userID string
+	var sendErr error
+	err := db.Update(func(tx msgpdb.Tx) error {
+		user := adminUser(tx, r)
+		apiAbortIfTarget(checkAdminTarget(tx, apiSessionUser(tx, session), user, ""))
+		userID = user.ID()
+		email := user.Email()
+		if email == "" {
+			apiAbort(409, "user has no email address")
+		}
+
+		pw, err := randomToken()
+		apiAbortIf(500, err)
+		apiAbortIf(500, user.SetPassword(pw))
+		apiAbortIf(500, user.RemoveSessions(""))
+		token, err := user.CreatePasswordReset(passwordResetValidity)
+		apiAbortIf(500, err)
+
+		body := fmt.Sprintf("An administrator has reset the password of your account.\n\n"+
+			"Open %s/user/reset/%s within %v to set a new password.\n",
+			strings.TrimSuffix(config.Mail.BaseURL, "/"), token, passwordResetValidity)
+		sendErr = mailer.Send(email, "MSGp password reset", body)
+		return sendErr
+	})
+	if sendErr != nil {
+		apiAbort(502, sendErr.Error())
+	}
+	apiAbortIf(500, err)
+	closeSessionWebsockets(userID, "")
+}
+
+func apiAdminDevicesGet(w http.ResponseWriter, r *http.Request) {
+	db.View(func(tx msgpdb.Tx) error {
+		devices, next, err := tx.ListDevices(adminListOptions(r))
+		if err == msgpdb.ErrBadCursor {
+			apiAbort(400, err.Error())
+		}
+		apiAbortIf(500, err)
+		if devices == nil {
+			devices = []msgpdb.DeviceInfo{}
+		}
+		adminWritePage(w, devices, next)
+		return nil
+	})
+}
+
+// apiAdminUserDeviceKeyGet returns the secret key of a device of a user as {"key": "..."}.
+func apiAdminUserDeviceKeyGet(w http.ResponseWriter, r *http.Request) {
+	db.View(func(tx msgpdb.Tx) error {
+		dev := apiUserDevice(adminUser(tx, r), mux.Vars(r)["device"])
+		data, err := json.Marshal(map[string]string{"key": string(dev.Key())})
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+type adminGroupEntry struct {
+	ID     string   `json:"id"`
+	Users  []string `json:"users"`
+	Admins []string `json:"admins"`
+}
+
+func sortedUserIDs(users map[string]msgpdb.User) []string {
+	result := make([]string, 0, len(users))
+	for id := range users {
+		result = append(result, id)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func apiAdminGroupsGet(w http.ResponseWriter, r *http.Request) {
+	db.View(func(tx msgpdb.Tx) error {
+		groups := tx.Groups()
+		if groups == nil {
+			apiAbort(500, "could not list groups")
+		}
+
+		result := make([]adminGroupEntry, 0, len(groups))
+		for id, group := range groups {
+			result = append(result, adminGroupEntry{id, sortedUserIDs(group.GetUsers()), sortedUserIDs(group.GetAdmins())})
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+		data, err := json.Marshal(result)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+func adminGroup(tx msgpdb.Tx, r *http.Request) msgpdb.Group {
+	group := tx.Group(mux.Vars(r)["group"])
+	if group == nil {
+		apiAbort(404, "no such group")
+	}
+	return group
+}
+
+// apiAdminGroupUserSet adds a user to a group or removes it with DELETE. Group admins may change their own groups.
+func apiAdminGroupUserSet(w http.ResponseWriter, r *http.Request) {
+	err := db.Update(func(tx msgpdb.Tx) error {
+		group := adminGroup(tx, r)
+		user := adminUser(tx, r)
+		if r.Method == "DELETE" {
+			return group.RemoveUser(user.ID())
+		}
+		return group.AddUser(user.ID())
+	})
+	apiAbortIf(500, err)
+}
+
+// apiAdminGroupAdminSet makes a member of a group an admin of the group, or revokes it with DELETE.
+func apiAdminGroupAdminSet(w http.ResponseWriter, r *http.Request) {
+	err := db.Update(func(tx msgpdb.Tx) error {
+		group := adminGroup(tx, r)
+		user := adminUser(tx, r)
+		if r.Method == "DELETE" {
+			return group.UnsetAdmin(user.ID())
+		}
+		return group.SetAdmin(user.ID())
+	})
+	apiAbortIf(500, err)
+}
+
+// apiAdminUserDeviceRemove removes a device from a user, and unlinks the device in the registry if it is linked to
+// the user.
+func apiAdminUserDeviceRemove(w http.ResponseWriter, r *http.Request) {
+	devID := mux.Vars(r)["device"]
+
+	var userID string
+	err := db.Update(func(utx msgpdb.Tx) error {
+		return devdb.Update(func(dtx regdev.Tx) error {
+			user := adminUser(utx, r)
+			apiUserDevice(user, devID)
+
+			if dev := dtx.Device(devID); dev != nil {
+				if linked, ok := dev.UserLink(); ok && linked == user.ID() {
+					apiAbortIf(500, dev.Unlink())
+				}
+			}
+			apiAbortIf(500, user.RemoveDevice(devID))
+			userID = user.ID()
+			return nil
+		})
+	})
+	apiAbortIf(500, err)
+	apiCtx.Webhooks.Emit(userID, msgpdb.WebhookDeviceUnlinked, webhook.DeviceEvent{devID})
+}
+
+func apiAdminRegistryGet(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := adminListLimit(r, msgpdb.MaxListLimit)
+
+	devdb.View(func(dtx regdev.Tx) error {
+		devices, next := dtx.DevicesPage(q.Get("after"), q.Get("search"), limit)
+		entries := make([]adminRegistryEntry, 0, len(devices))
+		for _, dev := range devices {
+			entry := adminRegistryEntry{ID: dev.ID(), Network: redactNetwork(dev.GetNetworkConfig())}
+			entry.User, _ = dev.UserLink()
+			if hbs := dev.HeartbeatsBefore(time.Time{}, 1); len(hbs) > 0 {
+				entry.LastHeartbeat = &hbs[0].Time
+			}
+			entries = append(entries, entry)
+		}
+		adminWritePage(w, entries, next)
+		return nil
+	})
+}
+
+// apiAdminRegistryUnlink unlinks a device in the registry and removes it from the user it was linked to.
+func apiAdminRegistryUnlink(w http.ResponseWriter, r *http.Request) {
+	devID := mux.Vars(r)["device"]
+
+	var removedFrom string
+	err := db.Update(func(utx msgpdb.Tx) error {
+		return devdb.Update(func(dtx regdev.Tx) error {
+			dev := apiDevice(dtx, devID)
+			userID, linked := dev.UserLink()
+			if !linked {
+				apiAbort(409, "device is not linked")
+			}
+
+			apiAbortIf(500, dev.Unlink())
+			if user := utx.User(userID); user != nil && user.Device(devID) != nil {
+				apiAbortIf(500, user.RemoveDevice(devID))
+				removedFrom = user.ID()
+			}
+			return nil
+		})
+	})
+	apiAbortIf(500, err)
+	if removedFrom != "" {
+		apiCtx.Webhooks.Emit(removedFrom, msgpdb.WebhookDeviceUnlinked, webhook.DeviceEvent{devID})
+	}
+}
+
+// apiAdminRegistryClaimToken issues a claim token for an unlinked device, e.g. for an installer to hand to the owner.
+func apiAdminRegistryClaimToken(w http.ResponseWriter, r *http.Request) {
+	var token string
+	devdb.Update(func(dtx regdev.Tx) error {
+		dev := apiDevice(dtx, mux.Vars(r)["device"])
+		if _, linked := dev.UserLink(); linked {
+			apiAbort(409, regdev.ErrAlreadyLinked.Error())
+		}
+
+		var err error
+		token, err = dev.CreateClaimToken(regdev.ClaimTokenValidity)
+		apiAbortIf(500, err)
+		return nil
+	})
+
+	data, err := json.Marshal(map[string]interface{}{
+		"token":   token,
+		"expires": time.Now().Add(regdev.ClaimTokenValidity),
+	})
+	apiAbortIf(500, err)
+	w.Write(data)
+}
+
+func apiAdminRegistryHeartbeatsGet(w http.ResponseWriter, r *http.Request) {
+	limit := adminListLimit(r, msgpdb.MaxListLimit)
+
+	var before time.Time
+	if s := r.URL.Query().Get("after"); s != "" {
+		ts, err := strconv.ParseInt(s, 10, 64)
+		apiAbortIf(400, err)
+		before = time.Unix(ts, 0)
+	}
+
+	devdb.View(func(dtx regdev.Tx) error {
+		hbs := apiDevice(dtx, mux.Vars(r)["device"]).HeartbeatsBefore(before, limit)
+		for i := range hbs {
+			if hbs[i].Config != nil {
+				conf := redactNetwork(*hbs[i].Config)
+				hbs[i].Config = &conf
+			}
+		}
+
+		var next string
+		if len(hbs) == limit {
+			next = strconv.FormatInt(hbs[limit-1].Time.Unix(), 10)
+		}
+		if hbs == nil {
+			hbs = []regdev.Heartbeat{}
+		}
+		adminWritePage(w, hbs, next)
+		return nil
+	})
+}
+
+func loggedInSwitch(in, out func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := getSession(w, r)
+		if _, found := session.Values["user"]; found {
+			in(w, r)
+		} else {
+			out(w, r)
+		}
+	}
+}
+
+func userDevices(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	db.View(func(tx msgpdb.Tx) error {
+		if _, ok := session.Values["user"].(string); !ok {
+			removeSessionAndNotifyUser(w, r, session)
+			return nil
+		}
+
+		u := tx.User(session.Values["user"].(string))
+		if u == nil {
+			removeSessionAndNotifyUser(w, r, session)
+			return nil
 		}
 
 		devs := make(map[string]interface{})
@@ -545,229 +1991,1037 @@ func userDevices(w http.ResponseWriter, r *http.Request) {
 					"unit": sens.Unit(),
 				}
 			}
-			devs[id] = map[string]interface{}{
-				"name":    dev.Name(),
-				"sensors": sensors,
+			devs[id] = map[string]interface{}{
+				"name":    dev.Name(),
+				"sensors": sensors,
+			}
+		}
+
+		templates.ExecuteTemplate(w, "user-devices", devs)
+		return nil
+	})
+}
+
+type apiError struct {
+	Code int
+	Msg  string
+}
+
+func apiBlock(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			switch err := recover().(type) {
+			case nil:
+				return
+			case *apiError:
+				http.Error(w, err.Msg, err.Code)
+			default:
+				panic(err)
+			}
+		}()
+
+		fn(w, r)
+	}
+}
+
+func apiAbort(code int, msg string) {
+	panic(&apiError{code, msg})
+}
+
+func apiAbortIf(code int, err error) {
+	if err != nil {
+		apiAbort(code, err.Error())
+	}
+}
+
+func apiSessionUser(tx msgpdb.Tx, s *sessions.Session) msgpdb.User {
+	userID, ok := s.Values["user"].(string)
+	if !ok {
+		apiAbort(401, "not authorized")
+	}
+	user := tx.User(userID)
+	if user == nil {
+		apiAbort(401, "not authorized")
+	}
+	return user
+}
+
+func apiDevice(tx regdev.Tx, devID string) regdev.RegisteredDevice {
+	dev := tx.Device(devID)
+	if dev == nil {
+		apiAbort(404, "no such device")
+	}
+	return dev
+}
+
+func apiUserDevice(user msgpdb.User, devID string) msgpdb.Device {
+	dev := user.Device(devID)
+	if dev == nil {
+		apiAbort(404, "no such device")
+	}
+	return dev
+}
+
+// apiUserDevicesAdd links a registered device to the session user. The request must prove access to the device
+// with its pairing code or a claim token, given as {"code": "..."}.
+func apiUserDevicesAdd(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	devID := mux.Vars(r)["device"]
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	apiAbortIf(400, json.NewDecoder(r.Body).Decode(&req))
+	if req.Code == "" {
+		apiAbort(400, "pairing code missing")
+	}
+
+	var userID string
+	var data map[string]interface{}
+	err := db.Update(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+		userID = user.ID()
+		if claimLimits.blocked(user.ID()) {
+			apiAbort(http.StatusTooManyRequests, regdev.ErrClaimLocked.Error())
+		}
+
+		// failed claims are recorded in the device database, so the transaction is committed in that case
+		var claimErr error
+		devdb.Update(func(dtx regdev.Tx) error {
+			dev := apiDevice(dtx, devID)
+
+			claimErr = dev.Claim(user.ID(), req.Code)
+			switch claimErr {
+			case nil:
+			case regdev.ErrBadClaim:
+				claimLimits.fail(user.ID())
+				return nil
+			case regdev.ErrClaimLocked:
+				apiAbort(http.StatusTooManyRequests, claimErr.Error())
+			default:
+				apiAbort(400, claimErr.Error())
+			}
+
+			_, err := user.AddDevice(dev.ID(), dev.Key(), false)
+			apiAbortIf(500, err)
+			return nil
+		})
+		if claimErr != nil {
+			apiAbort(403, claimErr.Error())
+		}
+
+		data = map[string]interface{}{
+			devID: map[string]interface{}{
+				"name": user.Device(devID).Name(),
+			},
+		}
+		return nil
+	})
+	apiAbortIf(500, err)
+	apiCtx.Webhooks.Emit(userID, msgpdb.WebhookDeviceLinked, webhook.DeviceEvent{devID})
+
+	raw, _ := json.Marshal(data)
+	w.Write(raw)
+}
+
+func apiUserDevicesRemove(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	devID := mux.Vars(r)["device"]
+
+	var userID string
+	err := db.Update(func(utx msgpdb.Tx) error {
+		return devdb.Update(func(dtx regdev.Tx) error {
+			user := apiSessionUser(utx, session)
+			dev := apiDevice(dtx, devID)
+
+			apiAbortIf(500, dev.Unlink())
+			apiAbortIf(500, user.RemoveDevice(devID))
+			userID = user.ID()
+			return nil
+		})
+	})
+	apiAbortIf(500, err)
+	apiCtx.Webhooks.Emit(userID, msgpdb.WebhookDeviceUnlinked, webhook.DeviceEvent{devID})
+}
+
+func apiUserDeviceConfigGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	devID := mux.Vars(r)["device"]
+	db.View(func(utx msgpdb.Tx) error {
+		return devdb.View(func(dtx regdev.Tx) error {
+			user := apiSessionUser(utx, session)
+			rdev := apiDevice(dtx, devID)
+			dev := apiUserDevice(user, devID)
+
+			netconf := rdev.GetNetworkConfig()
+			conf := map[string]interface{}{
+				"lan":  netconf.LAN,
+				"wifi": netconf.Wifi,
+				"name": dev.Name(),
+			}
+			data, err := json.Marshal(conf)
+			apiAbortIf(500, err)
+			w.Write(data)
+			return nil
+		})
+	})
+}
+
+func apiUserDeviceConfigSet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	devID := mux.Vars(r)["device"]
+	db.Update(func(utx msgpdb.Tx) error {
+		return devdb.Update(func(dtx regdev.Tx) error {
+			user := apiSessionUser(utx, session)
+			rdev := apiDevice(dtx, devID)
+			dev := apiUserDevice(user, devID)
+
+			var conf regdev.DeviceConfigNetwork
+			var name struct {
+				Name string `json:"name"`
+			}
+
+			data, err := ioutil.ReadAll(r.Body)
+			apiAbortIf(500, err)
+
+			apiAbortIf(400, json.Unmarshal(data, &conf))
+			apiAbortIf(400, json.Unmarshal(data, &name))
+
+			apiAbortIf(400, dev.SetName(name.Name))
+			apiAbortIf(400, rdev.SetNetworkConfig(&conf))
+			return nil
+		})
+	})
+}
+
+func apiUserDeviceSensorPropsGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	devID := mux.Vars(r)["device"]
+	sensID := mux.Vars(r)["sensor"]
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+		dev := apiUserDevice(user, devID)
+
+		sens := dev.Sensor(sensID)
+		if sens == nil {
+			apiAbort(404, "no such sensor")
+		}
+
+		conf := map[string]interface{}{
+			"name":   sens.Name(),
+			"unit":   sens.Unit(),
+			"port":   sens.Port(),
+			"factor": sens.Factor(),
+		}
+
+		data, err := json.Marshal(conf)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+func apiUserDeviceSensorPropsSet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	devID := mux.Vars(r)["device"]
+	sensID := mux.Vars(r)["sensor"]
+	db.Update(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+		dev := apiUserDevice(user, devID)
+
+		sens := dev.Sensor(sensID)
+		if sens == nil {
+			apiAbort(404, "no such sensor")
+		}
+
+		data, err := ioutil.ReadAll(r.Body)
+		apiAbortIf(500, err)
+
+		var conf struct {
+			Name string
+		}
+
+		apiAbortIf(500, json.Unmarshal(data, &conf))
+		apiAbortIf(500, sens.SetName(conf.Name))
+
+		apiCtx.Hub.Publish(user.ID(), msg2api.UserEventMetadataArgs{
+			Devices: map[string]msg2api.DeviceMetadata{
+				devID: {
+					Sensors: map[string]msg2api.SensorMetadata{
+						sensID: {
+							Name: &conf.Name,
+						},
+					},
+				},
+			},
+		})
+
+		return nil
+	})
+}
+
+func apiUserDeviceSensorCalibrationsGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	devID := mux.Vars(r)["device"]
+	sensID := mux.Vars(r)["sensor"]
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+		dev := apiUserDevice(user, devID)
+
+		sens := dev.Sensor(sensID)
+		if sens == nil {
+			apiAbort(404, "no such sensor")
+		}
+
+		calibrations, err := sens.Calibrations()
+		apiAbortIf(500, err)
+
+		data, err := json.Marshal(calibrations)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+func apiUserDeviceSensorCalibrationsAdd(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	devID := mux.Vars(r)["device"]
+	sensID := mux.Vars(r)["sensor"]
+	db.Update(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+		dev := apiUserDevice(user, devID)
+
+		sens := dev.Sensor(sensID)
+		if sens == nil {
+			apiAbort(404, "no such sensor")
+		}
+
+		data, err := ioutil.ReadAll(r.Body)
+		apiAbortIf(500, err)
+
+		// fields missing from the request keep their current values
+		conf := msgpdb.Calibration{Unit: sens.Unit(), Port: sens.Port(), Factor: sens.Factor()}
+		apiAbortIf(400, json.Unmarshal(data, &conf))
+		apiAbortIf(400, sens.Calibrate(conf))
+
+		unit, port, factor := sens.Unit(), sens.Port(), sens.Factor()
+		apiCtx.Hub.Publish(user.ID(), msg2api.UserEventMetadataArgs{
+			Devices: map[string]msg2api.DeviceMetadata{
+				devID: {
+					Sensors: map[string]msg2api.SensorMetadata{
+						sensID: {
+							Unit:   &unit,
+							Port:   &port,
+							Factor: &factor,
+						},
+					},
+				},
+			},
+		})
+
+		return nil
+	})
+}
+
+func apiUserDeviceSensorValidationGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	devID := mux.Vars(r)["device"]
+	sensID := mux.Vars(r)["sensor"]
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+		dev := apiUserDevice(user, devID)
+
+		sens := dev.Sensor(sensID)
+		if sens == nil {
+			apiAbort(404, "no such sensor")
+		}
+
+		effective := dev.ValidationRules()[sensID]
+		conf := map[string]interface{}{
+			"sensor":    sens.ValidationRule(),
+			"effective": effective,
+		}
+
+		data, err := json.Marshal(conf)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+func apiUserDeviceSensorValidationSet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	devID := mux.Vars(r)["device"]
+	sensID := mux.Vars(r)["sensor"]
+	db.Update(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+		dev := apiUserDevice(user, devID)
+
+		sens := dev.Sensor(sensID)
+		if sens == nil {
+			apiAbort(404, "no such sensor")
+		}
+
+		var rule *msgpdb.ValidationRule
+		if r.Method != "DELETE" {
+			data, err := ioutil.ReadAll(r.Body)
+			apiAbortIf(500, err)
+
+			rule = new(msgpdb.ValidationRule)
+			apiAbortIf(400, json.Unmarshal(data, rule))
+		}
+
+		apiAbortIf(400, sens.SetValidationRule(rule))
+		return nil
+	})
+}
+
+func apiUserDeviceSensorQuarantineGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	devID := mux.Vars(r)["device"]
+	sensID := mux.Vars(r)["sensor"]
+
+	// timespan defaults to the last day, since and until are unix timestamps
+	until := time.Now()
+	since := until.Add(-24 * time.Hour)
+	if arg := r.FormValue("since"); arg != "" {
+		ts, err := strconv.ParseInt(arg, 10, 64)
+		apiAbortIf(400, err)
+		since = time.Unix(ts, 0)
+	}
+	if arg := r.FormValue("until"); arg != "" {
+		ts, err := strconv.ParseInt(arg, 10, 64)
+		apiAbortIf(400, err)
+		until = time.Unix(ts, 0)
+	}
+
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+		dev := apiUserDevice(user, devID)
+
+		sens := dev.Sensor(sensID)
+		if sens == nil {
+			apiAbort(404, "no such sensor")
+		}
+
+		readings, err := sens.QuarantinedReadings(since, until)
+		apiAbortIf(500, err)
+
+		data, err := json.Marshal(readings)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+func apiUserAlertRulesGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+
+		rules, err := user.AlertRules()
+		apiAbortIf(500, err)
+
+		data, err := json.Marshal(rules)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+func apiUserAlertRulesAdd(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+
+	var rule msgpdb.AlertRule
+	apiAbortIf(400, json.NewDecoder(r.Body).Decode(&rule))
+
+	var id uint64
+	err := db.Update(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+
+		var err error
+		id, err = user.AddAlertRule(rule)
+		return err
+	})
+	apiAbortIf(400, err)
+	apiAbortIf(500, apiCtx.Alerts.Reload())
+
+	data, err := json.Marshal(map[string]uint64{"id": id})
+	apiAbortIf(500, err)
+	w.Write(data)
+}
+
+func apiUserAlertRulesRemove(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	id, err := strconv.ParseUint(mux.Vars(r)["rule"], 10, 64)
+	apiAbortIf(400, err)
+
+	err = db.Update(func(utx msgpdb.Tx) error {
+		return apiSessionUser(utx, session).RemoveAlertRule(id)
+	})
+	apiAbortIf(500, err)
+	apiAbortIf(500, apiCtx.Alerts.Reload())
+}
+
+func apiUserAlertsGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+
+	// since is a unix timestamp and defaults to one week ago
+	since := time.Now().AddDate(0, 0, -7)
+	if arg := r.FormValue("since"); arg != "" {
+		ts, err := strconv.ParseInt(arg, 10, 64)
+		apiAbortIf(400, err)
+		since = time.Unix(ts, 0)
+	}
+
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+
+		alerts, err := user.Alerts(since)
+		apiAbortIf(500, err)
+
+		data, err := json.Marshal(alerts)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+func apiUserSummaryGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+
+		summary, err := user.ConsumptionSummary()
+		apiAbortIf(500, err)
+
+		data, err := json.Marshal(summary)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+const (
+	// autoResolutionMaxPoints is the number of values per sensor returned for resolution "auto" without a point limit.
+	autoResolutionMaxPoints = 1000
+	// maxRequestedPoints is the highest point limit a client may request.
+	maxRequestedPoints = 10000
+)
+
+// valuesRequest is the body of POST /api/user/v1/values, timestamps are milliseconds since the epoch.
+// The options are described by msgpdb.ReadingOptions.
+type valuesRequest struct {
+	Since      int64               `json:"since"`
+	Until      int64               `json:"until"`
+	Resolution string              `json:"resolution"`
+	Sensors    map[string][]string `json:"sensors"`
+	MaxPoints  int                 `json:"maxPoints"`
+	Downsample string              `json:"downsample"`
+	Fill       string              `json:"fill"`
+}
+
+// valuesResponse holds the [timestamp, value] pairs of each sensor by device, the resolution they were loaded in and
+// the start of every gap marked by fill "null".
+type valuesResponse struct {
+	Resolution string                             `json:"resolution"`
+	Values     map[string]map[string][][2]float64 `json:"values"`
+	Gaps       map[string]map[string][]int64      `json:"gaps"`
+}
+
+func apiUserValuesQuery(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+
+	var req valuesRequest
+	apiAbortIf(400, json.NewDecoder(r.Body).Decode(&req))
+	if req.MaxPoints < 0 || req.MaxPoints > maxRequestedPoints {
+		apiAbort(400, fmt.Sprintf("maxPoints must be at most %v", maxRequestedPoints))
+	}
+	if req.MaxPoints == 0 && req.Resolution == msgpdb.ResolutionAuto {
+		req.MaxPoints = autoResolutionMaxPoints
+	}
+
+	ms := func(t int64) time.Time {
+		return time.Unix(0, t*int64(time.Millisecond))
+	}
+	opts := &msgpdb.ReadingOptions{MaxPoints: req.MaxPoints, Downsample: req.Downsample, Fill: req.Fill}
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+
+		readings, err := user.LoadReadings(ms(req.Since), ms(req.Until), req.Resolution, req.Sensors, opts)
+		apiAbortIf(400, err)
+
+		result := valuesResponse{
+			Resolution: opts.Resolution,
+			Values:     make(map[string]map[string][][2]float64, len(readings)),
+			Gaps:       make(map[string]map[string][]int64, len(opts.Gaps)),
+		}
+		for devID, sensors := range readings {
+			result.Values[devID] = make(map[string][][2]float64, len(sensors))
+			for sensID, values := range sensors {
+				pairs := make([][2]float64, 0, len(values))
+				for _, v := range values {
+					pairs = append(pairs, [2]float64{float64(v.Time.UnixNano() / int64(time.Millisecond)), v.Value})
+				}
+				result.Values[devID][sensID] = pairs
+			}
+		}
+		for devID, sensors := range opts.Gaps {
+			result.Gaps[devID] = make(map[string][]int64, len(sensors))
+			for sensID, starts := range sensors {
+				for _, start := range starts {
+					result.Gaps[devID][sensID] = append(result.Gaps[devID][sensID], start.UnixNano()/int64(time.Millisecond))
+				}
 			}
 		}
 
-		templates.ExecuteTemplate(w, "user-devices", devs)
-		return nil
+		data, err := json.Marshal(result)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+func apiUserSessionsGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+
+		list, err := user.Sessions()
+		apiAbortIf(500, err)
+
+		type sessionInfo struct {
+			msgpdb.Session
+			Current bool `json:"current"`
+		}
+		current := utx.Session(session.Values["session"].(string))
+		result := make([]sessionInfo, 0, len(list))
+		for _, s := range list {
+			result = append(result, sessionInfo{s, current != nil && s.ID == current.ID})
+		}
+
+		data, err := json.Marshal(result)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
+
+func apiUserSessionsRemoveAll(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	var userID string
+	err := db.Update(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+		userID = user.ID()
+		return user.RemoveSessions("")
+	})
+	apiAbortIf(500, err)
+	closeSessionWebsockets(userID, "")
+}
+
+func apiUserSessionsRemove(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	id, err := strconv.ParseUint(mux.Vars(r)["session"], 10, 64)
+	apiAbortIf(400, err)
+
+	var userID string
+	err = db.Update(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+		userID = user.ID()
+		return user.RemoveSession(id)
 	})
+	apiAbortIf(500, err)
+	apiCtx.CloseUserSessions(func(s msgp.UserSession) bool { return s.User == userID && s.ID == id })
 }
 
-type apiError struct {
-	Code int
-	Msg  string
+func apiUserWebhooksGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+
+		hooks, err := user.Webhooks()
+		apiAbortIf(500, err)
+
+		data, err := json.Marshal(hooks)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
 }
 
-func apiBlock(fn func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			switch err := recover().(type) {
-			case nil:
-				return
-			case *apiError:
-				http.Error(w, err.Msg, err.Code)
-			default:
-				panic(err)
-			}
-		}()
+func apiUserWebhooksAdd(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
 
-		fn(w, r)
+	var req struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
 	}
+	apiAbortIf(400, json.NewDecoder(r.Body).Decode(&req))
+
+	var hook msgpdb.Webhook
+	err := db.Update(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+
+		var err error
+		hook, err = user.AddWebhook(req.URL, req.Events)
+		return err
+	})
+	apiAbortIf(400, err)
+	apiAbortIf(500, apiCtx.Webhooks.Reload())
+
+	// the secret is only ever shown in this response
+	data, err := json.Marshal(hook)
+	apiAbortIf(500, err)
+	w.Write(data)
 }
 
-func apiAbort(code int, msg string) {
-	panic(&apiError{code, msg})
+func apiUserWebhooksRemove(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	id, err := strconv.ParseUint(mux.Vars(r)["webhook"], 10, 64)
+	apiAbortIf(400, err)
+
+	err = db.Update(func(utx msgpdb.Tx) error {
+		return apiSessionUser(utx, session).RemoveWebhook(id)
+	})
+	apiAbortIf(500, err)
+	apiAbortIf(500, apiCtx.Webhooks.Reload())
 }
 
-func apiAbortIf(code int, err error) {
-	if err != nil {
-		apiAbort(code, err.Error())
+func apiUserWebhookDeliveriesGet(w http.ResponseWriter, r *http.Request) {
+	session := getSession(w, r)
+	id, err := strconv.ParseUint(mux.Vars(r)["webhook"], 10, 64)
+	apiAbortIf(400, err)
+
+	limit := 100
+	if arg := r.FormValue("limit"); arg != "" {
+		limit, err = strconv.Atoi(arg)
+		apiAbortIf(400, err)
 	}
+
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+
+		deliveries, err := user.WebhookDeliveries(id, limit)
+		apiAbortIf(500, err)
+
+		data, err := json.Marshal(deliveries)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
 }
 
-func apiSessionUser(tx msgpdb.Tx, s *sessions.Session) msgpdb.User {
-	user := tx.User(s.Values["user"].(string))
-	if user == nil {
-		apiAbort(401, "not authorized")
-	}
-	return user
+// deviceTransferValidity is the time both users have to accept a device transfer.
+const deviceTransferValidity = 7 * 24 * time.Hour
+
+// transferRequest is the body of requests that create a device transfer.
+type transferRequest struct {
+	To          string `json:"to"`
+	WithHistory bool   `json:"withHistory"`
 }
 
-func apiDevice(tx regdev.Tx, devID string) regdev.RegisteredDevice {
-	dev := tx.Device(devID)
-	if dev == nil {
-		apiAbort(404, "no such device")
+func readTransferRequest(r *http.Request) transferRequest {
+	var req transferRequest
+	apiAbortIf(400, json.NewDecoder(r.Body).Decode(&req))
+	if req.To == "" {
+		apiAbort(400, "receiving user missing")
 	}
-	return dev
+	return req
 }
 
-func apiUserDevice(user msgpdb.User, devID string) msgpdb.Device {
-	dev := user.Device(devID)
-	if dev == nil {
-		apiAbort(404, "no such device")
+func apiAbortIfTransfer(err error) {
+	switch err {
+	case nil:
+	case msgpdb.ErrNoUser, msgpdb.ErrNoDevice, msgpdb.ErrNoTransfer:
+		apiAbort(404, err.Error())
+	case msgpdb.ErrTransferExists, msgpdb.ErrTransferConflict, regdev.ErrNotLinkedTo:
+		apiAbort(409, err.Error())
+	default:
+		apiAbort(500, err.Error())
 	}
-	return dev
 }
 
-func apiUserDevicesAdd(w http.ResponseWriter, r *http.Request) {
+func writeTransfer(w http.ResponseWriter, t *msgpdb.DeviceTransfer) {
+	data, err := json.Marshal(t)
+	apiAbortIf(500, err)
+	w.Write(data)
+}
+
+// apiUserDeviceTransferAdd offers a device of the session user to another user. The offer counts as acceptance by
+// the session user, the transfer is carried out once the receiving user accepts it.
+func apiUserDeviceTransferAdd(w http.ResponseWriter, r *http.Request) {
 	session := getSession(w, r)
 	devID := mux.Vars(r)["device"]
+	req := readTransferRequest(r)
 
 	db.Update(func(utx msgpdb.Tx) error {
-		return devdb.Update(func(dtx regdev.Tx) error {
-			user := apiSessionUser(utx, session)
-			dev := apiDevice(dtx, devID)
-
-			apiAbortIf(400, dev.LinkTo(user.ID()))
-
-			_, err := user.AddDevice(dev.ID(), dev.Key(), false)
-			apiAbortIf(500, err)
-
-			data := map[string]interface{}{
-				devID: map[string]interface{}{
-					"name": user.Device(devID).Name(),
-				},
-			}
-			raw, _ := json.Marshal(data)
-			w.Write(raw)
-			return nil
-		})
+		user := apiSessionUser(utx, session)
+		t, err := utx.AddDeviceTransfer(devID, user.ID(), req.To, req.WithHistory, deviceTransferValidity)
+		apiAbortIfTransfer(err)
+		t, err = user.AcceptTransfer(t.ID)
+		apiAbortIfTransfer(err)
+		writeTransfer(w, t)
+		return nil
 	})
 }
 
-func apiUserDevicesRemove(w http.ResponseWriter, r *http.Request) {
-	session := getSession(w, r)
-	devID := mux.Vars(r)["device"]
+// apiAdminUserDeviceTransferAdd creates a transfer of a device between two users, which both users have to accept.
+func apiAdminUserDeviceTransferAdd(w http.ResponseWriter, r *http.Request) {
+	req := readTransferRequest(r)
 
 	db.Update(func(utx msgpdb.Tx) error {
-		return devdb.Update(func(dtx regdev.Tx) error {
-			user := apiSessionUser(utx, session)
-			dev := apiDevice(dtx, devID)
-
-			apiAbortIf(500, dev.Unlink())
-			apiAbortIf(500, user.RemoveDevice(devID))
-			return nil
-		})
+		t, err := utx.AddDeviceTransfer(mux.Vars(r)["device"], mux.Vars(r)["user"], req.To, req.WithHistory,
+			deviceTransferValidity)
+		apiAbortIfTransfer(err)
+		writeTransfer(w, t)
+		return nil
 	})
 }
 
-func apiUserDeviceConfigGet(w http.ResponseWriter, r *http.Request) {
+func apiUserTransfersGet(w http.ResponseWriter, r *http.Request) {
 	session := getSession(w, r)
-	devID := mux.Vars(r)["device"]
 	db.View(func(utx msgpdb.Tx) error {
-		return devdb.View(func(dtx regdev.Tx) error {
-			user := apiSessionUser(utx, session)
-			rdev := apiDevice(dtx, devID)
-			dev := apiUserDevice(user, devID)
+		transfers, err := apiSessionUser(utx, session).DeviceTransfers()
+		apiAbortIf(500, err)
+		if transfers == nil {
+			transfers = []msgpdb.DeviceTransfer{}
+		}
+		data, err := json.Marshal(transfers)
+		apiAbortIf(500, err)
+		w.Write(data)
+		return nil
+	})
+}
 
-			netconf := rdev.GetNetworkConfig()
-			conf := map[string]interface{}{
-				"lan":  netconf.LAN,
-				"wifi": netconf.Wifi,
-				"name": dev.Name(),
-			}
-			data, err := json.Marshal(conf)
-			apiAbortIf(500, err)
-			w.Write(data)
-			return nil
-		})
+// apiCheckTransferProof aborts unless code proves access to a registered device the user is to receive, like the
+// code of a claim in apiUserDevicesAdd. The device keeps its key, which the sending user may know, so the receiving
+// user pairs the device again.
+func apiCheckTransferProof(userID, devID, code string) {
+	if claimLimits.blocked(userID) {
+		apiAbort(http.StatusTooManyRequests, regdev.ErrClaimLocked.Error())
+	}
+
+	// failed checks are recorded in the device database, so the transaction is committed in that case
+	var proofErr error
+	err := devdb.Update(func(dtx regdev.Tx) error {
+		if dev := dtx.Device(devID); dev != nil {
+			proofErr = dev.CheckClaim(code)
+		}
+		return nil
 	})
+	apiAbortIf(500, err)
+
+	switch proofErr {
+	case nil:
+	case regdev.ErrBadClaim:
+		claimLimits.fail(userID)
+		apiAbort(403, proofErr.Error())
+	case regdev.ErrClaimLocked:
+		apiAbort(http.StatusTooManyRequests, proofErr.Error())
+	default:
+		apiAbort(500, proofErr.Error())
+	}
 }
 
-func apiUserDeviceConfigSet(w http.ResponseWriter, r *http.Request) {
+// apiUserTransferAccept accepts a transfer for the session user. The receiving user gives the pairing code of the
+// device or a claim token as {"code": "..."}. Once both users accepted it, the device is moved in the database and
+// relinked in the device registry. The registry is changed last and changed back if the database transaction fails
+// to commit, so both stay consistent.
+func apiUserTransferAccept(w http.ResponseWriter, r *http.Request) {
 	session := getSession(w, r)
-	devID := mux.Vars(r)["device"]
-	db.Update(func(utx msgpdb.Tx) error {
-		return devdb.Update(func(dtx regdev.Tx) error {
-			user := apiSessionUser(utx, session)
-			rdev := apiDevice(dtx, devID)
-			dev := apiUserDevice(user, devID)
+	id, err := strconv.ParseUint(mux.Vars(r)["transfer"], 10, 64)
+	apiAbortIf(400, err)
 
-			var conf regdev.DeviceConfigNetwork
-			var name struct {
-				Name string `json:"name"`
+	var req struct {
+		Code string `json:"code"`
+	}
+	if r.ContentLength != 0 {
+		apiAbortIf(400, json.NewDecoder(r.Body).Decode(&req))
+	}
+
+	var userID string
+	var pending *msgpdb.DeviceTransfer
+	db.View(func(utx msgpdb.Tx) error {
+		user := apiSessionUser(utx, session)
+		userID = user.ID()
+		transfers, err := user.DeviceTransfers()
+		apiAbortIf(500, err)
+		for i := range transfers {
+			if transfers[i].ID == id {
+				pending = &transfers[i]
 			}
+		}
+		return nil
+	})
+	if pending == nil {
+		apiAbort(404, msgpdb.ErrNoTransfer.Error())
+	}
+	if pending.To == userID && !pending.ToAccepted {
+		apiCheckTransferProof(pending.To, pending.Device, req.Code)
+	}
 
-			data, err := ioutil.ReadAll(r.Body)
-			apiAbortIf(500, err)
+	var t *msgpdb.DeviceTransfer
+	relinked := false
+	err = db.Update(func(utx msgpdb.Tx) error {
+		var err error
+		t, err = apiSessionUser(utx, session).AcceptTransfer(id)
+		apiAbortIfTransfer(err)
+		if !t.Done() {
+			return nil
+		}
 
-			apiAbortIf(400, json.Unmarshal(data, &conf))
-			apiAbortIf(400, json.Unmarshal(data, &name))
+		// virtual devices are not registered
+		registered := false
+		apiAbortIfTransfer(devdb.Update(func(dtx regdev.Tx) error {
+			dev := dtx.Device(t.Device)
+			if dev == nil {
+				return nil
+			}
+			registered = true
+			return dev.Transfer(t.From, t.To)
+		}))
+		relinked = registered
+		return nil
+	})
+	if err != nil {
+		if relinked {
+			err := devdb.Update(func(dtx regdev.Tx) error {
+				return dtx.Device(t.Device).Transfer(t.To, t.From)
+			})
+			if err != nil {
+				log.Printf("reverting transfer of %v to %v: %v", t.Device, t.To, err)
+			}
+		}
+		apiAbort(500, err.Error())
+	}
 
-			apiAbortIf(400, dev.SetName(name.Name))
-			apiAbortIf(400, rdev.SetNetworkConfig(&conf))
+	if t.Done() {
+		// the websocket of the device still belongs to the sending user, the device reconnects as the receiving user,
+		// which it learns from its heartbeats
+		apiCtx.WithDevice(t.Device, func(dev *msgp.WsDevAPI) error {
+			dev.Close()
 			return nil
 		})
-	})
+		if err := apiCtx.Alerts.Reload(); err != nil {
+			log.Printf("reloading alert rules: %v", err)
+		}
+		apiCtx.Webhooks.Emit(t.From, msgpdb.WebhookDeviceUnlinked, webhook.DeviceEvent{t.Device})
+		apiCtx.Webhooks.Emit(t.To, msgpdb.WebhookDeviceLinked, webhook.DeviceEvent{t.Device})
+	}
+	writeTransfer(w, t)
 }
 
-func apiUserDeviceSensorPropsGet(w http.ResponseWriter, r *http.Request) {
+func apiUserTransferRemove(w http.ResponseWriter, r *http.Request) {
 	session := getSession(w, r)
-	devID := mux.Vars(r)["device"]
-	sensID := mux.Vars(r)["sensor"]
-	db.View(func(utx msgpdb.Tx) error {
-		user := apiSessionUser(utx, session)
-		dev := apiUserDevice(user, devID)
+	id, err := strconv.ParseUint(mux.Vars(r)["transfer"], 10, 64)
+	apiAbortIf(400, err)
 
-		sens := dev.Sensor(sensID)
-		if sens == nil {
-			apiAbort(404, "no such sensor")
-		}
+	db.Update(func(utx msgpdb.Tx) error {
+		apiAbortIfTransfer(apiSessionUser(utx, session).RemoveTransfer(id))
+		return nil
+	})
+}
 
-		conf := map[string]interface{}{
-			"name":   sens.Name(),
-			"unit":   sens.Unit(),
-			"port":   sens.Port(),
-			"factor": sens.Factor(),
+func checkHub() error {
+	if !h.Alive(time.Second) {
+		return errHubNotResponding
+	}
+	return nil
+}
+
+func checkBuffer() error {
+	if lag := db.BufferLag(); lag > maxBufferLag {
+		return fmt.Errorf("oldest buffered value waiting for %v", lag)
+	}
+	return nil
+}
+
+// healthHandler runs all checks and reports their results as a JSON object, with status 503 if any check failed.
+func healthHandler(checks map[string]func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		result := make(map[string]string, len(checks))
+		for name, check := range checks {
+			if err := check(); err != nil {
+				result[name] = err.Error()
+				status = http.StatusServiceUnavailable
+			} else {
+				result[name] = "ok"
+			}
 		}
 
-		data, err := json.Marshal(conf)
-		apiAbortIf(500, err)
+		data, _ := json.Marshal(result)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
 		w.Write(data)
-		return nil
-	})
+	}
 }
 
-func apiUserDeviceSensorPropsSet(w http.ResponseWriter, r *http.Request) {
-	session := getSession(w, r)
+func apiDeviceBackfill(w http.ResponseWriter, r *http.Request) {
 	devID := mux.Vars(r)["device"]
-	sensID := mux.Vars(r)["sensor"]
-	db.Update(func(utx msgpdb.Tx) error {
-		user := apiSessionUser(utx, session)
-		dev := apiUserDevice(user, devID)
 
-		sens := dev.Sensor(sensID)
-		if sens == nil {
-			apiAbort(404, "no such sensor")
+	var key []byte
+	var userID string
+	var linked bool
+	devdb.View(func(dtx regdev.Tx) error {
+		if dev := dtx.Device(devID); dev != nil {
+			key = dev.Key()
+			userID, linked = dev.UserLink()
 		}
+		return nil
+	})
+	if key == nil {
+		apiAbort(404, "no such device")
+	}
 
-		data, err := ioutil.ReadAll(r.Body)
-		apiAbortIf(500, err)
+	body, err := regdev.ReadSignedBody(r, key)
+	apiAbortIf(400, err)
+	if !linked {
+		apiAbort(404, errDeviceNotLinked.Error())
+	}
 
-		var conf struct {
-			Name string
-		}
+	// values are sent as [timestamp in milliseconds, value] pairs per sensor
+	var raw map[string][][2]float64
+	apiAbortIf(400, json.Unmarshal(body, &raw))
 
-		apiAbortIf(500, json.Unmarshal(data, &conf))
-		apiAbortIf(500, sens.SetName(conf.Name))
+	values := make(map[string][]msg2api.Measurement, len(raw))
+	for sensID, pairs := range raw {
+		for _, pair := range pairs {
+			ts := time.Unix(0, int64(pair[0]*float64(time.Millisecond)))
+			values[sensID] = append(values[sensID], msg2api.Measurement{ts, pair[1]})
+		}
+	}
 
-		apiCtx.Hub.Publish(user.ID(), msg2api.UserEventMetadataArgs{
-			Devices: map[string]msg2api.DeviceMetadata{
-				devID: {
-					Sensors: map[string]msg2api.SensorMetadata{
-						sensID: {
-							Name: &conf.Name,
-						},
-					},
-				},
-			},
-		})
+	var added, quarantined int
+	err = db.Update(func(utx msgpdb.Tx) error {
+		user := utx.User(userID)
+		if user == nil {
+			return msgpdb.ErrNoUser
+		}
+		dev := user.Device(devID)
+		if dev == nil {
+			return errDeviceNotLinked
+		}
 
-		return nil
+		var err error
+		added, quarantined, err = dev.Backfill(values)
+		return err
 	})
+	switch err {
+	case nil:
+	case msgpdb.ErrNoUser, msgpdb.ErrNoSensor, errDeviceNotLinked:
+		apiAbort(404, err.Error())
+	case msgpdb.ErrBackfillTooLarge:
+		apiAbort(400, err.Error())
+	default:
+		apiAbort(500, err.Error())
+	}
+
+	metrics.ValuesReceived.WithLabelValues("quarantined").Add(float64(quarantined))
+
+	data, err := json.Marshal(map[string]int{"added": added, "quarantined": quarantined})
+	apiAbortIf(500, err)
+	w.Write(data)
 }
 
 func main() {
@@ -784,27 +3038,111 @@ func main() {
 		router.HandleFunc("/user/register", staticTemplate("register")).Methods("GET")
 		router.HandleFunc("/user/register", defaultHeaders(userRegister)).Methods("POST")
 		router.HandleFunc("/user/devices", defaultHeaders(userDevices)).Methods("GET")
+		router.HandleFunc("/user/account", defaultHeaders(userAccount)).Methods("GET")
+		router.HandleFunc("/user/account/password", defaultHeaders(userAccountPassword)).Methods("POST")
+		router.HandleFunc("/user/account/email", defaultHeaders(userAccountEmail)).Methods("POST")
+		router.HandleFunc("/user/account/export", defaultHeaders(userAccountExport)).Methods("GET")
+		router.HandleFunc("/user/account/delete", defaultHeaders(userAccountDelete)).Methods("POST")
+		router.HandleFunc("/user/account/sessions/logout", defaultHeaders(userAccountLogoutAll)).Methods("POST")
+		router.HandleFunc("/user/account/sessions/{session}/logout", defaultHeaders(userAccountLogoutSession)).Methods("POST")
+		router.HandleFunc("/user/reset", staticTemplate("user-reset")).Methods("GET")
+		router.HandleFunc("/user/reset", defaultHeaders(userResetRequest)).Methods("POST")
+		router.HandleFunc("/user/reset/{token}", defaultHeaders(userResetForm)).Methods("GET")
+		router.HandleFunc("/user/reset/{token}", defaultHeaders(userResetPassword)).Methods("POST")
 		router.HandleFunc("/api/user/v1/device/{device}", apiBlock(apiUserDevicesAdd)).Methods("POST")
 		router.HandleFunc("/api/user/v1/device/{device}", apiBlock(apiUserDevicesRemove)).Methods("DELETE")
 		router.HandleFunc("/api/user/v1/device/{device}/config", apiBlock(apiUserDeviceConfigGet)).Methods("GET")
+		router.HandleFunc("/api/user/v1/device/{device}/transfer", apiBlock(apiUserDeviceTransferAdd)).Methods("POST")
 		router.HandleFunc("/api/user/v1/device/{device}/config", apiBlock(apiUserDeviceConfigSet)).Methods("POST")
 		router.HandleFunc("/api/user/v1/sensor/{device}/{sensor}/props", apiBlock(apiUserDeviceSensorPropsGet)).Methods("GET")
 		router.HandleFunc("/api/user/v1/sensor/{device}/{sensor}/props", apiBlock(apiUserDeviceSensorPropsSet)).Methods("POST")
-
-		router.HandleFunc("/admin", defaultHeaders(adminHandler))
+		router.HandleFunc("/api/user/v1/sensor/{device}/{sensor}/calibrations", apiBlock(apiUserDeviceSensorCalibrationsGet)).Methods("GET")
+		router.HandleFunc("/api/user/v1/sensor/{device}/{sensor}/calibrations", apiBlock(apiUserDeviceSensorCalibrationsAdd)).Methods("POST")
+		router.HandleFunc("/api/user/v1/sensor/{device}/{sensor}/validation", apiBlock(apiUserDeviceSensorValidationGet)).Methods("GET")
+		router.HandleFunc("/api/user/v1/sensor/{device}/{sensor}/validation", apiBlock(apiUserDeviceSensorValidationSet)).Methods("POST", "DELETE")
+		router.HandleFunc("/api/user/v1/sensor/{device}/{sensor}/quarantine", apiBlock(apiUserDeviceSensorQuarantineGet)).Methods("GET")
+		router.HandleFunc("/api/user/v1/permissions", apiBlock(apiUserPermissionsGet)).Methods("GET")
+		router.HandleFunc("/api/user/v1/summary", apiBlock(apiUserSummaryGet)).Methods("GET")
+		router.HandleFunc("/api/user/v1/values", apiBlock(apiUserValuesQuery)).Methods("POST")
+		router.HandleFunc("/api/user/v1/alerts", apiBlock(apiUserAlertsGet)).Methods("GET")
+		router.HandleFunc("/api/user/v1/alerts/rules", apiBlock(apiUserAlertRulesGet)).Methods("GET")
+		router.HandleFunc("/api/user/v1/alerts/rules", apiBlock(apiUserAlertRulesAdd)).Methods("POST")
+		router.HandleFunc("/api/user/v1/alerts/rules/{rule}", apiBlock(apiUserAlertRulesRemove)).Methods("DELETE")
+		router.HandleFunc("/api/user/v1/sessions", apiBlock(apiUserSessionsGet)).Methods("GET")
+		router.HandleFunc("/api/user/v1/sessions", apiBlock(apiUserSessionsRemoveAll)).Methods("DELETE")
+		router.HandleFunc("/api/user/v1/sessions/{session}", apiBlock(apiUserSessionsRemove)).Methods("DELETE")
+		router.HandleFunc("/api/user/v1/transfers", apiBlock(apiUserTransfersGet)).Methods("GET")
+		router.HandleFunc("/api/user/v1/transfers/{transfer}/accept", apiBlock(apiUserTransferAccept)).Methods("POST")
+		router.HandleFunc("/api/user/v1/transfers/{transfer}", apiBlock(apiUserTransferRemove)).Methods("DELETE")
+		router.HandleFunc("/api/user/v1/webhooks", apiBlock(apiUserWebhooksGet)).Methods("GET")
+		router.HandleFunc("/api/user/v1/webhooks", apiBlock(apiUserWebhooksAdd)).Methods("POST")
+		router.HandleFunc("/api/user/v1/webhooks/{webhook}", apiBlock(apiUserWebhooksRemove)).Methods("DELETE")
+		router.HandleFunc("/api/user/v1/webhooks/{webhook}/deliveries", apiBlock(apiUserWebhookDeliveriesGet)).Methods("GET")
+
+		router.HandleFunc("/admin", requirePermission(msgpdb.PermUsersRead, staticTemplate("admin"))).Methods("GET")
+		router.HandleFunc("/admin/user/{user}/dashboard", requirePermission(msgpdb.PermUsersData, wsTemplate("index_user"))).Methods("GET")
+		router.HandleFunc("/admin/user/{user}/roles", requirePermission(msgpdb.PermRolesRead, adminUserRolesGet)).Methods("GET")
+		router.HandleFunc("/admin/user/{user}/roles/{role}", requirePermission(msgpdb.PermRolesWrite, adminUserRoleSet)).Methods("PUT", "DELETE")
+		router.HandleFunc("/admin/roles", requirePermission(msgpdb.PermRolesRead, adminRolesGet)).Methods("GET")
+		router.HandleFunc("/admin/roles/{role}", requirePermission(msgpdb.PermRolesWrite, adminRoleSet)).Methods("PUT")
+		router.HandleFunc("/admin/roles/{role}", requirePermission(msgpdb.PermRolesWrite, adminRoleRemove)).Methods("DELETE")
+		router.HandleFunc("/api/admin/v1/users", requirePermission(msgpdb.PermUsersRead, apiBlock(apiAdminUsersGet))).Methods("GET")
+		router.HandleFunc("/api/admin/v1/users/{user}", requirePermission(msgpdb.PermUsersRead, apiBlock(apiAdminUserGet))).Methods("GET")
+		router.HandleFunc("/api/admin/v1/users/{user}/disable", requirePermission(msgpdb.PermUsersWrite, apiBlock(apiAdminUserDisable))).Methods("POST")
+		router.HandleFunc("/api/admin/v1/users/{user}/enable", requirePermission(msgpdb.PermUsersWrite, apiBlock(apiAdminUserDisable))).Methods("POST")
+		router.HandleFunc("/api/admin/v1/users/{user}/reset-password", requirePermission(msgpdb.PermUsersWrite, apiBlock(apiAdminUserResetPassword))).Methods("POST")
+		router.HandleFunc("/api/admin/v1/users/{user}/devices/{device}", requirePermission(msgpdb.PermDevicesWrite, apiBlock(apiAdminUserDeviceRemove))).Methods("DELETE")
+		router.HandleFunc("/api/admin/v1/users/{user}/devices/{device}/transfer", requirePermission(msgpdb.PermDevicesWrite, apiBlock(apiAdminUserDeviceTransferAdd))).Methods("POST")
+		router.HandleFunc("/api/admin/v1/users/{user}/devices/{device}/key", requirePermission(msgpdb.PermDevicesKeys, apiBlock(apiAdminUserDeviceKeyGet))).Methods("GET")
+		router.HandleFunc("/api/admin/v1/groups", requirePermission(msgpdb.PermGroupsRead, apiBlock(apiAdminGroupsGet))).Methods("GET")
+		router.HandleFunc("/api/admin/v1/groups/{group}/users/{user}", requireGroupPermission(apiBlock(apiAdminGroupUserSet))).Methods("PUT", "DELETE")
+		router.HandleFunc("/api/admin/v1/groups/{group}/admins/{user}", requirePermission(msgpdb.PermGroupsWrite, apiBlock(apiAdminGroupAdminSet))).Methods("PUT", "DELETE")
+		router.HandleFunc("/api/admin/v1/devices", requirePermission(msgpdb.PermDevicesRead, apiBlock(apiAdminDevicesGet))).Methods("GET")
+		router.HandleFunc("/api/admin/v1/registry", requirePermission(msgpdb.PermRegistryRead, apiBlock(apiAdminRegistryGet))).Methods("GET")
+		router.HandleFunc("/api/admin/v1/registry/{device}/unlink", requirePermission(msgpdb.PermRegistryWrite, apiBlock(apiAdminRegistryUnlink))).Methods("POST")
+		router.HandleFunc("/api/admin/v1/registry/{device}/claim-token", requirePermission(msgpdb.PermRegistryWrite, apiBlock(apiAdminRegistryClaimToken))).Methods("POST")
+		router.HandleFunc("/api/admin/v1/registry/{device}/heartbeats", requirePermission(msgpdb.PermRegistryRead, apiBlock(apiAdminRegistryHeartbeatsGet))).Methods("GET")
+		router.HandleFunc("/healthz", healthHandler(map[string]func() error{
+			"hub":    checkHub,
+			"buffer": checkBuffer,
+		})).Methods("GET")
+		router.HandleFunc("/readyz", healthHandler(map[string]func() error{
+			"postgres": db.Ping,
+			"regdev":   devdb.Ping,
+			"hub":      checkHub,
+			"buffer":   checkBuffer,
+		})).Methods("GET")
 
 		if config.EnableAdminOps {
-			router.HandleFunc("/admin/user/{user}", adminUserAdd).Methods("PUT")
-			router.HandleFunc("/admin/user/{user}/props", adminUserSet).Methods("POST")
+			router.HandleFunc("/admin/user/{user}", requirePermission(msgpdb.PermUsersWrite, adminUserAdd)).Methods("PUT")
+			router.HandleFunc("/admin/user/{user}/props", requirePermission(msgpdb.PermRolesWrite, adminUserSet)).Methods("POST")
+			router.HandleFunc("/admin/validation", requirePermission(msgpdb.PermValidationRead, adminValidationGet)).Methods("GET")
+			router.HandleFunc("/admin/validation/{unit}", requirePermission(msgpdb.PermValidationWrite, adminValidationSet)).Methods("PUT", "DELETE")
 		}
 
 		router.HandleFunc("/ws/user/{user}/{token}", wsHandlerUser)
 		router.HandleFunc("/ws/device/{user}/{device}", wsHandlerDevice)
+		router.HandleFunc("/api/regdev/v1/{device}/backfill", apiBlock(apiDeviceBackfill)).Methods("POST")
 		server.RegisterRoutes(router.PathPrefix("/api/regdev").Subrouter())
 		router.PathPrefix("/").Handler(http.FileServer(http.Dir(config.AssetsDir)))
 
 		http.Handle("/", router)
 
+		go apiCtx.Alerts.Run(time.Duration(config.Alerts.Interval) * time.Second)
+		go apiCtx.Webhooks.Run(5 * time.Second)
+		if config.MetricsListen != "" {
+			metricsMux := http.NewServeMux()
+			metricsMux.Handle("/metrics", promhttp.Handler())
+			go func() {
+				if err := http.ListenAndServe(config.MetricsListen, metricsMux); err != nil {
+					log.Fatalf("could not serve metrics: %v", err)
+				}
+			}()
+		}
+		if config.MQTT.Broker != "" {
+			startMQTTBridge()
+		}
+
 		log.Print("Listening on ", config.ListenAddr)
 		if config.TLS.Cert != "" {
 			log.Printf("Using SSL cert and key %v, %v", config.TLS.Cert, config.TLS.Key)
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/gorilla/websocket"
+	"github.com/mysmartgrid/msg-prototype-2/devsim"
+	"github.com/mysmartgrid/msg-prototype-2/regdev"
+	"github.com/mysmartgrid/msg2api"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const userAPIProtocol = "v5.user.msg"
+
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+type historyConfig struct {
+	Interval   duration `toml:"interval"`
+	Span       duration `toml:"span"`
+	Resolution string   `toml:"resolution"`
+}
+
+type loadConfig struct {
+	Server         string        `toml:"server"`
+	InsecureTLS    bool          `toml:"insecure-tls"`
+	Prefix         string        `toml:"prefix"`
+	Users          int           `toml:"users"`
+	Devices        int           `toml:"devices"`
+	Sensors        int64         `toml:"sensors"`
+	UpdateInterval duration      `toml:"update-interval"`
+	Duration       duration      `toml:"duration"`
+	RealtimeShare  float64       `toml:"realtime-share"`
+	History        historyConfig `toml:"history"`
+}
+
+var configFile = flag.String("config", "", "configuration file")
+var config loadConfig
+
+var tlsConfig tls.Config
+
+var errNoWsURL = errors.New("websocket url not found")
+
+// wsURLPattern matches the websocket url passed to the user interface by the index page.
+var wsURLPattern = regexp.MustCompile(`value\("wsurl", ("[^"]*")\)`)
+
+// samples collects durations of a single kind of operation.
+type samples struct {
+	mtx    sync.Mutex
+	values []time.Duration
+	errors int
+}
+
+func (s *samples) add(d time.Duration) {
+	s.mtx.Lock()
+	s.values = append(s.values, d)
+	s.mtx.Unlock()
+}
+
+func (s *samples) fail() {
+	s.mtx.Lock()
+	s.errors++
+	s.mtx.Unlock()
+}
+
+func (s *samples) report(name string, elapsed time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.values) == 0 {
+		log.Printf("%-16s no samples, %d errors", name, s.errors)
+		return
+	}
+
+	sort.Sort(durations(s.values))
+	percentile := func(p float64) time.Duration {
+		return s.values[int(p*float64(len(s.values)-1))]
+	}
+	log.Printf("%-16s %8d ops %10.2f ops/s  p50 %-12s p90 %-12s p99 %-12s max %-12s %d errors",
+		name, len(s.values), float64(len(s.values))/elapsed.Seconds(),
+		percentile(0.5), percentile(0.9), percentile(0.99), s.values[len(s.values)-1], s.errors)
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+var stats struct {
+	deviceUpdates samples
+	historyFirst  samples
+	realtimeLag   samples
+	bufferLag     samples
+	valuesSent    int64
+	valuesMtx     sync.Mutex
+}
+
+// simUser is a user account created for the load test, along with its devices.
+type simUser struct {
+	ID       string
+	password string
+	client   *http.Client
+	wsURL    string
+	devices  []*devsim.Device
+	realtime bool
+}
+
+func serverURL(path string) string {
+	return strings.TrimRight(config.Server, "/") + path
+}
+
+func wsBaseURL() string {
+	base := strings.TrimRight(config.Server, "/")
+	if strings.HasPrefix(base, "https://") {
+		return "wss://" + strings.TrimPrefix(base, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(base, "http://")
+}
+
+func checkResponse(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%v: %v", resp.Status, string(body))
+	}
+	return nil
+}
+
+func newSimUser(id string) (*simUser, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &simUser{
+		ID:       id,
+		password: fmt.Sprintf("%x", rand.Int63()),
+		client: &http.Client{
+			Jar:       jar,
+			Transport: &http.Transport{TLSClientConfig: &tlsConfig},
+		},
+	}
+
+	form := url.Values{"user": {u.ID}, "password": {u.password}}
+	if err := checkResponse(u.client.PostForm(serverURL("/user/register"), form)); err != nil {
+		return nil, err
+	}
+	if err := checkResponse(u.client.PostForm(serverURL("/user/login"), form)); err != nil {
+		return nil, err
+	}
+
+	resp, err := u.client.Get(serverURL("/"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	match := wsURLPattern.FindSubmatch(body)
+	if match == nil {
+		return nil, errNoWsURL
+	}
+	if err := json.Unmarshal(match[1], &u.wsURL); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (u *simUser) addDevice() error {
+	dev := devsim.NewRandomDevice()
+	dev.API = wsBaseURL() + "/ws/device"
+	dev.RegdevAPI = serverURL("/api/regdev/v1")
+	dev.TLSConfig = &tlsConfig
+	dev.HTTPClient = u.client
+	dev.GenerateRandomSensors(config.Sensors)
+
+	if err := dev.Register(); err != nil {
+		return err
+	}
+	claim, err := json.Marshal(map[string]string{"code": regdev.PairingCode(dev.Key)})
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(u.client.Post(serverURL("/api/user/v1/device/"+dev.ID), "application/json", bytes.NewReader(claim))); err != nil {
+		return err
+	}
+	dev.User = u.ID
+	if err := dev.RegisterSensors(); err != nil {
+		return err
+	}
+
+	u.devices = append(u.devices, dev)
+	return nil
+}
+
+// remove deletes the account of the user along with its devices.
+func (u *simUser) remove() error {
+	form := url.Values{"password": {u.password}}
+	return checkResponse(u.client.PostForm(serverURL("/user/account/delete"), form))
+}
+
+func removeUsers(users []*simUser) {
+	for _, u := range users {
+		if err := u.remove(); err != nil {
+			log.Printf("could not remove user %v: %v", u.ID, err)
+		}
+	}
+	log.Printf("Removed %d users", len(users))
+}
+
+func (u *simUser) sensors() map[string][]string {
+	result := make(map[string][]string)
+	for _, dev := range u.devices {
+		for id := range dev.Sensors {
+			result[dev.ID] = append(result[dev.ID], id)
+		}
+	}
+	return result
+}
+
+func runDevice(dev *devsim.Device, done <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	client, err := dev.Client()
+	if err != nil {
+		log.Printf("device %v: %v", dev.ID, err)
+		return
+	}
+
+	ticker := time.NewTicker(config.UpdateInterval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		values := make(map[string][]msg2api.Measurement, len(dev.Sensors))
+		for id := range dev.Sensors {
+			values[id] = []msg2api.Measurement{{start, rand.Float64()}}
+		}
+		if err := client.Update(values); err != nil {
+			stats.deviceUpdates.fail()
+			continue
+		}
+		stats.deviceUpdates.add(time.Since(start))
+
+		stats.valuesMtx.Lock()
+		stats.valuesSent += int64(len(values))
+		stats.valuesMtx.Unlock()
+	}
+}
+
+type userCommand struct {
+	Cmd  string      `json:"cmd"`
+	Args interface{} `json:"args,omitempty"`
+}
+
+type getValuesArgs struct {
+	Since      int64               `json:"since"`
+	Until      int64               `json:"until"`
+	Resolution string              `json:"resolution"`
+	Sensors    map[string][]string `json:"sensors"`
+}
+
+type userEvent struct {
+	Cmd  string `json:"cmd"`
+	Args struct {
+		Resolution string                             `json:"resolution"`
+		Values     map[string]map[string][][2]float64 `json:"values"`
+	} `json:"args"`
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms float64) time.Time {
+	return time.Unix(0, int64(ms*float64(time.Millisecond)))
+}
+
+func runUser(u *simUser, done <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	cookieURL, err := url.Parse(serverURL("/"))
+	if err != nil {
+		log.Printf("user %v: %v", u.ID, err)
+		return
+	}
+	header := http.Header{}
+	for _, c := range u.client.Jar.Cookies(cookieURL) {
+		header.Add("Cookie", c.String())
+	}
+	dialer := websocket.Dialer{
+		Subprotocols:    []string{userAPIProtocol},
+		TLSClientConfig: &tlsConfig,
+	}
+	conn, _, err := dialer.Dial(u.wsURL, header)
+	if err != nil {
+		log.Printf("user %v: %v", u.ID, err)
+		return
+	}
+	defer conn.Close()
+
+	var mtx sync.Mutex
+	var requested time.Time
+	var newest time.Time
+	answered := true
+
+	go func() {
+		for {
+			var ev userEvent
+			if err := conn.ReadJSON(&ev); err != nil {
+				return
+			}
+			if ev.Cmd != "update" {
+				continue
+			}
+
+			now := time.Now()
+			mtx.Lock()
+			if u.realtime {
+				for _, sensors := range ev.Args.Values {
+					for _, values := range sensors {
+						for _, v := range values {
+							stats.realtimeLag.add(now.Sub(fromMillis(v[0])))
+						}
+					}
+				}
+			} else {
+				if !answered {
+					stats.historyFirst.add(now.Sub(requested))
+					answered = true
+				}
+				for _, sensors := range ev.Args.Values {
+					for _, values := range sensors {
+						for _, v := range values {
+							if ts := fromMillis(v[0]); ts.After(newest) {
+								newest = ts
+							}
+						}
+					}
+				}
+			}
+			mtx.Unlock()
+		}
+	}()
+
+	interval := config.History.Interval.Duration
+	if u.realtime {
+		// msgpd forwards realtime values for 40 seconds after a request
+		interval = 20 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var cmd userCommand
+		if u.realtime {
+			cmd = userCommand{Cmd: "requestRealtimeUpdates", Args: u.sensors()}
+		} else {
+			now := time.Now()
+			cmd = userCommand{Cmd: "getValues", Args: getValuesArgs{
+				Since:      millis(now.Add(-config.History.Span.Duration)),
+				Until:      millis(now),
+				Resolution: config.History.Resolution,
+				Sensors:    u.sensors(),
+			}}
+
+			mtx.Lock()
+			if !answered {
+				stats.historyFirst.fail()
+			}
+			if config.History.Resolution == "raw" && !newest.IsZero() {
+				stats.bufferLag.add(requested.Sub(newest))
+			}
+			requested, newest, answered = now, time.Time{}, false
+			mtx.Unlock()
+		}
+
+		if err := conn.WriteJSON(cmd); err != nil {
+			log.Printf("user %v: %v", u.ID, err)
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func init() {
+	flag.Parse()
+
+	if *configFile == "" {
+		log.Fatal("missing -config")
+	}
+
+	configData, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		log.Fatalf("could not read config file: %v", err.Error())
+	}
+	if err := toml.Unmarshal(configData, &config); err != nil {
+		log.Fatalf("could not load config file: %v", err.Error())
+	}
+
+	if config.Server == "" {
+		config.Server = "http://[::1]:8080"
+	}
+	if config.Prefix == "" {
+		config.Prefix = "loadtest"
+	}
+	if config.UpdateInterval.Duration == 0 {
+		config.UpdateInterval.Duration = time.Second
+	}
+	if config.History.Interval.Duration == 0 {
+		config.History.Interval.Duration = 10 * time.Second
+	}
+	if config.History.Span.Duration == 0 {
+		config.History.Span.Duration = time.Hour
+	}
+	if config.History.Resolution == "" {
+		config.History.Resolution = "raw"
+	}
+	if config.Users < 1 || config.Devices < 1 || config.Sensors < 1 || config.Duration.Duration <= 0 {
+		log.Fatal("users, devices, sensors and duration must be set")
+	}
+
+	tlsConfig.InsecureSkipVerify = config.InsecureTLS
+}
+
+func main() {
+	runID := time.Now().Unix()
+	log.Printf("Setting up %d users with %d devices with %d sensors each", config.Users, config.Devices, config.Sensors)
+
+	var users []*simUser
+	for i := 0; i < config.Users; i++ {
+		u, err := newSimUser(fmt.Sprintf("%v-%v-%v", config.Prefix, runID, i))
+		if err != nil {
+			removeUsers(users)
+			log.Fatalf("could not create user: %v", err)
+		}
+		users = append(users, u)
+
+		for j := 0; j < config.Devices; j++ {
+			if err := u.addDevice(); err != nil {
+				removeUsers(users)
+				log.Fatalf("could not add device for user %v: %v", u.ID, err)
+			}
+		}
+		u.realtime = float64(i) < config.RealtimeShare*float64(config.Users)
+	}
+	defer removeUsers(users)
+
+	log.Printf("Running for %v", config.Duration.Duration)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, u := range users {
+		for _, dev := range u.devices {
+			wg.Add(1)
+			go runDevice(dev, done, &wg)
+		}
+		wg.Add(1)
+		go runUser(u, done, &wg)
+	}
+
+	time.Sleep(config.Duration.Duration)
+	close(done)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	log.Printf("==== Result ====")
+	log.Printf("Sent %d values, %.2f v/s", stats.valuesSent, float64(stats.valuesSent)/elapsed.Seconds())
+	stats.deviceUpdates.report("device update", elapsed)
+	stats.historyFirst.report("history query", elapsed)
+	stats.realtimeLag.report("realtime lag", elapsed)
+	stats.bufferLag.report("buffer lag", elapsed)
+}
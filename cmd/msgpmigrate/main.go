@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	msgpdb "github.com/mysmartgrid/msg-prototype-2/db"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+type postgresConfig struct {
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+	Address  string `toml:"address"`
+	Port     string `toml:"port"`
+	Database string `toml:"database"`
+}
+
+// migrateConfig reads the postgres section of the msgpd or msgdbd configuration.
+type migrateConfig struct {
+	Postgres postgresConfig `toml:"postgres"`
+}
+
+var configFile = flag.String("config", "", "msgpd or msgdbd configuration file")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %s -config <file> <command>
+
+commands:
+  status          list all migrations and when they were applied
+  up [version]    apply pending migrations up to version, all if omitted
+  down <version>  revert applied migrations after version, 0 reverts all
+`, os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *configFile == "" || flag.NArg() < 1 || flag.NArg() > 2 {
+		usage()
+	}
+
+	var config migrateConfig
+	configData, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		log.Fatalf("could not read config file: %v", err.Error())
+	}
+	if err := toml.Unmarshal(configData, &config); err != nil {
+		log.Fatalf("could not load config file: %v", err.Error())
+	}
+
+	version := 0
+	if flag.NArg() == 2 {
+		version, err = strconv.Atoi(flag.Arg(1))
+		if err != nil {
+			usage()
+		}
+	}
+
+	migrator, err := msgpdb.OpenMigrator(config.Postgres.Address, config.Postgres.Port, config.Postgres.Database,
+		config.Postgres.User, config.Postgres.Password)
+	if err != nil {
+		log.Fatal("error opening db: ", err)
+	}
+	defer migrator.Close()
+
+	switch flag.Arg(0) {
+	case "status":
+		migrations, err := migrator.Status()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, m := range migrations {
+			applied := "pending"
+			if m.Applied != nil {
+				applied = m.Applied.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-30s %s\n", m.Version, m.Name, applied)
+		}
+		return
+
+	case "up":
+		err = migrator.Up(version)
+
+	case "down":
+		if flag.NArg() != 2 {
+			usage()
+		}
+		err = migrator.Down(version)
+
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	current, err := migrator.Version()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("schema is at version %v\n", current)
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"github.com/lib/pq"
+	"net/mail"
+	"time"
+)
+
+var (
+	// ErrBadResetToken is returned for password reset tokens that do not exist, were used or have expired.
+	ErrBadResetToken = errors.New("invalid or expired password reset token")
+	// ErrEmailExists is returned if an email address is already set for another user.
+	ErrEmailExists = errors.New("email address in use")
+)
+
+// UserExport holds all data of a user, e.g. to hand it out before the account is removed.
+type UserExport struct {
+	User       string                  `json:"user"`
+	Email      string                  `json:"email"`
+	Exported   time.Time               `json:"exported"`
+	Resolution string                  `json:"resolution"`
+	Devices    map[string]DeviceExport `json:"devices"`
+	AlertRules []AlertRule             `json:"alertRules"`
+	Webhooks   []Webhook               `json:"webhooks"`
+}
+
+// DeviceExport holds all data of a device of a UserExport.
+type DeviceExport struct {
+	Name      string                  `json:"name"`
+	IsVirtual bool                    `json:"isVirtual"`
+	Sensors   map[string]SensorExport `json:"sensors"`
+}
+
+// SensorExport holds all data of a sensor of a UserExport. Values are [milliseconds, value] pairs.
+type SensorExport struct {
+	Name         string        `json:"name"`
+	Unit         string        `json:"unit"`
+	Port         int32         `json:"port"`
+	Factor       float64       `json:"factor"`
+	IsVirtual    bool          `json:"isVirtual"`
+	Calibrations []Calibration `json:"calibrations"`
+	Values       [][2]float64  `json:"values"`
+}
+
+// LockoutPolicy describes when accounts are locked after failed logins.
+type LockoutPolicy struct {
+	// MaxFailures is the number of consecutive failed logins after which the account is locked.
+	MaxFailures int
+	// Lockout is the time the account is locked after MaxFailures failed logins. It doubles with every further
+	// failed login, up to MaxLockout.
+	Lockout    time.Duration
+	MaxLockout time.Duration
+}
+
+func (p LockoutPolicy) lockout(failures int) time.Duration {
+	if p.MaxFailures <= 0 || failures < p.MaxFailures {
+		return 0
+	}
+	d := p.Lockout
+	for i := p.MaxFailures; i < failures && d < p.MaxLockout; i++ {
+		d *= 2
+	}
+	if d > p.MaxLockout {
+		d = p.MaxLockout
+	}
+	return d
+}
+
+// newToken returns a random token to be handed out to a user. Only its hash is stored.
+func newToken() (string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+func (u *user) SetPassword(pw string) error {
+	if err := u.init(pw); err != nil {
+		return err
+	}
+	if _, err := u.tx.Exec(`DELETE FROM password_resets WHERE user_id = $1`, u.id); err != nil {
+		return err
+	}
+	return u.ClearLoginFailures()
+}
+
+func (u *user) LockedUntil() time.Time {
+	var until pq.NullTime
+	u.tx.QueryRow(`SELECT locked_until FROM users WHERE user_id = $1`, u.id).Scan(&until)
+	return until.Time
+}
+
+func (u *user) RecordLoginFailure(policy LockoutPolicy) (time.Time, error) {
+	var failures int
+	err := u.tx.QueryRow(`UPDATE users SET failed_logins = failed_logins + 1 WHERE user_id = $1 RETURNING failed_logins`,
+		u.id).Scan(&failures)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	d := policy.lockout(failures)
+	if d == 0 {
+		return time.Time{}, nil
+	}
+	until := time.Now().Add(d)
+	_, err = u.tx.Exec(`UPDATE users SET locked_until = $1 WHERE user_id = $2`, until, u.id)
+	return until, err
+}
+
+func (u *user) ClearLoginFailures() error {
+	_, err := u.tx.Exec(`UPDATE users SET failed_logins = 0, locked_until = NULL WHERE user_id = $1`, u.id)
+	return err
+}
+
+func (u *user) Email() string {
+	var email sql.NullString
+	u.tx.QueryRow(`SELECT email FROM users WHERE user_id = $1`, u.id).Scan(&email)
+	return email.String
+}
+
+func (u *user) SetEmail(email string) error {
+	if email == "" {
+		_, err := u.tx.Exec(`UPDATE users SET email = NULL WHERE user_id = $1`, u.id)
+		return err
+	}
+
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return errBadEmail
+	}
+	if other := u.tx.UserByEmail(email); other != nil && other.ID() != u.id {
+		return ErrEmailExists
+	}
+	_, err := u.tx.Exec(`UPDATE users SET email = $1 WHERE user_id = $2`, email, u.id)
+	return err
+}
+
+func (u *user) CreatePasswordReset(validFor time.Duration) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := u.tx.Exec(`DELETE FROM password_resets WHERE expires < now()`); err != nil {
+		return "", err
+	}
+	_, err = u.tx.Exec(`INSERT INTO password_resets(token_hash, user_id, expires) VALUES($1, $2, $3)`,
+		hashToken(token), u.id, time.Now().Add(validFor))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (u *user) Export(resolution string) (*UserExport, error) {
+	result := &UserExport{
+		User:       u.id,
+		Email:      u.Email(),
+		Exported:   time.Now(),
+		Resolution: resolution,
+		Devices:    make(map[string]DeviceExport),
+	}
+
+	sensors := make(map[string][]string)
+	for devID, dev := range u.Devices() {
+		d := DeviceExport{Name: dev.Name(), IsVirtual: dev.IsVirtual(), Sensors: make(map[string]SensorExport)}
+		for sensID, sens := range dev.Sensors() {
+			calibrations, err := sens.Calibrations()
+			if err != nil {
+				return nil, err
+			}
+			d.Sensors[sensID] = SensorExport{
+				Name:         sens.Name(),
+				Unit:         sens.Unit(),
+				Port:         sens.Port(),
+				Factor:       sens.Factor(),
+				IsVirtual:    sens.IsVirtual(),
+				Calibrations: calibrations,
+			}
+			sensors[devID] = append(sensors[devID], sensID)
+		}
+		result.Devices[devID] = d
+	}
+
+	readings, err := u.LoadReadings(time.Unix(0, 0), result.Exported, resolution, sensors, nil)
+	if err != nil {
+		return nil, err
+	}
+	for devID, devReadings := range readings {
+		for sensID, values := range devReadings {
+			s := result.Devices[devID].Sensors[sensID]
+			s.Values = make([][2]float64, 0, len(values))
+			for _, v := range values {
+				s.Values = append(s.Values, [2]float64{float64(v.Time.UnixNano() / int64(time.Millisecond)), v.Value})
+			}
+			result.Devices[devID].Sensors[sensID] = s
+		}
+	}
+
+	if result.AlertRules, err = u.AlertRules(); err != nil {
+		return nil, err
+	}
+	if result.Webhooks, err = u.Webhooks(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (tx *tx) UserByEmail(email string) User {
+	var userID string
+	err := tx.QueryRow(`SELECT user_id FROM users WHERE lower(email) = lower($1)`, email).Scan(&userID)
+	if err != nil {
+		return nil
+	}
+
+	return &user{tx, userID}
+}
+
+func (tx *tx) ResetPassword(token, pw string) (User, error) {
+	var userID string
+	err := tx.QueryRow(`DELETE FROM password_resets WHERE token_hash = $1 AND expires >= now() RETURNING user_id`,
+		hashToken(token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, ErrBadResetToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &user{tx, userID}
+	if err := result.SetPassword(pw); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
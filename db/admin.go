@@ -0,0 +1,178 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+// MaxListLimit is the maximum number of entries of a page of ListUsers and ListDevices.
+const MaxListLimit = 500
+
+// ErrBadCursor is returned for list cursors that were not returned by a previous call.
+var ErrBadCursor = errors.New("invalid cursor")
+
+// ListOptions selects a page of a list.
+type ListOptions struct {
+	// Search limits the list to entries with ids or names containing Search, ignoring case.
+	Search string
+	// After is the cursor returned along with the previous page, or empty for the first page.
+	After string
+	// Limit is the maximum number of entries of the page, at most MaxListLimit.
+	Limit int
+}
+
+// UserInfo describes a user for administrators.
+type UserInfo struct {
+	ID          string     `json:"id"`
+	Email       string     `json:"email"`
+	Roles       []string   `json:"roles"`
+	Disabled    bool       `json:"disabled"`
+	LockedUntil *time.Time `json:"lockedUntil"`
+	Devices     int        `json:"devices"`
+}
+
+// DeviceInfo describes a device of a user for administrators. The key of the device is not included.
+type DeviceInfo struct {
+	ID        string `json:"id"`
+	User      string `json:"user"`
+	Name      string `json:"name"`
+	IsVirtual bool   `json:"isVirtual"`
+	Sensors   int    `json:"sensors"`
+}
+
+// encodeCursor returns an opaque cursor for the sort key of the last entry of a page.
+func encodeCursor(parts ...string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(parts, "\x00")))
+}
+
+func decodeCursor(cursor string, n int) ([]string, error) {
+	if cursor == "" {
+		return make([]string, n), nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != n {
+		return nil, ErrBadCursor
+	}
+	return parts, nil
+}
+
+// likePattern returns a pattern for LIKE matching all strings that contain s.
+func likePattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	return "%" + s + "%"
+}
+
+func (o *ListOptions) limit() int {
+	if o.Limit <= 0 || o.Limit > MaxListLimit {
+		return MaxListLimit
+	}
+	return o.Limit
+}
+
+func (tx *tx) scanUserInfos(where string, args ...interface{}) ([]UserInfo, error) {
+	rows, err := tx.Query(`SELECT u.user_id, coalesce(u.email, ''), u.disabled, u.locked_until,
+			array(SELECT r.role_id FROM user_roles r WHERE r.user_id = u.user_id ORDER BY r.role_id),
+			(SELECT count(*) FROM devices d WHERE d.user_id = u.user_id)
+		FROM users u `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []UserInfo
+	defer rows.Close()
+	for rows.Next() {
+		var u UserInfo
+		var locked pq.NullTime
+		var roles pq.StringArray
+		if err := rows.Scan(&u.ID, &u.Email, &u.Disabled, &locked, &roles, &u.Devices); err != nil {
+			return nil, err
+		}
+		if locked.Valid {
+			u.LockedUntil = &locked.Time
+		}
+		u.Roles = []string(roles)
+		result = append(result, u)
+	}
+	return result, rows.Err()
+}
+
+func (tx *tx) ListUsers(opts ListOptions) ([]UserInfo, string, error) {
+	after, err := decodeCursor(opts.After, 1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	limit := opts.limit()
+	users, err := tx.scanUserInfos(`WHERE u.user_id > $1 AND ($2 = '' OR u.user_id ILIKE $3 OR u.email ILIKE $3)
+		ORDER BY u.user_id LIMIT $4`, after[0], opts.Search, likePattern(opts.Search), limit+1)
+	if err != nil || len(users) <= limit {
+		return users, "", err
+	}
+	users = users[:limit]
+	return users, encodeCursor(users[limit-1].ID), nil
+}
+
+func (tx *tx) ListDevices(opts ListOptions) ([]DeviceInfo, string, error) {
+	after, err := decodeCursor(opts.After, 2)
+	if err != nil {
+		return nil, "", err
+	}
+
+	limit := opts.limit()
+	rows, err := tx.Query(`SELECT d.device_id, d.user_id, d.name, d.is_virtual,
+			(SELECT count(*) FROM sensors s WHERE s.user_id = d.user_id AND s.device_id = d.device_id)
+		FROM devices d
+		WHERE (d.device_id, d.user_id) > ($1, $2)
+			AND ($3 = '' OR d.device_id ILIKE $4 OR d.name ILIKE $4 OR d.user_id ILIKE $4)
+		ORDER BY d.device_id, d.user_id LIMIT $5`, after[0], after[1], opts.Search, likePattern(opts.Search), limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var result []DeviceInfo
+	defer rows.Close()
+	for rows.Next() {
+		var d DeviceInfo
+		if err := rows.Scan(&d.ID, &d.User, &d.Name, &d.IsVirtual, &d.Sensors); err != nil {
+			return nil, "", err
+		}
+		result = append(result, d)
+	}
+	if err := rows.Err(); err != nil || len(result) <= limit {
+		return result, "", err
+	}
+	result = result[:limit]
+	return result, encodeCursor(result[limit-1].ID, result[limit-1].User), nil
+}
+
+func (u *user) Info() (UserInfo, error) {
+	users, err := u.tx.scanUserInfos(`WHERE u.user_id = $1`, u.id)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	if len(users) == 0 {
+		return UserInfo{}, ErrNoUser
+	}
+	return users[0], nil
+}
+
+func (u *user) IsDisabled() bool {
+	var disabled bool
+	err := u.tx.QueryRow(`SELECT disabled FROM users WHERE user_id = $1`, u.id).Scan(&disabled)
+	return err == nil && disabled
+}
+
+func (u *user) SetDisabled(b bool) error {
+	_, err := u.tx.Exec(`UPDATE users SET disabled = $1 WHERE user_id = $2`, b, u.id)
+	if err != nil || !b {
+		return err
+	}
+	return u.RemoveSessions("")
+}
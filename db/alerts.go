@@ -0,0 +1,180 @@
+package db
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+// Kinds of alert rules.
+const (
+	// AlertAbove fires if the values of a sensor stay above Threshold for Duration.
+	AlertAbove = "above"
+	// AlertBelow fires if the values of a sensor stay below Threshold for Duration.
+	AlertBelow = "below"
+	// AlertNoData fires if a sensor sends no values for Duration.
+	AlertNoData = "nodata"
+	// AlertDeviation fires if the hourly average of a sensor deviates from the average of the same hour one week
+	// earlier by more than Threshold, given as a fraction of the earlier value.
+	AlertDeviation = "deviation"
+)
+
+var (
+	errBadAlertKind = errors.New("unknown alert kind")
+	errBadEmail     = errors.New("invalid email address")
+	errBadWebhook   = errors.New("webhook url must be an http or https url")
+	errNoWebhook    = errors.New("webhook url must be the url of a webhook of the user")
+)
+
+// AlertRule describes a condition on the values of a sensor a user wants to be alerted of.
+type AlertRule struct {
+	ID        uint64        `json:"id"`
+	User      string        `json:"-"`
+	Device    string        `json:"device"`
+	Sensor    string        `json:"sensor"`
+	Kind      string        `json:"kind"`
+	Threshold float64       `json:"threshold"`
+	Duration  time.Duration `json:"duration"`
+	// WebhookURL and Email are the notification targets of the rule, empty targets are not notified.
+	// WebhookURL must be the URL of a webhook of the user, alerts are delivered like other events of the webhook.
+	WebhookURL string `json:"webhookUrl"`
+	Email      string `json:"email"`
+}
+
+// Alert is a single occurence of an alert rule firing.
+type Alert struct {
+	ID     uint64    `json:"id"`
+	RuleID uint64    `json:"rule"`
+	Device string    `json:"device"`
+	Sensor string    `json:"sensor"`
+	Kind   string    `json:"kind"`
+	Fired  time.Time `json:"fired"`
+	// Resolved is nil while the condition of the rule still holds.
+	Resolved *time.Time `json:"resolved"`
+	Value    float64    `json:"value"`
+	Message  string     `json:"message"`
+}
+
+const alertRuleColumns = `r.rule_id, r.user_id, s.device_id, s.sensor_id, r.kind, r.threshold, r.duration_ms, r.webhook_url, r.email`
+
+func (tx *tx) scanAlertRules(where string, args ...interface{}) ([]AlertRule, error) {
+	rows, err := tx.Query(`SELECT `+alertRuleColumns+` FROM alert_rules r JOIN sensors s ON s.sensor_seq = r.sensor_seq `+where+` ORDER BY r.rule_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []AlertRule
+	defer rows.Close()
+	for rows.Next() {
+		var r AlertRule
+		var durationMs int64
+		if err := rows.Scan(&r.ID, &r.User, &r.Device, &r.Sensor, &r.Kind, &r.Threshold, &durationMs, &r.WebhookURL, &r.Email); err != nil {
+			return nil, err
+		}
+		r.Duration = time.Duration(durationMs) * time.Millisecond
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+func (tx *tx) AlertRules() ([]AlertRule, error) {
+	return tx.scanAlertRules(``)
+}
+
+func (u *user) AlertRules() ([]AlertRule, error) {
+	return u.tx.scanAlertRules(`WHERE r.user_id = $1`, u.id)
+}
+
+func (u *user) AddAlertRule(rule AlertRule) (uint64, error) {
+	switch rule.Kind {
+	case AlertAbove, AlertBelow, AlertNoData, AlertDeviation:
+	default:
+		return 0, errBadAlertKind
+	}
+	if rule.Email != "" {
+		if addr, err := mail.ParseAddress(rule.Email); err != nil || addr.Address != rule.Email {
+			return 0, errBadEmail
+		}
+	}
+	if rule.WebhookURL != "" {
+		if u, err := url.Parse(rule.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return 0, errBadWebhook
+		}
+		var exists bool
+		err := u.tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM webhooks WHERE user_id = $1 AND url = $2)`, u.id, rule.WebhookURL).Scan(&exists)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			return 0, errNoWebhook
+		}
+	}
+
+	dev := u.Device(rule.Device)
+	if dev == nil {
+		return 0, ErrNoSensor
+	}
+	sensor := dev.Sensor(rule.Sensor)
+	if sensor == nil {
+		return 0, ErrNoSensor
+	}
+
+	var id uint64
+	err := u.tx.QueryRow(`INSERT INTO alert_rules(user_id, sensor_seq, kind, threshold, duration_ms, webhook_url, email)
+		VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING rule_id`,
+		u.id, sensor.DbID(), rule.Kind, rule.Threshold, int64(rule.Duration/time.Millisecond), rule.WebhookURL, rule.Email).Scan(&id)
+	return id, err
+}
+
+func (u *user) RemoveAlertRule(id uint64) error {
+	_, err := u.tx.Exec(`DELETE FROM alert_rules WHERE user_id = $1 AND rule_id = $2`, u.id, id)
+	return err
+}
+
+func (u *user) AddAlert(a Alert) (uint64, error) {
+	var id uint64
+	err := u.tx.QueryRow(`INSERT INTO alerts(rule_id, fired, value, message)
+		SELECT rule_id, $3, $4, $5 FROM alert_rules WHERE user_id = $1 AND rule_id = $2
+		RETURNING alert_id`, u.id, a.RuleID, a.Fired, a.Value, a.Message).Scan(&id)
+	return id, err
+}
+
+func (u *user) ResolveAlert(id uint64, resolved time.Time) error {
+	_, err := u.tx.Exec(`UPDATE alerts a SET resolved = $3 FROM alert_rules r
+		WHERE a.rule_id = r.rule_id AND r.user_id = $1 AND a.alert_id = $2`, u.id, id, resolved)
+	return err
+}
+
+func (tx *tx) scanAlerts(where string, args ...interface{}) ([]Alert, error) {
+	rows, err := tx.Query(`SELECT a.alert_id, a.rule_id, s.device_id, s.sensor_id, r.kind, a.fired, a.resolved, a.value, a.message
+		FROM alerts a JOIN alert_rules r ON r.rule_id = a.rule_id JOIN sensors s ON s.sensor_seq = r.sensor_seq
+		`+where+` ORDER BY a.fired`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Alert
+	defer rows.Close()
+	for rows.Next() {
+		var a Alert
+		var resolved pq.NullTime
+		if err := rows.Scan(&a.ID, &a.RuleID, &a.Device, &a.Sensor, &a.Kind, &a.Fired, &resolved, &a.Value, &a.Message); err != nil {
+			return nil, err
+		}
+		if resolved.Valid {
+			a.Resolved = &resolved.Time
+		}
+		result = append(result, a)
+	}
+	return result, rows.Err()
+}
+
+func (tx *tx) UnresolvedAlerts() ([]Alert, error) {
+	return tx.scanAlerts(`WHERE a.resolved IS NULL`)
+}
+
+func (u *user) Alerts(since time.Time) ([]Alert, error) {
+	return u.tx.scanAlerts(`WHERE r.user_id = $1 AND (a.fired >= $2 OR a.resolved IS NULL)`, u.id, since)
+}
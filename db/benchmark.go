@@ -1,9 +1,12 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/mysmartgrid/msg2api"
 	"log"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -12,9 +15,13 @@ func measureTime(start time.Time, name string) {
 	log.Printf("%s took %s", name, elapsed)
 }
 
-func (d *db) clearDb() {
-	defer measureTime(time.Now(), "Clearing database")
-	_, err := d.sqldb.db.Exec(`TRUNCATE users CASCADE`)
+// benchUserPrefix starts the ids of all users created by the benchmark. Other users and their values are left alone.
+const benchUserPrefix = "benchmark-user-"
+
+// removeBenchUsers removes all users created by the benchmark, along with their devices, sensors and values.
+func (d *db) removeBenchUsers() {
+	defer measureTime(time.Now(), "Removing benchmark users")
+	_, err := d.sqldb.db.Exec(`DELETE FROM users WHERE user_id LIKE $1`, benchUserPrefix+"%")
 
 	if err != nil {
 		log.Print(err)
@@ -46,27 +53,21 @@ func (d *db) deviceEmulator(sensors []Sensor, interval time.Duration, done, hold
 	}
 }
 
-func (d *db) benchAddUsers(count int) []User {
+func (d *db) benchAddUsers(count int) []string {
 	defer measureTime(time.Now(), fmt.Sprintf("Adding %d users", count))
 
 	names := make([]string, count)
 	passwords := make([]string, count)
-	var result []User
 
 	for i := 0; i < count; i++ {
-		names[i] = fmt.Sprintf("Bench User %d", i)
+		names[i] = fmt.Sprintf("%s%d", benchUserPrefix, i)
 		passwords[i] = fmt.Sprintf("benchmark%d", i)
 	}
 
 	for i := 0; i < count; i++ {
 		err := d.Update(func(tx Tx) error {
-			user, err := tx.AddUser(names[i], passwords[i])
-			if err != nil {
-				return err
-			}
-
-			result = append(result, user)
-			return nil
+			_, err := tx.AddUser(names[i], passwords[i])
+			return err
 		})
 
 		if err != nil {
@@ -74,10 +75,10 @@ func (d *db) benchAddUsers(count int) []User {
 			os.Exit(1)
 		}
 	}
-	return result
+	return names
 }
 
-func (d *db) benchAddDevices(count int) map[User][]Device {
+func (d *db) benchAddDevices(users []string, count int) map[User][]Device {
 	defer measureTime(time.Now(), fmt.Sprintf("Adding %d devices per user", count))
 
 	names := make([]string, count)
@@ -88,8 +89,8 @@ func (d *db) benchAddDevices(count int) map[User][]Device {
 	}
 
 	err := d.Update(func(tx Tx) error {
-		users := tx.Users()
-		for _, user := range users {
+		for _, id := range users {
+			user := tx.User(id)
 			for i := 0; i < count; i++ {
 				device, err := user.AddDevice(names[i], nil, false)
 				if err != nil {
@@ -108,7 +109,7 @@ func (d *db) benchAddDevices(count int) map[User][]Device {
 	return result
 }
 
-func (d *db) benchAddSensors(count int) map[User]map[Device][]Sensor {
+func (d *db) benchAddSensors(users []string, count int) map[User]map[Device][]Sensor {
 	defer measureTime(time.Now(), fmt.Sprintf("Adding %d sensors per device", count))
 
 	names := make([]string, count)
@@ -119,8 +120,8 @@ func (d *db) benchAddSensors(count int) map[User]map[Device][]Sensor {
 	}
 
 	err := d.Update(func(tx Tx) error {
-		users := tx.Users()
-		for _, user := range users {
+		for _, id := range users {
+			user := tx.User(id)
 			result[user] = make(map[Device][]Sensor)
 			devices := user.Devices()
 			for _, device := range devices {
@@ -143,6 +144,11 @@ func (d *db) benchAddSensors(count int) map[User]map[Device][]Sensor {
 	return result
 }
 
+// benchCountQuery counts the values of the benchmark users in measure_raw. msgdbd must be stopped while the benchmark
+// runs, aggregation removes the values from measure_raw.
+const benchCountQuery = `SELECT COUNT(*) FROM measure_raw
+	WHERE sensor IN (SELECT sensor_seq FROM sensors WHERE user_id LIKE $1)`
+
 func (d *db) PeriodicRate(interval time.Duration, done, hold chan bool) {
 	ok := true
 	for ok {
@@ -162,7 +168,7 @@ func (d *db) PeriodicRate(interval time.Duration, done, hold chan bool) {
 		default:
 			elapsed := time.Since(start)
 			var count int64
-			d.sqldb.db.QueryRow(`SELECT COUNT(sensor) FROM measure_raw`).Scan(&count)
+			d.sqldb.db.QueryRow(benchCountQuery, benchUserPrefix+"%").Scan(&count)
 			log.Printf("Current Rate: %.2f v/s", float64(count)/elapsed.Seconds())
 		}
 		time.Sleep(interval)
@@ -194,24 +200,117 @@ func (d *db) benchAddReadings(sensors map[User]map[Device][]Sensor, duration tim
 	time.Sleep(time.Second * 2)
 
 	var count int64
-	d.sqldb.db.QueryRow(`SELECT COUNT(*) FROM measure_raw`).Scan(&count)
+	d.sqldb.db.QueryRow(benchCountQuery, benchUserPrefix+"%").Scan(&count)
 
 	return float64(count) / duration.Seconds()
 }
 
+// legacyLoadValues loads values with a query built from a list of sensor ids and a separate query for correction factors,
+// as sqlHandler.loadValues did before it used prepared statements. It is kept to compare both in the benchmark.
+func (d *db) legacyLoadValues(since, until time.Time, resolution string, sensorSeqs []uint64) (map[uint64][]msg2api.Measurement, error) {
+	var sensorSeqsList bytes.Buffer
+	for idx, seq := range sensorSeqs {
+		if idx != 0 {
+			sensorSeqsList.WriteString(", ")
+		}
+		sensorSeqsList.WriteString(strconv.FormatUint(seq, 10))
+	}
+
+	factorRows, err := d.sqldb.db.Query(fmt.Sprintf(`SELECT "sensor_seq", "factor" FROM "sensors" WHERE "sensor_seq" in (%v)`, sensorSeqsList.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	factorMap := make(map[uint64]float64)
+	for factorRows.Next() {
+		var sensorid uint64
+		var factor float64
+		if err := factorRows.Scan(&sensorid, &factor); err != nil {
+			factorRows.Close()
+			return nil, err
+		}
+		factorMap[sensorid] = factor
+	}
+	factorRows.Close()
+
+	table, value, err := valueSource(resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.sqldb.db.Query(fmt.Sprintf(`SELECT v."sensor", v."timestamp", %v FROM "%v" v WHERE v."sensor" IN (%v) AND v."timestamp" BETWEEN $1 AND $2`,
+		value, table, sensorSeqsList.String()), since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[uint64][]msg2api.Measurement)
+	for rows.Next() {
+		var sensorid uint64
+		var timestamp time.Time
+		var value float64
+		if err := rows.Scan(&sensorid, &timestamp, &value); err != nil {
+			return nil, err
+		}
+		result[sensorid] = append(result[sensorid], msg2api.Measurement{timestamp, value * factorMap[sensorid]})
+	}
+	return result, rows.Err()
+}
+
+func (d *db) benchLoadValues(sensors map[User]map[Device][]Sensor, resolution string, rounds int) {
+	var seqs []uint64
+	for _, devices := range sensors {
+		for _, devsensors := range devices {
+			for _, sensor := range devsensors {
+				seqs = append(seqs, sensor.DbID())
+			}
+		}
+	}
+
+	until := time.Now()
+	since := until.Add(-time.Hour)
+
+	measure := func(name string, load func(since, until time.Time, resolution string, sensorSeqs []uint64) (map[uint64][]msg2api.Measurement, error)) {
+		start := time.Now()
+		count := 0
+		for i := 0; i < rounds; i++ {
+			values, err := load(since, until, resolution, seqs)
+			if err != nil {
+				log.Print(err)
+				os.Exit(1)
+			}
+			for _, v := range values {
+				count += len(v)
+			}
+		}
+		elapsed := time.Since(start)
+		log.Printf("%s (%s): %d sensors, %d values, %s per query", name, resolution, len(seqs), count/rounds, elapsed/time.Duration(rounds))
+	}
+
+	measure("String built query", d.legacyLoadValues)
+	measure("Prepared query", d.sqldb.loadValues)
+}
+
 func (d *db) RunBenchmark(usrCnt, devCnt, snsCnt int, duration time.Duration) {
 	defer measureTime(time.Now(), "Benchmark")
-	d.clearDb()
-	d.benchAddUsers(usrCnt)
-	d.benchAddDevices(devCnt)
-	sensors := d.benchAddSensors(snsCnt)
+	d.removeBenchUsers()
+	defer d.removeBenchUsers()
+	users := d.benchAddUsers(usrCnt)
+	d.benchAddDevices(users, devCnt)
+	sensors := d.benchAddSensors(users, snsCnt)
 	rate := d.benchAddReadings(sensors, duration, time.Second*1)
 
 	log.Printf("==== Result ====")
+	log.Printf("Durability mode %s", d.durability)
 	log.Printf("Simulated %d users having %d devices having %d sensors", usrCnt, devCnt, snsCnt)
 	log.Printf("Total of %d sensors", usrCnt*devCnt*snsCnt)
 	log.Printf("Wrote %.2f values per second", rate)
 	log.Printf("%.2f v/s per device", rate/float64(usrCnt*devCnt))
 	log.Printf("%.2f v/s per sensor", rate/float64(usrCnt*devCnt*snsCnt))
 
+	log.Printf("==== Loading ====")
+	d.benchLoadValues(sensors, "raw", 10)
+	d.benchLoadValues(sensors, "second", 10)
+
 }
@@ -4,8 +4,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/mysmartgrid/msg-prototype-2/metrics"
 	"github.com/mysmartgrid/msg2api"
 	"log"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +18,10 @@ const (
 var (
 	// ErrIDExists is returned after an attempt to insert a new object into the DB using an id which already exists in the DB.
 	ErrIDExists = errors.New("id exists")
+	// ErrNoUser is returned by operations on the Db that name a user which does not exist in the DB.
+	ErrNoUser = errors.New("no such user")
+	// ErrBadDurability is returned by OpenDb for unknown durability modes.
+	ErrBadDurability = errors.New("unknown durability mode")
 )
 
 type db struct {
@@ -23,10 +29,19 @@ type db struct {
 
 	bufferedValues     map[uint64][]msg2api.Measurement
 	bufferedValueCount uint32
+	// bufferedSince is the time in unix nanoseconds the oldest value in the buffer was added, 0 if the buffer is empty.
+	// It is accessed atomically.
+	bufferedSince int64
 
 	bufferInput chan bufferValue
 	bufferAdd   chan uint64
 	bufferKill  chan uint64
+	// bufferFlush requests a flush of the buffer, the channel sent is closed once it is done.
+	bufferFlush chan chan struct{}
+
+	durability string
+	// rawLog logs all buffered values with DurabilityWAL, nil otherwise.
+	rawLog *rawLog
 }
 
 type bufferValue struct {
@@ -39,12 +54,45 @@ func (db *db) flushBuffer() {
 		return
 	}
 
-	err := db.sqldb.saveValuesAndClear(db.bufferedValues)
-	if err != nil {
-		panic(err.Error())
+	start := time.Now()
+	if db.rawLog == nil {
+		if err := db.sqldb.saveValuesAndClear(db.bufferedValues, nil); err != nil {
+			panic(err.Error())
+		}
+	} else {
+		segment, err := db.rawLog.seal()
+		if err != nil {
+			panic(err.Error())
+		}
+		var segments []*rawLogSegment
+		if segment.path != "" {
+			segments = append(segments, &segment)
+		}
+		err = db.sqldb.saveValuesAndClear(db.bufferedValues, func(tx *sql.Tx) error {
+			replayed, err := db.rawLog.recoverLost(tx, segments)
+			if err != nil {
+				return err
+			}
+			segments = append(segments, replayed...)
+			_, err = db.rawLog.prepare(tx, segments)
+			return err
+		})
+		if err == nil {
+			err = db.rawLog.commit(segments)
+		}
+		if err != nil {
+			panic(err.Error())
+		}
+		if err := db.rawLog.prune(db.sqldb.db); err != nil {
+			log.Printf("could not prune raw log: %v", err)
+		}
 	}
+	metrics.BufferFlushDuration.Observe(time.Since(start).Seconds())
+	metrics.BufferFlushedValues.Add(float64(db.bufferedValueCount))
 
 	db.bufferedValueCount = 0
+	atomic.StoreInt64(&db.bufferedSince, 0)
+	metrics.BufferedValues.Set(0)
 }
 
 func (db *db) manageBuffer() {
@@ -67,8 +115,17 @@ func (db *db) manageBuffer() {
 				log.Printf("adding value to bad key %v", bval.key)
 				continue
 			}
+			if db.rawLog != nil {
+				if err := db.rawLog.append(bval); err != nil {
+					panic(err.Error())
+				}
+			}
 			db.bufferedValues[bval.key] = append(slice, bval.value)
 			db.bufferedValueCount++
+			if db.bufferedValueCount == 1 {
+				atomic.StoreInt64(&db.bufferedSince, time.Now().UnixNano())
+			}
+			metrics.BufferedValues.Set(float64(db.bufferedValueCount))
 
 			// Flush full buffer to database
 			if db.bufferedValueCount >= bufferSize {
@@ -83,6 +140,11 @@ func (db *db) manageBuffer() {
 		case key := <-db.bufferAdd:
 			db.bufferedValues[key] = make([]msg2api.Measurement, 0, 4)
 
+		// Flush buffer on request
+		case done := <-db.bufferFlush:
+			db.flushBuffer()
+			close(done)
+
 		// Periodically flush buffer
 		case <-ticker.C:
 			db.flushBuffer()
@@ -90,10 +152,14 @@ func (db *db) manageBuffer() {
 	}
 }
 
-// OpenDb opens a connection to the postgres database with the given parameters,
-// starts a process to manage its value buffer and adds all sensors in the database to the buffer manager.
-// Returns a Db struct on success or an error otherwise
-func OpenDb(sqlAddr, sqlPort, sqlDb, sqlUser, sqlPass string) (Db, error) {
+// flush writes all buffered values to measure_raw and returns once they are committed.
+func (db *db) flush() {
+	done := make(chan struct{})
+	db.bufferFlush <- done
+	<-done
+}
+
+func openPostgres(sqlAddr, sqlPort, sqlDb, sqlUser, sqlPass string) (*sql.DB, error) {
 	cfg := fmt.Sprintf("user=%s password=%s dbname=%s host=%s port=%s sslmode=disable",
 		sqlUser,
 		sqlPass,
@@ -102,17 +168,81 @@ func OpenDb(sqlAddr, sqlPort, sqlDb, sqlUser, sqlPass string) (Db, error) {
 		sqlPort,
 	)
 
-	postgres, err := sql.Open("postgres", cfg)
+	return sql.Open("postgres", cfg)
+}
+
+// Options configures OpenDb.
+type Options struct {
+	// Migrate applies pending schema migrations, otherwise OpenDb fails with ErrSchemaOutdated if migrations are pending.
+	Migrate bool
+	// Durability is one of DurabilityUnlogged, DurabilityLogged or DurabilityWAL, DurabilityUnlogged if empty.
+	Durability string
+	// WALDir is the directory of the value log with DurabilityWAL. The directory must not be shared.
+	WALDir string
+}
+
+// OpenDb opens a connection to the postgres database with the given parameters,
+// starts a process to manage its value buffer and adds all sensors in the database to the buffer manager.
+// Values lost in a crash are replayed first if opts selects DurabilityWAL.
+// Returns a Db struct on success or an error otherwise
+func OpenDb(sqlAddr, sqlPort, sqlDb, sqlUser, sqlPass string, opts Options) (Db, error) {
+	postgres, err := openPostgres(sqlAddr, sqlPort, sqlDb, sqlUser, sqlPass)
+	if err != nil {
+		return nil, err
+	}
+
+	migrator := &Migrator{postgres}
+	if opts.Migrate {
+		err = migrator.Up(0)
+	} else {
+		var status []Migration
+		status, err = migrator.Status()
+		if err == nil && appliedVersion(status) != len(status) {
+			err = ErrSchemaOutdated
+		}
+	}
+	if err != nil {
+		postgres.Close()
+		return nil, err
+	}
+
+	if opts.Durability == "" {
+		opts.Durability = DurabilityUnlogged
+	}
+
+	var rawLog *rawLog
+	switch opts.Durability {
+	case DurabilityUnlogged, DurabilityWAL:
+		err = setRawPersistence(postgres, false)
+	case DurabilityLogged:
+		err = setRawPersistence(postgres, true)
+	default:
+		err = ErrBadDurability
+	}
+	if err == nil && opts.Durability == DurabilityWAL {
+		rawLog, err = openRawLog(opts.WALDir)
+		if err == nil {
+			var replayed int
+			replayed, err = rawLog.recover(postgres)
+			if replayed > 0 {
+				log.Printf("replayed %v values from the raw log", replayed)
+			}
+		}
+	}
 	if err != nil {
+		postgres.Close()
 		return nil, err
 	}
 
 	result := &db{
-		sqldb:          sqlHandler{postgres},
+		durability:     opts.Durability,
+		rawLog:         rawLog,
+		sqldb:          newSQLHandler(postgres),
 		bufferedValues: make(map[uint64][]msg2api.Measurement),
 		bufferInput:    make(chan bufferValue),
 		bufferKill:     make(chan uint64),
 		bufferAdd:      make(chan uint64),
+		bufferFlush:    make(chan chan struct{}),
 	}
 
 	go result.manageBuffer()
@@ -138,11 +268,40 @@ func OpenDb(sqlAddr, sqlPort, sqlDb, sqlUser, sqlPass string) (Db, error) {
 	return result, nil
 }
 
+// setRawPersistence makes measure_raw a logged or unlogged table if it is not already.
+func setRawPersistence(postgres *sql.DB, logged bool) error {
+	var persistence string
+	if err := postgres.QueryRow(`SELECT relpersistence FROM pg_class WHERE oid = 'measure_raw'::regclass`).Scan(&persistence); err != nil {
+		return err
+	}
+
+	var err error
+	if logged && persistence != "p" {
+		_, err = postgres.Exec(`ALTER TABLE measure_raw SET LOGGED`)
+	} else if !logged && persistence == "p" {
+		_, err = postgres.Exec(`ALTER TABLE measure_raw SET UNLOGGED`)
+	}
+	return err
+}
+
 func (db *db) Close() {
 	close(db.bufferInput)
+	db.sqldb.closeStatements()
 	db.sqldb.db.Close()
 }
 
+func (db *db) Ping() error {
+	return db.sqldb.db.Ping()
+}
+
+func (db *db) BufferLag() time.Duration {
+	since := atomic.LoadInt64(&db.bufferedSince)
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
 func (db *db) View(fn func(Tx) error) error {
 	t, err := db.sqldb.db.Begin()
 	if err != nil {
@@ -192,3 +351,44 @@ func (db *db) AddReading(sensor Sensor, time time.Time, value float64) error {
 	db.bufferInput <- bufferValue{sensor.DbID(), msg2api.Measurement{time, value}}
 	return nil
 }
+
+func (db *db) StreamReadings(userID string, since, until time.Time, resolution string, sensors map[string][]string, chunkSize int, fn func(ReadingsChunk) error) error {
+	var keys []uint64
+	var sensorsByKey map[uint64]Sensor
+
+	err := db.View(func(tx Tx) error {
+		u, ok := tx.User(userID).(*user)
+		if !ok {
+			return ErrNoUser
+		}
+		keys, sensorsByKey = u.sensorsByKey(sensors)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the time taken by fn, e.g. to send chunks to slow clients, is not counted as load time
+	var loading time.Duration
+	start := time.Now()
+	span := until.Sub(since)
+	err = db.sqldb.streamValues(since, until, resolution, keys, chunkSize, func(values map[uint64][]msg2api.Measurement, last time.Time) error {
+		loading += time.Since(start)
+		defer func() { start = time.Now() }()
+
+		chunk := ReadingsChunk{
+			Values:   groupByDevice(values, sensorsByKey),
+			Last:     last,
+			Progress: 1,
+		}
+		if span > 0 && last.Before(until) {
+			chunk.Progress = float64(last.Sub(since)) / float64(span)
+		}
+		return fn(chunk)
+	})
+	if err != nil {
+		return err
+	}
+	metrics.LoadDuration.WithLabelValues(resolution).Observe((loading + time.Since(start)).Seconds())
+	return nil
+}
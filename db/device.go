@@ -1,5 +1,12 @@
 package db
 
+import (
+	"github.com/lib/pq"
+	"github.com/mysmartgrid/msg2api"
+	"sort"
+	"time"
+)
+
 type device struct {
 	user      *user
 	id        string
@@ -14,6 +21,12 @@ func (d *device) AddSensor(id, unit string, port int32, factor float64) (Sensor,
 		return nil, err
 	}
 
+	_, err = d.user.tx.Exec(`INSERT INTO sensor_calibrations(sensor_seq, valid_from, unit, port, factor) VALUES($1, '-infinity', $2, $3, $4)`,
+		seq, unit, port, factor)
+	if err != nil {
+		return nil, err
+	}
+
 	result := &sensor{d, id, seq, factor, false}
 
 	d.user.tx.db.bufferAdd <- seq
@@ -25,7 +38,7 @@ func (d *device) Sensor(id string) Sensor {
 	var seq uint64
 	var factor float64
 	var isVirtual bool
-	err := d.user.tx.QueryRow(`SELECT sensor_seq, factor, is_virtual FROM sensors WHERE user_id = $1 AND device_id = $2 AND sensor_id = $3`, d.user.id, d.id, id).Scan(&seq, &factor, &isVirtual)
+	err := d.user.tx.QueryRow(`SELECT sensor_seq, `+currentCalibration("factor")+`, is_virtual FROM sensors WHERE user_id = $1 AND device_id = $2 AND sensor_id = $3`, d.user.id, d.id, id).Scan(&seq, &factor, &isVirtual)
 	if err != nil {
 		return nil
 	}
@@ -36,7 +49,7 @@ func (d *device) Sensor(id string) Sensor {
 }
 
 func (d *device) Sensors() map[string]Sensor {
-	rows, err := d.user.tx.Query(`SELECT sensor_id, sensor_seq, factor, is_virtual FROM sensors WHERE user_id = $1 AND device_id = $2`, d.user.id, d.id)
+	rows, err := d.user.tx.Query(`SELECT sensor_id, sensor_seq, `+currentCalibration("factor")+`, is_virtual FROM sensors WHERE user_id = $1 AND device_id = $2`, d.user.id, d.id)
 	if err != nil {
 		return nil
 	}
@@ -129,3 +142,79 @@ func (d *device) SetName(name string) error {
 func (d *device) IsVirtual() bool {
 	return d.isVirtual
 }
+
+func (d *device) Backfill(values map[string][]msg2api.Measurement) (int, int, error) {
+	count := 0
+	sensors := make(map[string]Sensor, len(values))
+	for id, sensorValues := range values {
+		sensors[id] = d.Sensor(id)
+		if sensors[id] == nil {
+			return 0, 0, ErrNoSensor
+		}
+
+		count += len(sensorValues)
+		if count > MaxBackfillValues {
+			return 0, 0, ErrBackfillTooLarge
+		}
+	}
+
+	now := time.Now()
+	rules := d.ValidationRules()
+	added, quarantined := 0, 0
+	for id, sensorValues := range values {
+		// rates of change are checked between consecutive values
+		sorted := append([]msg2api.Measurement(nil), sensorValues...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+		var rule *ValidationRule
+		if r, ok := rules[id]; ok {
+			rule = &r
+		}
+		accepted, rejected := ValidateReadings(sorted, rule, nil, now, true)
+		for _, r := range rejected {
+			_, err := d.user.tx.Exec(quarantineQuery, sensors[id].DbID(), r.Value.Time, pgFloat(r.Value.Value), r.Err.Error())
+			if err != nil {
+				return 0, 0, err
+			}
+			quarantined++
+		}
+		if len(accepted) == 0 {
+			continue
+		}
+
+		timestamps := make([]float64, len(accepted))
+		readings := make([]float64, len(accepted))
+		for i, value := range accepted {
+			timestamps[i] = float64(value.Time.UnixNano()) / float64(time.Second)
+			readings[i] = value.Value
+		}
+
+		var sensorAdded int
+		err := d.user.tx.QueryRow(`SELECT do_backfill($1, $2, $3)`,
+			sensors[id].DbID(), pq.Float64Array(timestamps), pq.Float64Array(readings)).Scan(&sensorAdded)
+		if err != nil {
+			return 0, 0, err
+		}
+		added += sensorAdded
+	}
+
+	// consumption summaries are only updated for the recent past by msgdbd, the days backfilled are queued to be
+	// summarized for the user of the device by msgdbd as well
+	var earliest time.Time
+	for _, sensorValues := range values {
+		for _, value := range sensorValues {
+			if earliest.IsZero() || value.Time.Before(earliest) {
+				earliest = value.Time
+			}
+		}
+	}
+	if added > 0 {
+		_, err := d.user.tx.Exec(`INSERT INTO summary_backlog(user_id, since) VALUES($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET since = least(summary_backlog.since, excluded.since)`, d.user.id, earliest)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return added, quarantined, nil
+}
@@ -11,6 +11,13 @@ type Db interface {
 	// buffered values to the database.
 	Close()
 
+	// Ping checks that the database is reachable.
+	Ping() error
+
+	// BufferLag returns the time the oldest value in the buffer has been waiting to be written to the database,
+	// or 0 if the buffer is empty.
+	BufferLag() time.Duration
+
 	// Update executes a database transaction defined by a series of operations
 	// in the function fn on its Tx struct.
 	Update(func(Tx) error) error
@@ -21,6 +28,16 @@ type Db interface {
 	// AddReading adds a single measurment of a specific sensor to the database buffer.
 	AddReading(sensor Sensor, time time.Time, value float64) error
 
+	// Quarantine stores a reading of a sensor that was rejected by validation, along with the reason for rejection.
+	Quarantine(sensor Sensor, value msg2api.Measurement, reason string) error
+
+	// StreamReadings loads measurements of a users sensors like User.LoadReadings, but passes them to fn in chunks
+	// of at most chunkSize values ordered by time instead of loading all of them at once. Values of resolution "raw"
+	// include the values already aggregated into seconds.
+	// Streaming stops and the error is returned as soon as fn returns an error.
+	// Returns ErrNoUser if the user does not exist in the database.
+	StreamReadings(userID string, since, until time.Time, resolution string, sensors map[string][]string, chunkSize int, fn func(ReadingsChunk) error) error
+
 	RunBenchmark(usrCount, devCnt, snsCnt int, duration time.Duration)
 }
 
@@ -44,6 +61,39 @@ type Tx interface {
 	// Users gets all users from the database and retrurns a map associating user ids with their representing structs.
 	Users() map[string]User
 
+	// UserByEmail gets the user with the given email address, ignoring case.
+	// Returns nil if no user has the address.
+	UserByEmail(email string) User
+
+	// Session gets the session identified by token from the database, regardless of whether it expired.
+	// Returns nil if the session does not exist.
+	Session(token string) *Session
+
+	// TouchSession sets the time the session identified by token was last used to now.
+	TouchSession(token string) error
+
+	// RemoveSession removes the session identified by token.
+	RemoveSession(token string) error
+
+	// PruneSessions removes all sessions that expired with the given idle and absolute timeouts.
+	PruneSessions(idle, absolute time.Duration) error
+
+	// ResetPassword sets the password of the user a reset token was created for and returns the user.
+	// Tokens can be used only once. Returns ErrBadResetToken if the token is unknown or expired.
+	ResetPassword(token, pw string) (User, error)
+
+	// ListUsers returns a page of all users ordered by id, along with the cursor of the next page, which is empty
+	// on the last page. Search matches user ids and email addresses.
+	ListUsers(opts ListOptions) ([]UserInfo, string, error)
+
+	// ListDevices returns a page of the devices of all users ordered by device id and user id, along with the cursor
+	// of the next page, which is empty on the last page. Search matches device ids, device names and user ids.
+	ListDevices(opts ListOptions) ([]DeviceInfo, string, error)
+
+	// AddDeviceTransfer creates a transfer of a device from one user to another that expires after validFor.
+	// Neither user has accepted the transfer yet. Returns ErrTransferExists if a transfer of the device is pending.
+	AddDeviceTransfer(devID, from, to string, withHistory bool, validFor time.Duration) (*DeviceTransfer, error)
+
 	// AddGroups adds new group to the database and returns the representing struct.
 	// Returns an error if the group id already exists in the database.
 	AddGroup(id string) (Group, error)
@@ -58,6 +108,51 @@ type Tx interface {
 
 	// Groups gets all groups from the database and retrurns a map associating group ids with their representing structs.
 	Groups() map[string]Group
+
+	// Roles returns all roles along with their permissions.
+	Roles() ([]Role, error)
+
+	// SetRole creates a role or replaces the description and permissions of an existing role.
+	// Returns ErrBadPermission if any permission is not listed in Permissions, ErrPredefinedRole for predefined roles.
+	SetRole(role Role) error
+
+	// RemoveRole removes a role, users with the role lose it. Returns ErrNoRole if the role does not exist,
+	// ErrPredefinedRole for predefined roles.
+	RemoveRole(id string) error
+
+	// UnitValidationRules returns the validation rules applying to all sensors with a unit, by unit.
+	UnitValidationRules() map[string]ValidationRule
+
+	// SetUnitValidationRule sets the validation rule for all sensors with the given unit, nil removes the rule.
+	SetUnitValidationRule(unit string, rule *ValidationRule) error
+
+	// AlertRules returns the alert rules of all users.
+	AlertRules() ([]AlertRule, error)
+
+	// UnresolvedAlerts returns the alerts of all users that are not resolved.
+	UnresolvedAlerts() ([]Alert, error)
+
+	// Webhooks returns the webhooks of all users, including their secrets.
+	Webhooks() ([]Webhook, error)
+
+	// QueueWebhookDelivery queues an event for delivery to a webhook. payload is the JSON encoded body of the delivery.
+	QueueWebhookDelivery(webhook uint64, event string, payload []byte) error
+
+	// ClaimWebhookDeliveries returns up to limit deliveries that are due for an attempt, oldest first, and postpones
+	// their next attempt by lease, so concurrent callers claim different deliveries. Deliveries locked by other
+	// transactions are skipped, as are deliveries queued after a pending delivery of the same webhook that is not
+	// claimed along with them.
+	ClaimWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error)
+
+	// ReleaseWebhookDeliveries makes claimed deliveries due again without recording an attempt.
+	ReleaseWebhookDeliveries(ids []uint64) error
+
+	// RecordWebhookAttempt records the result of a delivery attempt. An empty failure marks the delivery as delivered,
+	// otherwise it is attempted again at retryAt, or never if retryAt is nil.
+	RecordWebhookAttempt(id uint64, status int, failure string, retryAt *time.Time) error
+
+	// PruneWebhookDeliveries removes finished deliveries created before the given time.
+	PruneWebhookDeliveries(before time.Time) error
 }
 
 // User provides a set of operations on users as represented in the database.
@@ -84,14 +179,95 @@ type User interface {
 	VirtualDevices() map[string]Device
 
 	// HasPassword returns true if the hash stored in the database for the current user matches the hash of the provided pw string, return false otherwise.
+	// If the password matches a hash of an outdated scheme or with outdated parameters, the hash is replaced by a
+	// current one. The replacement is only stored within Update.
 	HasPassword(pw string) bool
 
-	// IsAdmin returns the state of the Admin flag stored in the database for the currrent user.
+	// SetPassword changes the password of the current user, invalidates all password reset tokens of the user and
+	// unlocks the account.
+	SetPassword(pw string) error
+
+	// LockedUntil returns the time until which logins of the current user are refused after failed logins.
+	// The time is zero or in the past if the account is not locked.
+	LockedUntil() time.Time
+
+	// RecordLoginFailure counts a failed login of the current user and locks the account as described by policy.
+	// Returns the time until which the account is locked, or zero if it is not locked.
+	RecordLoginFailure(policy LockoutPolicy) (time.Time, error)
+
+	// ClearLoginFailures resets the count of failed logins of the current user and unlocks the account.
+	ClearLoginFailures() error
+
+	// AddSession starts a new session of the current user and returns the token identifying it.
+	// address and userAgent describe the client of the session.
+	AddSession(address, userAgent string) (string, error)
+
+	// Sessions returns all sessions of the current user, most recently used first.
+	Sessions() ([]Session, error)
+
+	// RemoveSession removes a session of the current user by its id.
+	RemoveSession(id uint64) error
+
+	// RemoveSessions removes all sessions of the current user except the one identified by token keep, which may be
+	// empty to remove all sessions.
+	RemoveSessions(keep string) error
+
+	// Email returns the email address of the current user, or an empty string if none is set.
+	Email() string
+
+	// SetEmail sets the email address of the current user, an empty string removes the address.
+	// Returns ErrEmailExists if another user has the same address.
+	SetEmail(email string) error
+
+	// CreatePasswordReset creates a token that allows to set a new password for the current user through
+	// Tx.ResetPassword until it expires after validFor.
+	CreatePasswordReset(validFor time.Duration) (string, error)
+
+	// Export returns all devices, sensors, calibrations, alert rules and webhooks of the current user, along with
+	// all values of the sensors in the given resolution.
+	Export(resolution string) (*UserExport, error)
+
+	// Info returns a summary of the current user for administrators.
+	Info() (UserInfo, error)
+
+	// IsDisabled returns true if the current user was disabled and may not log in.
+	IsDisabled() bool
+
+	// SetDisabled disables or enables the current user. Disabling a user removes all its sessions.
+	SetDisabled(b bool) error
+
+	// DeviceTransfers returns the pending transfers of devices from or to the current user.
+	DeviceTransfers() ([]DeviceTransfer, error)
+
+	// AcceptTransfer records that the current user accepts a pending transfer. Once both users accepted it, the
+	// device is moved to the receiving user and the returned transfer is Done. The device registry must then be
+	// updated before the transaction is committed. Returns ErrNoTransfer if the current user is not involved.
+	AcceptTransfer(id uint64) (*DeviceTransfer, error)
+
+	// RemoveTransfer declines or cancels a pending transfer the current user is involved in.
+	RemoveTransfer(id uint64) error
+
+	// IsAdmin returns true if the current user has the admin role.
 	IsAdmin() bool
 
-	// SetAdmin sets the Admin flag in the database for the current user.
+	// SetAdmin adds or removes the admin role of the current user.
 	SetAdmin(b bool) error
 
+	// Roles returns the ids of the roles of the current user.
+	Roles() ([]string, error)
+
+	// AddRole assigns a role to the current user. Returns ErrNoRole if the role does not exist.
+	AddRole(role string) error
+
+	// RemoveRole removes a role from the current user.
+	RemoveRole(role string) error
+
+	// Permissions returns all permissions granted to the current user by its roles.
+	Permissions() ([]string, error)
+
+	// HasPermission returns true if any role of the current user grants the permission.
+	HasPermission(perm string) bool
+
 	// Groups returns a map of group ids to Group objects for all groups the current users belongs to.
 	Groups() map[string]Group
 
@@ -102,8 +278,45 @@ type User interface {
 	ID() string
 
 	// LoadReadings loads measurements for the given timespan, resolution and sensors identified by device and id from the database, if they belong to the user.
+	// If opts is not nil, values are additionally gap filled and downsampled as described by opts, and resolution may be ResolutionAuto.
+	// Values are then loaded in chunks like Db.StreamReadings, and loading fails if more than a million values of all sensors
+	// would have to be held at once. The resolution chosen and the gaps found are stored in opts.
 	// Returns a mapping device id to sensorid to Value arrays.
-	LoadReadings(since, until time.Time, resolution string, sensors map[string][]string) (map[string]map[string][]msg2api.Measurement, error)
+	LoadReadings(since, until time.Time, resolution string, sensors map[string][]string, opts *ReadingOptions) (map[string]map[string][]msg2api.Measurement, error)
+
+	// ConsumptionSummary returns the precomputed consumption of the user by summary period (SummaryToday, SummaryWeek,
+	// SummaryMonth and SummaryYear). Periods without values are empty.
+	ConsumptionSummary() (map[string]*ConsumptionSummary, error)
+
+	// AlertRules returns the alert rules of the user.
+	AlertRules() ([]AlertRule, error)
+
+	// AddAlertRule adds an alert rule for a sensor of the user and returns its id, the ID and User fields of rule are ignored.
+	AddAlertRule(rule AlertRule) (uint64, error)
+
+	// RemoveAlertRule removes an alert rule of the user along with its alerts.
+	RemoveAlertRule(id uint64) error
+
+	// AddAlert records an alert fired for a rule of the user and returns its id.
+	AddAlert(a Alert) (uint64, error)
+
+	// ResolveAlert marks an alert of the user as resolved.
+	ResolveAlert(id uint64, resolved time.Time) error
+
+	// Alerts returns the alerts of the user fired since the given time and all unresolved alerts.
+	Alerts(since time.Time) ([]Alert, error)
+
+	// Webhooks returns the webhooks of the user. Secrets are not included.
+	Webhooks() ([]Webhook, error)
+
+	// AddWebhook adds a webhook for the given events of the user and returns it along with its generated secret.
+	AddWebhook(url string, events []string) (Webhook, error)
+
+	// RemoveWebhook removes a webhook of the user along with its deliveries.
+	RemoveWebhook(id uint64) error
+
+	// WebhookDeliveries returns the last limit deliveries of a webhook of the user, newest first.
+	WebhookDeliveries(id uint64, limit int) ([]WebhookDelivery, error)
 }
 
 // Group provides a set of operations on groups as represented in the database.
@@ -153,6 +366,19 @@ type Device interface {
 	// Returns the representing Sensors struct or an error if the the device already exists.
 	AddSensor(id, unit string, port int32, factor float64) (Sensor, error)
 
+	// Backfill stores values of sensors of the device measured in the past, e.g. while the device was offline, and
+	// aggregates them immediately. Values are deduplicated by sensor and timestamp, values with timestamps already
+	// stored, in seconds already aggregated or older than the users retention period for seconds are skipped.
+	// Values are validated with ValidateReadings and the validation rules of their sensor, values failing validation
+	// are quarantined. No values are stored if any of them belongs to an unknown sensor. The consumption summaries
+	// of the days backfilled are updated by msgdbd afterwards.
+	// Returns the number of values stored and the number of values quarantined.
+	Backfill(values map[string][]msg2api.Measurement) (added, quarantined int, err error)
+
+	// ValidationRules returns the effective validation rules of all sensors of the device that have one, by sensor id.
+	// Limits set for a sensor take precedence over limits set for its unit.
+	ValidationRules() map[string]ValidationRule
+
 	// Sensor gets the sensor with id from the database if it is associated with the current device and creates the representing sensor struct.
 	// Returns nil if the seonsor does not exist in the database.
 	Sensor(id string) Sensor
@@ -208,15 +434,33 @@ type Sensor interface {
 	// Groups returns a map of group ids to Group objects for all groups the current sensor belongs to.
 	Groups() map[string]Group
 
-	// Port returns the physical port the sensor was assinged with on creation.
+	// Port returns the physical port of the sensor in the calibration valid now.
 	Port() int32
 
-	// Unit returns the unit of the measured values of the sensors assinged on creation.
+	// Unit returns the unit of the measured values of the sensor in the calibration valid now.
 	Unit() string
 
-	// Factor returns the correction factor applied to a measurments when reading the sensor's values
+	// Factor returns the correction factor of the calibration valid now. Values of other times are corrected with
+	// the factor valid at their time, see CalibrationAt.
 	Factor() float64
 
+	// Calibrate changes unit, port and correction factor of the sensor for all values starting at c.ValidFrom.
+	// Values before c.ValidFrom keep the calibration valid at their time. Aggregated values are stored corrected,
+	// so c.ValidFrom must not precede values of the sensor already aggregated.
+	Calibrate(c Calibration) error
+
+	// Calibrations returns the calibration history of the sensor ordered by time.
+	Calibrations() ([]Calibration, error)
+
+	// ValidationRule returns the validation rule set for the sensor itself, or nil if none is set.
+	ValidationRule() *ValidationRule
+
+	// SetValidationRule sets the validation rule of the sensor, nil removes the rule.
+	SetValidationRule(rule *ValidationRule) error
+
+	// QuarantinedReadings returns the readings of the sensor in the given timespan that were rejected by validation.
+	QuarantinedReadings(since, until time.Time) ([]QuarantinedReading, error)
+
 	// IsVirtual returns the state of the virtual flag of the current sensor in the database.
 	IsVirtual() bool
 }
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the schema migrations. Every migration is a pair of files <version>_<name>.up.sql and
+// <version>_<name>.down.sql, versions are numbered from 1 without gaps. Applied migrations must never be changed,
+// schema changes are made by adding a migration.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// initdbUpgrade upgrades databases created from the old initdb.sql to the schema of the initial migration.
+//
+//go:embed initdb_upgrade.sql
+var initdbUpgrade string
+
+// migrationLockKey is the advisory lock held while migrating, so concurrent migrations wait for each other.
+const migrationLockKey = 0x6d736d67
+
+var (
+	// ErrSchemaOutdated is returned by OpenDb if migrations are pending and were not applied.
+	ErrSchemaOutdated = errors.New("database schema is outdated, migrations are pending")
+	// ErrSchemaTooNew is returned if the database has migrations applied this program does not know.
+	ErrSchemaTooNew = errors.New("database schema is newer than this program")
+	// ErrBadMigrationVersion is returned for migration targets that do not exist.
+	ErrBadMigrationVersion = errors.New("no such migration")
+)
+
+// Migration is a single step of the database schema.
+type Migration struct {
+	Version int
+	Name    string
+	// Applied is the time the migration was applied, nil if it is pending.
+	Applied *time.Time
+
+	up, down string
+}
+
+// Migrations returns all known migrations, ordered by version.
+func Migrations() ([]Migration, error) {
+	files, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, f := range files {
+		var direction string
+		name := f.Name()
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction, name = "up", strings.TrimSuffix(name, ".up.sql")
+		case strings.HasSuffix(name, ".down.sql"):
+			direction, name = "down", strings.TrimSuffix(name, ".down.sql")
+		default:
+			return nil, fmt.Errorf("bad migration file name %v", f.Name())
+		}
+
+		parts := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("bad migration file name %v", f.Name())
+		}
+
+		body, err := migrationFiles.ReadFile(path.Join("migrations", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	result := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+
+	for i, m := range result {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %v is missing", i+1)
+		}
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %v is incomplete", m.Version)
+		}
+	}
+	return result, nil
+}
+
+// Migrator applies and reverts schema migrations of a database.
+type Migrator struct {
+	db *sql.DB
+}
+
+// OpenMigrator opens a connection to the postgres database with the given parameters for migrating.
+func OpenMigrator(sqlAddr, sqlPort, sqlDb, sqlUser, sqlPass string) (*Migrator, error) {
+	postgres, err := openPostgres(sqlAddr, sqlPort, sqlDb, sqlUser, sqlPass)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{postgres}, nil
+}
+
+// Close closes the database connection of the migrator.
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// Status returns all known migrations with the time they were applied.
+func (m *Migrator) Status() ([]Migration, error) {
+	var result []Migration
+	err := m.inTx(func(tx *sql.Tx, migrations []Migration) error {
+		result = migrations
+		return nil
+	})
+	return result, err
+}
+
+// Version returns the version of the last applied migration, 0 for an empty database.
+func (m *Migrator) Version() (int, error) {
+	var version int
+	err := m.inTx(func(tx *sql.Tx, migrations []Migration) error {
+		version = appliedVersion(migrations)
+		return nil
+	})
+	return version, err
+}
+
+// Up applies all pending migrations up to and including version target, all pending migrations if target is 0.
+// Either all migrations are applied or none.
+func (m *Migrator) Up(target int) error {
+	return m.inTx(func(tx *sql.Tx, migrations []Migration) error {
+		if target == 0 {
+			target = len(migrations)
+		}
+		if target < 0 || target > len(migrations) {
+			return ErrBadMigrationVersion
+		}
+
+		for _, mig := range migrations[appliedVersion(migrations):target] {
+			if _, err := tx.Exec(mig.up); err != nil {
+				return fmt.Errorf("migration %v_%v: %v", mig.Version, mig.Name, err)
+			}
+			if _, err := tx.Exec(`INSERT INTO public.schema_migrations(version, name) VALUES($1, $2)`, mig.Version, mig.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down reverts all applied migrations after version target, target 0 reverts all migrations.
+// Either all migrations are reverted or none.
+func (m *Migrator) Down(target int) error {
+	return m.inTx(func(tx *sql.Tx, migrations []Migration) error {
+		if target < 0 || target > len(migrations) {
+			return ErrBadMigrationVersion
+		}
+
+		for v := appliedVersion(migrations); v > target; v-- {
+			mig := migrations[v-1]
+			if _, err := tx.Exec(mig.down); err != nil {
+				return fmt.Errorf("migration %v_%v: %v", mig.Version, mig.Name, err)
+			}
+			if _, err := tx.Exec(`DELETE FROM public.schema_migrations WHERE version = $1`, mig.Version); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// inTx calls fn with all known migrations and their state within a transaction holding the migration lock.
+// Databases created from initdb.sql before migrations were introduced are upgraded to the schema of the initial
+// migration and recorded as having it applied.
+// The transaction runs on a connection of its own, which is reset afterwards: the initial migration changes
+// session settings, which must not leak into other users of the connection pool.
+func (m *Migrator) inTx(fn func(*sql.Tx, []Migration) error) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer conn.ExecContext(ctx, `RESET ALL`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockKey); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS public.schema_migrations (
+		version integer PRIMARY KEY,
+		name character varying NOT NULL,
+		applied timestamp with time zone DEFAULT now() NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	var legacy bool
+	err = tx.QueryRow(`SELECT to_regclass('public.users') IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM public.schema_migrations)`).Scan(&legacy)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		if _, err := tx.Exec(initdbUpgrade); err != nil {
+			return fmt.Errorf("initdb.sql upgrade: %v", err)
+		}
+		_, err = tx.Exec(`INSERT INTO public.schema_migrations(version, name) VALUES(1, $1)`, migrations[0].Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT version, applied FROM public.schema_migrations ORDER BY version`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var applied time.Time
+		if err := rows.Scan(&version, &applied); err != nil {
+			return err
+		}
+		if version > len(migrations) {
+			return ErrSchemaTooNew
+		}
+		migrations[version-1].Applied = &applied
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if err := fn(tx, migrations); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// appliedVersion returns the version of the last applied migration.
+func appliedVersion(migrations []Migration) int {
+	version := 0
+	for _, m := range migrations {
+		if m.Applied != nil {
+			version = m.Version
+		}
+	}
+	return version
+}
@@ -0,0 +1,39 @@
+--
+-- Drops everything created by 0001_initial.up.sql.
+--
+
+SET search_path = public, pg_catalog;
+
+DROP FUNCTION IF EXISTS do_aggregate();
+DROP FUNCTION IF EXISTS do_summarize(timestamp with time zone);
+DROP FUNCTION IF EXISTS do_backfill(bigint, double precision[], double precision[]);
+DROP FUNCTION IF EXISTS do_remove_old_values();
+
+DROP TABLE IF EXISTS
+    alert_rules,
+    alerts,
+    consumption_daily,
+    consumption_summaries,
+    webhooks,
+    webhook_deliveries,
+    devices,
+    groups,
+    measure_aggregated_seconds,
+    measure_aggregated_minutes,
+    measure_aggregated_hours,
+    measure_aggregated_days,
+    measure_aggregated_weeks,
+    measure_aggregated_months,
+    measure_aggregated_years,
+    measure_raw,
+    measure_quarantine,
+    sensor_groups,
+    sensors,
+    sensor_calibrations,
+    sensor_validation_rules,
+    unit_validation_rules,
+    user_groups,
+    users,
+    virtual_sensor_sensors,
+    virtual_sensors
+    CASCADE;
@@ -141,6 +141,234 @@ with updates as (
 select count(*) from do_update_y;$$;
 
 
+--
+-- Name: do_summarize(timestamp with time zone); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION do_summarize(timestamp with time zone) RETURNS void
+    LANGUAGE sql
+    AS $$
+with hours as (
+	select
+		h."timestamp",
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		s.sensor_id,
+		s.unit,
+		h.sum / h.count * coalesce(c.factor, s.factor) as value
+	from measure_aggregated_hours h
+	join sensors s on s.sensor_seq = h.sensor
+	left join lateral (select c.factor from sensor_calibrations c
+		where c.sensor_seq = h.sensor and c.valid_from <= h."timestamp"
+		order by c.valid_from desc limit 1) c on true
+	where h."timestamp" >= date_trunc('day', $1) and h.count > 0 and s.unit in ('W', 'Wh', 'kWh')
+), minutes as (
+	select
+		m."timestamp",
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		m.sum / m.count * coalesce(c.factor, s.factor) as power
+	from measure_aggregated_minutes m
+	join sensors s on s.sensor_seq = m.sensor
+	left join lateral (select c.factor from sensor_calibrations c
+		where c.sensor_seq = m.sensor and c.valid_from <= m."timestamp"
+		order by c.valid_from desc limit 1) c on true
+	where m."timestamp" >= date_trunc('day', $1) and m.count > 0 and s.unit = 'W'
+), sensor_days as (
+	select
+		date_trunc('day', "timestamp")::date as day,
+		sensor_seq,
+		user_id,
+		device_id,
+		sensor_id,
+		-- power sensors are integrated over their hourly averages, meters report their difference
+		case unit
+			when 'W' then sum(value)
+			when 'Wh' then max(value) - min(value)
+			else (max(value) - min(value)) * 1000
+		end as energy
+	from hours
+	group by day, sensor_seq, user_id, device_id, sensor_id, unit
+), sensor_peaks as (
+	select date_trunc('day', "timestamp")::date as day, sensor_seq, max(power) as peak
+	from minutes
+	group by day, sensor_seq
+), device_peaks as (
+	select day, user_id, device_id, max(power) as peak
+	from (
+		select date_trunc('day', "timestamp")::date as day, user_id, device_id, sum(power) as power
+		from minutes
+		group by "timestamp", user_id, device_id
+	) p
+	group by day, user_id, device_id
+), user_peaks as (
+	select day, user_id, max(power) as peak
+	from (
+		select date_trunc('day', "timestamp")::date as day, user_id, sum(power) as power
+		from minutes
+		group by "timestamp", user_id
+	) p
+	group by day, user_id
+), days as (
+	select d.day, d.user_id, d.device_id, d.sensor_id, d.energy, p.peak
+	from sensor_days d
+	left join sensor_peaks p on p.day = d.day and p.sensor_seq = d.sensor_seq
+	union all
+	select d.day, d.user_id, d.device_id, '', sum(d.energy), max(p.peak)
+	from sensor_days d
+	left join device_peaks p on p.day = d.day and p.user_id = d.user_id and p.device_id = d.device_id
+	group by d.day, d.user_id, d.device_id
+	union all
+	select d.day, d.user_id, '', '', sum(d.energy), max(p.peak)
+	from sensor_days d
+	left join user_peaks p on p.day = d.day and p.user_id = d.user_id
+	group by d.day, d.user_id
+)
+insert into consumption_daily as c
+select * from days
+on conflict (day, user_id, device_id, sensor_id) do update
+set energy = excluded.energy, peak = excluded.peak;
+
+insert into consumption_summaries as c
+select p.period, d.user_id, d.device_id, d.sensor_id, sum(d.energy), max(d.peak), now()
+from consumption_daily d
+join (values
+	('today', date_trunc('day', now())),
+	('week', date_trunc('week', now())),
+	('month', date_trunc('month', now())),
+	('year', date_trunc('year', now()))
+) p(period, start) on d.day >= p.start::date
+group by p.period, d.user_id, d.device_id, d.sensor_id
+on conflict (period, user_id, device_id, sensor_id) do update
+set energy = excluded.energy, peak = excluded.peak, updated = excluded.updated;
+
+delete from consumption_summaries where updated < now();
+$$;
+
+
+--
+-- Name: do_backfill(bigint, double precision[], double precision[]); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION do_backfill(bigint, double precision[], double precision[]) RETURNS bigint
+    LANGUAGE sql
+    AS $$
+with input as (
+	select distinct on (date_trunc('second', to_timestamp(t.ts)))
+		to_timestamp(t.ts) as "timestamp",
+		t.value
+	from unnest($2, $3) as t(ts, value)
+	order by date_trunc('second', to_timestamp(t.ts)), t.ts
+), updates as (
+	select
+		$1 as sensor,
+		i."timestamp",
+		i.value
+	from input i, sensors s, users u
+	where s.sensor_seq = $1
+		and u.user_id = s.user_id
+		and (u.remove_data_after[1] is null or i."timestamp" >= now() - u.remove_data_after[1])
+		and not exists (
+			select 1 from measure_aggregated_seconds m
+			where m.sensor = $1 and m."timestamp" = date_trunc('second', i."timestamp"))
+		and not exists (
+			select 1 from measure_raw r
+			where r.sensor = $1
+				and r."timestamp" >= date_trunc('second', i."timestamp")
+				and r."timestamp" < date_trunc('second', i."timestamp") + interval '1 second')
+), do_update_s as (
+	insert into measure_aggregated_seconds as m
+	select
+		date_trunc('second', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		1
+	from updates
+	group by
+		ts,
+		sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_m as (
+	insert into measure_aggregated_minutes as m
+	select
+		date_trunc('minute', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		2
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_h as (
+	insert into measure_aggregated_hours as m
+	select
+		date_trunc('hour', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		3
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_d as (
+	insert into measure_aggregated_days as m
+	select
+		date_trunc('day', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		4
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_w as (
+	insert into measure_aggregated_weeks as m
+	select
+		date_trunc('week', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		5
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_mo as (
+	insert into measure_aggregated_months as m
+	select
+		date_trunc('months', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		6
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_y as (
+	insert into measure_aggregated_years as m
+	select
+		date_trunc('year', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		7
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+)
+
+select count(*) from updates;$$;
+
+
 --
 -- TOC entry 212 (class 1255 OID 16402)
 -- Name: do_remove_old_values(); Type: FUNCTION; Schema: public; Owner: -
@@ -192,6 +420,97 @@ SET default_tablespace = '';
 
 SET default_with_oids = false;
 
+--
+-- Name: alert_rules; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE alert_rules (
+    rule_id bigserial NOT NULL,
+    user_id character varying NOT NULL,
+    sensor_seq bigint NOT NULL,
+    kind character varying NOT NULL,
+    threshold double precision DEFAULT 0 NOT NULL,
+    duration_ms bigint DEFAULT 0 NOT NULL,
+    webhook_url character varying DEFAULT '' NOT NULL,
+    email character varying DEFAULT '' NOT NULL
+);
+
+
+--
+-- Name: alerts; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE alerts (
+    alert_id bigserial NOT NULL,
+    rule_id bigint NOT NULL,
+    fired timestamp with time zone NOT NULL,
+    resolved timestamp with time zone,
+    value double precision NOT NULL,
+    message character varying NOT NULL
+);
+
+
+--
+-- Name: consumption_daily; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE consumption_daily (
+    day date NOT NULL,
+    user_id character varying NOT NULL,
+    device_id character varying DEFAULT '' NOT NULL,
+    sensor_id character varying DEFAULT '' NOT NULL,
+    energy double precision NOT NULL,
+    peak double precision
+);
+
+
+--
+-- Name: consumption_summaries; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE consumption_summaries (
+    period character varying NOT NULL,
+    user_id character varying NOT NULL,
+    device_id character varying DEFAULT '' NOT NULL,
+    sensor_id character varying DEFAULT '' NOT NULL,
+    energy double precision NOT NULL,
+    peak double precision,
+    updated timestamp with time zone NOT NULL
+);
+
+
+--
+-- Name: webhooks; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE webhooks (
+    webhook_id bigserial NOT NULL,
+    user_id character varying NOT NULL,
+    url character varying NOT NULL,
+    secret character varying NOT NULL,
+    events character varying[] DEFAULT '{}' NOT NULL,
+    created timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+--
+-- Name: webhook_deliveries; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE webhook_deliveries (
+    delivery_id bigserial NOT NULL,
+    webhook_id bigint NOT NULL,
+    event character varying NOT NULL,
+    payload text NOT NULL,
+    created timestamp with time zone DEFAULT now() NOT NULL,
+    attempts integer DEFAULT 0 NOT NULL,
+    next_attempt timestamp with time zone,
+    delivered timestamp with time zone,
+    status integer DEFAULT 0 NOT NULL,
+    error character varying DEFAULT '' NOT NULL
+);
+
+
 --
 -- TOC entry 181 (class 1259 OID 16544)
 -- Name: devices; Type: TABLE; Schema: public; Owner: -
@@ -326,6 +645,19 @@ CREATE UNLOGGED TABLE measure_raw (
 );
 
 
+--
+-- Name: measure_quarantine; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE measure_quarantine (
+    sensor bigint NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    value double precision,
+    reason character varying NOT NULL,
+    received timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
 --
 -- TOC entry 191 (class 1259 OID 16580)
 -- Name: sensor_groups; Type: TABLE; Schema: public; Owner: -
@@ -355,6 +687,43 @@ CREATE TABLE sensors (
 );
 
 
+--
+-- Name: sensor_calibrations; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE sensor_calibrations (
+    sensor_seq bigint NOT NULL,
+    valid_from timestamp with time zone NOT NULL,
+    unit character varying NOT NULL,
+    port integer NOT NULL,
+    factor double precision NOT NULL
+);
+
+
+--
+-- Name: sensor_validation_rules; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE sensor_validation_rules (
+    sensor_seq bigint NOT NULL,
+    min_value double precision,
+    max_value double precision,
+    max_rate double precision
+);
+
+
+--
+-- Name: unit_validation_rules; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE unit_validation_rules (
+    unit character varying NOT NULL,
+    min_value double precision,
+    max_value double precision,
+    max_rate double precision
+);
+
+
 --
 -- TOC entry 193 (class 1259 OID 16593)
 -- Name: sensors_sensor_seq_seq; Type: SEQUENCE; Schema: public; Owner: -
@@ -464,6 +833,54 @@ ALTER TABLE ONLY sensors ALTER COLUMN sensor_seq SET DEFAULT nextval('sensors_se
 ALTER TABLE ONLY virtual_sensors ALTER COLUMN vsensor_id SET DEFAULT nextval('virtual_sensors_vsensor_id_seq'::regclass);
 
 
+--
+-- Name: alert_rules_pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY alert_rules
+    ADD CONSTRAINT alert_rules_pk PRIMARY KEY (rule_id);
+
+
+--
+-- Name: alerts_pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY alerts
+    ADD CONSTRAINT alerts_pk PRIMARY KEY (alert_id);
+
+
+--
+-- Name: consumption_daily_pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY consumption_daily
+    ADD CONSTRAINT consumption_daily_pk PRIMARY KEY (day, user_id, device_id, sensor_id);
+
+
+--
+-- Name: consumption_summaries_pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY consumption_summaries
+    ADD CONSTRAINT consumption_summaries_pk PRIMARY KEY (user_id, period, device_id, sensor_id);
+
+
+--
+-- Name: webhooks_pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY webhooks
+    ADD CONSTRAINT webhooks_pk PRIMARY KEY (webhook_id);
+
+
+--
+-- Name: webhook_deliveries_pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY webhook_deliveries
+    ADD CONSTRAINT webhook_deliveries_pk PRIMARY KEY (delivery_id);
+
+
 --
 -- TOC entry 2101 (class 2606 OID 18094)
 -- Name: days_pk; Type: CONSTRAINT; Schema: public; Owner: -
@@ -545,6 +962,30 @@ ALTER TABLE ONLY sensor_groups
     ADD CONSTRAINT sensor_groups_pk PRIMARY KEY (sensor_seq, group_id);
 
 
+--
+-- Name: sensor_calibrations_pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY sensor_calibrations
+    ADD CONSTRAINT sensor_calibrations_pk PRIMARY KEY (sensor_seq, valid_from);
+
+
+--
+-- Name: sensor_validation_rules_pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY sensor_validation_rules
+    ADD CONSTRAINT sensor_validation_rules_pk PRIMARY KEY (sensor_seq);
+
+
+--
+-- Name: unit_validation_rules_pk; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY unit_validation_rules
+    ADD CONSTRAINT unit_validation_rules_pk PRIMARY KEY (unit);
+
+
 --
 -- TOC entry 2118 (class 2606 OID 16412)
 -- Name: sensor_pk; Type: CONSTRAINT; Schema: public; Owner: -
@@ -625,6 +1066,90 @@ ALTER TABLE ONLY measure_aggregated_years
 CREATE INDEX brin_index ON measure_raw USING brin ("timestamp");
 
 
+--
+-- Name: measure_quarantine_index; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX measure_quarantine_index ON measure_quarantine USING btree (sensor, "timestamp");
+
+
+--
+-- Name: alerts_rule_index; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX alerts_rule_index ON alerts USING btree (rule_id, fired);
+
+
+--
+-- Name: webhook_deliveries_pending_index; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX webhook_deliveries_pending_index ON webhook_deliveries USING btree (next_attempt) WHERE (next_attempt IS NOT NULL);
+
+
+--
+-- Name: webhook_deliveries_webhook_index; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX webhook_deliveries_webhook_index ON webhook_deliveries USING btree (webhook_id, delivery_id);
+
+
+--
+-- Name: alert_rules_sensor_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY alert_rules
+    ADD CONSTRAINT alert_rules_sensor_fk FOREIGN KEY (sensor_seq) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+--
+-- Name: alert_rules_user_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY alert_rules
+    ADD CONSTRAINT alert_rules_user_fk FOREIGN KEY (user_id) REFERENCES users(user_id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+--
+-- Name: alerts_rule_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY alerts
+    ADD CONSTRAINT alerts_rule_fk FOREIGN KEY (rule_id) REFERENCES alert_rules(rule_id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+--
+-- Name: consumption_daily_user_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY consumption_daily
+    ADD CONSTRAINT consumption_daily_user_fk FOREIGN KEY (user_id) REFERENCES users(user_id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+--
+-- Name: consumption_summaries_user_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY consumption_summaries
+    ADD CONSTRAINT consumption_summaries_user_fk FOREIGN KEY (user_id) REFERENCES users(user_id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+--
+-- Name: webhooks_user_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY webhooks
+    ADD CONSTRAINT webhooks_user_fk FOREIGN KEY (user_id) REFERENCES users(user_id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+--
+-- Name: webhook_deliveries_webhook_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY webhook_deliveries
+    ADD CONSTRAINT webhook_deliveries_webhook_fk FOREIGN KEY (webhook_id) REFERENCES webhooks(webhook_id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
 --
 -- TOC entry 2142 (class 2606 OID 16418)
 -- Name: device_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
@@ -670,6 +1195,30 @@ ALTER TABLE ONLY virtual_sensors
     ADD CONSTRAINT sensor_fk FOREIGN KEY (representing_sensor) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE;
 
 
+--
+-- Name: sensor_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY sensor_calibrations
+    ADD CONSTRAINT sensor_fk FOREIGN KEY (sensor_seq) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+--
+-- Name: sensor_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY sensor_validation_rules
+    ADD CONSTRAINT sensor_fk FOREIGN KEY (sensor_seq) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+--
+-- Name: sensor_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY measure_quarantine
+    ADD CONSTRAINT sensor_fk FOREIGN KEY (sensor) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
 --
 -- TOC entry 2136 (class 2606 OID 17687)
 -- Name: sensor_fk; Type: FK CONSTRAINT; Schema: public; Owner: -
@@ -0,0 +1,90 @@
+--
+-- Moves the values of all partitions back into unpartitioned tables.
+--
+
+SET search_path = public, pg_catalog;
+
+DROP FUNCTION do_manage_partitions();
+
+CREATE OR REPLACE FUNCTION do_remove_old_values() RETURNS void
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+DELETE FROM measure_aggregated_seconds
+USING users u, sensors s
+WHERE sensor = s.sensor_seq
+	AND s.user_id = u.user_id
+	AND "timestamp" < (now() - u.remove_data_after[1]);
+DELETE FROM measure_aggregated_minutes
+USING users u, sensors s
+WHERE sensor = s.sensor_seq
+	AND s.user_id = u.user_id
+	AND "timestamp" < (now() - u.remove_data_after[2]);
+DELETE FROM measure_aggregated_hours
+USING users u, sensors s
+WHERE sensor = s.sensor_seq
+	AND s.user_id = u.user_id
+	AND "timestamp" < (now() - u.remove_data_after[3]);
+DELETE FROM measure_aggregated_days
+USING users u, sensors s
+WHERE sensor = s.sensor_seq
+	AND s.user_id = u.user_id
+	AND "timestamp" < (now() - u.remove_data_after[4]);
+DELETE FROM measure_aggregated_weeks
+USING users u, sensors s
+WHERE sensor = s.sensor_seq
+	AND s.user_id = u.user_id
+	AND "timestamp" < (now() - u.remove_data_after[5]);
+DELETE FROM measure_aggregated_months
+USING users u, sensors s
+WHERE sensor = s.sensor_seq
+	AND s.user_id = u.user_id
+	AND "timestamp" < (now() - u.remove_data_after[6]);
+DELETE FROM measure_aggregated_years
+USING users u, sensors s
+WHERE sensor = s.sensor_seq
+	AND s.user_id = u.user_id
+	AND "timestamp" < (now() - u.remove_data_after[7]);
+END;$$;
+
+DROP TABLE measure_tables;
+
+
+ALTER TABLE measure_aggregated_seconds RENAME TO measure_aggregated_seconds_partitioned;
+CREATE TABLE measure_aggregated_seconds AS SELECT * FROM measure_aggregated_seconds_partitioned;
+DROP TABLE measure_aggregated_seconds_partitioned;
+ALTER TABLE measure_aggregated_seconds ALTER COLUMN "timestamp" SET NOT NULL, ALTER COLUMN sensor SET NOT NULL;
+ALTER TABLE ONLY measure_aggregated_seconds
+    ADD CONSTRAINT seconds_pk PRIMARY KEY ("timestamp", sensor);
+ALTER TABLE ONLY measure_aggregated_seconds
+    ADD CONSTRAINT sensor_fk FOREIGN KEY (sensor) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED;
+
+
+ALTER TABLE measure_aggregated_minutes RENAME TO measure_aggregated_minutes_partitioned;
+CREATE TABLE measure_aggregated_minutes AS SELECT * FROM measure_aggregated_minutes_partitioned;
+DROP TABLE measure_aggregated_minutes_partitioned;
+ALTER TABLE measure_aggregated_minutes ALTER COLUMN "timestamp" SET NOT NULL, ALTER COLUMN sensor SET NOT NULL;
+ALTER TABLE ONLY measure_aggregated_minutes
+    ADD CONSTRAINT minutes_pk PRIMARY KEY ("timestamp", sensor);
+ALTER TABLE ONLY measure_aggregated_minutes
+    ADD CONSTRAINT sensor_fk FOREIGN KEY (sensor) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED;
+
+
+ALTER TABLE measure_aggregated_hours RENAME TO measure_aggregated_hours_partitioned;
+CREATE TABLE measure_aggregated_hours AS SELECT * FROM measure_aggregated_hours_partitioned;
+DROP TABLE measure_aggregated_hours_partitioned;
+ALTER TABLE measure_aggregated_hours ALTER COLUMN "timestamp" SET NOT NULL, ALTER COLUMN sensor SET NOT NULL;
+ALTER TABLE ONLY measure_aggregated_hours
+    ADD CONSTRAINT hours_pk PRIMARY KEY ("timestamp", sensor);
+ALTER TABLE ONLY measure_aggregated_hours
+    ADD CONSTRAINT sensor_fk FOREIGN KEY (sensor) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED;
+
+
+ALTER TABLE measure_aggregated_days RENAME TO measure_aggregated_days_partitioned;
+CREATE TABLE measure_aggregated_days AS SELECT * FROM measure_aggregated_days_partitioned;
+DROP TABLE measure_aggregated_days_partitioned;
+ALTER TABLE measure_aggregated_days ALTER COLUMN "timestamp" SET NOT NULL, ALTER COLUMN sensor SET NOT NULL;
+ALTER TABLE ONLY measure_aggregated_days
+    ADD CONSTRAINT days_pk PRIMARY KEY ("timestamp", sensor);
+ALTER TABLE ONLY measure_aggregated_days
+    ADD CONSTRAINT sensor_fk FOREIGN KEY (sensor) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED;
@@ -0,0 +1,212 @@
+--
+-- Partitions the aggregated measurement tables of seconds, minutes, hours and days by time.
+--
+-- Partitions are created ahead of time and dropped after their retention by do_manage_partitions, which msgdbd
+-- runs periodically. Values outside of all partitions go to the default partition of each table, which also holds
+-- all values stored before this migration. Creating a partition moves the values in its range out of the default
+-- partition.
+--
+-- measure_raw is drained by every aggregation run and stays unpartitioned. The aggregated tables of weeks, months
+-- and years hold few values per sensor and stay unpartitioned as well, old values are still deleted row by row.
+--
+
+SET search_path = public, pg_catalog;
+
+
+--
+-- Name: measure_tables; Type: TABLE; Schema: public; Owner: -
+--
+-- resolution is the index of the table in users.remove_data_after.
+-- Tables with a partition_unit (day, week, month or year) are partitioned by that unit, with premake partitions
+-- created ahead of the current one.
+-- retention caps the retention of all users for the table, values are kept as long as users want if it is null.
+--
+
+CREATE TABLE measure_tables (
+    table_name character varying NOT NULL,
+    resolution integer NOT NULL,
+    partition_unit character varying,
+    premake integer DEFAULT 0 NOT NULL,
+    retention interval,
+    CONSTRAINT measure_tables_unit_check CHECK (partition_unit IN ('day', 'week', 'month', 'year'))
+);
+
+ALTER TABLE ONLY measure_tables
+    ADD CONSTRAINT measure_tables_pk PRIMARY KEY (table_name);
+
+INSERT INTO measure_tables (table_name, resolution, partition_unit, premake) VALUES
+    ('measure_aggregated_seconds', 1, 'day', 3),
+    ('measure_aggregated_minutes', 2, 'week', 2),
+    ('measure_aggregated_hours', 3, 'month', 2),
+    ('measure_aggregated_days', 4, 'year', 1),
+    ('measure_aggregated_weeks', 5, NULL, 0),
+    ('measure_aggregated_months', 6, NULL, 0),
+    ('measure_aggregated_years', 7, NULL, 0);
+
+
+--
+-- Name: measure_aggregated_seconds; Type: TABLE; Schema: public; Owner: -
+--
+
+ALTER TABLE measure_aggregated_seconds DROP CONSTRAINT sensor_fk;
+ALTER TABLE measure_aggregated_seconds RENAME CONSTRAINT seconds_pk TO measure_aggregated_seconds_default_pk;
+ALTER TABLE measure_aggregated_seconds RENAME TO measure_aggregated_seconds_default;
+
+CREATE TABLE measure_aggregated_seconds (
+    "timestamp" timestamp with time zone NOT NULL,
+    sum double precision,
+    count bigint,
+    sensor bigint NOT NULL,
+    "precision" integer,
+    CONSTRAINT seconds_pk PRIMARY KEY ("timestamp", sensor),
+    CONSTRAINT sensor_fk FOREIGN KEY (sensor) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED
+)
+PARTITION BY RANGE ("timestamp");
+
+ALTER TABLE measure_aggregated_seconds ATTACH PARTITION measure_aggregated_seconds_default DEFAULT;
+
+
+--
+-- Name: measure_aggregated_minutes; Type: TABLE; Schema: public; Owner: -
+--
+
+ALTER TABLE measure_aggregated_minutes DROP CONSTRAINT sensor_fk;
+ALTER TABLE measure_aggregated_minutes RENAME CONSTRAINT minutes_pk TO measure_aggregated_minutes_default_pk;
+ALTER TABLE measure_aggregated_minutes RENAME TO measure_aggregated_minutes_default;
+
+CREATE TABLE measure_aggregated_minutes (
+    "timestamp" timestamp with time zone NOT NULL,
+    sum double precision,
+    count bigint,
+    sensor bigint NOT NULL,
+    "precision" integer,
+    CONSTRAINT minutes_pk PRIMARY KEY ("timestamp", sensor),
+    CONSTRAINT sensor_fk FOREIGN KEY (sensor) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED
+)
+PARTITION BY RANGE ("timestamp");
+
+ALTER TABLE measure_aggregated_minutes ATTACH PARTITION measure_aggregated_minutes_default DEFAULT;
+
+
+--
+-- Name: measure_aggregated_hours; Type: TABLE; Schema: public; Owner: -
+--
+
+ALTER TABLE measure_aggregated_hours DROP CONSTRAINT sensor_fk;
+ALTER TABLE measure_aggregated_hours RENAME CONSTRAINT hours_pk TO measure_aggregated_hours_default_pk;
+ALTER TABLE measure_aggregated_hours RENAME TO measure_aggregated_hours_default;
+
+CREATE TABLE measure_aggregated_hours (
+    "timestamp" timestamp with time zone NOT NULL,
+    sum double precision,
+    count bigint,
+    sensor bigint NOT NULL,
+    "precision" integer,
+    CONSTRAINT hours_pk PRIMARY KEY ("timestamp", sensor),
+    CONSTRAINT sensor_fk FOREIGN KEY (sensor) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED
+)
+PARTITION BY RANGE ("timestamp");
+
+ALTER TABLE measure_aggregated_hours ATTACH PARTITION measure_aggregated_hours_default DEFAULT;
+
+
+--
+-- Name: measure_aggregated_days; Type: TABLE; Schema: public; Owner: -
+--
+
+ALTER TABLE measure_aggregated_days DROP CONSTRAINT sensor_fk;
+ALTER TABLE measure_aggregated_days RENAME CONSTRAINT days_pk TO measure_aggregated_days_default_pk;
+ALTER TABLE measure_aggregated_days RENAME TO measure_aggregated_days_default;
+
+CREATE TABLE measure_aggregated_days (
+    "timestamp" timestamp with time zone NOT NULL,
+    sum double precision,
+    count bigint,
+    sensor bigint NOT NULL,
+    "precision" integer,
+    CONSTRAINT days_pk PRIMARY KEY ("timestamp", sensor),
+    CONSTRAINT sensor_fk FOREIGN KEY (sensor) REFERENCES sensors(sensor_seq) ON UPDATE RESTRICT ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED
+)
+PARTITION BY RANGE ("timestamp");
+
+ALTER TABLE measure_aggregated_days ATTACH PARTITION measure_aggregated_days_default DEFAULT;
+
+
+--
+-- Name: do_manage_partitions(); Type: FUNCTION; Schema: public; Owner: -
+--
+-- Partition bounds are computed in UTC, so they do not depend on the time zone of the session running msgdbd.
+--
+
+CREATE FUNCTION do_manage_partitions() RETURNS void
+    LANGUAGE plpgsql
+    SET timezone = 'UTC'
+    AS $$
+DECLARE
+	t record;
+	part record;
+	span interval;
+	lo timestamp with time zone;
+	keep interval;
+	part_name text;
+BEGIN
+FOR t IN SELECT * FROM measure_tables WHERE partition_unit IS NOT NULL LOOP
+	span := ('1 ' || t.partition_unit)::interval;
+
+	FOR i IN 0..t.premake LOOP
+		lo := date_trunc(t.partition_unit, now()) + i * span;
+		part_name := t.table_name || '_p' || to_char(lo, 'YYYYMMDD');
+		CONTINUE WHEN to_regclass(part_name) IS NOT NULL;
+
+		EXECUTE format('CREATE TABLE %I (LIKE %I INCLUDING DEFAULTS)', part_name, t.table_name);
+		EXECUTE format('WITH moved AS (DELETE FROM %I WHERE "timestamp" >= $1 AND "timestamp" < $2 RETURNING *)
+			INSERT INTO %I SELECT * FROM moved', t.table_name || '_default', part_name) USING lo, lo + span;
+		EXECUTE format('ALTER TABLE %I ATTACH PARTITION %I FOR VALUES FROM (%L) TO (%L)',
+			t.table_name, part_name, lo, lo + span);
+	END LOOP;
+
+	-- values are kept as long as the user with the longest retention wants, but no longer than the table retention
+	SELECT least(t.retention,
+			CASE WHEN bool_or(u.remove_data_after[t.resolution] IS NULL) THEN NULL
+			ELSE max(u.remove_data_after[t.resolution]) END)
+	INTO keep
+	FROM users u;
+	CONTINUE WHEN keep IS NULL;
+
+	FOR part IN
+		SELECT c.relname,
+			substring(pg_get_expr(c.relpartbound, c.oid) FROM 'TO \(''([^'']+)''\)')::timestamp with time zone AS upper
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = t.table_name::regclass
+	LOOP
+		IF part.upper IS NOT NULL AND part.upper <= now() - keep THEN
+			EXECUTE format('DROP TABLE %I', part.relname);
+		END IF;
+	END LOOP;
+END LOOP;
+END;$$;
+
+
+--
+-- Name: do_remove_old_values(); Type: FUNCTION; Schema: public; Owner: -
+--
+-- Removes the values of users with a shorter retention than the partitions of their values, and all values of
+-- unpartitioned tables and default partitions past their retention.
+--
+
+CREATE OR REPLACE FUNCTION do_remove_old_values() RETURNS void
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+	t record;
+BEGIN
+FOR t IN SELECT * FROM measure_tables LOOP
+	EXECUTE format('DELETE FROM %I m
+		USING users u, sensors s
+		WHERE m.sensor = s.sensor_seq
+			AND s.user_id = u.user_id
+			AND m."timestamp" < (now() - least(u.remove_data_after[$1], $2))', t.table_name)
+	USING t.resolution, t.retention;
+END LOOP;
+END;$$;
@@ -0,0 +1,109 @@
+--
+-- Removes the tracking of values written by msgpd instances with durability mode "wal".
+--
+
+SET search_path = public, pg_catalog;
+
+CREATE OR REPLACE FUNCTION do_aggregate() RETURNS bigint
+    LANGUAGE sql
+    AS $$
+with updates as (
+	delete from measure_raw
+	returning
+		sensor,
+		"timestamp",
+		value
+
+), do_update_s as (
+	insert into measure_aggregated_seconds as m
+	select
+		date_trunc('second', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		1
+	from updates
+	group by
+		ts,
+		sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_m as (
+	insert into measure_aggregated_minutes as m
+	select
+		date_trunc('minute', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		2
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_h as (
+	insert into measure_aggregated_hours as m
+	select
+		date_trunc('hour', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		3
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_d as (
+	insert into measure_aggregated_days as m
+	select
+		date_trunc('day', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		4
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_w as (
+	insert into measure_aggregated_weeks as m
+	select
+		date_trunc('week', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		5
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_mo as (
+	insert into measure_aggregated_months as m
+	select
+		date_trunc('months', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		6
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_y as (
+	insert into measure_aggregated_years as m
+	select
+		date_trunc('year', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		7
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+	returning 1
+)
+
+select count(*) from do_update_y;$$;
+
+DROP TABLE raw_log_markers;
+DROP TABLE raw_log_instances;
@@ -0,0 +1,148 @@
+--
+-- Keeps track of the values lost from measure_raw in postgres crashes, for msgpd instances that log values before
+-- writing them (durability mode "wal").
+--
+-- Every aggregation run records its snapshot for each instance, all values written in transactions visible in the
+-- snapshot were aggregated. Crash recovery truncates the unlogged raw_log_markers, which stops the snapshot of an
+-- instance until the instance has replayed the values it wrote after the snapshot and added its marker again.
+--
+
+SET search_path = public, pg_catalog;
+
+
+--
+-- Name: raw_log_instances; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE raw_log_instances (
+    instance_id character varying NOT NULL,
+    snapshot txid_snapshot NOT NULL
+);
+
+ALTER TABLE ONLY raw_log_instances
+    ADD CONSTRAINT raw_log_instances_pk PRIMARY KEY (instance_id);
+
+
+--
+-- Name: raw_log_markers; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE UNLOGGED TABLE raw_log_markers (
+    instance_id character varying NOT NULL
+);
+
+ALTER TABLE ONLY raw_log_markers
+    ADD CONSTRAINT raw_log_markers_pk PRIMARY KEY (instance_id);
+
+
+--
+-- Name: do_aggregate(); Type: FUNCTION; Schema: public; Owner: -
+--
+-- The snapshot is taken before values are removed from measure_raw, so every transaction visible in it is visible
+-- to the removal as well.
+--
+
+CREATE OR REPLACE FUNCTION do_aggregate() RETURNS bigint
+    LANGUAGE sql
+    AS $$
+update raw_log_instances i
+set snapshot = txid_current_snapshot()
+where exists (select 1 from raw_log_markers m where m.instance_id = i.instance_id);
+
+with updates as (
+	delete from measure_raw
+	returning
+		sensor,
+		"timestamp",
+		value
+
+), do_update_s as (
+	insert into measure_aggregated_seconds as m
+	select
+		date_trunc('second', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		1
+	from updates
+	group by
+		ts,
+		sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_m as (
+	insert into measure_aggregated_minutes as m
+	select
+		date_trunc('minute', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		2
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_h as (
+	insert into measure_aggregated_hours as m
+	select
+		date_trunc('hour', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		3
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_d as (
+	insert into measure_aggregated_days as m
+	select
+		date_trunc('day', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		4
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_w as (
+	insert into measure_aggregated_weeks as m
+	select
+		date_trunc('week', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		5
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_mo as (
+	insert into measure_aggregated_months as m
+	select
+		date_trunc('months', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		6
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_y as (
+	insert into measure_aggregated_years as m
+	select
+		date_trunc('year', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		7
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+	returning 1
+)
+
+select count(*) from do_update_y;$$;
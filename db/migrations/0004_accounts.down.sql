@@ -0,0 +1,11 @@
+--
+-- Removes email addresses and password resets.
+--
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE password_resets;
+
+DROP INDEX users_email_idx;
+
+ALTER TABLE users DROP COLUMN email;
@@ -0,0 +1,28 @@
+--
+-- Adds email addresses to users and the tokens of password resets mailed to them.
+--
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE users ADD COLUMN email character varying;
+
+CREATE UNIQUE INDEX users_email_idx ON users (lower(email));
+
+
+--
+-- Name: password_resets; Type: TABLE; Schema: public; Owner: -
+--
+-- Only the sha256 hash of a token is stored, the token itself is only known to the mail recipient.
+--
+
+CREATE TABLE password_resets (
+    token_hash bytea NOT NULL,
+    user_id character varying NOT NULL,
+    expires timestamp with time zone NOT NULL
+);
+
+ALTER TABLE ONLY password_resets
+    ADD CONSTRAINT password_resets_pk PRIMARY KEY (token_hash);
+
+ALTER TABLE ONLY password_resets
+    ADD CONSTRAINT password_resets_user_fk FOREIGN KEY (user_id) REFERENCES users(user_id) ON UPDATE RESTRICT ON DELETE CASCADE;
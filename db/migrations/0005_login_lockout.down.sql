@@ -0,0 +1,9 @@
+--
+-- Removes the tracking of failed logins.
+--
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE users DROP COLUMN locked_until;
+
+ALTER TABLE users DROP COLUMN failed_logins;
@@ -0,0 +1,11 @@
+--
+-- Tracks failed logins of users to lock accounts after repeated failures.
+--
+-- failed_logins counts the failed logins since the last successful one, logins are refused until locked_until.
+--
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE users ADD COLUMN failed_logins integer DEFAULT 0 NOT NULL;
+
+ALTER TABLE users ADD COLUMN locked_until timestamp with time zone;
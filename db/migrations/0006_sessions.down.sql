@@ -0,0 +1,7 @@
+--
+-- Removes the server side storage of sessions.
+--
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE sessions;
@@ -0,0 +1,33 @@
+--
+-- Stores the login sessions of users, so sessions can be listed, expired and revoked on the server.
+--
+
+SET search_path = public, pg_catalog;
+
+
+--
+-- Name: sessions; Type: TABLE; Schema: public; Owner: -
+--
+-- Only the sha256 hash of the session token is stored, the token itself is only known to the session cookie.
+--
+
+CREATE TABLE sessions (
+    session_id bigserial NOT NULL,
+    token_hash bytea NOT NULL,
+    user_id character varying NOT NULL,
+    created timestamp with time zone DEFAULT now() NOT NULL,
+    last_seen timestamp with time zone DEFAULT now() NOT NULL,
+    address character varying NOT NULL,
+    user_agent character varying NOT NULL
+);
+
+ALTER TABLE ONLY sessions
+    ADD CONSTRAINT sessions_pk PRIMARY KEY (session_id);
+
+ALTER TABLE ONLY sessions
+    ADD CONSTRAINT sessions_token_key UNIQUE (token_hash);
+
+CREATE INDEX sessions_user_idx ON sessions USING btree (user_id);
+
+ALTER TABLE ONLY sessions
+    ADD CONSTRAINT sessions_user_fk FOREIGN KEY (user_id) REFERENCES users(user_id) ON UPDATE RESTRICT ON DELETE CASCADE;
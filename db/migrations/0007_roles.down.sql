@@ -0,0 +1,18 @@
+--
+-- Restores the admin flag of users from the admin role and removes all roles.
+--
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE users ADD COLUMN is_admin boolean DEFAULT false NOT NULL;
+
+UPDATE users SET is_admin = true
+WHERE user_id IN (SELECT user_id FROM user_roles WHERE role_id = 'admin');
+
+ALTER TABLE users ALTER COLUMN is_admin DROP DEFAULT;
+
+DROP TABLE user_roles;
+
+DROP TABLE role_permissions;
+
+DROP TABLE roles;
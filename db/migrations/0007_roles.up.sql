@@ -0,0 +1,96 @@
+--
+-- Replaces the admin flag of users by roles granting permissions.
+--
+-- Users with the admin flag get the admin role, which holds all permissions.
+--
+
+SET search_path = public, pg_catalog;
+
+
+--
+-- Name: roles; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE roles (
+    role_id character varying NOT NULL,
+    description character varying DEFAULT '' NOT NULL
+);
+
+ALTER TABLE ONLY roles
+    ADD CONSTRAINT roles_pk PRIMARY KEY (role_id);
+
+
+--
+-- Name: role_permissions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE role_permissions (
+    role_id character varying NOT NULL,
+    permission character varying NOT NULL
+);
+
+ALTER TABLE ONLY role_permissions
+    ADD CONSTRAINT role_permissions_pk PRIMARY KEY (role_id, permission);
+
+ALTER TABLE ONLY role_permissions
+    ADD CONSTRAINT role_permissions_role_fk FOREIGN KEY (role_id) REFERENCES roles(role_id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: user_roles; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE user_roles (
+    user_id character varying NOT NULL,
+    role_id character varying NOT NULL
+);
+
+ALTER TABLE ONLY user_roles
+    ADD CONSTRAINT user_roles_pk PRIMARY KEY (user_id, role_id);
+
+CREATE INDEX user_roles_role_idx ON user_roles USING btree (role_id);
+
+ALTER TABLE ONLY user_roles
+    ADD CONSTRAINT user_roles_user_fk FOREIGN KEY (user_id) REFERENCES users(user_id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+ALTER TABLE ONLY user_roles
+    ADD CONSTRAINT user_roles_role_fk FOREIGN KEY (role_id) REFERENCES roles(role_id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+INSERT INTO roles (role_id, description) VALUES
+    ('admin', 'Full access'),
+    ('support', 'Helps users with their accounts and devices'),
+    ('installer', 'Registers and installs devices'),
+    ('operator', 'Operates the platform'),
+    ('auditor', 'Read-only access to all accounts and settings');
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT 'admin', p FROM unnest(ARRAY[
+    'users.read', 'users.write', 'users.data',
+    'devices.read', 'devices.write', 'devices.keys',
+    'groups.read', 'groups.write',
+    'registry.read', 'registry.write',
+    'validation.read', 'validation.write',
+    'roles.read', 'roles.write']) p;
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT 'support', p FROM unnest(ARRAY[
+    'users.read', 'users.write', 'users.data', 'devices.read', 'groups.read', 'registry.read']) p;
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT 'installer', p FROM unnest(ARRAY[
+    'devices.read', 'devices.keys', 'registry.read', 'registry.write']) p;
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT 'operator', p FROM unnest(ARRAY[
+    'users.read', 'devices.read', 'devices.write', 'groups.read', 'groups.write',
+    'registry.read', 'registry.write', 'validation.read', 'validation.write']) p;
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT 'auditor', p FROM unnest(ARRAY[
+    'users.read', 'devices.read', 'groups.read', 'registry.read', 'validation.read', 'roles.read']) p;
+
+INSERT INTO user_roles (user_id, role_id)
+SELECT user_id, 'admin' FROM users WHERE is_admin;
+
+ALTER TABLE users DROP COLUMN is_admin;
@@ -0,0 +1,7 @@
+--
+-- Removes the disabling of user accounts.
+--
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE users DROP COLUMN disabled;
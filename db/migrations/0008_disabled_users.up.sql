@@ -0,0 +1,7 @@
+--
+-- Allows administrators to disable user accounts. Disabled users cannot log in.
+--
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE users ADD COLUMN disabled boolean DEFAULT false NOT NULL;
@@ -0,0 +1,7 @@
+--
+-- Removes pending device transfers.
+--
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE device_transfers;
@@ -0,0 +1,36 @@
+--
+-- Stores pending transfers of devices between users, which are carried out once both users accepted them.
+--
+
+SET search_path = public, pg_catalog;
+
+
+--
+-- Name: device_transfers; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE device_transfers (
+    transfer_id bigserial NOT NULL,
+    device_id character varying NOT NULL,
+    from_user character varying NOT NULL,
+    to_user character varying NOT NULL,
+    with_history boolean DEFAULT false NOT NULL,
+    from_accepted boolean DEFAULT false NOT NULL,
+    to_accepted boolean DEFAULT false NOT NULL,
+    created timestamp with time zone DEFAULT now() NOT NULL,
+    expires timestamp with time zone NOT NULL
+);
+
+ALTER TABLE ONLY device_transfers
+    ADD CONSTRAINT device_transfers_pk PRIMARY KEY (transfer_id);
+
+ALTER TABLE ONLY device_transfers
+    ADD CONSTRAINT device_transfers_device_key UNIQUE (device_id, from_user);
+
+CREATE INDEX device_transfers_to_user_idx ON device_transfers USING btree (to_user);
+
+ALTER TABLE ONLY device_transfers
+    ADD CONSTRAINT device_transfers_device_fk FOREIGN KEY (device_id, from_user) REFERENCES devices(device_id, user_id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+ALTER TABLE ONLY device_transfers
+    ADD CONSTRAINT device_transfers_to_user_fk FOREIGN KEY (to_user) REFERENCES users(user_id) ON UPDATE RESTRICT ON DELETE CASCADE;
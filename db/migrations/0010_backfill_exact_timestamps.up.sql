@@ -0,0 +1,125 @@
+--
+-- Deduplicates backfilled readings by their exact timestamp instead of their second, so readings less than a second
+-- apart are all stored. Seconds already aggregated are still skipped, the timestamps of their readings are not known.
+--
+
+SET LOCAL search_path = public, pg_catalog;
+
+
+--
+-- Name: do_backfill(bigint, double precision[], double precision[]); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE OR REPLACE FUNCTION do_backfill(bigint, double precision[], double precision[]) RETURNS bigint
+    LANGUAGE sql
+    AS $$
+with input as (
+	select distinct on (to_timestamp(t.ts))
+		to_timestamp(t.ts) as "timestamp",
+		t.value
+	from unnest($2, $3) as t(ts, value)
+	order by to_timestamp(t.ts)
+), updates as (
+	select
+		$1 as sensor,
+		i."timestamp",
+		i.value
+	from input i, sensors s, users u
+	where s.sensor_seq = $1
+		and u.user_id = s.user_id
+		and (u.remove_data_after[1] is null or i."timestamp" >= now() - u.remove_data_after[1])
+		and not exists (
+			select 1 from measure_aggregated_seconds m
+			where m.sensor = $1 and m."timestamp" = date_trunc('second', i."timestamp"))
+		and not exists (
+			select 1 from measure_raw r
+			where r.sensor = $1 and r."timestamp" = i."timestamp")
+), do_update_s as (
+	insert into measure_aggregated_seconds as m
+	select
+		date_trunc('second', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		1
+	from updates
+	group by
+		ts,
+		sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_m as (
+	insert into measure_aggregated_minutes as m
+	select
+		date_trunc('minute', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		2
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_h as (
+	insert into measure_aggregated_hours as m
+	select
+		date_trunc('hour', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		3
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_d as (
+	insert into measure_aggregated_days as m
+	select
+		date_trunc('day', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		4
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_w as (
+	insert into measure_aggregated_weeks as m
+	select
+		date_trunc('week', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		5
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_mo as (
+	insert into measure_aggregated_months as m
+	select
+		date_trunc('months', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		6
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_y as (
+	insert into measure_aggregated_years as m
+	select
+		date_trunc('year', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		7
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+)
+
+select count(*) from updates;$$;
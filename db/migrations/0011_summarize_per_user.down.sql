@@ -0,0 +1,114 @@
+--
+-- Restores do_summarize summarizing all users from hourly averages.
+--
+
+SET LOCAL search_path = public, pg_catalog;
+
+DROP FUNCTION do_summarize(timestamp with time zone, character varying);
+
+
+--
+-- Name: do_summarize(timestamp with time zone); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION do_summarize(timestamp with time zone) RETURNS void
+    LANGUAGE sql
+    AS $$
+with hours as (
+	select
+		h."timestamp",
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		s.sensor_id,
+		s.unit,
+		h.sum / h.count * coalesce(c.factor, s.factor) as value
+	from measure_aggregated_hours h
+	join sensors s on s.sensor_seq = h.sensor
+	left join lateral (select c.factor from sensor_calibrations c
+		where c.sensor_seq = h.sensor and c.valid_from <= h."timestamp"
+		order by c.valid_from desc limit 1) c on true
+	where h."timestamp" >= date_trunc('day', $1) and h.count > 0 and s.unit in ('W', 'Wh', 'kWh')
+), minutes as (
+	select
+		m."timestamp",
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		m.sum / m.count * coalesce(c.factor, s.factor) as power
+	from measure_aggregated_minutes m
+	join sensors s on s.sensor_seq = m.sensor
+	left join lateral (select c.factor from sensor_calibrations c
+		where c.sensor_seq = m.sensor and c.valid_from <= m."timestamp"
+		order by c.valid_from desc limit 1) c on true
+	where m."timestamp" >= date_trunc('day', $1) and m.count > 0 and s.unit = 'W'
+), sensor_days as (
+	select
+		date_trunc('day', "timestamp")::date as day,
+		sensor_seq,
+		user_id,
+		device_id,
+		sensor_id,
+		-- power sensors are integrated over their hourly averages, meters report their difference
+		case unit
+			when 'W' then sum(value)
+			when 'Wh' then max(value) - min(value)
+			else (max(value) - min(value)) * 1000
+		end as energy
+	from hours
+	group by day, sensor_seq, user_id, device_id, sensor_id, unit
+), sensor_peaks as (
+	select date_trunc('day', "timestamp")::date as day, sensor_seq, max(power) as peak
+	from minutes
+	group by day, sensor_seq
+), device_peaks as (
+	select day, user_id, device_id, max(power) as peak
+	from (
+		select date_trunc('day', "timestamp")::date as day, user_id, device_id, sum(power) as power
+		from minutes
+		group by "timestamp", user_id, device_id
+	) p
+	group by day, user_id, device_id
+), user_peaks as (
+	select day, user_id, max(power) as peak
+	from (
+		select date_trunc('day', "timestamp")::date as day, user_id, sum(power) as power
+		from minutes
+		group by "timestamp", user_id
+	) p
+	group by day, user_id
+), days as (
+	select d.day, d.user_id, d.device_id, d.sensor_id, d.energy, p.peak
+	from sensor_days d
+	left join sensor_peaks p on p.day = d.day and p.sensor_seq = d.sensor_seq
+	union all
+	select d.day, d.user_id, d.device_id, '', sum(d.energy), max(p.peak)
+	from sensor_days d
+	left join device_peaks p on p.day = d.day and p.user_id = d.user_id and p.device_id = d.device_id
+	group by d.day, d.user_id, d.device_id
+	union all
+	select d.day, d.user_id, '', '', sum(d.energy), max(p.peak)
+	from sensor_days d
+	left join user_peaks p on p.day = d.day and p.user_id = d.user_id
+	group by d.day, d.user_id
+)
+insert into consumption_daily as c
+select * from days
+on conflict (day, user_id, device_id, sensor_id) do update
+set energy = excluded.energy, peak = excluded.peak;
+
+insert into consumption_summaries as c
+select p.period, d.user_id, d.device_id, d.sensor_id, sum(d.energy), max(d.peak), now()
+from consumption_daily d
+join (values
+	('today', date_trunc('day', now())),
+	('week', date_trunc('week', now())),
+	('month', date_trunc('month', now())),
+	('year', date_trunc('year', now()))
+) p(period, start) on d.day >= p.start::date
+group by p.period, d.user_id, d.device_id, d.sensor_id
+on conflict (period, user_id, device_id, sensor_id) do update
+set energy = excluded.energy, peak = excluded.peak, updated = excluded.updated;
+
+delete from consumption_summaries where updated < now();
+$$;
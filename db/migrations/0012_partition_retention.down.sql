@@ -0,0 +1,92 @@
+--
+-- Restores unlimited default retentions of the partitioned measurement tables.
+--
+
+SET LOCAL search_path = public, pg_catalog;
+
+UPDATE measure_tables SET retention = NULL
+WHERE table_name IN ('measure_aggregated_seconds', 'measure_aggregated_minutes', 'measure_aggregated_hours',
+    'measure_aggregated_days');
+
+
+--
+-- Name: do_manage_partitions(); Type: FUNCTION; Schema: public; Owner: -
+--
+-- Partition bounds are computed in UTC, so they do not depend on the time zone of the session running msgdbd.
+--
+
+CREATE OR REPLACE FUNCTION do_manage_partitions() RETURNS void
+    LANGUAGE plpgsql
+    SET timezone = 'UTC'
+    AS $$
+DECLARE
+	t record;
+	part record;
+	span interval;
+	lo timestamp with time zone;
+	keep interval;
+	part_name text;
+BEGIN
+FOR t IN SELECT * FROM measure_tables WHERE partition_unit IS NOT NULL LOOP
+	span := ('1 ' || t.partition_unit)::interval;
+
+	FOR i IN 0..t.premake LOOP
+		lo := date_trunc(t.partition_unit, now()) + i * span;
+		part_name := t.table_name || '_p' || to_char(lo, 'YYYYMMDD');
+		CONTINUE WHEN to_regclass(part_name) IS NOT NULL;
+
+		EXECUTE format('CREATE TABLE %I (LIKE %I INCLUDING DEFAULTS)', part_name, t.table_name);
+		EXECUTE format('WITH moved AS (DELETE FROM %I WHERE "timestamp" >= $1 AND "timestamp" < $2 RETURNING *)
+			INSERT INTO %I SELECT * FROM moved', t.table_name || '_default', part_name) USING lo, lo + span;
+		EXECUTE format('ALTER TABLE %I ATTACH PARTITION %I FOR VALUES FROM (%L) TO (%L)',
+			t.table_name, part_name, lo, lo + span);
+	END LOOP;
+
+	-- values are kept as long as the user with the longest retention wants, but no longer than the table retention
+	SELECT least(t.retention,
+			CASE WHEN bool_or(u.remove_data_after[t.resolution] IS NULL) THEN NULL
+			ELSE max(u.remove_data_after[t.resolution]) END)
+	INTO keep
+	FROM users u;
+	CONTINUE WHEN keep IS NULL;
+
+	FOR part IN
+		SELECT c.relname,
+			substring(pg_get_expr(c.relpartbound, c.oid) FROM 'TO \(''([^'']+)''\)')::timestamp with time zone AS upper
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = t.table_name::regclass
+	LOOP
+		IF part.upper IS NOT NULL AND part.upper <= now() - keep THEN
+			EXECUTE format('DROP TABLE %I', part.relname);
+		END IF;
+	END LOOP;
+END LOOP;
+END;$$;
+
+
+--
+-- Name: do_remove_old_values(); Type: FUNCTION; Schema: public; Owner: -
+--
+-- Removes the values of users with a shorter retention than the partitions of their values, and all values of
+-- unpartitioned tables and default partitions past their retention.
+--
+
+CREATE OR REPLACE FUNCTION do_remove_old_values() RETURNS void
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+	t record;
+BEGIN
+FOR t IN SELECT * FROM measure_tables LOOP
+	EXECUTE format('DELETE FROM %I m
+		USING users u, sensors s
+		WHERE m.sensor = s.sensor_seq
+			AND s.user_id = u.user_id
+			AND m."timestamp" < (now() - least(u.remove_data_after[$1], $2))', t.table_name)
+	USING t.resolution, t.retention;
+END LOOP;
+END;$$;
+
+
+DROP FUNCTION measure_table_keep(measure_tables);
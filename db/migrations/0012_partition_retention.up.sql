@@ -0,0 +1,119 @@
+--
+-- Caps the retention of the partitioned measurement tables, so partitions are dropped even if users keep their
+-- values forever, and stops do_remove_old_values from deleting values row by row in partitions that are dropped.
+-- Operators may raise the retentions in measure_tables, or set them to null to keep values as long as users want.
+--
+
+SET LOCAL search_path = public, pg_catalog;
+
+UPDATE measure_tables SET retention = v.retention
+FROM (VALUES
+    ('measure_aggregated_seconds', interval '7 days'),
+    ('measure_aggregated_minutes', interval '3 months'),
+    ('measure_aggregated_hours', interval '2 years'),
+    ('measure_aggregated_days', interval '10 years')
+) v(table_name, retention)
+WHERE measure_tables.table_name = v.table_name AND measure_tables.retention IS NULL;
+
+
+--
+-- Name: measure_table_keep(measure_tables); Type: FUNCTION; Schema: public; Owner: -
+--
+-- Values are kept as long as the user with the longest retention wants, but no longer than the table retention.
+-- Users without a retention keep their values for the table retention.
+--
+
+CREATE FUNCTION measure_table_keep(measure_tables) RETURNS interval
+    LANGUAGE sql STABLE
+    AS $$
+SELECT least($1.retention,
+		CASE WHEN bool_or(u.remove_data_after[$1.resolution] IS NULL) THEN NULL
+		ELSE max(u.remove_data_after[$1.resolution]) END)
+FROM users u;
+$$;
+
+
+--
+-- Name: do_manage_partitions(); Type: FUNCTION; Schema: public; Owner: -
+--
+-- Partition bounds are computed in UTC, so they do not depend on the time zone of the session running msgdbd.
+--
+
+CREATE OR REPLACE FUNCTION do_manage_partitions() RETURNS void
+    LANGUAGE plpgsql
+    SET timezone = 'UTC'
+    AS $$
+DECLARE
+	t measure_tables;
+	part record;
+	span interval;
+	lo timestamp with time zone;
+	keep interval;
+	part_name text;
+BEGIN
+FOR t IN SELECT * FROM measure_tables WHERE partition_unit IS NOT NULL LOOP
+	span := ('1 ' || t.partition_unit)::interval;
+
+	FOR i IN 0..t.premake LOOP
+		lo := date_trunc(t.partition_unit, now()) + i * span;
+		part_name := t.table_name || '_p' || to_char(lo, 'YYYYMMDD');
+		CONTINUE WHEN to_regclass(part_name) IS NOT NULL;
+
+		EXECUTE format('CREATE TABLE %I (LIKE %I INCLUDING DEFAULTS)', part_name, t.table_name);
+		EXECUTE format('WITH moved AS (DELETE FROM %I WHERE "timestamp" >= $1 AND "timestamp" < $2 RETURNING *)
+			INSERT INTO %I SELECT * FROM moved', t.table_name || '_default', part_name) USING lo, lo + span;
+		EXECUTE format('ALTER TABLE %I ATTACH PARTITION %I FOR VALUES FROM (%L) TO (%L)',
+			t.table_name, part_name, lo, lo + span);
+	END LOOP;
+
+	keep := measure_table_keep(t);
+	CONTINUE WHEN keep IS NULL;
+
+	FOR part IN
+		SELECT c.relname,
+			substring(pg_get_expr(c.relpartbound, c.oid) FROM 'TO \(''([^'']+)''\)')::timestamp with time zone AS upper
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = t.table_name::regclass
+	LOOP
+		IF part.upper IS NOT NULL AND part.upper <= now() - keep THEN
+			EXECUTE format('DROP TABLE %I', part.relname);
+		END IF;
+	END LOOP;
+END LOOP;
+END;$$;
+
+
+--
+-- Name: do_remove_old_values(); Type: FUNCTION; Schema: public; Owner: -
+--
+-- Removes the values of users with a shorter retention than the partitions of their values, and all values of
+-- unpartitioned tables and default partitions past their retention. Values in partitions dropped by
+-- do_manage_partitions are left to it.
+--
+
+CREATE OR REPLACE FUNCTION do_remove_old_values() RETURNS void
+    LANGUAGE plpgsql
+    SET timezone = 'UTC'
+    AS $$
+DECLARE
+	t measure_tables;
+	keep interval;
+	remove text := 'DELETE FROM %I m
+		USING users u, sensors s
+		WHERE m.sensor = s.sensor_seq
+			AND s.user_id = u.user_id
+			AND m."timestamp" < (now() - least(u.remove_data_after[$1], $2))';
+BEGIN
+FOR t IN SELECT * FROM measure_tables LOOP
+	keep := measure_table_keep(t);
+	IF t.partition_unit IS NULL OR keep IS NULL THEN
+		EXECUTE format(remove, t.table_name) USING t.resolution, t.retention;
+		CONTINUE;
+	END IF;
+
+	EXECUTE format(remove || ' AND m."timestamp" >= $3', t.table_name)
+	USING t.resolution, t.retention, date_trunc(t.partition_unit, now() - keep);
+	EXECUTE format(remove, t.table_name || '_default') USING t.resolution, t.retention;
+END LOOP;
+END;$$;
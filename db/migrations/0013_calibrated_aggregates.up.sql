@@ -0,0 +1,463 @@
+--
+-- Stores aggregated values with the correction factor valid at the time of each value applied, instead of applying
+-- the factor valid at the start of a bucket when reading it. Buckets spanning a calibration change are then
+-- corrected value by value. Existing aggregates are scaled with the factor they were read with so far.
+--
+-- do_aggregate and do_backfill hold advisory lock 1836278625 shared while they apply factors, Sensor.Calibrate
+-- holds it exclusively while it checks that no values after the start of the new calibration were aggregated yet.
+--
+
+SET LOCAL search_path = public, pg_catalog;
+
+CREATE TEMPORARY TABLE scaled_sensors ON COMMIT DROP AS
+SELECT sensor_seq FROM sensors WHERE factor <> 1
+UNION
+SELECT sensor_seq FROM sensor_calibrations WHERE factor <> 1;
+
+UPDATE measure_aggregated_seconds m
+SET sum = m.sum * coalesce((SELECT c.factor FROM sensor_calibrations c
+		WHERE c.sensor_seq = m.sensor AND c.valid_from <= m."timestamp"
+		ORDER BY c.valid_from DESC LIMIT 1), s.factor)
+FROM sensors s
+WHERE s.sensor_seq = m.sensor AND m.sensor IN (SELECT sensor_seq FROM scaled_sensors);
+
+UPDATE measure_aggregated_minutes m
+SET sum = m.sum * coalesce((SELECT c.factor FROM sensor_calibrations c
+		WHERE c.sensor_seq = m.sensor AND c.valid_from <= m."timestamp"
+		ORDER BY c.valid_from DESC LIMIT 1), s.factor)
+FROM sensors s
+WHERE s.sensor_seq = m.sensor AND m.sensor IN (SELECT sensor_seq FROM scaled_sensors);
+
+UPDATE measure_aggregated_hours m
+SET sum = m.sum * coalesce((SELECT c.factor FROM sensor_calibrations c
+		WHERE c.sensor_seq = m.sensor AND c.valid_from <= m."timestamp"
+		ORDER BY c.valid_from DESC LIMIT 1), s.factor)
+FROM sensors s
+WHERE s.sensor_seq = m.sensor AND m.sensor IN (SELECT sensor_seq FROM scaled_sensors);
+
+UPDATE measure_aggregated_days m
+SET sum = m.sum * coalesce((SELECT c.factor FROM sensor_calibrations c
+		WHERE c.sensor_seq = m.sensor AND c.valid_from <= m."timestamp"
+		ORDER BY c.valid_from DESC LIMIT 1), s.factor)
+FROM sensors s
+WHERE s.sensor_seq = m.sensor AND m.sensor IN (SELECT sensor_seq FROM scaled_sensors);
+
+UPDATE measure_aggregated_weeks m
+SET sum = m.sum * coalesce((SELECT c.factor FROM sensor_calibrations c
+		WHERE c.sensor_seq = m.sensor AND c.valid_from <= m."timestamp"
+		ORDER BY c.valid_from DESC LIMIT 1), s.factor)
+FROM sensors s
+WHERE s.sensor_seq = m.sensor AND m.sensor IN (SELECT sensor_seq FROM scaled_sensors);
+
+UPDATE measure_aggregated_months m
+SET sum = m.sum * coalesce((SELECT c.factor FROM sensor_calibrations c
+		WHERE c.sensor_seq = m.sensor AND c.valid_from <= m."timestamp"
+		ORDER BY c.valid_from DESC LIMIT 1), s.factor)
+FROM sensors s
+WHERE s.sensor_seq = m.sensor AND m.sensor IN (SELECT sensor_seq FROM scaled_sensors);
+
+UPDATE measure_aggregated_years m
+SET sum = m.sum * coalesce((SELECT c.factor FROM sensor_calibrations c
+		WHERE c.sensor_seq = m.sensor AND c.valid_from <= m."timestamp"
+		ORDER BY c.valid_from DESC LIMIT 1), s.factor)
+FROM sensors s
+WHERE s.sensor_seq = m.sensor AND m.sensor IN (SELECT sensor_seq FROM scaled_sensors);
+
+
+--
+-- Name: do_aggregate(); Type: FUNCTION; Schema: public; Owner: -
+--
+-- The snapshot is taken before values are removed from measure_raw, so every transaction visible in it is visible
+-- to the removal as well.
+--
+
+CREATE OR REPLACE FUNCTION do_aggregate() RETURNS bigint
+    LANGUAGE sql
+    AS $$
+select pg_advisory_xact_lock_shared(1836278625);
+
+update raw_log_instances i
+set snapshot = txid_current_snapshot()
+where exists (select 1 from raw_log_markers m where m.instance_id = i.instance_id);
+
+with removed as (
+	delete from measure_raw
+	returning
+		sensor,
+		"timestamp",
+		value
+), calibrations as (
+	select
+		c.sensor_seq,
+		c.factor,
+		c.valid_from,
+		coalesce(lead(c.valid_from) over (partition by c.sensor_seq order by c.valid_from), 'infinity') as valid_until
+	from sensor_calibrations c
+	where c.sensor_seq in (select distinct sensor from removed)
+), updates as (
+	select
+		r.sensor,
+		r."timestamp",
+		r.value * coalesce(c.factor, s.factor, 1) as value
+	from removed r
+	left join sensors s on s.sensor_seq = r.sensor
+	left join calibrations c on c.sensor_seq = r.sensor
+		and r."timestamp" >= c.valid_from and r."timestamp" < c.valid_until
+), do_update_s as (
+	insert into measure_aggregated_seconds as m
+	select
+		date_trunc('second', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		1
+	from updates
+	group by
+		ts,
+		sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_m as (
+	insert into measure_aggregated_minutes as m
+	select
+		date_trunc('minute', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		2
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_h as (
+	insert into measure_aggregated_hours as m
+	select
+		date_trunc('hour', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		3
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_d as (
+	insert into measure_aggregated_days as m
+	select
+		date_trunc('day', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		4
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_w as (
+	insert into measure_aggregated_weeks as m
+	select
+		date_trunc('week', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		5
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_mo as (
+	insert into measure_aggregated_months as m
+	select
+		date_trunc('months', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		6
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_y as (
+	insert into measure_aggregated_years as m
+	select
+		date_trunc('year', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		7
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+	returning 1
+)
+
+select count(*) from do_update_y;$$;
+
+
+--
+-- Name: do_backfill(bigint, double precision[], double precision[]); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE OR REPLACE FUNCTION do_backfill(bigint, double precision[], double precision[]) RETURNS bigint
+    LANGUAGE sql
+    AS $$
+select pg_advisory_xact_lock_shared(1836278625);
+
+with input as (
+	select distinct on (to_timestamp(t.ts))
+		to_timestamp(t.ts) as "timestamp",
+		t.value
+	from unnest($2, $3) as t(ts, value)
+	order by to_timestamp(t.ts)
+), calibrations as (
+	select
+		c.factor,
+		c.valid_from,
+		coalesce(lead(c.valid_from) over (order by c.valid_from), 'infinity') as valid_until
+	from sensor_calibrations c
+	where c.sensor_seq = $1
+), updates as (
+	select
+		$1 as sensor,
+		i."timestamp",
+		i.value * coalesce(c.factor, s.factor, 1) as value
+	from input i
+	join sensors s on s.sensor_seq = $1
+	join users u on u.user_id = s.user_id
+	left join calibrations c on i."timestamp" >= c.valid_from and i."timestamp" < c.valid_until
+	where (u.remove_data_after[1] is null or i."timestamp" >= now() - u.remove_data_after[1])
+		and not exists (
+			select 1 from measure_aggregated_seconds m
+			where m.sensor = $1 and m."timestamp" = date_trunc('second', i."timestamp"))
+		and not exists (
+			select 1 from measure_raw r
+			where r.sensor = $1 and r."timestamp" = i."timestamp")
+), do_update_s as (
+	insert into measure_aggregated_seconds as m
+	select
+		date_trunc('second', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		1
+	from updates
+	group by
+		ts,
+		sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_m as (
+	insert into measure_aggregated_minutes as m
+	select
+		date_trunc('minute', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		2
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_h as (
+	insert into measure_aggregated_hours as m
+	select
+		date_trunc('hour', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		3
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_d as (
+	insert into measure_aggregated_days as m
+	select
+		date_trunc('day', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		4
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_w as (
+	insert into measure_aggregated_weeks as m
+	select
+		date_trunc('week', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		5
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_mo as (
+	insert into measure_aggregated_months as m
+	select
+		date_trunc('months', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		6
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+), do_update_y as (
+	insert into measure_aggregated_years as m
+	select
+		date_trunc('year', "timestamp") as ts,
+		sum(value) as sum,
+		count(value) as count,
+		sensor,
+		7
+	from updates
+	group by ts, sensor
+	on conflict ("timestamp", sensor) do update
+	set sum = m.sum + excluded.sum, count = m.count + excluded.count
+)
+
+select count(*) from updates;$$;
+
+
+--
+-- Name: do_summarize(timestamp with time zone, character varying); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE OR REPLACE FUNCTION do_summarize(timestamp with time zone, character varying DEFAULT NULL) RETURNS void
+    LANGUAGE sql
+    AS $$
+with hours as (
+	select
+		h."timestamp",
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		s.sensor_id,
+		h.sum / h.count as value
+	from measure_aggregated_hours h
+	join sensors s on s.sensor_seq = h.sensor
+	where h."timestamp" >= date_trunc('day', $1) and h.count > 0 and s.unit = 'W'
+		and ($2 is null or s.user_id = $2)
+), meters as (
+	-- the last minute of every day with readings, starting with the day before the first summarized day
+	select distinct on (m.sensor, date_trunc('day', m."timestamp"))
+		date_trunc('day', m."timestamp")::date as day,
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		s.sensor_id,
+		m.sum / m.count * case s.unit when 'kWh' then 1000 else 1 end as value
+	from measure_aggregated_minutes m
+	join sensors s on s.sensor_seq = m.sensor
+	where m."timestamp" >= date_trunc('day', $1) - interval '1 day' and m.count > 0 and s.unit in ('Wh', 'kWh')
+		and ($2 is null or s.user_id = $2)
+	order by m.sensor, date_trunc('day', m."timestamp"), m."timestamp" desc
+), meter_firsts as (
+	-- the first minute of every day, for days without readings on an earlier day
+	select distinct on (m.sensor, date_trunc('day', m."timestamp"))
+		date_trunc('day', m."timestamp")::date as day,
+		m.sensor as sensor_seq,
+		m.sum / m.count * case s.unit when 'kWh' then 1000 else 1 end as value
+	from measure_aggregated_minutes m
+	join sensors s on s.sensor_seq = m.sensor
+	where m."timestamp" >= date_trunc('day', $1) - interval '1 day' and m.count > 0 and s.unit in ('Wh', 'kWh')
+		and ($2 is null or s.user_id = $2)
+	order by m.sensor, date_trunc('day', m."timestamp"), m."timestamp"
+), minutes as (
+	select
+		m."timestamp",
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		m.sum / m.count as power
+	from measure_aggregated_minutes m
+	join sensors s on s.sensor_seq = m.sensor
+	where m."timestamp" >= date_trunc('day', $1) and m.count > 0 and s.unit = 'W'
+		and ($2 is null or s.user_id = $2)
+), sensor_days as (
+	-- power sensors are integrated over their hourly averages
+	select
+		date_trunc('day', "timestamp")::date as day,
+		sensor_seq,
+		user_id,
+		device_id,
+		sensor_id,
+		sum(value) as energy
+	from hours
+	group by day, sensor_seq, user_id, device_id, sensor_id
+	union all
+	-- meters report the difference of their last readings of the day and the previous day with readings
+	select day, sensor_seq, user_id, device_id, sensor_id, energy
+	from (
+		select
+			m.day,
+			m.sensor_seq,
+			m.user_id,
+			m.device_id,
+			m.sensor_id,
+			m.value - coalesce(lag(m.value) over (partition by m.sensor_seq order by m.day), f.value) as energy
+		from meters m
+		join meter_firsts f on f.sensor_seq = m.sensor_seq and f.day = m.day
+	) d
+	where day >= date_trunc('day', $1)::date
+), sensor_peaks as (
+	select date_trunc('day', "timestamp")::date as day, sensor_seq, max(power) as peak
+	from minutes
+	group by day, sensor_seq
+), device_peaks as (
+	select day, user_id, device_id, max(power) as peak
+	from (
+		select date_trunc('day', "timestamp")::date as day, user_id, device_id, sum(power) as power
+		from minutes
+		group by "timestamp", user_id, device_id
+	) p
+	group by day, user_id, device_id
+), user_peaks as (
+	select day, user_id, max(power) as peak
+	from (
+		select date_trunc('day', "timestamp")::date as day, user_id, sum(power) as power
+		from minutes
+		group by "timestamp", user_id
+	) p
+	group by day, user_id
+), days as (
+	select d.day, d.user_id, d.device_id, d.sensor_id, d.energy, p.peak
+	from sensor_days d
+	left join sensor_peaks p on p.day = d.day and p.sensor_seq = d.sensor_seq
+	union all
+	select d.day, d.user_id, d.device_id, '', sum(d.energy), max(p.peak)
+	from sensor_days d
+	left join device_peaks p on p.day = d.day and p.user_id = d.user_id and p.device_id = d.device_id
+	group by d.day, d.user_id, d.device_id
+	union all
+	select d.day, d.user_id, '', '', sum(d.energy), max(p.peak)
+	from sensor_days d
+	left join user_peaks p on p.day = d.day and p.user_id = d.user_id
+	group by d.day, d.user_id
+)
+insert into consumption_daily as c
+select * from days
+on conflict (day, user_id, device_id, sensor_id) do update
+set energy = excluded.energy, peak = excluded.peak;
+
+insert into consumption_summaries as c
+select p.period, d.user_id, d.device_id, d.sensor_id, sum(d.energy), max(d.peak), now()
+from consumption_daily d
+join (values
+	('today', date_trunc('day', now())),
+	('week', date_trunc('week', now())),
+	('month', date_trunc('month', now())),
+	('year', date_trunc('year', now()))
+) p(period, start) on d.day >= p.start::date
+where $2 is null or d.user_id = $2
+group by p.period, d.user_id, d.device_id, d.sensor_id
+on conflict (period, user_id, device_id, sensor_id) do update
+set energy = excluded.energy, peak = excluded.peak, updated = excluded.updated;
+
+delete from consumption_summaries where updated < now() and ($2 is null or user_id = $2);
+$$;
@@ -0,0 +1,147 @@
+--
+-- Restores do_summarize summarizing values with the current unit of their sensor.
+--
+
+SET LOCAL search_path = public, pg_catalog;
+
+DROP FUNCTION do_summarize_backlog();
+DROP TABLE summary_backlog;
+
+
+--
+-- Name: do_summarize(timestamp with time zone, character varying); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE OR REPLACE FUNCTION do_summarize(timestamp with time zone, character varying DEFAULT NULL) RETURNS void
+    LANGUAGE sql
+    AS $$
+with hours as (
+	select
+		h."timestamp",
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		s.sensor_id,
+		h.sum / h.count as value
+	from measure_aggregated_hours h
+	join sensors s on s.sensor_seq = h.sensor
+	where h."timestamp" >= date_trunc('day', $1) and h.count > 0 and s.unit = 'W'
+		and ($2 is null or s.user_id = $2)
+), meters as (
+	-- the last minute of every day with readings, starting with the day before the first summarized day
+	select distinct on (m.sensor, date_trunc('day', m."timestamp"))
+		date_trunc('day', m."timestamp")::date as day,
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		s.sensor_id,
+		m.sum / m.count * case s.unit when 'kWh' then 1000 else 1 end as value
+	from measure_aggregated_minutes m
+	join sensors s on s.sensor_seq = m.sensor
+	where m."timestamp" >= date_trunc('day', $1) - interval '1 day' and m.count > 0 and s.unit in ('Wh', 'kWh')
+		and ($2 is null or s.user_id = $2)
+	order by m.sensor, date_trunc('day', m."timestamp"), m."timestamp" desc
+), meter_firsts as (
+	-- the first minute of every day, for days without readings on an earlier day
+	select distinct on (m.sensor, date_trunc('day', m."timestamp"))
+		date_trunc('day', m."timestamp")::date as day,
+		m.sensor as sensor_seq,
+		m.sum / m.count * case s.unit when 'kWh' then 1000 else 1 end as value
+	from measure_aggregated_minutes m
+	join sensors s on s.sensor_seq = m.sensor
+	where m."timestamp" >= date_trunc('day', $1) - interval '1 day' and m.count > 0 and s.unit in ('Wh', 'kWh')
+		and ($2 is null or s.user_id = $2)
+	order by m.sensor, date_trunc('day', m."timestamp"), m."timestamp"
+), minutes as (
+	select
+		m."timestamp",
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		m.sum / m.count as power
+	from measure_aggregated_minutes m
+	join sensors s on s.sensor_seq = m.sensor
+	where m."timestamp" >= date_trunc('day', $1) and m.count > 0 and s.unit = 'W'
+		and ($2 is null or s.user_id = $2)
+), sensor_days as (
+	-- power sensors are integrated over their hourly averages
+	select
+		date_trunc('day', "timestamp")::date as day,
+		sensor_seq,
+		user_id,
+		device_id,
+		sensor_id,
+		sum(value) as energy
+	from hours
+	group by day, sensor_seq, user_id, device_id, sensor_id
+	union all
+	-- meters report the difference of their last readings of the day and the previous day with readings
+	select day, sensor_seq, user_id, device_id, sensor_id, energy
+	from (
+		select
+			m.day,
+			m.sensor_seq,
+			m.user_id,
+			m.device_id,
+			m.sensor_id,
+			m.value - coalesce(lag(m.value) over (partition by m.sensor_seq order by m.day), f.value) as energy
+		from meters m
+		join meter_firsts f on f.sensor_seq = m.sensor_seq and f.day = m.day
+	) d
+	where day >= date_trunc('day', $1)::date
+), sensor_peaks as (
+	select date_trunc('day', "timestamp")::date as day, sensor_seq, max(power) as peak
+	from minutes
+	group by day, sensor_seq
+), device_peaks as (
+	select day, user_id, device_id, max(power) as peak
+	from (
+		select date_trunc('day', "timestamp")::date as day, user_id, device_id, sum(power) as power
+		from minutes
+		group by "timestamp", user_id, device_id
+	) p
+	group by day, user_id, device_id
+), user_peaks as (
+	select day, user_id, max(power) as peak
+	from (
+		select date_trunc('day', "timestamp")::date as day, user_id, sum(power) as power
+		from minutes
+		group by "timestamp", user_id
+	) p
+	group by day, user_id
+), days as (
+	select d.day, d.user_id, d.device_id, d.sensor_id, d.energy, p.peak
+	from sensor_days d
+	left join sensor_peaks p on p.day = d.day and p.sensor_seq = d.sensor_seq
+	union all
+	select d.day, d.user_id, d.device_id, '', sum(d.energy), max(p.peak)
+	from sensor_days d
+	left join device_peaks p on p.day = d.day and p.user_id = d.user_id and p.device_id = d.device_id
+	group by d.day, d.user_id, d.device_id
+	union all
+	select d.day, d.user_id, '', '', sum(d.energy), max(p.peak)
+	from sensor_days d
+	left join user_peaks p on p.day = d.day and p.user_id = d.user_id
+	group by d.day, d.user_id
+)
+insert into consumption_daily as c
+select * from days
+on conflict (day, user_id, device_id, sensor_id) do update
+set energy = excluded.energy, peak = excluded.peak;
+
+insert into consumption_summaries as c
+select p.period, d.user_id, d.device_id, d.sensor_id, sum(d.energy), max(d.peak), now()
+from consumption_daily d
+join (values
+	('today', date_trunc('day', now())),
+	('week', date_trunc('week', now())),
+	('month', date_trunc('month', now())),
+	('year', date_trunc('year', now()))
+) p(period, start) on d.day >= p.start::date
+where $2 is null or d.user_id = $2
+group by p.period, d.user_id, d.device_id, d.sensor_id
+on conflict (period, user_id, device_id, sensor_id) do update
+set energy = excluded.energy, peak = excluded.peak, updated = excluded.updated;
+
+delete from consumption_summaries where updated < now() and ($2 is null or user_id = $2);
+$$;
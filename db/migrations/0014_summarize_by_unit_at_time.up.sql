@@ -0,0 +1,188 @@
+--
+-- Summarizes values with the unit valid at their time, so sensors changing between power and energy units are
+-- summarized correctly before and after the change. Days backfilled by devices are queued in summary_backlog and
+-- summarized by msgdbd with do_summarize_backlog, instead of within the transaction storing the values.
+--
+
+SET LOCAL search_path = public, pg_catalog;
+
+
+--
+-- Name: summary_backlog; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE summary_backlog (
+    user_id character varying NOT NULL,
+    since timestamp with time zone NOT NULL
+);
+
+ALTER TABLE ONLY summary_backlog
+    ADD CONSTRAINT summary_backlog_pk PRIMARY KEY (user_id);
+
+ALTER TABLE ONLY summary_backlog
+    ADD CONSTRAINT summary_backlog_user_fk FOREIGN KEY (user_id) REFERENCES users(user_id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+--
+-- Name: do_summarize(timestamp with time zone, character varying); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE OR REPLACE FUNCTION do_summarize(timestamp with time zone, character varying DEFAULT NULL) RETURNS void
+    LANGUAGE sql
+    AS $$
+with calibrations as (
+	-- the time ranges of the units of all sensors summarized
+	select
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		s.sensor_id,
+		coalesce(c.unit, s.unit) as unit,
+		coalesce(c.valid_from, '-infinity') as valid_from,
+		coalesce(lead(c.valid_from) over (partition by s.sensor_seq order by c.valid_from), 'infinity') as valid_until
+	from sensors s
+	left join sensor_calibrations c on c.sensor_seq = s.sensor_seq
+	where $2 is null or s.user_id = $2
+), hours as (
+	select
+		h."timestamp",
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		s.sensor_id,
+		h.sum / h.count as value
+	from measure_aggregated_hours h
+	join calibrations s on s.sensor_seq = h.sensor and h."timestamp" >= s.valid_from and h."timestamp" < s.valid_until
+	where h."timestamp" >= date_trunc('day', $1) and h.count > 0 and s.unit = 'W'
+), meters as (
+	-- the last minute of every day with readings, starting with the day before the first summarized day
+	select distinct on (m.sensor, date_trunc('day', m."timestamp"))
+		date_trunc('day', m."timestamp")::date as day,
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		s.sensor_id,
+		m.sum / m.count * case s.unit when 'kWh' then 1000 else 1 end as value
+	from measure_aggregated_minutes m
+	join calibrations s on s.sensor_seq = m.sensor and m."timestamp" >= s.valid_from and m."timestamp" < s.valid_until
+	where m."timestamp" >= date_trunc('day', $1) - interval '1 day' and m.count > 0 and s.unit in ('Wh', 'kWh')
+	order by m.sensor, date_trunc('day', m."timestamp"), m."timestamp" desc
+), meter_firsts as (
+	-- the first minute of every day, for days without readings on an earlier day
+	select distinct on (m.sensor, date_trunc('day', m."timestamp"))
+		date_trunc('day', m."timestamp")::date as day,
+		m.sensor as sensor_seq,
+		m.sum / m.count * case s.unit when 'kWh' then 1000 else 1 end as value
+	from measure_aggregated_minutes m
+	join calibrations s on s.sensor_seq = m.sensor and m."timestamp" >= s.valid_from and m."timestamp" < s.valid_until
+	where m."timestamp" >= date_trunc('day', $1) - interval '1 day' and m.count > 0 and s.unit in ('Wh', 'kWh')
+	order by m.sensor, date_trunc('day', m."timestamp"), m."timestamp"
+), minutes as (
+	select
+		m."timestamp",
+		s.sensor_seq,
+		s.user_id,
+		s.device_id,
+		m.sum / m.count as power
+	from measure_aggregated_minutes m
+	join calibrations s on s.sensor_seq = m.sensor and m."timestamp" >= s.valid_from and m."timestamp" < s.valid_until
+	where m."timestamp" >= date_trunc('day', $1) and m.count > 0 and s.unit = 'W'
+), sensor_days as (
+	-- power sensors are integrated over their hourly averages
+	select
+		date_trunc('day', "timestamp")::date as day,
+		sensor_seq,
+		user_id,
+		device_id,
+		sensor_id,
+		sum(value) as energy
+	from hours
+	group by day, sensor_seq, user_id, device_id, sensor_id
+	union all
+	-- meters report the difference of their last readings of the day and the previous day with readings
+	select day, sensor_seq, user_id, device_id, sensor_id, energy
+	from (
+		select
+			m.day,
+			m.sensor_seq,
+			m.user_id,
+			m.device_id,
+			m.sensor_id,
+			m.value - coalesce(lag(m.value) over (partition by m.sensor_seq order by m.day), f.value) as energy
+		from meters m
+		join meter_firsts f on f.sensor_seq = m.sensor_seq and f.day = m.day
+	) d
+	where day >= date_trunc('day', $1)::date
+), sensor_peaks as (
+	select date_trunc('day', "timestamp")::date as day, sensor_seq, max(power) as peak
+	from minutes
+	group by day, sensor_seq
+), device_peaks as (
+	select day, user_id, device_id, max(power) as peak
+	from (
+		select date_trunc('day', "timestamp")::date as day, user_id, device_id, sum(power) as power
+		from minutes
+		group by "timestamp", user_id, device_id
+	) p
+	group by day, user_id, device_id
+), user_peaks as (
+	select day, user_id, max(power) as peak
+	from (
+		select date_trunc('day', "timestamp")::date as day, user_id, sum(power) as power
+		from minutes
+		group by "timestamp", user_id
+	) p
+	group by day, user_id
+), days as (
+	select d.day, d.user_id, d.device_id, d.sensor_id, d.energy, p.peak
+	from sensor_days d
+	left join sensor_peaks p on p.day = d.day and p.sensor_seq = d.sensor_seq
+	union all
+	select d.day, d.user_id, d.device_id, '', sum(d.energy), max(p.peak)
+	from sensor_days d
+	left join device_peaks p on p.day = d.day and p.user_id = d.user_id and p.device_id = d.device_id
+	group by d.day, d.user_id, d.device_id
+	union all
+	select d.day, d.user_id, '', '', sum(d.energy), max(p.peak)
+	from sensor_days d
+	left join user_peaks p on p.day = d.day and p.user_id = d.user_id
+	group by d.day, d.user_id
+)
+insert into consumption_daily as c
+select * from days
+on conflict (day, user_id, device_id, sensor_id) do update
+set energy = excluded.energy, peak = excluded.peak;
+
+insert into consumption_summaries as c
+select p.period, d.user_id, d.device_id, d.sensor_id, sum(d.energy), max(d.peak), now()
+from consumption_daily d
+join (values
+	('today', date_trunc('day', now())),
+	('week', date_trunc('week', now())),
+	('month', date_trunc('month', now())),
+	('year', date_trunc('year', now()))
+) p(period, start) on d.day >= p.start::date
+where $2 is null or d.user_id = $2
+group by p.period, d.user_id, d.device_id, d.sensor_id
+on conflict (period, user_id, device_id, sensor_id) do update
+set energy = excluded.energy, peak = excluded.peak, updated = excluded.updated;
+
+delete from consumption_summaries where updated < now() and ($2 is null or user_id = $2);
+$$;
+
+
+--
+-- Name: do_summarize_backlog(); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION do_summarize_backlog() RETURNS void
+    LANGUAGE plpgsql
+    AS $$
+declare
+	r record;
+begin
+	for r in delete from summary_backlog returning user_id, since loop
+		perform do_summarize(r.since, r.user_id);
+	end loop;
+end
+$$;
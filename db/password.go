@@ -0,0 +1,119 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Password hashes are stored in the PHC string format, which encodes the scheme and its parameters along with the
+// salt, e.g. $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>. Hashes of users created before the format was introduced
+// are plain bcrypt hashes ($2a$...), which also encode their parameters. Hashes in any other scheme or with other
+// parameters than passwordParams are replaced on the next successful login.
+
+// argon2Params are the parameters of argon2id hashes.
+type argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	KeyLen  uint32
+}
+
+// passwordParams are the parameters new password hashes are created with.
+var passwordParams = argon2Params{Memory: 64 * 1024, Time: 3, Threads: 2, KeyLen: 32}
+
+const passwordSaltLen = 16
+
+var errBadPasswordHash = errors.New("unknown password hash format")
+
+var b64 = base64.RawStdEncoding
+
+// passwordSlots bounds the number of password hashes computed concurrently, each argon2 hash takes
+// passwordParams.Memory KiB.
+var passwordSlots = make(chan struct{}, runtime.NumCPU())
+
+// dummyHash is checked by CheckDummyPassword.
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// idKey computes an argon2id key, waiting for a free slot in passwordSlots.
+func idKey(pw string, salt []byte, p argon2Params) []byte {
+	passwordSlots <- struct{}{}
+	defer func() { <-passwordSlots }()
+
+	return argon2.IDKey([]byte(pw), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+}
+
+// CheckDummyPassword takes as long as checking the password of a user, so logins of unknown users cannot be told
+// apart from wrong passwords by their duration.
+func CheckDummyPassword(pw string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("")
+	})
+	checkPassword(dummyHash, pw)
+}
+
+func hashPassword(pw string) ([]byte, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	p := passwordParams
+	key := idKey(pw, salt, p)
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		b64.EncodeToString(salt), b64.EncodeToString(key))
+	return []byte(hash), nil
+}
+
+// checkPassword compares pw to a stored hash. upgrade is true if the hash should be replaced by a hash with the
+// current parameters.
+func checkPassword(hash []byte, pw string) (ok, upgrade bool, err error) {
+	if strings.HasPrefix(string(hash), "$2") {
+		passwordSlots <- struct{}{}
+		err := bcrypt.CompareHashAndPassword(hash, []byte(pw))
+		<-passwordSlots
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+		return err == nil, true, err
+	}
+
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return false, false, errBadPasswordHash
+	}
+
+	var version int
+	var p argon2Params
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, errBadPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return false, false, errBadPasswordHash
+	}
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return false, false, errBadPasswordHash
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, false, errBadPasswordHash
+	}
+	p.KeyLen = uint32(len(key))
+
+	computed := idKey(pw, salt, p)
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return false, false, nil
+	}
+	return true, p != passwordParams || len(salt) != passwordSaltLen, nil
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+// argon2Hash returns the PHC string of an argon2id hash of pw with the given parameters.
+func argon2Hash(pw string, salt []byte, p argon2Params) string {
+	key := idKey(pw, salt, p)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		b64.EncodeToString(salt), b64.EncodeToString(key))
+}
+
+func TestCheckPassword(t *testing.T) {
+	current, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := make([]byte, passwordSaltLen)
+	weak := argon2Hash("secret", salt, argon2Params{Memory: 1024, Time: 1, Threads: 1, KeyLen: 32})
+	shortSalt := argon2Hash("secret", salt[:8], passwordParams)
+
+	tests := []struct {
+		name    string
+		hash    string
+		pw      string
+		ok      bool
+		upgrade bool
+		err     error
+	}{
+		{"current", string(current), "secret", true, false, nil},
+		{"current wrong password", string(current), "wrong", false, false, nil},
+		{"bcrypt", string(bcrypted), "secret", true, true, nil},
+		{"bcrypt wrong password", string(bcrypted), "wrong", false, false, nil},
+		{"other parameters", weak, "secret", true, true, nil},
+		{"other parameters wrong password", weak, "wrong", false, false, nil},
+		{"short salt", shortSalt, "secret", true, true, nil},
+		{"other scheme", "$scrypt$ln=15,r=8,p=1$c2FsdA$aGFzaA", "secret", false, false, errBadPasswordHash},
+		{"other version", "$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$aGFzaA", "secret", false, false, errBadPasswordHash},
+		{"missing parameters", "$argon2id$v=19$m=1024$c2FsdA$aGFzaA", "secret", false, false, errBadPasswordHash},
+		{"bad salt", "$argon2id$v=19$m=1024,t=1,p=1$!!$aGFzaA", "secret", false, false, errBadPasswordHash},
+		{"empty key", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$", "secret", false, false, errBadPasswordHash},
+		{"empty", "", "secret", false, false, errBadPasswordHash},
+	}
+
+	for _, test := range tests {
+		ok, upgrade, err := checkPassword([]byte(test.hash), test.pw)
+		if ok != test.ok || upgrade != test.upgrade || err != test.err {
+			t.Errorf("%v: got %v %v %v, want %v %v %v", test.name, ok, upgrade, err, test.ok, test.upgrade, test.err)
+		}
+	}
+}
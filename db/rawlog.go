@@ -0,0 +1,433 @@
+package db
+
+import (
+	"bufio"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Durability modes of values between their arrival at msgpd and their aggregation.
+const (
+	// DurabilityUnlogged keeps measure_raw unlogged. Values in the buffer are lost if msgpd crashes, values not
+	// aggregated yet are lost if postgres crashes.
+	DurabilityUnlogged = "unlogged"
+	// DurabilityLogged makes measure_raw a logged table. Values written from the buffer survive postgres crashes,
+	// at the cost of writing every value to the write-ahead log of postgres as well. Values in the buffer are
+	// lost if msgpd crashes.
+	DurabilityLogged = "logged"
+	// DurabilityWAL keeps measure_raw unlogged and appends every value to a log on disk before buffering it.
+	// Values lost in a crash of msgpd or postgres are replayed into measure_raw by OpenDb. The log is synced to
+	// disk whenever the buffer is written, values of the last second may be lost if the machine running msgpd
+	// crashes.
+	DurabilityWAL = "wal"
+)
+
+// rawLogRecordSize is the size of a logged value: sensor, timestamp in unix nanoseconds and value.
+const rawLogRecordSize = 24
+
+// rawLogPruneInterval is the interval at which segments of aggregated values are removed.
+const rawLogPruneInterval = time.Minute
+
+const (
+	segmentOpen = iota
+	// segmentPending segments are being written by the transaction of the segment, it is unknown whether it
+	// committed.
+	segmentPending
+	// segmentFlushed segments were written by the committed transaction of the segment.
+	segmentFlushed
+)
+
+// rawLogSegment is a file holding the values of one buffer flush.
+// Its name is <seq>.log while values are appended, <seq>.pending-<txid> while the values are written in
+// transaction txid and <seq>.flushed-<txid> once the transaction committed.
+type rawLogSegment struct {
+	path  string
+	seq   uint64
+	state int
+	txid  int64
+}
+
+// rawLog is the log of values used with DurabilityWAL.
+type rawLog struct {
+	dir      string
+	instance string
+
+	seq       uint64
+	file      *os.File
+	w         *bufio.Writer
+	lastPrune time.Time
+}
+
+func openRawLog(dir string) (*rawLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// the instance id identifies the log in raw_log_instances, it must stay the same for the directory
+	idPath := filepath.Join(dir, "instance")
+	id, err := ioutil.ReadFile(idPath)
+	if os.IsNotExist(err) {
+		var buf [16]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return nil, err
+		}
+		id = []byte(hex.EncodeToString(buf[:]))
+		err = ioutil.WriteFile(idPath, id, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l := &rawLog{dir: dir, instance: strings.TrimSpace(string(id))}
+	segments, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range segments {
+		if s.seq >= l.seq {
+			l.seq = s.seq + 1
+		}
+	}
+	return l, nil
+}
+
+func (l *rawLog) segments() ([]rawLogSegment, error) {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []rawLogSegment
+	for _, f := range files {
+		parts := strings.SplitN(f.Name(), ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		seq, err := strconv.ParseUint(parts[0], 16, 64)
+		if err != nil {
+			continue
+		}
+
+		s := rawLogSegment{path: filepath.Join(l.dir, f.Name()), seq: seq}
+		switch {
+		case parts[1] == "log":
+			s.state = segmentOpen
+		case strings.HasPrefix(parts[1], "pending-"):
+			s.state = segmentPending
+			s.txid, err = strconv.ParseInt(strings.TrimPrefix(parts[1], "pending-"), 10, 64)
+		case strings.HasPrefix(parts[1], "flushed-"):
+			s.state = segmentFlushed
+			s.txid, err = strconv.ParseInt(strings.TrimPrefix(parts[1], "flushed-"), 10, 64)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad raw log segment %v", f.Name())
+		}
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].seq < result[j].seq })
+	return result, nil
+}
+
+func (l *rawLog) segmentPath(seq uint64, suffix string) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016x.%s", seq, suffix))
+}
+
+// append adds a value to the open segment, opening a new segment if none is open.
+func (l *rawLog) append(v bufferValue) error {
+	if l.file == nil {
+		file, err := os.OpenFile(l.segmentPath(l.seq, "log"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		l.file = file
+		l.w = bufio.NewWriter(file)
+		l.seq++
+	}
+
+	var record [rawLogRecordSize]byte
+	binary.LittleEndian.PutUint64(record[0:], v.key)
+	binary.LittleEndian.PutUint64(record[8:], uint64(v.value.Time.UnixNano()))
+	binary.LittleEndian.PutUint64(record[16:], math.Float64bits(v.value.Value))
+	_, err := l.w.Write(record[:])
+	return err
+}
+
+// seal syncs and closes the open segment and returns it. Values appended later go to a new segment.
+func (l *rawLog) seal() (rawLogSegment, error) {
+	if l.file == nil {
+		return rawLogSegment{}, nil
+	}
+
+	s := rawLogSegment{path: l.file.Name(), seq: l.seq - 1, state: segmentOpen}
+	err := l.w.Flush()
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file, l.w = nil, nil
+	return s, err
+}
+
+func (l *rawLog) rename(s *rawLogSegment, state int, txid int64) error {
+	suffix := fmt.Sprintf("flushed-%d", txid)
+	if state == segmentPending {
+		suffix = fmt.Sprintf("pending-%d", txid)
+	}
+	path := l.segmentPath(s.seq, suffix)
+	if err := os.Rename(s.path, path); err != nil {
+		return err
+	}
+	s.path, s.state, s.txid = path, state, txid
+
+	dir, err := os.Open(l.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// prepare marks segments as being written by tx. It must be called right before tx is committed, and commit
+// must be called after tx committed.
+func (l *rawLog) prepare(tx *sql.Tx, segments []*rawLogSegment) (int64, error) {
+	var txid int64
+	if err := tx.QueryRow(`SELECT txid_current()`).Scan(&txid); err != nil {
+		return 0, err
+	}
+	for _, s := range segments {
+		if err := l.rename(s, segmentPending, txid); err != nil {
+			return 0, err
+		}
+	}
+	return txid, nil
+}
+
+// commit marks segments prepared for a committed transaction as flushed.
+func (l *rawLog) commit(segments []*rawLogSegment) error {
+	for _, s := range segments {
+		if err := l.rename(s, segmentFlushed, s.txid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune removes flushed segments whose values were aggregated.
+func (l *rawLog) prune(sqldb *sql.DB) error {
+	if time.Since(l.lastPrune) < rawLogPruneInterval {
+		return nil
+	}
+	l.lastPrune = time.Now()
+
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+
+	var txids []int64
+	paths := make(map[int64][]string)
+	for _, s := range segments {
+		if s.state == segmentFlushed {
+			txids = append(txids, s.txid)
+			paths[s.txid] = append(paths[s.txid], s.path)
+		}
+	}
+	if len(txids) == 0 {
+		return nil
+	}
+
+	rows, err := sqldb.Query(`SELECT t FROM unnest($1::bigint[]) t, raw_log_instances i
+		WHERE i.instance_id = $2 AND txid_visible_in_snapshot(t, i.snapshot)`, pq.Array(txids), l.instance)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var txid int64
+		if err := rows.Scan(&txid); err != nil {
+			return err
+		}
+		for _, path := range paths[txid] {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// readRawLogSegment reads all complete records of a segment. An incomplete last record is a value that was being
+// appended in a crash, it was never buffered.
+// Timestamps are returned in the format pq uses for time.Time, postgres rounds them to microseconds exactly like
+// the values written from the buffer.
+func readRawLogSegment(path string) (sensors []int64, timestamps []string, values []float64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var record [rawLogRecordSize]byte
+	for {
+		if _, err := io.ReadFull(r, record[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+		ns := int64(binary.LittleEndian.Uint64(record[8:]))
+		sensors = append(sensors, int64(binary.LittleEndian.Uint64(record[0:])))
+		timestamps = append(timestamps, time.Unix(0, ns).UTC().Format(time.RFC3339Nano))
+		values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(record[16:])))
+	}
+	return sensors, timestamps, values, nil
+}
+
+// recover replays all values of the log that did not reach measure_raw, or were removed from it by the crash
+// recovery of postgres before they were aggregated, and returns their number.
+func (l *rawLog) recover(sqldb *sql.DB) (int, error) {
+	tx, err := sqldb.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO raw_log_instances(instance_id, snapshot) VALUES($1, txid_current_snapshot())
+		ON CONFLICT DO NOTHING`, l.instance)
+	if err != nil {
+		return 0, err
+	}
+
+	crashed, err := l.markerLost(tx)
+	if err != nil {
+		return 0, err
+	}
+	replay, count, err := l.replay(tx, crashed, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := l.prepare(tx, replay); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, l.commit(replay)
+}
+
+// recoverLost replays the values lost in a crash of postgres while msgpd kept running, within the transaction tx
+// flushing the given segments. It returns the replayed segments, which must be prepared and committed along with
+// the flushed ones. Without it, the snapshot of the instance would stay behind while later values are aggregated,
+// and those values would be replayed and counted twice on the next start.
+func (l *rawLog) recoverLost(tx *sql.Tx, flushing []*rawLogSegment) ([]*rawLogSegment, error) {
+	crashed, err := l.markerLost(tx)
+	if err != nil || !crashed {
+		return nil, err
+	}
+	replay, count, err := l.replay(tx, true, flushing)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("replayed %v values from the raw log after a crash of postgres", count)
+	return replay, nil
+}
+
+// markerLost returns true if the marker of the instance is missing, i.e. if postgres crashed since it was added.
+func (l *rawLog) markerLost(tx *sql.Tx) (bool, error) {
+	var lost bool
+	err := tx.QueryRow(`SELECT NOT EXISTS(SELECT 1 FROM raw_log_markers WHERE instance_id = $1)`, l.instance).Scan(&lost)
+	return lost, err
+}
+
+// replay writes the values of all segments but the flushing ones to measure_raw that are not known to be there or
+// to be aggregated, and adds the marker of the instance. Flushed segments are only replayed if postgres crashed.
+func (l *rawLog) replay(tx *sql.Tx, crashed bool, flushing []*rawLogSegment) ([]*rawLogSegment, int, error) {
+	segments, err := l.segments()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	skip := make(map[uint64]bool)
+	for _, s := range flushing {
+		skip[s.seq] = true
+	}
+
+	var replay []*rawLogSegment
+	for i := range segments {
+		s := &segments[i]
+		if skip[s.seq] {
+			continue
+		}
+		if s.state == segmentPending {
+			// transactions too old to be known have committed long ago, pending segments are renamed right
+			// before committing
+			var status sql.NullString
+			if err := tx.QueryRow(`SELECT txid_status($1)`, s.txid).Scan(&status); err != nil {
+				return nil, 0, err
+			}
+			if !status.Valid || status.String == "committed" {
+				s.state = segmentFlushed
+			}
+		}
+
+		if s.state == segmentFlushed {
+			if !crashed {
+				continue
+			}
+			var aggregated bool
+			err := tx.QueryRow(`SELECT txid_visible_in_snapshot($1, snapshot) FROM raw_log_instances WHERE instance_id = $2`,
+				s.txid, l.instance).Scan(&aggregated)
+			if err != nil {
+				return nil, 0, err
+			}
+			if aggregated {
+				continue
+			}
+		}
+		replay = append(replay, s)
+	}
+
+	count := 0
+	for _, s := range replay {
+		sensors, timestamps, values, err := readRawLogSegment(s.path)
+		if err != nil {
+			return nil, 0, err
+		}
+		count += len(sensors)
+
+		// values of sensors removed in the meantime are dropped
+		_, err = tx.Exec(`INSERT INTO measure_raw(sensor, "timestamp", value)
+			SELECT v.sensor, v.ts, v.value
+			FROM unnest($1::bigint[], $2::timestamptz[], $3::double precision[]) AS v(sensor, ts, value)
+			WHERE EXISTS (SELECT 1 FROM sensors s WHERE s.sensor_seq = v.sensor)`,
+			pq.Array(sensors), pq.Array(timestamps), pq.Array(values))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO raw_log_markers(instance_id) VALUES($1) ON CONFLICT DO NOTHING`, l.instance)
+	if err != nil {
+		return nil, 0, err
+	}
+	return replay, count, nil
+}
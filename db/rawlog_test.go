@@ -0,0 +1,108 @@
+package db
+
+import (
+	"github.com/mysmartgrid/msg2api"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRawLogSegment(t *testing.T) {
+	l, err := openRawLog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2016, 3, 1, 12, 0, 0, 123456789, time.UTC)
+	for i := 0; i < 3; i++ {
+		v := bufferValue{key: uint64(i + 1), value: msg2api.Measurement{Time: at.Add(time.Duration(i) * time.Second), Value: float64(i) / 3}}
+		if err := l.append(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := l.seal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a partially written record is dropped
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(make([]byte, rawLogRecordSize/2))
+	file.Close()
+
+	sensors, timestamps, values, err := readRawLogSegment(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sensors) != 3 || len(timestamps) != 3 || len(values) != 3 {
+		t.Fatalf("got %v records, want 3", len(sensors))
+	}
+	for i := range sensors {
+		ts, err := time.Parse(time.RFC3339Nano, timestamps[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sensors[i] != int64(i+1) || !ts.Equal(at.Add(time.Duration(i)*time.Second)) || values[i] != float64(i)/3 {
+			t.Errorf("record %v: got %v %v %v", i, sensors[i], timestamps[i], values[i])
+		}
+	}
+
+	l2, err := openRawLog(l.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l2.instance != l.instance || l2.seq != l.seq {
+		t.Errorf("reopened log has instance %v seq %v, want %v %v", l2.instance, l2.seq, l.instance, l.seq)
+	}
+}
+
+func BenchmarkRawLogAppend(b *testing.B) {
+	l, err := openRawLog(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	v := bufferValue{key: 1, value: msg2api.Measurement{Time: time.Now(), Value: 1}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := l.append(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	l.seal()
+}
+
+// BenchmarkRawLogSeal measures a buffer write of 1000 values: syncing the segment and marking it pending and
+// flushed.
+func BenchmarkRawLogSeal(b *testing.B) {
+	l, err := openRawLog(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	v := bufferValue{key: 1, value: msg2api.Measurement{Time: time.Now(), Value: 1}}
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < 1000; j++ {
+			if err := l.append(v); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+
+		s, err := l.seal()
+		if err == nil {
+			err = l.rename(&s, segmentPending, int64(i))
+		}
+		if err == nil {
+			err = l.rename(&s, segmentFlushed, int64(i))
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
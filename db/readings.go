@@ -0,0 +1,333 @@
+package db
+
+import (
+	"errors"
+	"github.com/mysmartgrid/msg2api"
+	"math"
+	"sort"
+	"time"
+)
+
+// Downsampling methods for ReadingOptions.Downsample.
+const (
+	// DownsampleResolution switches to coarser resolutions until the number of buckets in the requested timespan
+	// does not exceed MaxPoints.
+	DownsampleResolution = "resolution"
+	// DownsampleLTTB loads values in the requested resolution and reduces them to MaxPoints values per sensor
+	// using the Largest-Triangle-Three-Buckets algorithm.
+	DownsampleLTTB = "lttb"
+)
+
+// Gap fill strategies for ReadingOptions.Fill.
+const (
+	// FillNone leaves missing buckets out of the result.
+	FillNone = ""
+	// FillNull marks the first missing bucket of every gap. Markers are returned in ReadingOptions.Gaps instead of
+	// the values, so values stay numbers.
+	FillNull = "null"
+	// FillPrevious fills every missing bucket with the last value before the gap.
+	FillPrevious = "previous"
+	// FillLinear fills every missing bucket with a value interpolated between the values around the gap.
+	FillLinear = "linear"
+)
+
+const (
+	// maxProcessedValues limits the number of values of all sensors User.LoadReadings holds in memory while
+	// loading and post processing values with options.
+	maxProcessedValues = 1000000
+	// processedChunkSize is the number of values loaded at once for post processing.
+	processedChunkSize = 10000
+)
+
+var (
+	errBadDownsample = errors.New("unknown downsampling method")
+	errBadFill       = errors.New("unknown gap fill strategy")
+	errAutoMaxPoints = errors.New("resolution auto requires a point limit")
+	errFillRaw       = errors.New("gaps can only be filled for aggregated resolutions")
+	errTooManyValues = errors.New("too many values requested")
+)
+
+// ReadingOptions controls the post processing of values loaded by User.LoadReadings.
+// A nil *ReadingOptions loads the values exactly as they are stored.
+type ReadingOptions struct {
+	// MaxPoints limits the number of values returned per sensor, zero means no limit.
+	MaxPoints int
+	// Downsample selects how MaxPoints is enforced, DownsampleResolution is used if empty.
+	Downsample string
+	// Fill selects how missing buckets of aggregated resolutions are handled.
+	Fill string
+
+	// Resolution is set by User.LoadReadings to the resolution the values were loaded in.
+	Resolution string
+	// Gaps is set by User.LoadReadings if Fill is FillNull. It maps device ids to sensor ids to the start of the
+	// first missing bucket of every gap.
+	Gaps map[string]map[string][]time.Time
+}
+
+// ReadingsChunk contains a part of the measurements loaded by Db.StreamReadings.
+type ReadingsChunk struct {
+	// Values maps device ids to sensor ids to measurements.
+	Values map[string]map[string][]msg2api.Measurement
+	// Last is the timestamp of the last value of the chunk.
+	Last time.Time
+	// Progress is the fraction of the requested timespan covered by this and all previous chunks.
+	Progress float64
+}
+
+// Time bounds of readings accepted from devices.
+const (
+	// MaxClockSkew is how far in the future the timestamp of a reading may be.
+	MaxClockSkew = 5 * time.Minute
+	// MaxBackfillAge is how far in the past the timestamp of a backfilled reading may be.
+	MaxBackfillAge = 30 * 24 * time.Hour
+	// MaxBackfillValues is the number of values a single call to Device.Backfill accepts.
+	MaxBackfillValues = 100000
+)
+
+var (
+	// ErrReadingInFuture is returned for readings with timestamps more than MaxClockSkew in the future.
+	ErrReadingInFuture = errors.New("reading timestamp is in the future")
+	// ErrReadingTooOld is returned for backfilled readings with timestamps more than MaxBackfillAge in the past.
+	ErrReadingTooOld = errors.New("reading timestamp is too old")
+	// ErrBadReadingValue is returned for readings that are not finite numbers.
+	ErrBadReadingValue = errors.New("reading value is not a number")
+	// ErrBackfillTooLarge is returned if a backfill contains more than MaxBackfillValues values.
+	ErrBackfillTooLarge = errors.New("too many values")
+	// ErrNoSensor is returned if a backfill contains values for sensors that do not exist.
+	ErrNoSensor = errors.New("no such sensor")
+)
+
+// CheckReading returns an error if a reading received at now may not be stored.
+// Timestamps older than MaxBackfillAge are only checked if backfill is set.
+func CheckReading(value msg2api.Measurement, now time.Time, backfill bool) error {
+	if math.IsNaN(value.Value) || math.IsInf(value.Value, 0) {
+		return ErrBadReadingValue
+	}
+	if value.Time.After(now.Add(MaxClockSkew)) {
+		return ErrReadingInFuture
+	}
+	if backfill && value.Time.Before(now.Add(-MaxBackfillAge)) {
+		return ErrReadingTooOld
+	}
+	return nil
+}
+
+// ResolutionAuto may be passed as resolution to User.LoadReadings together with a point limit to select
+// the finest resolution that does not exceed the limit.
+const ResolutionAuto = "auto"
+
+var timeResStep = map[timeRes]time.Duration{
+	timeResSecond: time.Second,
+	timeResMinute: time.Minute,
+	timeResHour:   time.Hour,
+	timeResDay:    24 * time.Hour,
+	timeResWeek:   7 * 24 * time.Hour,
+	timeResMonth:  30 * 24 * time.Hour,
+	timeResYear:   365 * 24 * time.Hour,
+}
+
+// nextBucket returns the start of the bucket following the bucket starting at t.
+func nextBucket(t time.Time, res timeRes) time.Time {
+	switch res {
+	case timeResDay:
+		return t.AddDate(0, 0, 1)
+	case timeResWeek:
+		return t.AddDate(0, 0, 7)
+	case timeResMonth:
+		return t.AddDate(0, 1, 0)
+	case timeResYear:
+		return t.AddDate(1, 0, 0)
+	default:
+		return t.Add(timeResStep[res])
+	}
+}
+
+func (o *ReadingOptions) check(resolution string) error {
+	switch o.Downsample {
+	case "", DownsampleResolution, DownsampleLTTB:
+	default:
+		return errBadDownsample
+	}
+
+	switch o.Fill {
+	case FillNone, FillNull, FillPrevious, FillLinear:
+	default:
+		return errBadFill
+	}
+
+	if resolution == ResolutionAuto && o.MaxPoints <= 0 {
+		return errAutoMaxPoints
+	}
+	return nil
+}
+
+// resolutionFor returns the resolution values should be loaded in for the given timespan.
+// If resolution based downsampling is requested, the requested resolution is the finest resolution considered.
+func (o *ReadingOptions) resolutionFor(since, until time.Time, resolution string) (string, error) {
+	if err := o.check(resolution); err != nil {
+		return "", err
+	}
+
+	if o.MaxPoints <= 0 || (o.Downsample == DownsampleLTTB && resolution != ResolutionAuto) {
+		return resolution, nil
+	}
+
+	var first timeRes
+	switch resolution {
+	case ResolutionAuto, "raw":
+		first = timeResSecond
+	default:
+		res, ok := timeResMap[resolution]
+		if !ok {
+			return "", errBadResolution
+		}
+		first = res
+	}
+
+	span := until.Sub(since)
+	for res := first; res < timeResYear; res++ {
+		if int64(span/timeResStep[res])+1 <= int64(o.MaxPoints) {
+			if res == first && resolution == "raw" {
+				return resolution, nil
+			}
+			return timeResName(res), nil
+		}
+	}
+	return timeResName(timeResYear), nil
+}
+
+func timeResName(res timeRes) string {
+	for name, r := range timeResMap {
+		if r == res {
+			return name
+		}
+	}
+	return ""
+}
+
+// apply fills gaps in and downsamples the values of a single sensor loaded with the given resolution.
+// Returns the values and the gap markers created by FillNull. Gap filling may create at most limit values.
+func (o *ReadingOptions) apply(values []msg2api.Measurement, resolution string, limit int) ([]msg2api.Measurement, []time.Time, error) {
+	sort.Sort(measurementsByTime(values))
+
+	var markers []time.Time
+	if o.Fill != FillNone {
+		res, ok := timeResMap[resolution]
+		if !ok {
+			return nil, nil, errFillRaw
+		}
+
+		var err error
+		values, markers, err = fillGaps(values, res, o.Fill, limit)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if o.MaxPoints > 0 && o.Downsample == DownsampleLTTB {
+		threshold := o.MaxPoints - len(markers)
+		if threshold < 3 {
+			threshold = 3
+		}
+		values = lttb(values, threshold)
+	}
+	return values, markers, nil
+}
+
+// fillGaps fills missing buckets between the first and the last value according to the fill strategy.
+// Gap markers created by FillNull are returned separately. The result may have at most limit values.
+func fillGaps(values []msg2api.Measurement, res timeRes, fill string, limit int) (filled []msg2api.Measurement, markers []time.Time, err error) {
+	if len(values) < 2 {
+		return values, nil, nil
+	}
+
+	// Buckets of days and coarser may be shifted by an hour when crossing DST boundaries.
+	tolerance := timeResStep[res] / 2
+	if tolerance > time.Hour {
+		tolerance = time.Hour
+	}
+
+	filled = make([]msg2api.Measurement, 0, len(values))
+	filled = append(filled, values[0])
+	for i := 1; i < len(values); i++ {
+		prev, cur := values[i-1], values[i]
+		for t := nextBucket(prev.Time, res); cur.Time.Sub(t) > tolerance; t = nextBucket(t, res) {
+			switch fill {
+			case FillNull:
+				markers = append(markers, t)
+			case FillPrevious:
+				filled = append(filled, msg2api.Measurement{Time: t, Value: prev.Value})
+			case FillLinear:
+				frac := float64(t.Sub(prev.Time)) / float64(cur.Time.Sub(prev.Time))
+				filled = append(filled, msg2api.Measurement{Time: t, Value: prev.Value + frac*(cur.Value-prev.Value)})
+			}
+
+			if fill == FillNull {
+				break
+			}
+			if len(filled) > limit {
+				return nil, nil, errTooManyValues
+			}
+		}
+		filled = append(filled, cur)
+	}
+	return filled, markers, nil
+}
+
+// lttb reduces values to threshold values using the Largest-Triangle-Three-Buckets algorithm.
+// The first and last value are always kept, values must be sorted by time.
+func lttb(values []msg2api.Measurement, threshold int) []msg2api.Measurement {
+	if threshold >= len(values) || threshold < 3 {
+		return values
+	}
+
+	x := func(m msg2api.Measurement) float64 {
+		return float64(m.Time.UnixNano())
+	}
+
+	result := make([]msg2api.Measurement, 0, threshold)
+	result = append(result, values[0])
+
+	every := float64(len(values)-2) / float64(threshold-2)
+	a := 0
+	for i := 0; i < threshold-2; i++ {
+		// average of the next bucket is the third point of the triangle
+		avgStart := int(float64(i+1)*every) + 1
+		avgEnd := int(float64(i+2)*every) + 1
+		if avgEnd > len(values) {
+			avgEnd = len(values)
+		}
+		var avgX, avgY float64
+		for _, v := range values[avgStart:avgEnd] {
+			avgX += x(v)
+			avgY += v.Value
+		}
+		avgX /= float64(avgEnd - avgStart)
+		avgY /= float64(avgEnd - avgStart)
+
+		rangeStart := int(float64(i)*every) + 1
+		rangeEnd := int(float64(i+1)*every) + 1
+
+		maxArea := -1.0
+		next := rangeStart
+		for j := rangeStart; j < rangeEnd; j++ {
+			area := math.Abs((x(values[a])-avgX)*(values[j].Value-values[a].Value) -
+				(x(values[a])-x(values[j]))*(avgY-values[a].Value))
+			if area > maxArea {
+				maxArea = area
+				next = j
+			}
+		}
+
+		result = append(result, values[next])
+		a = next
+	}
+
+	return append(result, values[len(values)-1])
+}
+
+type measurementsByTime []msg2api.Measurement
+
+func (m measurementsByTime) Len() int           { return len(m) }
+func (m measurementsByTime) Less(i, j int) bool { return m[i].Time.Before(m[j].Time) }
+func (m measurementsByTime) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
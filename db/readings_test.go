@@ -0,0 +1,107 @@
+package db
+
+import (
+	"github.com/mysmartgrid/msg2api"
+	"testing"
+	"time"
+)
+
+var testReadingsStart = time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// minutes returns measurements at the given minute offsets from testReadingsStart with the given values.
+func minutes(pairs ...float64) []msg2api.Measurement {
+	result := make([]msg2api.Measurement, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		result = append(result, msg2api.Measurement{
+			Time:  testReadingsStart.Add(time.Duration(pairs[i]) * time.Minute),
+			Value: pairs[i+1],
+		})
+	}
+	return result
+}
+
+func equalMeasurements(a, b []msg2api.Measurement) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Time.Equal(b[i].Time) || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFillGaps(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []msg2api.Measurement
+		fill    string
+		limit   int
+		filled  []msg2api.Measurement
+		markers []time.Duration
+		err     error
+	}{
+		{"empty", nil, FillPrevious, 100, nil, nil, nil},
+		{"single value", minutes(0, 1), FillLinear, 100, minutes(0, 1), nil, nil},
+		{"no gaps", minutes(0, 1, 1, 2, 2, 3), FillPrevious, 100, minutes(0, 1, 1, 2, 2, 3), nil, nil},
+		{"null", minutes(0, 1, 3, 4, 4, 5), FillNull, 100, minutes(0, 1, 3, 4, 4, 5), []time.Duration{time.Minute}, nil},
+		{"previous", minutes(0, 1, 3, 4), FillPrevious, 100, minutes(0, 1, 1, 1, 2, 1, 3, 4), nil, nil},
+		{"linear", minutes(0, 1, 3, 4), FillLinear, 100, minutes(0, 1, 1, 2, 2, 3, 3, 4), nil, nil},
+		{"gap after first value", minutes(0, 1, 2, 1, 3, 1), FillPrevious, 100, minutes(0, 1, 1, 1, 2, 1, 3, 1), nil, nil},
+		{"gap before last value", minutes(0, 1, 1, 1, 3, 1), FillPrevious, 100, minutes(0, 1, 1, 1, 2, 1, 3, 1), nil, nil},
+		{"gaps at both edges", minutes(0, 1, 2, 2, 4, 3), FillNull, 100, minutes(0, 1, 2, 2, 4, 3),
+			[]time.Duration{time.Minute, 3 * time.Minute}, nil},
+		{"limit", minutes(0, 1, 10, 2), FillPrevious, 5, nil, nil, errTooManyValues},
+		{"null ignores limit", minutes(0, 1, 10, 2), FillNull, 2, minutes(0, 1, 10, 2), []time.Duration{time.Minute}, nil},
+	}
+
+	for _, test := range tests {
+		filled, markers, err := fillGaps(test.values, timeResMinute, test.fill, test.limit)
+		if err != test.err {
+			t.Errorf("%v: got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if !equalMeasurements(filled, test.filled) {
+			t.Errorf("%v: got values %v, want %v", test.name, filled, test.filled)
+		}
+		if len(markers) != len(test.markers) {
+			t.Errorf("%v: got markers %v, want %v", test.name, markers, test.markers)
+			continue
+		}
+		for i, m := range markers {
+			if !m.Equal(testReadingsStart.Add(test.markers[i])) {
+				t.Errorf("%v: got marker %v, want %v", test.name, m, testReadingsStart.Add(test.markers[i]))
+			}
+		}
+	}
+}
+
+func TestLTTB(t *testing.T) {
+	ramp := minutes(0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9)
+
+	tests := []struct {
+		name      string
+		values    []msg2api.Measurement
+		threshold int
+		result    []msg2api.Measurement
+	}{
+		{"empty", nil, 3, nil},
+		{"threshold equals length", minutes(0, 1, 1, 2, 2, 3), 3, minutes(0, 1, 1, 2, 2, 3)},
+		{"threshold above length", minutes(0, 1, 1, 2), 10, minutes(0, 1, 1, 2)},
+		{"threshold below three", ramp, 2, ramp},
+		{"peak", minutes(0, 0, 1, 0, 2, 10, 3, 0, 4, 0), 3, minutes(0, 0, 2, 10, 4, 0)},
+	}
+
+	for _, test := range tests {
+		result := lttb(test.values, test.threshold)
+		if !equalMeasurements(result, test.result) {
+			t.Errorf("%v: got %v, want %v", test.name, result, test.result)
+		}
+	}
+
+	result := lttb(ramp, 4)
+	if len(result) != 4 || !equalMeasurements([]msg2api.Measurement{result[0], result[3]}, minutes(0, 0, 9, 9)) {
+		t.Errorf("first and last value not kept: %v", result)
+	}
+}
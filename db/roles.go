@@ -0,0 +1,222 @@
+package db
+
+import (
+	"errors"
+	"github.com/lib/pq"
+)
+
+// Permissions granted by roles.
+const (
+	// PermUsersRead allows to list all users and view their accounts.
+	PermUsersRead = "users.read"
+	// PermUsersWrite allows to create users and change their accounts.
+	PermUsersWrite = "users.write"
+	// PermUsersData allows to view the measurements of other users.
+	PermUsersData = "users.data"
+	// PermDevicesRead allows to view the devices and sensors of all users.
+	PermDevicesRead = "devices.read"
+	// PermDevicesWrite allows to change and remove the devices and sensors of all users.
+	PermDevicesWrite = "devices.write"
+	// PermDevicesKeys allows to view the secret keys of devices.
+	PermDevicesKeys = "devices.keys"
+	// PermGroupsRead allows to view all groups.
+	PermGroupsRead = "groups.read"
+	// PermGroupsWrite allows to change all groups, group admins may change their own groups without it.
+	PermGroupsWrite = "groups.write"
+	// PermRegistryRead allows to view the device registry, including heartbeats and network configurations.
+	PermRegistryRead = "registry.read"
+	// PermRegistryWrite allows to register devices and change their links.
+	PermRegistryWrite = "registry.write"
+	// PermValidationRead allows to view the validation rules of units.
+	PermValidationRead = "validation.read"
+	// PermValidationWrite allows to change the validation rules of units.
+	PermValidationWrite = "validation.write"
+	// PermRolesRead allows to view roles and the roles of users.
+	PermRolesRead = "roles.read"
+	// PermRolesWrite allows to change roles and assign them to users.
+	PermRolesWrite = "roles.write"
+)
+
+// Permissions lists all permissions roles may grant.
+var Permissions = []string{
+	PermUsersRead, PermUsersWrite, PermUsersData,
+	PermDevicesRead, PermDevicesWrite, PermDevicesKeys,
+	PermGroupsRead, PermGroupsWrite,
+	PermRegistryRead, PermRegistryWrite,
+	PermValidationRead, PermValidationWrite,
+	PermRolesRead, PermRolesWrite,
+}
+
+// Predefined roles, created by the migrations. They cannot be changed or removed.
+const (
+	// RoleAdmin is the role of administrators, it grants all permissions.
+	RoleAdmin = "admin"
+	// RoleSupport helps users with their accounts and devices.
+	RoleSupport = "support"
+	// RoleInstaller registers and installs devices.
+	RoleInstaller = "installer"
+	// RoleOperator operates the platform.
+	RoleOperator = "operator"
+	// RoleAuditor has read-only access to all accounts and settings.
+	RoleAuditor = "auditor"
+)
+
+// PredefinedRoles lists all predefined roles.
+var PredefinedRoles = []string{RoleAdmin, RoleSupport, RoleInstaller, RoleOperator, RoleAuditor}
+
+// IsPredefinedRole returns true if id is one of PredefinedRoles.
+func IsPredefinedRole(id string) bool {
+	for _, r := range PredefinedRoles {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// ErrBadPermission is returned for permissions not listed in Permissions.
+	ErrBadPermission = errors.New("unknown permission")
+	// ErrNoRole is returned for roles that do not exist.
+	ErrNoRole = errors.New("no such role")
+	// ErrPredefinedRole is returned for attempts to change or remove predefined roles.
+	ErrPredefinedRole = errors.New("predefined roles cannot be changed")
+)
+
+// Role is a named set of permissions assigned to users.
+type Role struct {
+	ID          string   `json:"id"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+func (tx *tx) Roles() ([]Role, error) {
+	rows, err := tx.Query(`SELECT r.role_id, r.description, array_remove(array_agg(p.permission ORDER BY p.permission), NULL)
+		FROM roles r LEFT JOIN role_permissions p ON p.role_id = r.role_id
+		GROUP BY r.role_id, r.description
+		ORDER BY r.role_id`)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Role
+	defer rows.Close()
+	for rows.Next() {
+		var r Role
+		var perms pq.StringArray
+		if err := rows.Scan(&r.ID, &r.Description, &perms); err != nil {
+			return nil, err
+		}
+		r.Permissions = []string(perms)
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+func (tx *tx) SetRole(role Role) error {
+	if IsPredefinedRole(role.ID) {
+		return ErrPredefinedRole
+	}
+
+	known := make(map[string]bool)
+	for _, p := range Permissions {
+		known[p] = true
+	}
+	for _, p := range role.Permissions {
+		if !known[p] {
+			return ErrBadPermission
+		}
+	}
+
+	_, err := tx.Exec(`INSERT INTO roles(role_id, description) VALUES($1, $2)
+		ON CONFLICT (role_id) DO UPDATE SET description = excluded.description`, role.ID, role.Description)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM role_permissions WHERE role_id = $1`, role.ID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO role_permissions(role_id, permission) SELECT $1, unnest($2::varchar[])`,
+		role.ID, pq.Array(role.Permissions))
+	return err
+}
+
+func (tx *tx) RemoveRole(id string) error {
+	if IsPredefinedRole(id) {
+		return ErrPredefinedRole
+	}
+
+	res, err := tx.Exec(`DELETE FROM roles WHERE role_id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNoRole
+	}
+	return nil
+}
+
+func (u *user) Roles() ([]string, error) {
+	rows, err := u.tx.Query(`SELECT role_id FROM user_roles WHERE user_id = $1 ORDER BY role_id`, u.id)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		result = append(result, role)
+	}
+	return result, rows.Err()
+}
+
+func (u *user) AddRole(role string) error {
+	var exists bool
+	if err := u.tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM roles WHERE role_id = $1)`, role).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoRole
+	}
+
+	_, err := u.tx.Exec(`INSERT INTO user_roles(user_id, role_id) VALUES($1, $2) ON CONFLICT DO NOTHING`, u.id, role)
+	return err
+}
+
+func (u *user) RemoveRole(role string) error {
+	_, err := u.tx.Exec(`DELETE FROM user_roles WHERE user_id = $1 AND role_id = $2`, u.id, role)
+	return err
+}
+
+func (u *user) Permissions() ([]string, error) {
+	rows, err := u.tx.Query(`SELECT DISTINCT p.permission
+		FROM user_roles r JOIN role_permissions p ON p.role_id = r.role_id
+		WHERE r.user_id = $1
+		ORDER BY p.permission`, u.id)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	defer rows.Close()
+	for rows.Next() {
+		var perm string
+		if err := rows.Scan(&perm); err != nil {
+			return nil, err
+		}
+		result = append(result, perm)
+	}
+	return result, rows.Err()
+}
+
+func (u *user) HasPermission(perm string) bool {
+	var has bool
+	err := u.tx.QueryRow(`SELECT EXISTS(SELECT 1
+		FROM user_roles r JOIN role_permissions p ON p.role_id = r.role_id
+		WHERE r.user_id = $1 AND p.permission = $2)`, u.id, perm).Scan(&has)
+	return err == nil && has
+}
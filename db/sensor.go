@@ -1,5 +1,48 @@
 package db
 
+import (
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+var (
+	errNoCalibrationTime = errors.New("calibration needs a start time")
+	errCalibrationInPast = errors.New("values after the calibration start were already aggregated")
+)
+
+// calibrationLockKey is the advisory lock held exclusively by Sensor.Calibrate and shared by do_aggregate and
+// do_backfill, which apply correction factors to the values they aggregate.
+const calibrationLockKey = 0x6d736361
+
+// Calibration describes the unit, port and correction factor of a sensor starting at ValidFrom.
+// The zero ValidFrom marks the calibration the sensor was created with.
+type Calibration struct {
+	ValidFrom time.Time `json:"validFrom"`
+	Unit      string    `json:"unit"`
+	Port      int32     `json:"port"`
+	Factor    float64   `json:"factor"`
+}
+
+// currentCalibration selects a column of the calibration of the sensor in the sensors table valid now. Calibrations
+// may start in the future, so the columns of the sensors table are only used for sensors without calibration history.
+func currentCalibration(column string) string {
+	return `coalesce((SELECT c.` + column + ` FROM sensor_calibrations c
+		WHERE c.sensor_seq = sensors.sensor_seq AND c.valid_from <= now()
+		ORDER BY c.valid_from DESC LIMIT 1), sensors.` + column + `)`
+}
+
+// CalibrationAt returns the calibration valid at t from calibrations ordered by time as returned by
+// Sensor.Calibrations, and false if none is valid at t.
+func CalibrationAt(calibrations []Calibration, t time.Time) (Calibration, bool) {
+	for i := len(calibrations) - 1; i >= 0; i-- {
+		if c := calibrations[i]; c.ValidFrom.IsZero() || !c.ValidFrom.After(t) {
+			return c, true
+		}
+	}
+	return Calibration{}, false
+}
+
 type sensor struct {
 	device    *device
 	id        string
@@ -62,7 +105,7 @@ func (s *sensor) Groups() map[string]Group {
 
 func (s *sensor) Port() int32 {
 	var port int32
-	err := s.device.user.tx.QueryRow(`SELECT port FROM sensors WHERE sensor_seq = $1`, s.seq).Scan(&port)
+	err := s.device.user.tx.QueryRow(`SELECT `+currentCalibration("port")+` FROM sensors WHERE sensor_seq = $1`, s.seq).Scan(&port)
 	if err != nil {
 		return -1
 	}
@@ -71,7 +114,7 @@ func (s *sensor) Port() int32 {
 
 func (s *sensor) Unit() string {
 	var unit string
-	err := s.device.user.tx.QueryRow(`SELECT unit FROM sensors WHERE sensor_seq = $1`, s.seq).Scan(&unit)
+	err := s.device.user.tx.QueryRow(`SELECT `+currentCalibration("unit")+` FROM sensors WHERE sensor_seq = $1`, s.seq).Scan(&unit)
 	if err != nil {
 		return ""
 	}
@@ -85,3 +128,66 @@ func (s *sensor) Factor() float64 {
 func (s *sensor) IsVirtual() bool {
 	return s.isVirtual
 }
+
+func (s *sensor) Calibrate(c Calibration) error {
+	if c.ValidFrom.IsZero() {
+		return errNoCalibrationTime
+	}
+
+	tx := s.device.user.tx
+
+	// aggregated values are stored corrected, so a calibration may only start after the values aggregated so far
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, calibrationLockKey); err != nil {
+		return err
+	}
+	var aggregated bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM measure_aggregated_seconds
+		WHERE sensor = $1 AND "timestamp" >= date_trunc('second', $2::timestamptz))`, s.seq, c.ValidFrom).Scan(&aggregated)
+	if err != nil {
+		return err
+	}
+	if aggregated {
+		return errCalibrationInPast
+	}
+
+	// sensors created before calibrations were versioned keep their initial settings for older values
+	_, err = tx.Exec(`INSERT INTO sensor_calibrations(sensor_seq, valid_from, unit, port, factor)
+		SELECT sensor_seq, '-infinity', unit, port, factor FROM sensors
+		WHERE sensor_seq = $1 AND NOT EXISTS (SELECT 1 FROM sensor_calibrations WHERE sensor_seq = $1)`, s.seq)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO sensor_calibrations(sensor_seq, valid_from, unit, port, factor) VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (sensor_seq, valid_from) DO UPDATE SET unit = excluded.unit, port = excluded.port, factor = excluded.factor`,
+		s.seq, c.ValidFrom, c.Unit, c.Port, c.Factor)
+	if err != nil {
+		return err
+	}
+
+	return tx.QueryRow(`UPDATE sensors s SET unit = c.unit, port = c.port, factor = c.factor
+		FROM (SELECT unit, port, factor FROM sensor_calibrations WHERE sensor_seq = $1 AND valid_from <= now()
+			ORDER BY valid_from DESC LIMIT 1) c
+		WHERE s.sensor_seq = $1
+		RETURNING s.factor`, s.seq).Scan(&s.factor)
+}
+
+func (s *sensor) Calibrations() ([]Calibration, error) {
+	rows, err := s.device.user.tx.Query(`SELECT NULLIF(valid_from, '-infinity'), unit, port, factor FROM sensor_calibrations WHERE sensor_seq = $1 ORDER BY valid_from`, s.seq)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Calibration
+	defer rows.Close()
+	for rows.Next() {
+		var c Calibration
+		var validFrom pq.NullTime
+		if err := rows.Scan(&validFrom, &c.Unit, &c.Port, &c.Factor); err != nil {
+			return nil, err
+		}
+		c.ValidFrom = validFrom.Time
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"time"
+)
+
+// Session is a login session of a user. The token identifying the session is only known to its holder.
+type Session struct {
+	ID        uint64    `json:"id"`
+	User      string    `json:"-"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Address   string    `json:"address"`
+	UserAgent string    `json:"userAgent"`
+}
+
+// Expired returns true if the session was not used for idle or was created longer than absolute ago.
+func (s *Session) Expired(idle, absolute time.Duration) bool {
+	now := time.Now()
+	return now.Sub(s.LastSeen) > idle || now.Sub(s.Created) > absolute
+}
+
+const sessionColumns = `session_id, user_id, created, last_seen, address, user_agent`
+
+func scanSession(row interface {
+	Scan(...interface{}) error
+}) (Session, error) {
+	var s Session
+	err := row.Scan(&s.ID, &s.User, &s.Created, &s.LastSeen, &s.Address, &s.UserAgent)
+	return s, err
+}
+
+func (u *user) AddSession(address, userAgent string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = u.tx.Exec(`INSERT INTO sessions(token_hash, user_id, address, user_agent) VALUES($1, $2, $3, $4)`,
+		hashToken(token), u.id, address, userAgent)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (u *user) Sessions() ([]Session, error) {
+	rows, err := u.tx.Query(`SELECT `+sessionColumns+` FROM sessions WHERE user_id = $1 ORDER BY last_seen DESC`, u.id)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Session
+	defer rows.Close()
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+func (u *user) RemoveSession(id uint64) error {
+	_, err := u.tx.Exec(`DELETE FROM sessions WHERE user_id = $1 AND session_id = $2`, u.id, id)
+	return err
+}
+
+func (u *user) RemoveSessions(keep string) error {
+	_, err := u.tx.Exec(`DELETE FROM sessions WHERE user_id = $1 AND token_hash <> $2`, u.id, hashToken(keep))
+	return err
+}
+
+func (tx *tx) Session(token string) *Session {
+	s, err := scanSession(tx.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE token_hash = $1`, hashToken(token)))
+	if err != nil {
+		return nil
+	}
+	return &s
+}
+
+func (tx *tx) TouchSession(token string) error {
+	_, err := tx.Exec(`UPDATE sessions SET last_seen = now() WHERE token_hash = $1`, hashToken(token))
+	return err
+}
+
+func (tx *tx) RemoveSession(token string) error {
+	_, err := tx.Exec(`DELETE FROM sessions WHERE token_hash = $1`, hashToken(token))
+	return err
+}
+
+func (tx *tx) PruneSessions(idle, absolute time.Duration) error {
+	now := time.Now()
+	_, err := tx.Exec(`DELETE FROM sessions WHERE last_seen < $1 OR created < $2`, now.Add(-idle), now.Add(-absolute))
+	return err
+}
@@ -1,18 +1,28 @@
 package db
 
 import (
-	"bytes"
 	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/lib/pq"
 	"github.com/mysmartgrid/msg2api"
-	"strconv"
+	"sync"
 	"time"
 )
 
 type sqlHandler struct {
 	db *sql.DB
+
+	// stmts caches prepared statements by query name, see prepared
+	stmts    map[string]*sql.Stmt
+	stmtsMtx sync.Mutex
+}
+
+func newSQLHandler(db *sql.DB) sqlHandler {
+	return sqlHandler{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
 }
 
 type timeRes int
@@ -27,6 +37,8 @@ const (
 	timeResYear
 )
 
+var errBadResolution = errors.New("Time resolution not supported.")
+
 var timeResMap map[string]timeRes = map[string]timeRes{
 	"second": timeResSecond,
 	"minute": timeResMinute,
@@ -48,7 +60,8 @@ var timeResTable map[timeRes]string = map[timeRes]string{
 }
 
 // saveValuesAndClear write a set of measurements from different sensors to the database and empty the valueMap
-func (h *sqlHandler) saveValuesAndClear(valueMap map[uint64][]msg2api.Measurement) error {
+// If beforeCommit is not nil, it is called right before the transaction writing the values is committed.
+func (h *sqlHandler) saveValuesAndClear(valueMap map[uint64][]msg2api.Measurement, beforeCommit func(*sql.Tx) error) error {
 	tx, err := h.db.Begin()
 	if err != nil {
 		return err
@@ -77,6 +90,13 @@ func (h *sqlHandler) saveValuesAndClear(valueMap map[uint64][]msg2api.Measuremen
 		return err
 	}
 
+	if beforeCommit != nil {
+		if err := beforeCommit(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return err
@@ -88,96 +108,225 @@ func (h *sqlHandler) saveValuesAndClear(valueMap map[uint64][]msg2api.Measuremen
 	return nil
 }
 
-// loadValues loads measurements for a set of sensors in a single timespan and for a single resolution
+// prepared returns the prepared statement for query, preparing it on first use.
+// name identifies the query in the statement cache and must be unique for every query text.
+func (h *sqlHandler) prepared(name, query string) (*sql.Stmt, error) {
+	h.stmtsMtx.Lock()
+	defer h.stmtsMtx.Unlock()
+
+	if stmt, ok := h.stmts[name]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := h.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	h.stmts[name] = stmt
+	return stmt, nil
+}
+
+// closeStatements closes all cached prepared statements.
+func (h *sqlHandler) closeStatements() {
+	h.stmtsMtx.Lock()
+	defer h.stmtsMtx.Unlock()
+
+	for name, stmt := range h.stmts {
+		stmt.Close()
+		delete(h.stmts, name)
+	}
+}
+
+// valueSource returns the table values of the given resolution are stored in and the expression
+// computing the value of a row in that table, which is aliased as v. Aggregated values are stored with the
+// correction factor valid at the time of each value applied, raw values are stored uncorrected.
+func valueSource(resolution string) (table, value string, err error) {
+	if resolution == "raw" {
+		return "measure_raw", `v."value"`, nil
+	}
+
+	res, ok := timeResMap[resolution]
+	if !ok {
+		return "", "", errBadResolution
+	}
+	return timeResTable[res], `v."sum" / v."count"`, nil
+}
+
+// calibrationJoin joins the correction factor valid at the timestamp of each raw value v as c."factor".
+// The calibrations of the sensors in $1 are turned into time ranges once and joined by range, instead of looking
+// up the calibration of every value. Sensors without calibration history fall back to the factor of the sensor s.
+const calibrationJoin = `LEFT JOIN (SELECT c."sensor_seq", c."factor", c."valid_from",
+			COALESCE(lead(c."valid_from") OVER (PARTITION BY c."sensor_seq" ORDER BY c."valid_from"), 'infinity') AS "valid_until"
+		FROM "sensor_calibrations" c WHERE c."sensor_seq" = ANY($1)) c
+		ON c."sensor_seq" = v."sensor" AND v."timestamp" >= c."valid_from" AND v."timestamp" < c."valid_until"`
+
+// correctedValueSource is like valueSource, but the expression computes the corrected value of a row using the
+// tables of joins.
+func correctedValueSource(resolution string) (table, value, joins string, err error) {
+	table, value, err = valueSource(resolution)
+	if err != nil || resolution != "raw" {
+		return table, value, "", err
+	}
+	return table, value + ` * COALESCE(c."factor", s."factor")`, `JOIN "sensors" s ON s."sensor_seq" = v."sensor" ` + calibrationJoin, nil
+}
+
+// sensorSeqArray converts sensor sequence numbers to a parameter for "= ANY($n)" conditions.
+func sensorSeqArray(sensorSeqs []uint64) interface{} {
+	seqs := make([]int64, len(sensorSeqs))
+	for i, seq := range sensorSeqs {
+		seqs[i] = int64(seq)
+	}
+	return pq.Array(seqs)
+}
+
+// loadValues loads measurements for a set of sensors in a single timespan and for a single resolution.
+// The correction factor valid at the time of each value is applied, values are ordered by time.
+// The timespan is compared with the bare timestamp column, so partitions outside of it are pruned.
 func (h *sqlHandler) loadValues(since, until time.Time, resolution string, sensorSeqs []uint64) (map[uint64][]msg2api.Measurement, error) {
 	if len(sensorSeqs) < 1 {
 		return make(map[uint64][]msg2api.Measurement), nil
 	}
 
-	var sensorSeqsList bytes.Buffer
-	for idx, seq := range sensorSeqs {
-		if idx != 0 {
-			sensorSeqsList.WriteString(", ")
-		}
-		sensorSeqsList.WriteString(strconv.FormatUint(seq, 10))
+	table, value, joins, err := correctedValueSource(resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := h.prepared("load:"+resolution, fmt.Sprintf(`SELECT v."sensor", v."timestamp", %v
+		FROM "%v" v %v
+		WHERE v."sensor" = ANY($1) AND v."timestamp" BETWEEN $2 AND $3
+		ORDER BY v."sensor", v."timestamp"`, value, table, joins))
+	if err != nil {
+		return nil, err
 	}
 
-	//Read correction factors
-	factorRows, err := h.db.Query(fmt.Sprintf(`SELECT "sensor_seq", "factor" FROM "sensors" WHERE "sensor_seq" in (%v)`, sensorSeqsList.String()))
+	rows, err := stmt.Query(sensorSeqArray(sensorSeqs), since, until)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	factorMap := make(map[uint64]float64)
-	for factorRows.Next() {
-		var sensorid uint64
-		var factor float64
+	result := make(map[uint64][]msg2api.Measurement)
+	for rows.Next() {
+		var sensorid int64
+		var timestamp time.Time
+		var value float64
 
-		err = factorRows.Scan(&sensorid, &factor)
+		err = rows.Scan(&sensorid, &timestamp, &value)
 		if err != nil {
 			return nil, err
 		}
-
-		factorMap[sensorid] = factor
+		result[uint64(sensorid)] = append(result[uint64(sensorid)], msg2api.Measurement{timestamp, value})
 	}
 
-	factorRows.Close()
-	err = factorRows.Err()
+	err = rows.Err()
 	if err != nil {
 		return nil, err
 	}
 
-	//Read values
-	var valueQuery string
+	return result, nil
+}
+
+// streamValues passes measurements for a set of sensors in a single timespan and for a single resolution to fn
+// in chunks of at most chunkSize values, along with the timestamp of the last value in the chunk.
+// Values are read through cursors in a single read only transaction with repeatable read isolation, so all chunks
+// come from one snapshot while only a chunk is held in memory. The transaction stays open while fn runs.
+// Values of resolution "raw" start with the values already aggregated into seconds, followed by the values
+// not yet aggregated.
+func (h *sqlHandler) streamValues(since, until time.Time, resolution string, sensorSeqs []uint64, chunkSize int,
+	fn func(map[uint64][]msg2api.Measurement, time.Time) error) error {
+	if len(sensorSeqs) < 1 {
+		return fn(make(map[uint64][]msg2api.Measurement), until)
+	}
 
+	aggregated := resolution
 	if resolution == "raw" {
-		valueQuery = fmt.Sprintf(`SELECT "sensor", "timestamp", "value" FROM "measure_raw" WHERE "sensor" IN (%v) AND "timestamp" BETWEEN $1 AND $2`, sensorSeqsList.String())
-	} else {
-		res, ok := timeResMap[resolution]
-		if !ok {
-			return nil, errors.New("Time resolution not supported.")
-		}
-		valueQuery = fmt.Sprintf(`SELECT "sensor", "timestamp", "sum", "count" FROM "%v" WHERE "sensor" IN (%v) AND "timestamp" BETWEEN $1 AND $2`, timeResTable[res], sensorSeqsList.String())
+		aggregated = "second"
+	}
+	if _, _, err := valueSource(aggregated); err != nil {
+		return err
 	}
 
-	rows, err := h.db.Query(valueQuery, since, until)
+	tx, err := h.db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer tx.Rollback()
 
-	result := make(map[uint64][]msg2api.Measurement)
-	if resolution == "raw" {
-		for rows.Next() {
-			var sensorid uint64
-			var timestamp time.Time
-			var value float64
+	if _, err := tx.Exec(`SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY`); err != nil {
+		return err
+	}
 
-			err = rows.Scan(&sensorid, &timestamp, &value)
-			if err != nil {
-				return nil, err
-			}
-			result[sensorid] = append(result[sensorid], msg2api.Measurement{timestamp, value * factorMap[sensorid]})
+	seqs := sensorSeqArray(sensorSeqs)
+	chunk := make(map[uint64][]msg2api.Measurement)
+	count := 0
+	sent := false
+	lastTime := since
+
+	flush := func() error {
+		err := fn(chunk, lastTime)
+		chunk = make(map[uint64][]msg2api.Measurement)
+		count = 0
+		sent = true
+		return err
+	}
+
+	stream := func(cursor, resolution string) error {
+		table, value, joins, _ := correctedValueSource(resolution)
+		_, err := tx.Exec(fmt.Sprintf(`DECLARE %v NO SCROLL CURSOR FOR
+			SELECT v."sensor", v."timestamp", %v
+			FROM "%v" v %v
+			WHERE v."sensor" = ANY($1) AND v."timestamp" BETWEEN $2 AND $3
+			ORDER BY v."timestamp", v."sensor"`, cursor, value, table, joins), seqs, since, until)
+		if err != nil {
+			return err
 		}
-	} else {
-		for rows.Next() {
-			var sensorid uint64
-			var timestamp time.Time
-			var sum float64
-			var count int64
-
-			err = rows.Scan(&sensorid, &timestamp, &sum, &count)
+
+		for {
+			want := chunkSize - count
+			rows, err := tx.Query(fmt.Sprintf(`FETCH %v FROM %v`, want, cursor))
 			if err != nil {
-				return nil, err
+				return err
+			}
+
+			fetched := 0
+			for rows.Next() {
+				var sensor int64
+				var value float64
+				if err := rows.Scan(&sensor, &lastTime, &value); err != nil {
+					rows.Close()
+					return err
+				}
+				chunk[uint64(sensor)] = append(chunk[uint64(sensor)], msg2api.Measurement{lastTime, value})
+				fetched++
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			count += fetched
+
+			if fetched < want {
+				_, err := tx.Exec(`CLOSE ` + cursor)
+				return err
+			}
+			if err := flush(); err != nil {
+				return err
 			}
-			result[sensorid] = append(result[sensorid], msg2api.Measurement{timestamp, (sum / float64(count)) * factorMap[sensorid]})
 		}
 	}
 
-	rows.Close()
-	err = rows.Err()
-	if err != nil {
-		return nil, err
+	if err := stream("stream_aggregated", aggregated); err != nil {
+		return err
+	}
+	if resolution == "raw" {
+		if err := stream("stream_raw", resolution); err != nil {
+			return err
+		}
 	}
 
-	return result, nil
+	if count > 0 || !sent {
+		return flush()
+	}
+	return nil
 }
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Periods of consumption summaries, each starting at the beginning of the current day, week, month or year.
+const (
+	SummaryToday = "today"
+	SummaryWeek  = "week"
+	SummaryMonth = "month"
+	SummaryYear  = "year"
+)
+
+// Consumption is the energy consumed within a period in Wh and the peak power within it in W.
+// Peak is nil if no power sensor contributed to the summary.
+type Consumption struct {
+	Energy float64  `json:"energy"`
+	Peak   *float64 `json:"peak"`
+}
+
+// ConsumptionSummary holds the consumption of a user within a period, in total, per device and per sensor.
+// Summaries are maintained by msgdbd with do_summarize and include values up to Updated.
+type ConsumptionSummary struct {
+	Total   Consumption                       `json:"total"`
+	Devices map[string]Consumption            `json:"devices"`
+	Sensors map[string]map[string]Consumption `json:"sensors"`
+	Updated time.Time                         `json:"updated"`
+}
+
+func (u *user) ConsumptionSummary() (map[string]*ConsumptionSummary, error) {
+	rows, err := u.tx.Query(`SELECT period, device_id, sensor_id, energy, peak, updated
+		FROM consumption_summaries WHERE user_id = $1`, u.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]*ConsumptionSummary)
+	for _, period := range []string{SummaryToday, SummaryWeek, SummaryMonth, SummaryYear} {
+		result[period] = &ConsumptionSummary{
+			Devices: make(map[string]Consumption),
+			Sensors: make(map[string]map[string]Consumption),
+		}
+	}
+
+	for rows.Next() {
+		var period, device, sensor string
+		var c Consumption
+		var peak sql.NullFloat64
+		var updated time.Time
+		if err := rows.Scan(&period, &device, &sensor, &c.Energy, &peak, &updated); err != nil {
+			return nil, err
+		}
+		if peak.Valid {
+			c.Peak = &peak.Float64
+		}
+
+		s, ok := result[period]
+		if !ok {
+			continue
+		}
+		if updated.After(s.Updated) {
+			s.Updated = updated
+		}
+
+		switch {
+		case device == "":
+			s.Total = c
+		case sensor == "":
+			s.Devices[device] = c
+		default:
+			if s.Sensors[device] == nil {
+				s.Sensors[device] = make(map[string]Consumption)
+			}
+			s.Sensors[device][sensor] = c
+		}
+	}
+	return result, rows.Err()
+}
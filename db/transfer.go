@@ -0,0 +1,219 @@
+package db
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+var (
+	// ErrNoDevice is returned for transfers of devices the sending user does not have.
+	ErrNoDevice = errors.New("no such device")
+	// ErrNoTransfer is returned for transfers that do not exist, have expired or do not involve the user.
+	ErrNoTransfer = errors.New("no such transfer")
+	// ErrTransferExists is returned if a transfer of the device is already pending.
+	ErrTransferExists = errors.New("device transfer pending")
+	// ErrTransferConflict is returned for transfers to the owner of the device, or to a user that already has a
+	// device with the same id.
+	ErrTransferConflict = errors.New("receiving user cannot take the device")
+)
+
+// DeviceTransfer is a pending transfer of a device and its sensors from one user to another. It is carried out when
+// both users have accepted it.
+type DeviceTransfer struct {
+	ID     uint64 `json:"id"`
+	Device string `json:"device"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	// WithHistory moves all values of the sensors along with the device, otherwise they are removed.
+	WithHistory  bool      `json:"withHistory"`
+	FromAccepted bool      `json:"fromAccepted"`
+	ToAccepted   bool      `json:"toAccepted"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+}
+
+// Done returns true if both users accepted the transfer, i.e. if it has been carried out.
+func (t *DeviceTransfer) Done() bool {
+	return t.FromAccepted && t.ToAccepted
+}
+
+func (tx *tx) scanDeviceTransfers(where string, args ...interface{}) ([]DeviceTransfer, error) {
+	rows, err := tx.Query(`SELECT transfer_id, device_id, from_user, to_user, with_history, from_accepted, to_accepted,
+			created, expires
+		FROM device_transfers `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []DeviceTransfer
+	defer rows.Close()
+	for rows.Next() {
+		var t DeviceTransfer
+		err := rows.Scan(&t.ID, &t.Device, &t.From, &t.To, &t.WithHistory, &t.FromAccepted, &t.ToAccepted,
+			&t.Created, &t.Expires)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+func (tx *tx) AddDeviceTransfer(devID, from, to string, withHistory bool, validFor time.Duration) (*DeviceTransfer, error) {
+	if tx.User(to) == nil {
+		return nil, ErrNoUser
+	}
+	sender := tx.User(from)
+	if sender == nil {
+		return nil, ErrNoUser
+	}
+	if sender.Device(devID) == nil {
+		return nil, ErrNoDevice
+	}
+	if from == to || tx.User(to).Device(devID) != nil {
+		return nil, ErrTransferConflict
+	}
+
+	if _, err := tx.Exec(`DELETE FROM device_transfers WHERE expires < now()`); err != nil {
+		return nil, err
+	}
+
+	t := &DeviceTransfer{Device: devID, From: from, To: to, WithHistory: withHistory}
+	err := tx.QueryRow(`INSERT INTO device_transfers(device_id, from_user, to_user, with_history, expires)
+		VALUES($1, $2, $3, $4, $5) RETURNING transfer_id, created, expires`,
+		devID, from, to, withHistory, time.Now().Add(validFor)).Scan(&t.ID, &t.Created, &t.Expires)
+	if err, ok := err.(*pq.Error); ok && err.Code.Name() == "unique_violation" {
+		return nil, ErrTransferExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (u *user) DeviceTransfers() ([]DeviceTransfer, error) {
+	return u.tx.scanDeviceTransfers(`WHERE (from_user = $1 OR to_user = $1) AND expires >= now() ORDER BY created`, u.id)
+}
+
+// transfer returns a pending transfer the user is involved in, locking it for the transaction.
+func (u *user) transfer(id uint64) (*DeviceTransfer, error) {
+	transfers, err := u.tx.scanDeviceTransfers(`WHERE transfer_id = $1 AND (from_user = $2 OR to_user = $2)
+		AND expires >= now() FOR UPDATE`, id, u.id)
+	if err != nil {
+		return nil, err
+	}
+	if len(transfers) == 0 {
+		return nil, ErrNoTransfer
+	}
+	return &transfers[0], nil
+}
+
+func (u *user) AcceptTransfer(id uint64) (*DeviceTransfer, error) {
+	t, err := u.transfer(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.From == u.id {
+		t.FromAccepted = true
+	}
+	if t.To == u.id {
+		t.ToAccepted = true
+	}
+	if !t.Done() {
+		_, err := u.tx.Exec(`UPDATE device_transfers SET from_accepted = $1, to_accepted = $2 WHERE transfer_id = $3`,
+			t.FromAccepted, t.ToAccepted, t.ID)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	if err := u.tx.moveDevice(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (u *user) RemoveTransfer(id uint64) error {
+	res, err := u.tx.Exec(`DELETE FROM device_transfers WHERE transfer_id = $1 AND (from_user = $2 OR to_user = $2)`,
+		id, u.id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNoTransfer
+	}
+	return nil
+}
+
+// moveDevice carries out a transfer. Sensors keep their sequence numbers, so their values, calibrations and
+// validation rules move along with them. Alert rules and group memberships of the sending user are removed.
+func (tx *tx) moveDevice(t *DeviceTransfer) error {
+	if tx.User(t.To).Device(t.Device) != nil {
+		return ErrTransferConflict
+	}
+	if !t.WithHistory {
+		// buffered values of the sending user would be written after the history is removed
+		tx.db.flush()
+	}
+
+	_, err := tx.Exec(`INSERT INTO devices(device_id, key, name, user_id, is_virtual)
+		SELECT device_id, key, name, $3, is_virtual FROM devices WHERE device_id = $1 AND user_id = $2`,
+		t.Device, t.From, t.To)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE sensors SET user_id = $3 WHERE device_id = $1 AND user_id = $2`, t.Device, t.From, t.To)
+	if err != nil {
+		return err
+	}
+
+	var seqs pq.Int64Array
+	err = tx.QueryRow(`SELECT array(SELECT sensor_seq FROM sensors WHERE device_id = $1 AND user_id = $2)`,
+		t.Device, t.To).Scan(&seqs)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"alert_rules", "sensor_groups"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE sensor_seq = ANY($1)`, seqs); err != nil {
+			return err
+		}
+	}
+
+	if t.WithHistory {
+		_, err = tx.Exec(`DELETE FROM consumption_daily WHERE user_id = $1 AND device_id = $2`, t.To, t.Device)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE consumption_daily SET user_id = $3 WHERE user_id = $2 AND device_id = $1`,
+			t.Device, t.From, t.To)
+		if err != nil {
+			return err
+		}
+	} else {
+		tables := []string{"measure_raw", "measure_quarantine"}
+		for _, table := range timeResTable {
+			tables = append(tables, table)
+		}
+		for _, table := range tables {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE sensor = ANY($1)`, seqs); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(`DELETE FROM consumption_daily WHERE user_id = $1 AND device_id = $2`, t.From, t.Device)
+		if err != nil {
+			return err
+		}
+	}
+	// summaries are recomputed by msgdbd for the receiving user
+	_, err = tx.Exec(`DELETE FROM consumption_summaries WHERE user_id = $1 AND device_id = $2`, t.From, t.Device)
+	if err != nil {
+		return err
+	}
+
+	// removes the transfer through its foreign key
+	_, err = tx.Exec(`DELETE FROM devices WHERE device_id = $1 AND user_id = $2`, t.Device, t.From)
+	return err
+}
@@ -14,7 +14,7 @@ func (tx *tx) AddUser(id, password string) (User, error) {
 		return nil, ErrIDExists
 	}
 
-	_, err := tx.Exec(`INSERT INTO users(user_id, is_admin) VALUES($1, false)`, id)
+	_, err := tx.Exec(`INSERT INTO users(user_id) VALUES($1)`, id)
 	if err != nil {
 		return nil, err
 	}
@@ -103,7 +103,7 @@ func (tx *tx) Group(id string) Group {
 }
 
 func (tx *tx) Groups() map[string]Group {
-	rows, err := tx.Query(`SELECT group_id FROM group`)
+	rows, err := tx.Query(`SELECT group_id FROM groups`)
 	if err != nil {
 		return nil
 	}
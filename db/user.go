@@ -1,8 +1,9 @@
 package db
 
 import (
+	"github.com/mysmartgrid/msg-prototype-2/metrics"
 	"github.com/mysmartgrid/msg2api"
-	"golang.org/x/crypto/bcrypt"
+	"log"
 	"time"
 )
 
@@ -12,7 +13,7 @@ type user struct {
 }
 
 func (u *user) init(password string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 0)
+	hash, err := hashPassword(password)
 	if err != nil {
 		return err
 	}
@@ -32,8 +33,40 @@ func (u *user) HasPassword(pw string) bool {
 		return false
 	}
 
-	err = bcrypt.CompareHashAndPassword(pwHash, []byte(pw))
-	return err == nil
+	ok, upgrade, err := checkPassword(pwHash, pw)
+	if err != nil {
+		log.Printf("checking password of user %v: %v", u.id, err)
+	}
+	if ok && upgrade {
+		if err := u.upgradePassword(pwHash, pw); err != nil {
+			log.Printf("upgrading password hash of user %v: %v", u.id, err)
+		}
+	}
+	return ok
+}
+
+// upgradePassword replaces the hash old of the password of the user by a hash with the current parameters. It runs in
+// a transaction of its own, so the upgrade does not depend on the transaction of the caller. It is skipped if the row
+// of the user is locked, e.g. by the transaction of the caller, or the hash has changed meanwhile.
+func (u *user) upgradePassword(old []byte, pw string) error {
+	hash, err := hashPassword(pw)
+	if err != nil {
+		return err
+	}
+
+	tx, err := u.tx.db.sqldb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET pw_hash = $1
+		WHERE user_id = (SELECT user_id FROM users WHERE user_id = $2 AND pw_hash = $3 FOR UPDATE SKIP LOCKED)`,
+		hash, u.id, old)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (u *user) AddDevice(id string, key []byte, isVirtual bool) (Device, error) {
@@ -153,7 +186,7 @@ func (u *user) IsGroupAdmin(groupID string) bool {
 
 func (u *user) IsAdmin() bool {
 	var isAdmin bool
-	err := u.tx.QueryRow(`SELECT is_admin FROM users WHERE user_id = $1`, u.id).Scan(&isAdmin)
+	err := u.tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM user_roles WHERE user_id = $1 AND role_id = $2)`, u.id, RoleAdmin).Scan(&isAdmin)
 	if err == nil {
 		return isAdmin
 	}
@@ -161,17 +194,20 @@ func (u *user) IsAdmin() bool {
 }
 
 func (u *user) SetAdmin(b bool) error {
-	_, err := u.tx.Exec(`UPDATE users SET is_admin = $1 WHERE user_id = $2`, b, u.id)
-	return err
+	if b {
+		return u.AddRole(RoleAdmin)
+	}
+	return u.RemoveRole(RoleAdmin)
 }
 
 func (u *user) ID() string {
 	return u.id
 }
 
-func (u *user) LoadReadings(since, until time.Time, resolution string, sensors map[string][]string) (map[string]map[string][]msg2api.Measurement, error) {
+// sensorsByKey resolves the sensors identified by device and id that belong to the user to their database ids.
+func (u *user) sensorsByKey(sensors map[string][]string) ([]uint64, map[uint64]Sensor) {
 	var keys []uint64
-	sensorsByKey := make(map[uint64]Sensor)
+	result := make(map[uint64]Sensor)
 
 	for devID, sensorIDs := range sensors {
 		dev := u.Device(devID)
@@ -180,17 +216,17 @@ func (u *user) LoadReadings(since, until time.Time, resolution string, sensors m
 				sensor := dev.Sensor(sensorID)
 				if sensor != nil {
 					keys = append(keys, sensor.DbID())
-					sensorsByKey[sensor.DbID()] = sensor
+					result[sensor.DbID()] = sensor
 				}
 			}
 		}
 	}
 
-	readings, err := u.tx.db.sqldb.loadValues(since, until, resolution, keys)
-	if err != nil {
-		return nil, err
-	}
+	return keys, result
+}
 
+// groupByDevice converts a mapping of sensor database ids to values into a mapping of device ids to sensor ids to values.
+func groupByDevice(readings map[uint64][]msg2api.Measurement, sensorsByKey map[uint64]Sensor) map[string]map[string][]msg2api.Measurement {
 	result := make(map[string]map[string][]msg2api.Measurement)
 	for dbid, values := range readings {
 		devID := sensorsByKey[dbid].Device().ID()
@@ -199,6 +235,79 @@ func (u *user) LoadReadings(since, until time.Time, resolution string, sensors m
 		}
 		result[devID][sensorsByKey[dbid].ID()] = values
 	}
+	return result
+}
+
+// loadLimited loads values like sqlHandler.loadValues, but in chunks and fails once more than maxProcessedValues
+// values were loaded.
+func (u *user) loadLimited(since, until time.Time, resolution string, keys []uint64) (map[uint64][]msg2api.Measurement, error) {
+	result := make(map[uint64][]msg2api.Measurement)
+	total := 0
+	err := u.tx.db.sqldb.streamValues(since, until, resolution, keys, processedChunkSize, func(values map[uint64][]msg2api.Measurement, last time.Time) error {
+		for dbid, v := range values {
+			result[dbid] = append(result[dbid], v...)
+			total += len(v)
+		}
+		if total > maxProcessedValues {
+			return errTooManyValues
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (u *user) LoadReadings(since, until time.Time, resolution string, sensors map[string][]string, opts *ReadingOptions) (map[string]map[string][]msg2api.Measurement, error) {
+	keys, sensorsByKey := u.sensorsByKey(sensors)
+
+	if opts != nil {
+		var err error
+		resolution, err = opts.resolutionFor(since, until, resolution)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return result, nil
+	start := time.Now()
+	var readings map[uint64][]msg2api.Measurement
+	var err error
+	if opts == nil {
+		readings, err = u.tx.db.sqldb.loadValues(since, until, resolution, keys)
+	} else {
+		readings, err = u.loadLimited(since, until, resolution, keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	metrics.LoadDuration.WithLabelValues(resolution).Observe(time.Since(start).Seconds())
+
+	if opts != nil {
+		opts.Resolution = resolution
+		opts.Gaps = nil
+
+		total := 0
+		for _, values := range readings {
+			total += len(values)
+		}
+		for dbid, values := range readings {
+			var markers []time.Time
+			total -= len(values)
+			readings[dbid], markers, err = opts.apply(values, resolution, maxProcessedValues-total)
+			if err != nil {
+				return nil, err
+			}
+			total += len(readings[dbid]) + len(markers)
+			if len(markers) > 0 {
+				if opts.Gaps == nil {
+					opts.Gaps = make(map[string]map[string][]time.Time)
+				}
+				devID := sensorsByKey[dbid].Device().ID()
+				if opts.Gaps[devID] == nil {
+					opts.Gaps[devID] = make(map[string][]time.Time)
+				}
+				opts.Gaps[devID][sensorsByKey[dbid].ID()] = markers
+			}
+		}
+	}
+
+	return groupByDevice(readings, sensorsByKey), nil
 }
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/mysmartgrid/msg2api"
+	"math"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrBelowMin is returned by ValidationRule.Check for values below the minimum.
+	ErrBelowMin = errors.New("value below minimum")
+	// ErrAboveMax is returned by ValidationRule.Check for values above the maximum.
+	ErrAboveMax = errors.New("value above maximum")
+	// ErrRateExceeded is returned by ValidationRule.Check for values changing faster than allowed.
+	ErrRateExceeded = errors.New("value changes too fast")
+
+	errBadRule = errors.New("minimum is greater than maximum")
+)
+
+// ValidationRule describes the plausible values of a sensor. Nil limits are not checked.
+type ValidationRule struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+	// MaxRate is the largest allowed change of the value per second.
+	MaxRate *float64 `json:"maxRate"`
+}
+
+// QuarantinedReading is a reading that was rejected by validation instead of being stored.
+type QuarantinedReading struct {
+	Time time.Time `json:"time"`
+	// Value is nil for values that are not finite numbers.
+	Value    *float64  `json:"value"`
+	Reason   string    `json:"reason"`
+	Received time.Time `json:"received"`
+}
+
+// RejectedReading is a reading that failed validation, along with the reason.
+type RejectedReading struct {
+	Value msg2api.Measurement
+	Err   error
+}
+
+// ValidateReadings checks readings of a sensor received at now with CheckReading and, if not nil, rule, in the order
+// given. prev is the last accepted reading of the sensor before them, if known. Readings are split into those
+// that may be stored and those that must be quarantined.
+func ValidateReadings(values []msg2api.Measurement, rule *ValidationRule, prev *msg2api.Measurement, now time.Time, backfill bool) (accepted []msg2api.Measurement, rejected []RejectedReading) {
+	accepted = make([]msg2api.Measurement, 0, len(values))
+	for _, value := range values {
+		err := CheckReading(value, now, backfill)
+		if rule != nil && err == nil {
+			err = rule.Check(value, prev)
+		}
+		if err != nil {
+			rejected = append(rejected, RejectedReading{value, err})
+			continue
+		}
+
+		accepted = append(accepted, value)
+		prev = &accepted[len(accepted)-1]
+	}
+	return accepted, rejected
+}
+
+// Check returns the error describing the limit violated by value.
+// prev is the last accepted value of the sensor, the rate of change is only checked if it is not nil.
+func (r *ValidationRule) Check(value msg2api.Measurement, prev *msg2api.Measurement) error {
+	if r.Min != nil && value.Value < *r.Min {
+		return ErrBelowMin
+	}
+	if r.Max != nil && value.Value > *r.Max {
+		return ErrAboveMax
+	}
+	if r.MaxRate != nil && prev != nil {
+		dt := value.Time.Sub(prev.Time).Seconds()
+		if dt > 0 && math.Abs(value.Value-prev.Value)/dt > *r.MaxRate {
+			return ErrRateExceeded
+		}
+	}
+	return nil
+}
+
+func (r *ValidationRule) check() error {
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return errBadRule
+	}
+	return nil
+}
+
+// ruleFromColumns creates a rule from nullable database columns, returns nil if no limit is set.
+func ruleFromColumns(min, max, maxRate sql.NullFloat64) *ValidationRule {
+	if !min.Valid && !max.Valid && !maxRate.Valid {
+		return nil
+	}
+
+	column := func(v sql.NullFloat64) *float64 {
+		if !v.Valid {
+			return nil
+		}
+		return &v.Float64
+	}
+	return &ValidationRule{column(min), column(max), column(maxRate)}
+}
+
+// pgFloat formats v as a PostgreSQL double precision literal, including non finite values.
+func pgFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+const quarantineQuery = `INSERT INTO measure_quarantine(sensor, "timestamp", value, reason) VALUES($1, $2, $3::double precision, $4)`
+
+func (db *db) Quarantine(sensor Sensor, value msg2api.Measurement, reason string) error {
+	_, err := db.sqldb.db.Exec(quarantineQuery, sensor.DbID(), value.Time, pgFloat(value.Value), reason)
+	return err
+}
+
+func (tx *tx) UnitValidationRules() map[string]ValidationRule {
+	rows, err := tx.Query(`SELECT unit, min_value, max_value, max_rate FROM unit_validation_rules`)
+	if err != nil {
+		return nil
+	}
+
+	result := make(map[string]ValidationRule)
+	defer rows.Close()
+	for rows.Next() {
+		var unit string
+		var min, max, maxRate sql.NullFloat64
+		if err := rows.Scan(&unit, &min, &max, &maxRate); err != nil {
+			return nil
+		}
+		if rule := ruleFromColumns(min, max, maxRate); rule != nil {
+			result[unit] = *rule
+		}
+	}
+	if rows.Err() != nil {
+		return nil
+	}
+
+	return result
+}
+
+func (tx *tx) SetUnitValidationRule(unit string, rule *ValidationRule) error {
+	if rule == nil {
+		_, err := tx.Exec(`DELETE FROM unit_validation_rules WHERE unit = $1`, unit)
+		return err
+	}
+	if err := rule.check(); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`INSERT INTO unit_validation_rules(unit, min_value, max_value, max_rate) VALUES($1, $2, $3, $4)
+		ON CONFLICT (unit) DO UPDATE SET min_value = excluded.min_value, max_value = excluded.max_value, max_rate = excluded.max_rate`,
+		unit, rule.Min, rule.Max, rule.MaxRate)
+	return err
+}
+
+func (d *device) ValidationRules() map[string]ValidationRule {
+	rows, err := d.user.tx.Query(`SELECT s.sensor_id,
+			COALESCE(r.min_value, u.min_value), COALESCE(r.max_value, u.max_value), COALESCE(r.max_rate, u.max_rate)
+		FROM sensors s
+		LEFT JOIN sensor_validation_rules r ON r.sensor_seq = s.sensor_seq
+		LEFT JOIN unit_validation_rules u ON u.unit = s.unit
+		WHERE s.user_id = $1 AND s.device_id = $2`, d.user.id, d.id)
+	if err != nil {
+		return nil
+	}
+
+	result := make(map[string]ValidationRule)
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var min, max, maxRate sql.NullFloat64
+		if err := rows.Scan(&id, &min, &max, &maxRate); err != nil {
+			return nil
+		}
+		if rule := ruleFromColumns(min, max, maxRate); rule != nil {
+			result[id] = *rule
+		}
+	}
+	if rows.Err() != nil {
+		return nil
+	}
+
+	return result
+}
+
+func (s *sensor) ValidationRule() *ValidationRule {
+	var min, max, maxRate sql.NullFloat64
+	err := s.device.user.tx.QueryRow(`SELECT min_value, max_value, max_rate FROM sensor_validation_rules WHERE sensor_seq = $1`, s.seq).
+		Scan(&min, &max, &maxRate)
+	if err != nil {
+		return nil
+	}
+	return ruleFromColumns(min, max, maxRate)
+}
+
+func (s *sensor) SetValidationRule(rule *ValidationRule) error {
+	if rule == nil {
+		_, err := s.device.user.tx.Exec(`DELETE FROM sensor_validation_rules WHERE sensor_seq = $1`, s.seq)
+		return err
+	}
+	if err := rule.check(); err != nil {
+		return err
+	}
+
+	_, err := s.device.user.tx.Exec(`INSERT INTO sensor_validation_rules(sensor_seq, min_value, max_value, max_rate) VALUES($1, $2, $3, $4)
+		ON CONFLICT (sensor_seq) DO UPDATE SET min_value = excluded.min_value, max_value = excluded.max_value, max_rate = excluded.max_rate`,
+		s.seq, rule.Min, rule.Max, rule.MaxRate)
+	return err
+}
+
+func (s *sensor) QuarantinedReadings(since, until time.Time) ([]QuarantinedReading, error) {
+	rows, err := s.device.user.tx.Query(`SELECT "timestamp", value::text, reason, received FROM measure_quarantine
+		WHERE sensor = $1 AND "timestamp" BETWEEN $2 AND $3 ORDER BY "timestamp"`, s.seq, since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []QuarantinedReading
+	defer rows.Close()
+	for rows.Next() {
+		var q QuarantinedReading
+		var value string
+		if err := rows.Scan(&q.Time, &value, &q.Reason, &q.Received); err != nil {
+			return nil, err
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			q.Value = &v
+		}
+		result = append(result, q)
+	}
+	return result, rows.Err()
+}
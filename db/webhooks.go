@@ -0,0 +1,264 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/lib/pq"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Events webhooks may subscribe to.
+const (
+	WebhookSensorAdded    = "sensor.added"
+	WebhookSensorRemoved  = "sensor.removed"
+	WebhookDeviceLinked   = "device.linked"
+	WebhookDeviceUnlinked = "device.unlinked"
+	WebhookDeviceOffline  = "device.offline"
+	// WebhookMeasurements is sent with the values received from the devices of the user since the last delivery.
+	WebhookMeasurements = "measurements"
+	// WebhookAlert is sent when an alert fires or is resolved. Alerts are also sent to the webhook set in their rule.
+	WebhookAlert = "alert"
+)
+
+var (
+	errBadWebhookEvent = errors.New("unknown webhook event")
+	errPrivateWebhook  = errors.New("webhook url must not point to a private or loopback address")
+)
+
+// privateNets are the networks webhooks must not be delivered to, besides loopback, link local, multicast and
+// unspecified addresses.
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "198.18.0.0/15", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		privateNets = append(privateNets, n)
+	}
+}
+
+// PublicIP returns true if webhooks may be delivered to ip.
+func PublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Webhook is an endpoint events of a user are posted to.
+type Webhook struct {
+	ID   uint64 `json:"id"`
+	User string `json:"-"`
+	URL  string `json:"url"`
+	// Secret is the key of the HMAC signature of every delivery.
+	Secret string `json:"secret,omitempty"`
+	// Events lists the events posted to the webhook, all events are posted if empty.
+	Events  []string  `json:"events"`
+	Created time.Time `json:"created"`
+}
+
+// Wants returns true if event is posted to the webhook.
+func (w *Webhook) Wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is a single event queued for a webhook, along with the result of the last delivery attempt.
+type WebhookDelivery struct {
+	ID      uint64          `json:"id"`
+	Webhook uint64          `json:"webhook"`
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+	Created time.Time       `json:"created"`
+
+	Attempts int `json:"attempts"`
+	// NextAttempt is nil if the delivery succeeded or was given up.
+	NextAttempt *time.Time `json:"nextAttempt"`
+	Delivered   *time.Time `json:"delivered"`
+	// Status is the HTTP status of the last attempt, 0 if no response was received.
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+func (tx *tx) scanWebhooks(where string, args ...interface{}) ([]Webhook, error) {
+	rows, err := tx.Query(`SELECT webhook_id, user_id, url, secret, events, created FROM webhooks `+where+` ORDER BY webhook_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Webhook
+	defer rows.Close()
+	for rows.Next() {
+		var w Webhook
+		var events pq.StringArray
+		if err := rows.Scan(&w.ID, &w.User, &w.URL, &w.Secret, &events, &w.Created); err != nil {
+			return nil, err
+		}
+		w.Events = []string(events)
+		result = append(result, w)
+	}
+	return result, rows.Err()
+}
+
+const webhookDeliveryColumns = `d.delivery_id, d.webhook_id, d.event, d.payload, d.created, d.attempts, d.next_attempt, d.delivered, d.status, d.error`
+
+func (tx *tx) scanWebhookDeliveries(where string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := tx.Query(`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries d `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	return readWebhookDeliveries(rows)
+}
+
+func readWebhookDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	var result []WebhookDelivery
+	defer rows.Close()
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload []byte
+		var next, delivered pq.NullTime
+		if err := rows.Scan(&d.ID, &d.Webhook, &d.Event, &payload, &d.Created, &d.Attempts, &next, &delivered, &d.Status, &d.Error); err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		if next.Valid {
+			d.NextAttempt = &next.Time
+		}
+		if delivered.Valid {
+			d.Delivered = &delivered.Time
+		}
+		result = append(result, d)
+	}
+	return result, rows.Err()
+}
+
+func (tx *tx) Webhooks() ([]Webhook, error) {
+	return tx.scanWebhooks(``)
+}
+
+func (tx *tx) QueueWebhookDelivery(webhook uint64, event string, payload []byte) error {
+	_, err := tx.Exec(`INSERT INTO webhook_deliveries(webhook_id, event, payload, next_attempt) VALUES($1, $2, $3, now())`,
+		webhook, event, string(payload))
+	return err
+}
+
+func (tx *tx) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	// deliveries behind a pending delivery of the same webhook that is not claimed with them, e.g. one awaiting a
+	// retry or claimed by another transaction, are left for later to keep the order of each webhook
+	rows, err := tx.Query(`WITH candidates AS (
+			SELECT delivery_id, webhook_id FROM webhook_deliveries
+			WHERE next_attempt <= now()
+			ORDER BY delivery_id LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		), claimed AS (
+			SELECT c.delivery_id FROM candidates c
+			WHERE NOT EXISTS (SELECT 1 FROM webhook_deliveries e
+				WHERE e.webhook_id = c.webhook_id AND e.delivery_id < c.delivery_id AND e.next_attempt IS NOT NULL
+					AND e.delivery_id NOT IN (SELECT delivery_id FROM candidates)))
+		UPDATE webhook_deliveries d SET next_attempt = now() + $2 * interval '1 second'
+		FROM claimed c
+		WHERE d.delivery_id = c.delivery_id
+		RETURNING `+webhookDeliveryColumns, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := readWebhookDeliveries(rows)
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, err
+}
+
+func (tx *tx) ReleaseWebhookDeliveries(ids []uint64) error {
+	seqs := make(pq.Int64Array, len(ids))
+	for i, id := range ids {
+		seqs[i] = int64(id)
+	}
+	_, err := tx.Exec(`UPDATE webhook_deliveries SET next_attempt = now() WHERE delivery_id = ANY($1)`, seqs)
+	return err
+}
+
+func (tx *tx) RecordWebhookAttempt(id uint64, status int, failure string, retryAt *time.Time) error {
+	var err error
+	if failure == "" {
+		_, err = tx.Exec(`UPDATE webhook_deliveries
+			SET attempts = attempts + 1, status = $2, error = '', next_attempt = NULL, delivered = now()
+			WHERE delivery_id = $1`, id, status)
+	} else {
+		_, err = tx.Exec(`UPDATE webhook_deliveries
+			SET attempts = attempts + 1, status = $2, error = $3, next_attempt = $4
+			WHERE delivery_id = $1`, id, status, failure, retryAt)
+	}
+	return err
+}
+
+func (tx *tx) PruneWebhookDeliveries(before time.Time) error {
+	_, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE next_attempt IS NULL AND created < $1`, before)
+	return err
+}
+
+func (u *user) Webhooks() ([]Webhook, error) {
+	hooks, err := u.tx.scanWebhooks(`WHERE user_id = $1`, u.id)
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	return hooks, err
+}
+
+func (u *user) AddWebhook(hookURL string, events []string) (Webhook, error) {
+	parsed, err := url.Parse(hookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return Webhook{}, errBadWebhook
+	}
+	// names are checked again when delivering, they may resolve to different addresses by then
+	if ip := net.ParseIP(parsed.Hostname()); parsed.Hostname() == "localhost" || (ip != nil && !PublicIP(ip)) {
+		return Webhook{}, errPrivateWebhook
+	}
+	for _, e := range events {
+		switch e {
+		case WebhookSensorAdded, WebhookSensorRemoved, WebhookDeviceLinked, WebhookDeviceUnlinked, WebhookDeviceOffline, WebhookMeasurements, WebhookAlert:
+		default:
+			return Webhook{}, errBadWebhookEvent
+		}
+	}
+
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return Webhook{}, err
+	}
+
+	w := Webhook{User: u.id, URL: hookURL, Secret: hex.EncodeToString(secret[:]), Events: events}
+	if w.Events == nil {
+		w.Events = []string{}
+	}
+	err = u.tx.QueryRow(`INSERT INTO webhooks(user_id, url, secret, events) VALUES($1, $2, $3, $4) RETURNING webhook_id, created`,
+		u.id, w.URL, w.Secret, pq.StringArray(w.Events)).Scan(&w.ID, &w.Created)
+	return w, err
+}
+
+func (u *user) RemoveWebhook(id uint64) error {
+	_, err := u.tx.Exec(`DELETE FROM webhooks WHERE user_id = $1 AND webhook_id = $2`, u.id, id)
+	return err
+}
+
+func (u *user) WebhookDeliveries(id uint64, limit int) ([]WebhookDelivery, error) {
+	return u.tx.scanWebhookDeliveries(`JOIN webhooks w ON w.webhook_id = d.webhook_id
+		WHERE w.user_id = $1 AND w.webhook_id = $2
+		ORDER BY d.delivery_id DESC LIMIT $3`, u.id, id, limit)
+}
@@ -0,0 +1,538 @@
+package devsim
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mysmartgrid/msg2api"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrDeviceNotRegistered is returned by Heartbeat if the device is not known to the device database.
+var ErrDeviceNotRegistered = errors.New("device not registered")
+
+// Sensor describes a sensor of a simulated device.
+type Sensor struct {
+	Name                string
+	Unit                string
+	Port                int32
+	Factor              float64
+	LastRealtimeRequest time.Time
+}
+
+// Device is a simulated device.
+// The exported fields are the persistent state of the device, API endpoints and TLS configuration have to be set after loading a device.
+type Device struct {
+	ID  string
+	Key []byte
+
+	User string
+
+	Sensors map[string]Sensor
+
+	// API is the base URL of the device websocket API, e.g. ws://[::1]:8080/ws/device
+	API string `json:"-"`
+	// RegdevAPI is the base URL of the device registration API, e.g. http://[::1]:8080/api/regdev/v1
+	RegdevAPI string `json:"-"`
+	// TLSConfig is used for websocket connections to API.
+	TLSConfig *tls.Config `json:"-"`
+	// HTTPClient is used for requests to RegdevAPI, http.DefaultClient is used if nil.
+	HTTPClient *http.Client `json:"-"`
+	// OnRealtimeRequest is called when the server requests realtime updates for sensors of the device, if not nil.
+	OnRealtimeRequest func(sensors []string) `json:"-"`
+
+	client *msg2api.DeviceClient
+}
+
+func randomID() (string, []byte) {
+	var buf [32]byte
+
+	_, err := crand.Read(buf[:])
+	if err != nil {
+		log.Fatalf("rand read: %v", err.Error())
+	}
+
+	return hex.EncodeToString(buf[0:16]), buf[16:32]
+}
+
+// NewRandomDevice creates a device with random id and key and no sensors.
+func NewRandomDevice() *Device {
+	id, key := randomID()
+	return &Device{
+		ID:  id,
+		Key: key,
+	}
+}
+
+// NewDevice creates a device with random id and key, which has one sensor with a random id for each of the given sensor definitions.
+func NewDevice(definitions []Sensor) *Device {
+	id, key := randomID()
+	device := Device{
+		ID:      id,
+		Key:     key,
+		Sensors: make(map[string]Sensor),
+	}
+
+	for _, sensor := range definitions {
+		for {
+			var raw [16]byte
+
+			if _, err := crand.Read(raw[:]); err != nil {
+				log.Fatalf("rand read: %v", err.Error())
+			}
+
+			id := hex.EncodeToString(raw[:])
+			if _, ok := device.Sensors[id]; !ok {
+				device.Sensors[id] = sensor
+				break
+			}
+		}
+	}
+
+	return &device
+}
+
+func (dev *Device) httpClient() *http.Client {
+	if dev.HTTPClient != nil {
+		return dev.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Client returns the msg2api client of the device, connecting to the device API if necessary.
+func (dev *Device) Client() (*msg2api.DeviceClient, error) {
+	if dev.client == nil {
+		client, err := msg2api.NewDeviceClient(dev.API+"/"+dev.User+"/"+dev.ID, dev.Key, dev.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		client.RequestRealtimeUpdates = func(sensors []string) {
+			if dev.OnRealtimeRequest != nil {
+				dev.OnRealtimeRequest(sensors)
+			}
+			for _, sensor := range sensors {
+				if s, ok := dev.Sensors[sensor]; ok {
+					s.LastRealtimeRequest = time.Now()
+					dev.Sensors[sensor] = s
+				}
+			}
+		}
+
+		dev.client = client
+	}
+
+	return dev.client, nil
+}
+
+// GenerateRandomSensors adds count sensors with random ids and units to the device.
+func (dev *Device) GenerateRandomSensors(count int64) {
+	if dev.Sensors == nil {
+		dev.Sensors = make(map[string]Sensor)
+	}
+
+	for count > 0 {
+		var raw [16]byte
+
+		if _, err := crand.Read(raw[:]); err != nil {
+			log.Fatalf("rand read: %v", err.Error())
+		}
+
+		id := hex.EncodeToString(raw[:])
+		if _, ok := dev.Sensors[id]; ok {
+			continue
+		}
+
+		dev.Sensors[id] = Sensor{
+			Name:   fmt.Sprintf("Sensor %v", count),
+			Unit:   []string{"U1", "U2"}[rand.Int31n(2)],
+			Port:   int32(len(dev.Sensors)),
+			Factor: 1.0,
+		}
+		count--
+	}
+}
+
+// Register adds the device to the device database.
+func (dev *Device) Register() error {
+	req, err := http.NewRequest("POST", dev.RegdevAPI+"/"+dev.ID, nil)
+	if err != nil {
+		return err
+	}
+	req.Header["X-Key"] = []string{hex.EncodeToString(dev.Key)}
+	resp, err := dev.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+func getMemInfo() map[string]uint64 {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		panic(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	result := make(map[string]uint64)
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		key := fields[0]
+		value, err := strconv.ParseUint(strings.Fields(fields[1])[0], 10, 64)
+		if err != nil {
+			panic(err)
+		}
+
+		switch key {
+		case "MemTotal":
+			result["Total"] = value
+		case "MemFree":
+			result["Free"] = value
+		case "Cached":
+			result["Cached"] = value
+		case "Buffers":
+			result["Buffered"] = value
+		}
+	}
+
+	return result
+}
+
+func getUptime() uint64 {
+	data, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		panic(err.Error())
+	}
+	uptime, err := strconv.ParseFloat(strings.Fields(string(data))[0], 64)
+	if err != nil {
+		panic(err)
+	}
+	return uint64(uptime)
+}
+
+// Heartbeat sends a heartbeat to the device database and updates the user the device is linked to from the response.
+// Returns the decrypted device configuration sent by the server.
+func (dev *Device) Heartbeat() (map[string]interface{}, error) {
+	mac := hmac.New(sha256.New, dev.Key)
+	hbInfo := map[string]interface{}{
+		"Time":   time.Now().Unix(),
+		"Memory": getMemInfo(),
+		"Uptime": getUptime(),
+		"Resets": 0,
+		"Type":   "msgpc",
+		"Syslog": "",
+		"Firmware": map[string]string{
+			"Version":     "0.1",
+			"ReleaseTime": "not yet",
+			"Build":       "from git",
+			"Tag":         "<unknown>",
+		},
+		"config": map[string]interface{}{
+			"lan": map[string]interface{}{
+				"enabled":  true,
+				"protocol": "dhcp",
+			},
+		},
+	}
+	hbData, err := json.Marshal(hbInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	hbURL, _ := url.Parse(dev.RegdevAPI + "/" + dev.ID + "/status")
+	params := url.Values{
+		"ts": []string{strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+	mac.Write([]byte(params["ts"][0]))
+	mac.Write(hbData)
+	params["sig"] = []string{hex.EncodeToString(mac.Sum(nil))}
+	hbURL.RawQuery = params.Encode()
+	mac.Reset()
+
+	req, err := http.NewRequest("POST", hbURL.String(), bytes.NewReader(hbData))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dev.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		var err error
+		var body, nonce, iv, macValue []byte
+
+		if body, err = ioutil.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+		if body, err = hex.DecodeString(string(body)); err != nil {
+			return nil, err
+		}
+
+		if nonce, err = hex.DecodeString(resp.Header.Get("X-Nonce")); err != nil {
+			return nil, err
+		}
+		if iv, err = hex.DecodeString(resp.Header.Get("X-IV")); err != nil {
+			return nil, err
+		}
+		if macValue, err = hex.DecodeString(resp.Header.Get("X-HMAC")); err != nil {
+			return nil, err
+		}
+
+		mac.Write(body)
+
+		if !hmac.Equal(mac.Sum(nil), macValue) {
+			return nil, errors.New("bad hmac")
+		}
+
+		mac.Reset()
+		mac.Write(nonce)
+		key := mac.Sum(nil)[:16]
+
+		cinst, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		transform := cipher.NewCFBDecrypter(cinst, iv[:])
+		transform.XORKeyStream(body, body)
+
+		var content map[string]interface{}
+		if err := json.Unmarshal(body, &content); err != nil {
+			return nil, err
+		}
+		if user, ok := content["linkedTo"].(string); ok {
+			dev.User = user
+		} else {
+			dev.User = ""
+		}
+		return content, nil
+
+	case 404:
+		return nil, ErrDeviceNotRegistered
+
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New(string(body))
+	}
+}
+
+// Backfill sends values measured in the past to the server in a single signed request.
+// Returns the number of values the server stored, values already known to the server are skipped and values
+// failing validation are quarantined by the server.
+func (dev *Device) Backfill(values map[string][]msg2api.Measurement) (int, error) {
+	pairs := make(map[string][][2]float64, len(values))
+	for id, sensorValues := range values {
+		for _, value := range sensorValues {
+			ts := float64(value.Time.UnixNano()) / float64(time.Millisecond)
+			pairs[id] = append(pairs[id], [2]float64{ts, value.Value})
+		}
+	}
+	data, err := json.Marshal(pairs)
+	if err != nil {
+		return 0, err
+	}
+
+	bfURL, _ := url.Parse(dev.RegdevAPI + "/" + dev.ID + "/backfill")
+	params := url.Values{
+		"ts": []string{strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+	mac := hmac.New(sha256.New, dev.Key)
+	mac.Write([]byte(params["ts"][0]))
+	mac.Write(data)
+	params["sig"] = []string{hex.EncodeToString(mac.Sum(nil))}
+	bfURL.RawQuery = params.Encode()
+
+	resp, err := dev.httpClient().Post(bfURL.String(), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return 0, errors.New(string(body))
+	}
+
+	var result struct {
+		Added int `json:"added"`
+	}
+	err = json.Unmarshal(body, &result)
+	return result.Added, err
+}
+
+// BackfillRandomValues sends random values for every sensor of the device, one every interval over the last span.
+func (dev *Device) BackfillRandomValues(span, interval time.Duration) (int, error) {
+	values := make(map[string][]msg2api.Measurement, len(dev.Sensors))
+	now := time.Now()
+	for id := range dev.Sensors {
+		for t := now.Add(-span); t.Before(now); t = t.Add(interval) {
+			values[id] = append(values[id], msg2api.Measurement{t, rand.Float64()})
+		}
+	}
+	return dev.Backfill(values)
+}
+
+// RegisterSensors adds all sensors of the device to the users database and sets their names.
+func (dev *Device) RegisterSensors() error {
+	client, err := dev.Client()
+	if err != nil {
+		return err
+	}
+
+	for id, sens := range dev.Sensors {
+		if err := client.AddSensor(id, sens.Unit, sens.Port, sens.Factor); err != nil {
+			return err
+		}
+		md := msg2api.SensorMetadata{
+			Name: &sens.Name,
+		}
+		if err := client.UpdateSensor(id, md); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UpdateSensors sends the names of all sensors to the server.
+func (dev *Device) UpdateSensors() error {
+	client, err := dev.Client()
+	if err != nil {
+		return err
+	}
+
+	for id, sens := range dev.Sensors {
+		md := msg2api.SensorMetadata{
+			Name: &sens.Name,
+		}
+		if err := client.UpdateSensor(id, md); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SendRandomValues sends one random value for every sensor of the device in a single update.
+func (dev *Device) SendRandomValues() error {
+	client, err := dev.Client()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	values := make(map[string][]msg2api.Measurement, len(dev.Sensors))
+	for id := range dev.Sensors {
+		values[id] = []msg2api.Measurement{{now, rand.Float64()}}
+	}
+
+	return client.Update(values)
+}
+
+// SendRandomUpdates sends count random values for every sensor of the device, waiting interval between each round of values.
+// A negative count sends values until an error occurs.
+func (dev *Device) SendRandomUpdates(interval time.Duration, count int64) error {
+	for ; count != 0; count-- {
+		if err := dev.SendRandomValues(); err != nil {
+			return err
+		}
+
+		time.Sleep(interval)
+	}
+
+	return nil
+}
+
+// RenameSensors appends a random number to the name of every sensor.
+func (dev *Device) RenameSensors() error {
+	client, err := dev.Client()
+	if err != nil {
+		return err
+	}
+
+	for id, sens := range dev.Sensors {
+		name := fmt.Sprintf("%v (%v)", sens.Name, rand.Int31n(1000))
+		if err := client.UpdateSensor(id, msg2api.SensorMetadata{Name: &name}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReplaceSensors removes all sensors of the device and registers the same number of new random sensors.
+func (dev *Device) ReplaceSensors() error {
+	client, err := dev.Client()
+	if err != nil {
+		return err
+	}
+
+	for id := range dev.Sensors {
+		err := client.RemoveSensor(id)
+		switch e := err.(type) {
+		case *msg2api.Error:
+			if e.Code != "operation failed" || e.Extra != "id invalid" {
+				return err
+			}
+
+		case nil:
+		default:
+			return err
+		}
+	}
+	count := len(dev.Sensors)
+	dev.Sensors = nil
+	dev.GenerateRandomSensors(int64(count))
+
+	return dev.RegisterSensors()
+}
+
+// Rename sets a new random name for the device.
+func (dev *Device) Rename() error {
+	client, err := dev.Client()
+	if err != nil {
+		return err
+	}
+
+	return client.Rename(fmt.Sprintf("%v (%v)", dev.ID, rand.Int31n(100)))
+}
+
+// Wait processes count messages from the server.
+func (dev *Device) Wait(count uint64) error {
+	client, err := dev.Client()
+	if err != nil {
+		return err
+	}
+
+	for ; count > 0; count-- {
+		if err := client.RunOnce(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+// Package devsim contains simulated devices that talk to the MSGp service like real devices do:
+// they register themselves in the device database, send heartbeats and use the msg2api device protocol
+// to manage their sensors and send measurements.
+//
+// Simulated devices are used by the msgpc test client and the msgpload load testing tool.
+package devsim
@@ -1,3 +1,10 @@
+/*
+ * ws connects a flukso to msgpd as a device and bridges the websocket to a pair of fifos, one message per line. It
+ * does not look into the messages: they are composed by the flukso lua daemon, which is not part of this tree. Update
+ * batches of multiple sensors are therefore built by the daemon, which sends the values of all sensors of a sample
+ * as one update line; ws only has to accept lines as long as such a batch.
+ */
+
 #define _BSD_SOURCE
 
 #include <ctype.h>
@@ -87,7 +94,8 @@ enum {
 static int clientState = CS_AUTH_INIT;
 static unsigned char response[32];
 static struct pollfd pollSet[2];
-static char inputBuffer[4096];
+// large enough for an update batch of all sensors of a device, see the top of the file
+static char inputBuffer[65536];
 static unsigned inputBufferLength;
 static const char authResponseOK[] = "proceed";
 
@@ -215,7 +223,7 @@ static int msg_1_device_callback(struct libwebsocket_context *context, struct li
 		}
 
 		case CS_BRIDGING: {
-			unsigned char buffer[LWS_SEND_BUFFER_PRE_PADDING + LWS_SEND_BUFFER_POST_PADDING + sizeof(inputBuffer)];
+			static unsigned char buffer[LWS_SEND_BUFFER_PRE_PADDING + LWS_SEND_BUFFER_POST_PADDING + sizeof(inputBuffer)];
 
 			memcpy(buffer + LWS_SEND_BUFFER_PRE_PADDING, inputBuffer, inputBufferLength);
 			int sent = libwebsocket_write(wsi, buffer + LWS_SEND_BUFFER_PRE_PADDING, inputBufferLength, LWS_WRITE_TEXT);
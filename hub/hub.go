@@ -5,15 +5,23 @@
 // The hub is used by the user and device API to broadcast updates of sensors values, sensor metadata and other information.
 package hub
 
+import (
+	"github.com/mysmartgrid/msg-prototype-2/metrics"
+	"time"
+)
+
 // Hub manages all subscriptions and communications for a single hub.
 type Hub struct {
 	subscribers map[string]map[*Conn]bool
+	// subscriptions is the number of subscriptions in subscribers.
+	subscriptions int
 
 	subscribe   chan subscription
 	unsubscribe chan subscription
 	detach      chan *Conn
 
 	publish chan Value
+	ping    chan chan struct{}
 }
 
 type subscription struct {
@@ -37,12 +45,20 @@ type Conn struct {
 }
 
 func (h *Hub) doUnsubscribe(topic string, conn *Conn) {
+	if h.subscribers[topic][conn] {
+		h.subscriptions--
+	}
 	delete(h.subscribers[topic], conn)
 	if len(h.subscribers[topic]) == 0 {
 		delete(h.subscribers, topic)
 	}
 }
 
+func (h *Hub) updateMetrics() {
+	metrics.HubTopics.Set(float64(len(h.subscribers)))
+	metrics.HubSubscriptions.Set(float64(h.subscriptions))
+}
+
 // New creates a new hub and starts its management process.
 func New() *Hub {
 	hub := &Hub{
@@ -51,6 +67,7 @@ func New() *Hub {
 		unsubscribe: make(chan subscription),
 		detach:      make(chan *Conn),
 		publish:     make(chan Value),
+		ping:        make(chan chan struct{}),
 	}
 
 	go func() {
@@ -60,15 +77,24 @@ func New() *Hub {
 				if hub.subscribers[s.topic] == nil {
 					hub.subscribers[s.topic] = make(map[*Conn]bool)
 				}
+				if !hub.subscribers[s.topic][s.conn] {
+					hub.subscriptions++
+				}
 				hub.subscribers[s.topic][s.conn] = true
+				hub.updateMetrics()
 
 			case s := <-hub.unsubscribe:
 				hub.doUnsubscribe(s.topic, s.conn)
+				hub.updateMetrics()
 
 			case hc := <-hub.detach:
 				for topic := range hub.subscribers {
 					hub.doUnsubscribe(topic, hc)
 				}
+				hub.updateMetrics()
+
+			case reply := <-hub.ping:
+				close(reply)
 
 			case value := <-hub.publish:
 				for conn := range hub.subscribers[value.Topic] {
@@ -86,6 +112,26 @@ func (h *Hub) Publish(topic string, data interface{}) {
 	h.publish <- Value{topic, data}
 }
 
+// Alive returns true if the management process of the hub responds within timeout.
+func (h *Hub) Alive(timeout time.Duration) bool {
+	reply := make(chan struct{})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case h.ping <- reply:
+	case <-timer.C:
+		return false
+	}
+
+	select {
+	case <-reply:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
 // Connect creates a new connection to the hub with no subscriptions.
 func (h *Hub) Connect() *Conn {
 	r := &Conn{
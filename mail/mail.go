@@ -0,0 +1,68 @@
+// Package mail sends mails to users, e.g. password reset links.
+// Senders other than SMTPSender do not deliver mails and are meant for testing.
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Sender sends a plain text mail.
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+func format(from, to, subject, body string) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %v\r\n", from)
+	fmt.Fprintf(&msg, "To: %v\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %v\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n%v\r\n", strings.Replace(body, "\n", "\r\n", -1))
+	return msg.Bytes()
+}
+
+// SMTPSender sends mails through a mail server.
+type SMTPSender struct {
+	// Addr is the address of the mail server, including the port.
+	Addr string
+	From string
+	// Auth is used to authenticate with the mail server if not nil.
+	Auth smtp.Auth
+}
+
+// Send implements Sender.
+func (s *SMTPSender) Send(to, subject, body string) error {
+	return smtp.SendMail(s.Addr, s.Auth, s.From, []string{to}, format(s.From, to, subject, body))
+}
+
+// LogSender writes mails to the log instead of sending them.
+type LogSender struct{}
+
+// Send implements Sender.
+func (LogSender) Send(to, subject, body string) error {
+	log.Printf("mail to %v: %v\n%v", to, subject, body)
+	return nil
+}
+
+// FileSender writes every mail to a new file in Dir instead of sending it.
+type FileSender struct {
+	Dir  string
+	From string
+
+	count uint64
+}
+
+// Send implements Sender.
+func (s *FileSender) Send(to, subject, body string) error {
+	name := fmt.Sprintf("%d-%d.eml", time.Now().UnixNano(), atomic.AddUint64(&s.count, 1))
+	return ioutil.WriteFile(filepath.Join(s.Dir, name), format(s.From, to, subject, body), 0600)
+}
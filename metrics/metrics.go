@@ -0,0 +1,97 @@
+// Package metrics defines the Prometheus metrics of msgpd.
+// All metrics are registered with the default registry and exported by promhttp.Handler.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// BufferedValues is the number of values in the value buffer of the database, waiting to be written.
+	BufferedValues = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "msgp",
+		Subsystem: "db",
+		Name:      "buffered_values",
+		Help:      "Number of values waiting in the value buffer.",
+	})
+
+	// BufferFlushDuration observes the time taken to write the value buffer to the database.
+	BufferFlushDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "msgp",
+		Subsystem: "db",
+		Name:      "buffer_flush_duration_seconds",
+		Help:      "Time taken to write the value buffer to the database.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+
+	// BufferFlushedValues counts the values written from the value buffer.
+	BufferFlushedValues = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "msgp",
+		Subsystem: "db",
+		Name:      "buffer_flushed_values_total",
+		Help:      "Number of values written from the value buffer.",
+	})
+
+	// LoadDuration observes the time taken to load readings, by resolution.
+	LoadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "msgp",
+		Subsystem: "db",
+		Name:      "load_duration_seconds",
+		Help:      "Time taken to load readings.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"resolution"})
+
+	// HubTopics is the number of hub topics with at least one subscriber.
+	HubTopics = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "msgp",
+		Subsystem: "hub",
+		Name:      "topics",
+		Help:      "Number of hub topics with subscribers.",
+	})
+
+	// HubSubscriptions is the number of subscriptions to hub topics, including subscriptions to all topics.
+	HubSubscriptions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "msgp",
+		Subsystem: "hub",
+		Name:      "subscriptions",
+		Help:      "Number of subscriptions to hub topics.",
+	})
+
+	// Sessions is the number of open websocket sessions, by kind (device or user).
+	Sessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "msgp",
+		Subsystem: "api",
+		Name:      "sessions",
+		Help:      "Number of open websocket sessions.",
+	}, []string{"kind"})
+
+	// ValuesReceived counts values received from devices, by outcome (stored or quarantined).
+	ValuesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "msgp",
+		Subsystem: "api",
+		Name:      "values_received_total",
+		Help:      "Number of values received from devices.",
+	}, []string{"outcome"})
+
+	// LegacyMirrorFailures counts failed attempts to mirror values to the old mysmartgrid.
+	LegacyMirrorFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "msgp",
+		Subsystem: "api",
+		Name:      "legacy_mirror_failures_total",
+		Help:      "Number of failed attempts to mirror values to the old mysmartgrid.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		BufferedValues,
+		BufferFlushDuration,
+		BufferFlushedValues,
+		LoadDuration,
+		HubTopics,
+		HubSubscriptions,
+		Sessions,
+		ValuesReceived,
+		LegacyMirrorFailures,
+	)
+}
@@ -0,0 +1,348 @@
+package msgp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mysmartgrid/msg-prototype-2/regdev"
+	"github.com/mysmartgrid/msg2api"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errBadMessage   = errors.New("invalid message")
+	errBadSignature = errors.New("invalid signature")
+	errBadTimestamp = errors.New("timestamp out of range")
+	errReplayed     = errors.New("message replayed")
+)
+
+// mqttMaxSkew is the maximum difference between the timestamp of a signed MQTT message and the time it is received.
+const mqttMaxSkew = 5 * time.Minute
+
+// MQTTDeviceUser starts the user names devices connect to the embedded broker with, followed by the device id.
+const MQTTDeviceUser = "device/"
+
+// MQTTBridge connects devices and users to an MQTT broker.
+//
+// Devices publish to Prefix/device/<device>/<operation>, where operation is one of update, sensor/add, sensor/remove
+// and metadata. Every message is a JSON object {"ts": <unix timestamp>, "sig": <signature>, "body": <arguments>},
+// the signature is the hex encoded HMAC-SHA256 of the operation, a newline, the decimal timestamp, a newline and the
+// raw body, keyed with the regdev key of the device, see SignMQTTMessage. Signing the operation keeps a message from
+// being replayed as another operation. The arguments are
+//
+//	update:        {"<sensor>": [[<milliseconds since epoch>, <value>], ...], ...}
+//	sensor/add:    {"name": <sensor>, "unit": <unit>, "port": <port>, "factor": <factor>}
+//	sensor/remove: {"name": <sensor>}
+//	metadata:      device metadata as sent by msg2api devices
+//
+// Operations are executed as if the device had sent them over its websocket. Failures are published as msg2api
+// errors to Prefix/device/<device>/error.
+//
+// All stored values are republished as [<milliseconds since epoch>, <value>] to
+// Prefix/user/<user>/values/<device>/<sensor> if the bridge is set as MQTT of the context.
+type MQTTBridge struct {
+	Ctx     *WsAPIContext
+	Devices regdev.Db
+	// Client is a connected client, Run subscribes it to the device topics.
+	Client mqtt.Client
+	Prefix string
+
+	mtx  sync.Mutex
+	apis map[string]*WsDevAPI
+	// seen holds the decoded signatures of all messages received within twice mqttMaxSkew to reject replayed
+	// messages, seenQueue holds them in the order they were received to expire them.
+	seen      map[string]bool
+	seenQueue []mqttSeen
+}
+
+type mqttSeen struct {
+	signature string
+	received  time.Time
+}
+
+type mqttMessage struct {
+	Timestamp int64           `json:"ts"`
+	Signature string          `json:"sig"`
+	Body      json.RawMessage `json:"body"`
+}
+
+type mqttSensor struct {
+	Name   string  `json:"name"`
+	Unit   string  `json:"unit"`
+	Port   int32   `json:"port"`
+	Factor float64 `json:"factor"`
+}
+
+// SignMQTTMessage returns the payload of a message of a device for the given operation, signed with the key of the
+// device. The body is compacted first, as it is sent compacted.
+func SignMQTTMessage(key []byte, op string, ts int64, body []byte) ([]byte, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, body); err != nil {
+		return nil, err
+	}
+	sig := mqttSignature(key, op, ts, compact.Bytes())
+	return json.Marshal(mqttMessage{ts, hex.EncodeToString(sig), json.RawMessage(compact.Bytes())})
+}
+
+func mqttSignature(key []byte, op string, ts int64, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(op + "\n" + strconv.FormatInt(ts, 10) + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// MQTTAuth authenticates the clients of the embedded broker and restricts the topics they may use. The bridge
+// connects with BridgeUser and BridgePassword and may use all topics. Users connect with their user id and account
+// password and may only subscribe to the values of their own devices. Devices connect with MQTTDeviceUser followed
+// by their id and their hex encoded key, they may only publish their own operations and subscribe to their own
+// errors.
+type MQTTAuth struct {
+	mochi.HookBase
+
+	Prefix         string
+	BridgeUser     string
+	BridgePassword string
+	Devices        regdev.Db
+	// CheckUser returns true if password is the account password of the user.
+	CheckUser func(user, password string) bool
+}
+
+// ID returns the id of the hook.
+func (a *MQTTAuth) ID() string {
+	return "msgp-auth"
+}
+
+// Provides returns true for the hook methods implemented by MQTTAuth.
+func (a *MQTTAuth) Provides(b byte) bool {
+	return bytes.Contains([]byte{mochi.OnConnectAuthenticate, mochi.OnACLCheck}, []byte{b})
+}
+
+// OnConnectAuthenticate returns true if the client connected with the credentials of the bridge, a user or a device.
+func (a *MQTTAuth) OnConnectAuthenticate(cl *mochi.Client, pk packets.Packet) bool {
+	user, password := string(pk.Connect.Username), string(pk.Connect.Password)
+	switch {
+	case user == "":
+		return false
+	case user == a.BridgeUser:
+		return a.BridgePassword != "" && subtle.ConstantTimeCompare([]byte(password), []byte(a.BridgePassword)) == 1
+	case strings.HasPrefix(user, MQTTDeviceUser):
+		return a.checkDevice(strings.TrimPrefix(user, MQTTDeviceUser), password)
+	}
+	return validMQTTLevel(user) && a.CheckUser != nil && a.CheckUser(user, password)
+}
+
+func (a *MQTTAuth) checkDevice(device, password string) bool {
+	if !validMQTTLevel(device) {
+		return false
+	}
+	given, err := hex.DecodeString(password)
+	if err != nil {
+		return false
+	}
+	ok := false
+	a.Devices.View(func(tx regdev.Tx) error {
+		if dev := tx.Device(device); dev != nil {
+			ok = subtle.ConstantTimeCompare(given, dev.Key()) == 1
+		}
+		return nil
+	})
+	return ok
+}
+
+// OnACLCheck returns true if the client may publish to or subscribe to the topic filter.
+func (a *MQTTAuth) OnACLCheck(cl *mochi.Client, topic string, write bool) bool {
+	user := string(cl.Properties.Username)
+	if user == a.BridgeUser {
+		return true
+	}
+	if strings.HasPrefix(user, MQTTDeviceUser) {
+		base := a.Prefix + "/device/" + strings.TrimPrefix(user, MQTTDeviceUser) + "/"
+		if write {
+			return strings.HasPrefix(topic, base) && topic != base+"error" && !strings.ContainsAny(topic, "+#")
+		}
+		return topic == base+"error"
+	}
+	return !write && strings.HasPrefix(topic, a.Prefix+"/user/"+user+"/values/")
+}
+
+// validMQTTLevel returns true if s can be used as a single level of a topic without matching other topics.
+func validMQTTLevel(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "/+#")
+}
+
+// ServeEmbeddedMQTTBroker starts an MQTT broker on addr that authenticates clients with auth, to run the bridge
+// without an external broker or to test it.
+func ServeEmbeddedMQTTBroker(addr string, auth *MQTTAuth) (*mochi.Server, error) {
+	server := mochi.New(nil)
+	if err := server.AddHook(auth, nil); err != nil {
+		return nil, err
+	}
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "msgp", Address: addr})); err != nil {
+		return nil, err
+	}
+	return server, server.Serve()
+}
+
+// Run subscribes to the device topics.
+func (b *MQTTBridge) Run() error {
+	token := b.Client.Subscribe(b.Prefix+"/device/#", 1, b.handleDeviceMessage)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// PublishValue republishes a stored value of a sensor to the value topic of the sensor.
+func (b *MQTTBridge) PublishValue(user, device, sensor string, value msg2api.Measurement) {
+	payload, err := json.Marshal([2]float64{float64(value.Time.UnixNano() / int64(time.Millisecond)), value.Value})
+	if err != nil {
+		log.Printf("mqtt: could not encode value of %v/%v: %v", device, sensor, err)
+		return
+	}
+	b.Client.Publish(b.Prefix+"/user/"+user+"/values/"+device+"/"+sensor, 0, false, payload)
+}
+
+func (b *MQTTBridge) handleDeviceMessage(client mqtt.Client, msg mqtt.Message) {
+	// topic is Prefix/device/<device>/<operation>
+	parts := strings.SplitN(strings.TrimPrefix(msg.Topic(), b.Prefix+"/device/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "error" {
+		return
+	}
+	device, op := parts[0], parts[1]
+
+	var err *msg2api.Error
+	api, body, authErr := b.authenticate(device, op, msg.Payload())
+	if authErr != nil {
+		err = &msg2api.Error{Code: errNotAuthorized.Error(), Extra: authErr.Error()}
+	} else {
+		err = b.dispatch(api, op, body)
+	}
+
+	if err != nil {
+		payload, _ := json.Marshal(err)
+		b.Client.Publish(b.Prefix+"/device/"+device+"/error", 1, false, payload)
+	}
+}
+
+// authenticate checks the signature of a message sent by device for operation op and returns the device API of the
+// device along with the body of the message.
+func (b *MQTTBridge) authenticate(device, op string, payload []byte) (*WsDevAPI, []byte, error) {
+	var msg mqttMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, nil, errBadMessage
+	}
+
+	var key []byte
+	var user string
+	err := b.Devices.View(func(tx regdev.Tx) error {
+		dev := tx.Device(device)
+		if dev == nil {
+			return errNotAuthorized
+		}
+		uid, linked := dev.UserLink()
+		if !linked {
+			return errNotAuthorized
+		}
+		user = uid
+		key = append([]byte(nil), dev.Key()...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sig, err := hex.DecodeString(msg.Signature)
+	if err != nil {
+		return nil, nil, errBadSignature
+	}
+	if !hmac.Equal(mqttSignature(key, op, msg.Timestamp, msg.Body), sig) {
+		return nil, nil, errBadSignature
+	}
+
+	now := time.Now()
+	ts := time.Unix(msg.Timestamp, 0)
+	if ts.Before(now.Add(-mqttMaxSkew)) || ts.After(now.Add(mqttMaxSkew)) {
+		return nil, nil, errBadTimestamp
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.seen == nil {
+		b.seen = make(map[string]bool)
+	}
+	now = time.Now()
+	for len(b.seenQueue) > 0 && now.Sub(b.seenQueue[0].received) > 2*mqttMaxSkew {
+		delete(b.seen, b.seenQueue[0].signature)
+		b.seenQueue = b.seenQueue[1:]
+	}
+	if b.seen[string(sig)] {
+		return nil, nil, errReplayed
+	}
+	b.seen[string(sig)] = true
+	b.seenQueue = append(b.seenQueue, mqttSeen{string(sig), now})
+
+	if b.apis == nil {
+		b.apis = make(map[string]*WsDevAPI)
+	}
+	api := b.apis[device]
+	if api == nil || api.User != user {
+		api = &WsDevAPI{ctx: b.Ctx, User: user, Device: device}
+		b.apis[device] = api
+	}
+	return api, msg.Body, nil
+}
+
+func (b *MQTTBridge) dispatch(api *WsDevAPI, op string, body []byte) *msg2api.Error {
+	switch op {
+	case "update":
+		var raw map[string][][2]float64
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return &msg2api.Error{Code: "invalid input", Extra: err.Error()}
+		}
+		values := make(map[string][]msg2api.Measurement, len(raw))
+		for sensor, pairs := range raw {
+			for _, p := range pairs {
+				t := time.Unix(0, int64(p[0])*int64(time.Millisecond))
+				values[sensor] = append(values[sensor], msg2api.Measurement{t, p[1]})
+			}
+		}
+		return api.doUpdate(values)
+
+	case "sensor/add":
+		var s mqttSensor
+		if err := json.Unmarshal(body, &s); err != nil {
+			return &msg2api.Error{Code: "invalid input", Extra: err.Error()}
+		}
+		return api.doAddSensor(s.Name, s.Unit, s.Port, s.Factor)
+
+	case "sensor/remove":
+		var s mqttSensor
+		if err := json.Unmarshal(body, &s); err != nil {
+			return &msg2api.Error{Code: "invalid input", Extra: err.Error()}
+		}
+		return api.doRemoveSensor(s.Name)
+
+	case "metadata":
+		var md msg2api.DeviceMetadata
+		if err := json.Unmarshal(body, &md); err != nil {
+			return &msg2api.Error{Code: "invalid input", Extra: err.Error()}
+		}
+		return api.doUpdateMetadata(&md)
+	}
+
+	log.Printf("mqtt: unknown operation %v from device %v", op, api.Device)
+	return &msg2api.Error{Code: "invalid operation", Extra: op}
+}
@@ -0,0 +1,358 @@
+package msgp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mysmartgrid/msg-prototype-2/db"
+	"github.com/mysmartgrid/msg-prototype-2/hub"
+	"github.com/mysmartgrid/msg-prototype-2/regdev"
+	"github.com/mysmartgrid/msg2api"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testDeviceKey = []byte("0123456789abcdef")
+
+func startTestBroker(t *testing.T, ctx *WsAPIContext) (string, *MQTTBridge) {
+	devices, err := regdev.Open(filepath.Join(t.TempDir(), "devices.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(devices.Close)
+	err = devices.Update(func(tx regdev.Tx) error {
+		if err := tx.AddDevice("dev1", testDeviceKey); err != nil {
+			return err
+		}
+		return tx.Device("dev1").LinkTo("alice")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	auth := &MQTTAuth{
+		Prefix:         "msgp",
+		BridgeUser:     "bridge",
+		BridgePassword: "bridge-secret",
+		Devices:        devices,
+		CheckUser: func(user, password string) bool {
+			return user == "alice" && password == "alice-secret"
+		},
+	}
+	server, err := ServeEmbeddedMQTTBroker(addr, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	client, err := connectTestClient(addr, "bridge", "bridge-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge := &MQTTBridge{Ctx: ctx, Devices: devices, Client: client, Prefix: "msgp"}
+	if err := bridge.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return addr, bridge
+}
+
+func connectTestClient(addr, user, password string) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://" + addr).
+		SetClientID(user).
+		SetUsername(user).
+		SetPassword(password).
+		SetConnectTimeout(5 * time.Second)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	token.Wait()
+	return client, token.Error()
+}
+
+// subscribeTest subscribes client to topic and returns the granted QoS, 0x80 if the subscription was refused.
+func subscribeTest(t *testing.T, client mqtt.Client, topic string, received chan<- mqtt.Message) byte {
+	token := client.Subscribe(topic, 1, func(_ mqtt.Client, msg mqtt.Message) { received <- msg })
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribing to %v: %v", topic, token.Error())
+	}
+	return token.(*mqtt.SubscribeToken).Result()[topic]
+}
+
+func signedMessage(op string, ts int64, body string, key []byte) []byte {
+	payload, _ := SignMQTTMessage(key, op, ts, []byte(body))
+	return payload
+}
+
+func receiveError(t *testing.T, received <-chan mqtt.Message) msg2api.Error {
+	select {
+	case msg := <-received:
+		var result msg2api.Error
+		if err := json.Unmarshal(msg.Payload(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error published")
+	}
+	return msg2api.Error{}
+}
+
+func TestMQTTBridgeDeviceMessages(t *testing.T) {
+	addr, _ := startTestBroker(t, &WsAPIContext{})
+
+	device, err := connectTestClient(addr, MQTTDeviceUser+"dev1", hex.EncodeToString(testDeviceKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Disconnect(0)
+
+	errors := make(chan mqtt.Message, 10)
+	if qos := subscribeTest(t, device, "msgp/device/dev1/error", errors); qos == 0x80 {
+		t.Fatal("device may not subscribe to its errors")
+	}
+
+	ts := time.Now().Unix()
+	payload := signedMessage("bogus", ts, `{}`, testDeviceKey)
+	device.Publish("msgp/device/dev1/bogus", 1, false, payload).Wait()
+	if e := receiveError(t, errors); e.Code != "invalid operation" {
+		t.Errorf("unknown operation: got %+v", e)
+	}
+
+	device.Publish("msgp/device/dev1/bogus", 1, false, payload).Wait()
+	if e := receiveError(t, errors); e.Extra != errReplayed.Error() {
+		t.Errorf("replayed message: got %+v", e)
+	}
+
+	// the same signature in a different encoding is still a replay
+	var msg mqttMessage
+	json.Unmarshal(payload, &msg)
+	msg.Signature = strings.ToUpper(msg.Signature)
+	upper, _ := json.Marshal(msg)
+	device.Publish("msgp/device/dev1/bogus", 1, false, upper).Wait()
+	if e := receiveError(t, errors); e.Extra != errReplayed.Error() {
+		t.Errorf("replayed message with reencoded signature: got %+v", e)
+	}
+
+	device.Publish("msgp/device/dev1/bogus", 1, false, signedMessage("bogus", ts, `{}`, []byte("wrong key"))).Wait()
+	if e := receiveError(t, errors); e.Extra != errBadSignature.Error() {
+		t.Errorf("bad signature: got %+v", e)
+	}
+
+	// a message signed for one operation cannot be sent as another
+	device.Publish("msgp/device/dev1/sensor/remove", 1, false, signedMessage("sensor/add", ts, `{}`, testDeviceKey)).Wait()
+	if e := receiveError(t, errors); e.Extra != errBadSignature.Error() {
+		t.Errorf("message of another operation: got %+v", e)
+	}
+}
+
+// fakeDb provides the device dev1 of user alice with the sensor s1 to the device operations, and reports the
+// changes they make on calls.
+type fakeDb struct {
+	db.Db
+	calls chan string
+}
+
+func (f *fakeDb) View(fn func(db.Tx) error) error {
+	return fn(fakeTx{f: f})
+}
+
+func (f *fakeDb) Update(fn func(db.Tx) error) error {
+	return fn(fakeTx{f: f})
+}
+
+func (f *fakeDb) AddReading(s db.Sensor, t time.Time, value float64) error {
+	f.calls <- fmt.Sprintf("reading %v %v %v", s.ID(), t.UnixNano()/int64(time.Millisecond), value)
+	return nil
+}
+
+func (f *fakeDb) Quarantine(s db.Sensor, value msg2api.Measurement, reason string) error {
+	f.calls <- fmt.Sprintf("quarantine %v %v", s.ID(), reason)
+	return nil
+}
+
+type fakeTx struct {
+	db.Tx
+	f *fakeDb
+}
+
+func (tx fakeTx) User(id string) db.User {
+	if id != "alice" {
+		return nil
+	}
+	return fakeUser{f: tx.f}
+}
+
+type fakeUser struct {
+	db.User
+	f *fakeDb
+}
+
+func (u fakeUser) Device(id string) db.Device {
+	if id != "dev1" {
+		return nil
+	}
+	return fakeDevice{f: u.f}
+}
+
+type fakeDevice struct {
+	db.Device
+	f *fakeDb
+}
+
+func (d fakeDevice) ID() string {
+	return "dev1"
+}
+
+func (d fakeDevice) SetName(name string) error {
+	d.f.calls <- "device name " + name
+	return nil
+}
+
+func (d fakeDevice) AddSensor(id, unit string, port int32, factor float64) (db.Sensor, error) {
+	d.f.calls <- fmt.Sprintf("add sensor %v %v %v %v", id, unit, port, factor)
+	return fakeSensor{f: d.f, id: id}, nil
+}
+
+func (d fakeDevice) Sensor(id string) db.Sensor {
+	if id != "s1" {
+		return nil
+	}
+	return fakeSensor{f: d.f, id: id}
+}
+
+func (d fakeDevice) Sensors() map[string]db.Sensor {
+	return map[string]db.Sensor{"s1": d.Sensor("s1")}
+}
+
+func (d fakeDevice) ValidationRules() map[string]db.ValidationRule {
+	return nil
+}
+
+type fakeSensor struct {
+	db.Sensor
+	f  *fakeDb
+	id string
+}
+
+func (s fakeSensor) ID() string {
+	return s.id
+}
+
+func (s fakeSensor) Unit() string {
+	return "W"
+}
+
+func (s fakeSensor) Port() int32 {
+	return 1
+}
+
+func (s fakeSensor) Factor() float64 {
+	return 1
+}
+
+func (s fakeSensor) Calibrations() ([]db.Calibration, error) {
+	return nil, nil
+}
+
+func (s fakeSensor) SetName(name string) error {
+	s.f.calls <- fmt.Sprintf("sensor name %v %v", s.id, name)
+	return nil
+}
+
+func (s fakeSensor) Calibrate(c db.Calibration) error {
+	s.f.calls <- fmt.Sprintf("calibrate %v %v %v %v", s.id, c.Unit, c.Port, c.Factor)
+	return nil
+}
+
+func TestMQTTBridgeDeviceOperations(t *testing.T) {
+	calls := make(chan string, 10)
+	addr, _ := startTestBroker(t, &WsAPIContext{Db: &fakeDb{calls: calls}, Hub: hub.New()})
+
+	device, err := connectTestClient(addr, MQTTDeviceUser+"dev1", hex.EncodeToString(testDeviceKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Disconnect(0)
+
+	errors := make(chan mqtt.Message, 10)
+	subscribeTest(t, device, "msgp/device/dev1/error", errors)
+
+	ms := time.Now().Add(-time.Minute).UnixNano() / int64(time.Millisecond)
+	tests := []struct {
+		op    string
+		body  string
+		calls []string
+	}{
+		{"sensor/add", `{"name": "s2", "unit": "W", "port": 2, "factor": 0.5}`, []string{"add sensor s2 W 2 0.5"}},
+		{"update", fmt.Sprintf(`{"s1": [[%v, 42]]}`, ms), []string{fmt.Sprintf("reading s1 %v 42", ms)}},
+		{"metadata", `{"name": "meter", "sensors": {"s1": {"name": "mains", "factor": 2}}}`,
+			[]string{"device name meter", "sensor name s1 mains", "calibrate s1 W 1 2"}},
+	}
+
+	ts := time.Now().Unix()
+	for _, test := range tests {
+		device.Publish("msgp/device/dev1/"+test.op, 1, false, signedMessage(test.op, ts, test.body, testDeviceKey)).Wait()
+		for _, want := range test.calls {
+			select {
+			case call := <-calls:
+				if call != want {
+					t.Errorf("%v: got %v, want %v", test.op, call, want)
+				}
+			case msg := <-errors:
+				t.Fatalf("%v: got error %s", test.op, msg.Payload())
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%v: no call %v", test.op, want)
+			}
+		}
+	}
+
+	device.Publish("msgp/device/dev1/update", 1, false, signedMessage("update", ts, `{"s9": [[0, 1]]}`, testDeviceKey)).Wait()
+	if e := receiveError(t, errors); e.Code != "update failed" {
+		t.Errorf("update of unknown sensor: got %+v", e)
+	}
+}
+
+func TestMQTTBridgeUserValues(t *testing.T) {
+	addr, bridge := startTestBroker(t, &WsAPIContext{})
+
+	if _, err := connectTestClient(addr, "alice", "wrong"); err == nil {
+		t.Error("connected with a wrong password")
+	}
+
+	user, err := connectTestClient(addr, "alice", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Disconnect(0)
+
+	values := make(chan mqtt.Message, 10)
+	for _, topic := range []string{"msgp/user/+/values/#", "msgp/user/bob/values/#", "msgp/device/dev1/error"} {
+		if qos := subscribeTest(t, user, topic, values); qos != 0x80 {
+			t.Errorf("user may subscribe to %v", topic)
+		}
+	}
+	if qos := subscribeTest(t, user, "msgp/user/alice/values/#", values); qos == 0x80 {
+		t.Fatal("user may not subscribe to their values")
+	}
+
+	bridge.PublishValue("alice", "dev1", "s1", msg2api.Measurement{time.Unix(1500000000, 0), 42})
+	select {
+	case msg := <-values:
+		if msg.Topic() != "msgp/user/alice/values/dev1/s1" || string(msg.Payload()) != "[1500000000000,42]" {
+			t.Errorf("got %v %s", msg.Topic(), msg.Payload())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no value published")
+	}
+}
@@ -0,0 +1,152 @@
+package regdev
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A device is claimed by a user with a proof that the user has access to the device: either the pairing code of the
+// device, which the device derives from its key and shows or prints, or a claim token issued by the registry, which
+// is handed to the device or an installer and expires. Users are limited in their failed claims by the caller, devices
+// only refuse claims after many failed attempts, which takes more than one user.
+
+const (
+	// MaxClaimFailures is the number of failed claims after which a device refuses claims for ClaimLockout.
+	MaxClaimFailures = 50
+	// ClaimLockout is the time a device refuses claims after MaxClaimFailures failed claims.
+	ClaimLockout = 15 * time.Minute
+
+	claimCodeLen = 5
+)
+
+var (
+	// ErrBadClaim is returned for claims with a proof that is neither the pairing code nor a valid claim token.
+	ErrBadClaim = errors.New("invalid pairing code")
+	// ErrClaimLocked is returned for claims of devices that refuse claims after too many failed claims.
+	ErrClaimLocked = errors.New("too many failed claims, try again later")
+	// ErrReplayedRequest is returned for signed claim token requests that are not newer than the last one.
+	ErrReplayedRequest = errors.New("replayed request")
+
+	registeredDeviceClaimToken    = []byte("claimToken")
+	registeredDeviceClaimFailures = []byte("claimFailures")
+	registeredDeviceClaimRequest  = []byte("claimRequest")
+
+	codeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+type claimToken struct {
+	Hash    []byte
+	Expires int64
+}
+
+type claimFailures struct {
+	Count int
+	Until int64
+}
+
+// PairingCode returns the pairing code of a device with the given key.
+// It is the base32 encoding of the first five bytes of HMAC-SHA256(key, "pairing code").
+func PairingCode(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("pairing code"))
+	return codeEncoding.EncodeToString(mac.Sum(nil)[:claimCodeLen])
+}
+
+// normalizeCode removes separators and ignores case, so codes can be entered the way they are printed.
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+func hashClaimToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+func (r *registeredDevice) CreateClaimToken(validFor time.Duration) (string, error) {
+	var buf [claimCodeLen]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	token := codeEncoding.EncodeToString(buf[:])
+
+	data, err := json.Marshal(claimToken{hashClaimToken(token), time.Now().Add(validFor).Unix()})
+	if err != nil {
+		return "", err
+	}
+	if err := r.b.Put(registeredDeviceClaimToken, data); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (r *registeredDevice) UseClaimRequest(ts time.Time) error {
+	if data := r.b.Get(registeredDeviceClaimRequest); data != nil {
+		if last, err := strconv.ParseInt(string(data), 10, 64); err == nil && ts.Unix() <= last {
+			return ErrReplayedRequest
+		}
+	}
+	return r.b.Put(registeredDeviceClaimRequest, []byte(strconv.FormatInt(ts.Unix(), 10)))
+}
+
+func (r *registeredDevice) checkClaimProof(proof string) bool {
+	proof = normalizeCode(proof)
+	if subtle.ConstantTimeCompare([]byte(proof), []byte(PairingCode(r.Key()))) == 1 {
+		return true
+	}
+
+	var token claimToken
+	data := r.b.Get(registeredDeviceClaimToken)
+	if data == nil || json.Unmarshal(data, &token) != nil || time.Now().Unix() > token.Expires {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hashClaimToken(proof), token.Hash) == 1
+}
+
+func (r *registeredDevice) Claim(uid, proof string) error {
+	if _, linked := r.UserLink(); linked {
+		return ErrAlreadyLinked
+	}
+	if err := r.CheckClaim(proof); err != nil {
+		return err
+	}
+	return r.LinkTo(uid)
+}
+
+func (r *registeredDevice) CheckClaim(proof string) error {
+	var failures claimFailures
+	if data := r.b.Get(registeredDeviceClaimFailures); data != nil {
+		json.Unmarshal(data, &failures)
+	}
+	now := time.Now().Unix()
+	if failures.Until > now {
+		return ErrClaimLocked
+	}
+
+	if !r.checkClaimProof(proof) {
+		failures.Count++
+		if failures.Count >= MaxClaimFailures {
+			failures = claimFailures{0, time.Now().Add(ClaimLockout).Unix()}
+		}
+		data, err := json.Marshal(failures)
+		if err != nil {
+			return err
+		}
+		if err := r.b.Put(registeredDeviceClaimFailures, data); err != nil {
+			return err
+		}
+		return ErrBadClaim
+	}
+
+	if err := r.b.Delete(registeredDeviceClaimToken); err != nil {
+		return err
+	}
+	return r.b.Delete(registeredDeviceClaimFailures)
+}
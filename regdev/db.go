@@ -10,6 +10,10 @@ var (
 	ErrIDExists = errors.New("id exists")
 	// ErrAlreadyLinked is returned when trying to link a user to a device already associated with a user.
 	ErrAlreadyLinked = errors.New("already linked")
+	// ErrNotLinkedTo is returned when transferring a device that is not linked to the sending user.
+	ErrNotLinkedTo = errors.New("not linked to user")
+
+	errNoDeviceBucket = errors.New("device bucket missing")
 
 	dbRegisteredDevices = []byte("registeredDevices")
 )
@@ -42,6 +46,15 @@ func (d *db) Close() {
 	d.store.Close()
 }
 
+func (d *db) Ping() error {
+	return d.store.View(func(btx *bolt.Tx) error {
+		if btx.Bucket(dbRegisteredDevices) == nil {
+			return errNoDeviceBucket
+		}
+		return nil
+	})
+}
+
 func (d *db) View(fn func(Tx) error) error {
 	return d.store.View(func(btx *bolt.Tx) error {
 		return fn(&tx{d, btx})
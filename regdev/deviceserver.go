@@ -24,6 +24,11 @@ type DeviceServer struct {
 
 var errBadHeartbeat = errors.New("invalid heartbeat")
 var errBadArgs = errors.New("bad arguments")
+var errBadTimestamp = errors.New("bad timestamp")
+var errBadSignature = errors.New("bad signature")
+
+// ClaimTokenValidity is the time claim tokens requested by devices can be used.
+const ClaimTokenValidity = time.Hour
 
 func (s *DeviceServer) registerDevice(w http.ResponseWriter, r *http.Request) {
 	keys, hasKeys := r.Header["X-Key"]
@@ -154,8 +159,83 @@ func (s *DeviceServer) heartbeat(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// claimToken issues a claim token to a device, which the device shows to the user that claims it.
+// The request is signed like a heartbeat, its timestamp must be newer than that of the last request.
+func (s *DeviceServer) claimToken(w http.ResponseWriter, r *http.Request) {
+	s.Db.Update(func(tx Tx) error {
+		dev := tx.Device(mux.Vars(r)["device"])
+		if dev == nil {
+			http.Error(w, "not found", 404)
+			return errBadArgs
+		}
+
+		ts, _, err := readSignedBody(r, dev.Key())
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return err
+		}
+		if err := dev.UseClaimRequest(ts); err != nil {
+			http.Error(w, err.Error(), 400)
+			return err
+		}
+		if _, linked := dev.UserLink(); linked {
+			http.Error(w, ErrAlreadyLinked.Error(), 409)
+			return ErrAlreadyLinked
+		}
+
+		token, err := dev.CreateClaimToken(ClaimTokenValidity)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return err
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"token":   token,
+			"expires": time.Now().Add(ClaimTokenValidity).Unix(),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return err
+		}
+		w.Write(data)
+		return nil
+	})
+}
+
+// ReadSignedBody reads the body of a request signed with the device key like a heartbeat,
+// with the ts and sig query parameters. Returns an error if timestamp or signature are invalid.
+// Signed requests can be replayed while their timestamp is accepted, handlers must not act on them twice.
+func ReadSignedBody(r *http.Request, key []byte) ([]byte, error) {
+	_, body, err := readSignedBody(r, key)
+	return body, err
+}
+
+func readSignedBody(r *http.Request, key []byte) (time.Time, []byte, error) {
+	ts, tsRaw, sig, err := parseHeartbeatParams(r)
+	if err != nil {
+		return ts, nil, err
+	}
+	if math.Abs(ts.Sub(time.Now()).Hours()) > 4 {
+		return ts, nil, errBadTimestamp
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return ts, nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(tsRaw)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return ts, nil, errBadSignature
+	}
+
+	return ts, body, nil
+}
+
 // RegisterRoutes add the device speficif handler functions to the given router.
 func (s *DeviceServer) RegisterRoutes(r *mux.Router) {
 	r.HandleFunc("/v1/{device}", s.registerDevice).Methods("POST")
 	r.HandleFunc("/v1/{device}/status", s.heartbeat).Methods("POST")
+	r.HandleFunc("/v1/{device}/claim-token", s.claimToken).Methods("POST")
 }
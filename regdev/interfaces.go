@@ -10,6 +10,9 @@ type Tx interface {
 	AddDevice(id string, key []byte) error
 	Device(devID string) RegisteredDevice
 	Devices() map[string]RegisteredDevice
+	// DevicesPage returns up to limit devices with ids greater than after and containing search, ordered by id,
+	// along with the id to pass as after for the next page, which is empty on the last page.
+	DevicesPage(after, search string, limit int) ([]RegisteredDevice, string)
 }
 
 // DeviceIfaceIPConfig contains the configuration of a device's network interface.
@@ -141,6 +144,22 @@ type RegisteredDevice interface {
 	LinkTo(uid string) error
 	// Unlink unlinks the currently linked user from the device or returns an error if there is no user linked.
 	Unlink() error
+	// Transfer links the device to user id to instead of user id from, and removes the network configuration of the
+	// sending user. Returns ErrNotLinkedTo if the device is not linked to from.
+	Transfer(from, to string) error
+	// Claim links the device to the given user id if proof is the pairing code of the device or a valid claim token.
+	// Returns ErrBadClaim for other proofs and ErrClaimLocked after too many failed claims. Failed claims are
+	// recorded in the transaction, it must be committed even if Claim fails.
+	Claim(uid, proof string) error
+	// CheckClaim checks a proof of access to the device like Claim without linking the device, e.g. for the receiving
+	// user of a transfer. Failed checks are recorded in the transaction, it must be committed even if CheckClaim fails.
+	CheckClaim(proof string) error
+	// CreateClaimToken creates a claim token for the device that is valid until it is used or expires after validFor.
+	// It replaces earlier claim tokens of the device.
+	CreateClaimToken(validFor time.Duration) (string, error)
+	// UseClaimRequest records the timestamp of a signed claim token request of the device. Returns
+	// ErrReplayedRequest if it is not newer than the timestamp of the last request, so requests cannot be replayed.
+	UseClaimRequest(ts time.Time) error
 
 	// RegisterHeartbeat writes a new heartbeat from the device to the database
 	// and updates the devices network config in the database if necessary.
@@ -148,6 +167,9 @@ type RegisteredDevice interface {
 	// GetHeartbeats return the last 'maxCount' heartbeats received from the device or
 	// all of them if maxCount is zero.
 	GetHeartbeats(maxCount uint64) []Heartbeat
+	// HeartbeatsBefore returns up to limit heartbeats received before the given time, newest first.
+	// A zero time returns the latest heartbeats.
+	HeartbeatsBefore(before time.Time, limit int) []Heartbeat
 
 	// GetNetworkConfig returns the current network configuration stroed for the device.
 	GetNetworkConfig() DeviceConfigNetwork
@@ -160,6 +182,9 @@ type Db interface {
 	// Close closes the connection to the underlying BoltDB database.
 	Close()
 
+	// Ping checks that the database is open and readable.
+	Ping() error
+
 	// Update executes a database transaction defined by a series of operations
 	// in the function fn on its Tx struct.
 	Update(func(Tx) error) error
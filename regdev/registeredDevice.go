@@ -59,6 +59,16 @@ func (r *registeredDevice) Unlink() error {
 	return r.b.Delete(registeredDeviceNetwork)
 }
 
+func (r *registeredDevice) Transfer(from, to string) error {
+	if uid, linked := r.UserLink(); !linked || uid != from {
+		return ErrNotLinkedTo
+	}
+	if err := r.b.Delete(registeredDeviceNetwork); err != nil {
+		return err
+	}
+	return r.b.Put(registeredDeviceUser, []byte(to))
+}
+
 func (r *registeredDevice) RegisterHeartbeat(hb Heartbeat) error {
 	hbKey := []byte(strconv.FormatInt(hb.Time.Unix(), 10))
 
@@ -101,6 +111,32 @@ func (r *registeredDevice) GetHeartbeats(maxCount uint64) (result []Heartbeat) {
 	return
 }
 
+func (r *registeredDevice) HeartbeatsBefore(before time.Time, limit int) (result []Heartbeat) {
+	cursor := r.b.Bucket(registeredDeviceHeartbeat).Cursor()
+	key, value := cursor.Last()
+	if !before.IsZero() {
+		key, value = cursor.Seek([]byte(strconv.FormatInt(before.Unix(), 10)))
+		if key == nil {
+			key, value = cursor.Last()
+		} else {
+			key, value = cursor.Prev()
+		}
+	}
+	for ; len(result) < limit && key != nil; key, value = cursor.Prev() {
+		ts, err := strconv.ParseInt(string(key), 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		var hb Heartbeat
+		if err := json.Unmarshal(value, &hb); err != nil {
+			panic(err)
+		}
+		hb.Time = time.Unix(ts, 0)
+		result = append(result, hb)
+	}
+	return
+}
+
 func (r *registeredDevice) GetNetworkConfig() DeviceConfigNetwork {
 	var result DeviceConfigNetwork
 
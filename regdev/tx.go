@@ -1,6 +1,7 @@
 package regdev
 
 import (
+	"bytes"
 	"github.com/boltdb/bolt"
 )
 
@@ -37,3 +38,23 @@ func (tx *tx) Devices() map[string]RegisteredDevice {
 	})
 	return result
 }
+
+func (tx *tx) DevicesPage(after, search string, limit int) ([]RegisteredDevice, string) {
+	var result []RegisteredDevice
+	b := tx.Bucket(dbRegisteredDevices)
+	c := b.Cursor()
+	k, _ := c.Seek([]byte(after))
+	if k != nil && string(k) == after {
+		k, _ = c.Next()
+	}
+	for ; k != nil; k, _ = c.Next() {
+		if search != "" && !bytes.Contains(bytes.ToLower(k), bytes.ToLower([]byte(search))) {
+			continue
+		}
+		if len(result) == limit {
+			return result, result[limit-1].ID()
+		}
+		result = append(result, &registeredDevice{b.Bucket(k), string(k)})
+	}
+	return result, ""
+}
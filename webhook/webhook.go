@@ -0,0 +1,382 @@
+// Package webhook posts device and measurement events of users to the webhooks they registered.
+// Events are queued in the database and delivered with a signature in the X-Msgp-Signature header, keyed
+// with the secret of the webhook (see Sign). Failed deliveries are retried with exponential backoff, the
+// result of the last attempt is kept in the delivery log of the webhook. Deliveries to different webhooks are
+// attempted concurrently, deliveries to the same webhook in the order they were queued: while a failed delivery
+// awaits its retry, later deliveries to its webhook are held back.
+// Webhooks are only delivered to public addresses, see db.PublicIP.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mysmartgrid/msg-prototype-2/db"
+	"github.com/mysmartgrid/msg2api"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// MaxAttempts is the number of attempts after which a delivery is given up.
+	MaxAttempts = 10
+	// LogRetention is the time finished deliveries are kept in the delivery log.
+	LogRetention = 30 * 24 * time.Hour
+
+	firstRetry = 30 * time.Second
+	maxRetry   = 6 * time.Hour
+	batchSize  = 100
+	timeout    = 10 * time.Second
+	// claimLease postpones claimed deliveries until they were attempted, it must exceed the time needed to attempt
+	// all deliveries of a batch to a single webhook.
+	claimLease = 2 * batchSize * timeout
+)
+
+var errPrivateTarget = errors.New("webhook resolves to a private or loopback address")
+
+// defaultClient is used for deliveries if the dispatcher has no client. It only connects to public addresses,
+// checked after resolving names so names resolving to private addresses are refused as well.
+var defaultClient = &http.Client{
+	Timeout: timeout,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: timeout, Control: dialPublic}).DialContext,
+		TLSHandshakeTimeout: timeout,
+	},
+}
+
+func dialPublic(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !db.PublicIP(ip) {
+		return errPrivateTarget
+	}
+	return nil
+}
+
+// Payload is the body of every delivery.
+type Payload struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// DeviceEvent is the data of device events.
+type DeviceEvent struct {
+	Device string `json:"device"`
+}
+
+// SensorEvent is the data of sensor events.
+type SensorEvent struct {
+	Device string `json:"device"`
+	Sensor string `json:"sensor"`
+}
+
+type event struct {
+	user string
+	// url additionally selects the webhooks of the user with the URL, regardless of their events, if not empty.
+	url     string
+	payload Payload
+}
+
+// Dispatcher queues and delivers events.
+// Events are passed with Emit and Measurement, and written to the database and delivered by Run.
+type Dispatcher struct {
+	Db db.Db
+	// Client is used for deliveries, a client connecting only to public addresses is used if nil.
+	Client *http.Client
+
+	mtx    sync.Mutex
+	hooks  map[string][]db.Webhook
+	byID   map[uint64]db.Webhook
+	queue  []event
+	values map[string]map[string]map[string][][2]float64
+}
+
+// Reload loads all webhooks from the database.
+func (d *Dispatcher) Reload() error {
+	var hooks []db.Webhook
+	err := d.Db.View(func(tx db.Tx) error {
+		var err error
+		hooks, err = tx.Webhooks()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	byUser := make(map[string][]db.Webhook)
+	byID := make(map[uint64]db.Webhook, len(hooks))
+	for _, w := range hooks {
+		byUser[w.User] = append(byUser[w.User], w)
+		byID[w.ID] = w
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.hooks = byUser
+	d.byID = byID
+	return nil
+}
+
+func (d *Dispatcher) wants(user, event string) bool {
+	for _, w := range d.hooks[user] {
+		if w.Wants(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// Emit queues an event for all webhooks of the user subscribed to it.
+func (d *Dispatcher) Emit(user, name string, data interface{}) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if !d.wants(user, name) {
+		return
+	}
+	d.queue = append(d.queue, event{user, "", Payload{name, time.Now(), data}})
+}
+
+// EmitTo queues an event for all webhooks of the user subscribed to it and the webhooks of the user with the given
+// URL, whether they are subscribed to it or not.
+func (d *Dispatcher) EmitTo(user, url, name string, data interface{}) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.queue = append(d.queue, event{user, url, Payload{name, time.Now(), data}})
+}
+
+// Measurement adds a value to the next measurements event of the user.
+// Values are sent as [milliseconds since epoch, value] pairs by device and sensor.
+func (d *Dispatcher) Measurement(user, device, sensor string, value msg2api.Measurement) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if !d.wants(user, db.WebhookMeasurements) {
+		return
+	}
+
+	if d.values == nil {
+		d.values = make(map[string]map[string]map[string][][2]float64)
+	}
+	if d.values[user] == nil {
+		d.values[user] = make(map[string]map[string][][2]float64)
+	}
+	if d.values[user][device] == nil {
+		d.values[user][device] = make(map[string][][2]float64)
+	}
+	ms := float64(value.Time.UnixNano() / int64(time.Millisecond))
+	d.values[user][device][sensor] = append(d.values[user][device][sensor], [2]float64{ms, value.Value})
+}
+
+// Run reloads the webhooks, queues all pending events and attempts all due deliveries every interval. Run does not return.
+func (d *Dispatcher) Run(interval time.Duration) {
+	var lastPrune time.Time
+	for {
+		if err := d.Reload(); err != nil {
+			log.Printf("could not load webhooks: %v", err)
+		}
+
+		if err := d.flush(); err != nil {
+			log.Printf("could not queue webhook events: %v", err)
+		}
+
+		if err := d.deliverPending(); err != nil {
+			log.Printf("could not deliver webhook events: %v", err)
+		}
+
+		if time.Since(lastPrune) > time.Hour {
+			err := d.Db.Update(func(tx db.Tx) error {
+				return tx.PruneWebhookDeliveries(time.Now().Add(-LogRetention))
+			})
+			if err != nil {
+				log.Printf("could not prune webhook deliveries: %v", err)
+			}
+			lastPrune = time.Now()
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func (d *Dispatcher) flush() error {
+	d.mtx.Lock()
+	queue, values := d.queue, d.values
+	d.queue, d.values = nil, nil
+	now := time.Now()
+	for user, devices := range values {
+		queue = append(queue, event{user, "", Payload{db.WebhookMeasurements, now, devices}})
+	}
+	hooks := d.hooks
+	d.mtx.Unlock()
+
+	if len(queue) == 0 {
+		return nil
+	}
+
+	return d.Db.Update(func(tx db.Tx) error {
+		for _, e := range queue {
+			body, err := json.Marshal(e.payload)
+			if err != nil {
+				return err
+			}
+			for _, w := range hooks[e.user] {
+				if !w.Wants(e.payload.Event) && (e.url == "" || w.URL != e.url) {
+					continue
+				}
+				if err := tx.QueueWebhookDelivery(w.ID, e.payload.Event, body); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// deliverPending claims due deliveries and attempts them, concurrently for different webhooks.
+func (d *Dispatcher) deliverPending() error {
+	var pending []db.WebhookDelivery
+	err := d.Db.Update(func(tx db.Tx) error {
+		var err error
+		pending, err = tx.ClaimWebhookDeliveries(batchSize, claimLease)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	byHook := make(map[uint64][]db.WebhookDelivery)
+	for _, delivery := range pending {
+		byHook[delivery.Webhook] = append(byHook[delivery.Webhook], delivery)
+	}
+
+	var wg sync.WaitGroup
+	for id, deliveries := range byHook {
+		d.mtx.Lock()
+		hook, ok := d.byID[id]
+		d.mtx.Unlock()
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(hook db.Webhook, deliveries []db.WebhookDelivery) {
+			defer wg.Done()
+			for i, delivery := range deliveries {
+				delivered, err := d.attempt(hook, delivery)
+				if err != nil {
+					log.Printf("could not record webhook delivery %v: %v", delivery.ID, err)
+				}
+				if !delivered {
+					d.release(deliveries[i+1:])
+					return
+				}
+			}
+		}(hook, deliveries)
+	}
+	wg.Wait()
+	return nil
+}
+
+// release makes the remaining claimed deliveries of a webhook due again after one of them failed. They are claimed
+// once the failed delivery succeeded or was given up.
+func (d *Dispatcher) release(deliveries []db.WebhookDelivery) {
+	if len(deliveries) == 0 {
+		return
+	}
+	ids := make([]uint64, len(deliveries))
+	for i, delivery := range deliveries {
+		ids[i] = delivery.ID
+	}
+	err := d.Db.Update(func(tx db.Tx) error {
+		return tx.ReleaseWebhookDeliveries(ids)
+	})
+	if err != nil {
+		log.Printf("could not release webhook deliveries: %v", err)
+	}
+}
+
+// attempt posts a delivery and records the result. It returns true if the delivery succeeded.
+func (d *Dispatcher) attempt(hook db.Webhook, delivery db.WebhookDelivery) (bool, error) {
+	status, err := d.post(hook, delivery)
+	failure := ""
+	var retryAt *time.Time
+	if err != nil {
+		failure = err.Error()
+		if delivery.Attempts+1 < MaxAttempts {
+			t := time.Now().Add(backoff(delivery.Attempts + 1))
+			retryAt = &t
+		}
+	}
+
+	return err == nil, d.Db.Update(func(tx db.Tx) error {
+		return tx.RecordWebhookAttempt(delivery.ID, status, failure, retryAt)
+	})
+}
+
+// backoff returns the delay before the next attempt after the given number of failed attempts.
+func backoff(attempts int) time.Duration {
+	delay := firstRetry
+	for i := 1; i < attempts && delay < maxRetry; i++ {
+		delay *= 2
+	}
+	if delay > maxRetry {
+		delay = maxRetry
+	}
+	return delay
+}
+
+// Sign returns the signature of a delivery body sent at the given unix timestamp.
+// The signature is the hex encoded HMAC-SHA256 of the decimal timestamp, a period and the body.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) post(hook db.Webhook, delivery db.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Msgp-Event", delivery.Event)
+	req.Header.Set("X-Msgp-Delivery", strconv.FormatUint(delivery.ID, 10))
+	req.Header.Set("X-Msgp-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Msgp-Signature", "sha256="+Sign(hook.Secret, ts, delivery.Payload))
+
+	client := d.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
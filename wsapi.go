@@ -5,14 +5,19 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/mysmartgrid/msg-prototype-2/alert"
 	"github.com/mysmartgrid/msg-prototype-2/db"
 	"github.com/mysmartgrid/msg-prototype-2/hub"
+	"github.com/mysmartgrid/msg-prototype-2/metrics"
+	"github.com/mysmartgrid/msg-prototype-2/webhook"
 	"github.com/mysmartgrid/msg2api"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -25,6 +30,26 @@ var (
 	errDeviceAlreadyRegistered = errors.New("device already registered")
 )
 
+const (
+	// getValuesChunkSize is the maximum number of values sent to a client in a single update.
+	getValuesChunkSize = 10000
+
+	// Alerts are sent to users as updates of the sensor of the alert with one of these resolutions.
+	// The value is the id of the alert, details are available through the REST API.
+	alertFiredResolution    = "alert"
+	alertResolvedResolution = "alert-resolved"
+
+	// Consumption summaries are requested with getValues and this resolution, and sent as one update of energy and
+	// one update of peak power per summary period, with resolutions summary-energy-<period> and summary-peak-<period>.
+	// Values of devices are sent for sensor "", the values of the user for device "" and sensor "".
+	summaryResolution = "summary"
+
+	// Every chunk of values sent for getValues is followed by an update with resolution progress-<resolution>,
+	// holding the timestamp of the last value sent and the fraction of the requested timespan sent so far as the
+	// only value, for device "" and sensor "".
+	progressResolutionPrefix = "progress-"
+)
+
 type measurementWithMetadata struct {
 	Device, Sensor string
 	Time           time.Time
@@ -39,9 +64,56 @@ type WsAPIContext struct {
 	Db db.Db
 	// Hub is the communication hub all associated APIs are using.
 	Hub *hub.Hub
+	// Alerts evaluates alert rules on incoming values if not nil.
+	Alerts *alert.Engine
+	// Webhooks receives device and measurement events if not nil.
+	Webhooks *webhook.Dispatcher
+	// MQTT republishes all stored values if not nil.
+	MQTT *MQTTBridge
 
 	devices map[string]*WsDevAPI
 	devMtx  sync.RWMutex
+
+	users   map[*WsUserAPI]bool
+	userMtx sync.Mutex
+}
+
+// UserSession identifies the login session a user websocket was opened with.
+type UserSession struct {
+	// User is the user logged in, which may differ from the user whose data the websocket shows.
+	User  string
+	ID    uint64
+	Token string
+}
+
+// CloseUserSessions closes the websockets of all users opened with sessions matched by fn, e.g. after the sessions
+// were ended.
+func (ctx *WsAPIContext) CloseUserSessions(fn func(s UserSession) bool) {
+	ctx.userMtx.Lock()
+	defer ctx.userMtx.Unlock()
+
+	for api := range ctx.users {
+		if fn(api.Session) {
+			api.Close()
+		}
+	}
+}
+
+func (ctx *WsAPIContext) registerUser(api *WsUserAPI) {
+	ctx.userMtx.Lock()
+	defer ctx.userMtx.Unlock()
+
+	if ctx.users == nil {
+		ctx.users = make(map[*WsUserAPI]bool)
+	}
+	ctx.users[api] = true
+}
+
+func (ctx *WsAPIContext) removeUser(api *WsUserAPI) {
+	ctx.userMtx.Lock()
+	defer ctx.userMtx.Unlock()
+
+	delete(ctx.users, api)
 }
 
 // RegisterDevice registers a new device, accessible via WsDevAPI at the API context.
@@ -100,6 +172,9 @@ type WsDevAPI struct {
 
 	lastRealtimeUpdateRequest time.Time
 
+	// lastValues holds the last accepted value of every sensor to check rates of change.
+	lastValues map[string]msg2api.Measurement
+
 	// User and Device id associated with the connection
 	User, Device string
 
@@ -149,7 +224,15 @@ func (api *WsDevAPI) Run() error {
 	api.server.AddSensor = api.doAddSensor
 	api.server.RemoveSensor = api.doRemoveSensor
 	api.server.UpdateMetadata = api.doUpdateMetadata
-	return api.server.Run(key)
+
+	metrics.Sessions.WithLabelValues("device").Inc()
+	err = api.server.Run(key)
+	metrics.Sessions.WithLabelValues("device").Dec()
+
+	if api.ctx.Webhooks != nil {
+		api.ctx.Webhooks.Emit(api.User, db.WebhookDeviceOffline, webhook.DeviceEvent{api.Device})
+	}
+	return err
 }
 
 // RequestRealtimeUpdates forwards a realtime updates request to the device if enough time has passed since the last request.
@@ -188,8 +271,9 @@ func (api *WsDevAPI) viewDevice(fn func(tx db.Tx, user db.User, device db.Device
 	return
 }
 
+// updateDevice runs fn in a transaction, err is nil only if the transaction was committed.
 func (api *WsDevAPI) updateDevice(fn func(tx db.Tx, user db.User, device db.Device) *msg2api.Error) (err *msg2api.Error) {
-	api.ctx.Db.Update(func(tx db.Tx) error {
+	txErr := api.ctx.Db.Update(func(tx db.Tx) error {
 		u := tx.User(api.User)
 		if u == nil {
 			err = errAPINotAuthorized
@@ -206,6 +290,9 @@ func (api *WsDevAPI) updateDevice(fn func(tx db.Tx, user db.User, device db.Devi
 		}
 		return err
 	})
+	if txErr != nil && err == nil {
+		err = &msg2api.Error{Code: "operation failed", Extra: txErr.Error()}
+	}
 	return
 }
 
@@ -252,44 +339,117 @@ func (api *WsDevAPI) postValuesToOldMSG(sensor string, values []msg2api.Measurem
 	return nil
 }
 
+// doUpdate stores values of any number of sensors of the device.
+// Values failing validation are quarantined, the other values of the sensor are stored.
+// If any sensor fails, the returned error lists the reason for every failed sensor as a JSON object in Extra.
 func (api *WsDevAPI) doUpdate(values map[string][]msg2api.Measurement) *msg2api.Error {
-	if len(values) != 1 {
-		return &msg2api.Error{Code: "invalid input", Extra: "exactly one sensor required"}
+	if len(values) == 0 {
+		return &msg2api.Error{Code: "invalid input", Extra: "no sensor given"}
 	}
 
 	return api.viewDevice(func(tx db.Tx, user db.User, device db.Device) *msg2api.Error {
-		for name := range values {
-			if device.Sensor(name) == nil {
-				return &msg2api.Error{Code: "no sensor", Extra: name}
-			}
+		sensors := device.Sensors()
+		rules := device.ValidationRules()
+		failed := make(map[string]string)
+		now := time.Now()
+		realtime := now.Sub(api.lastRealtimeUpdateRequest) < 40*time.Second
+		stored := 0
+
+		if api.lastValues == nil {
+			api.lastValues = make(map[string]msg2api.Measurement)
 		}
 
+	sensorLoop:
 		for sensor, values := range values {
-			if sensor[len(sensor)-3:] == "/wh" {
-				if err := api.postValuesToOldMSG(sensor[0:len(sensor)-3], values); err != nil {
-					return err
+			s, ok := sensors[sensor]
+			if !ok {
+				failed[sensor] = "no sensor"
+				continue
+			}
+
+			var rule *db.ValidationRule
+			if r, ok := rules[sensor]; ok {
+				rule = &r
+			}
+			var prev *msg2api.Measurement
+			if last, ok := api.lastValues[sensor]; ok {
+				prev = &last
+			}
+			accepted, rejected := db.ValidateReadings(values, rule, prev, now, false)
+			for _, r := range rejected {
+				if err := api.ctx.Db.Quarantine(s, r.Value, r.Err.Error()); err != nil {
+					log.Printf("could not quarantine value of %v/%v: %v", device.ID(), sensor, err)
+				}
+				metrics.ValuesReceived.WithLabelValues("quarantined").Inc()
+			}
+			if len(rejected) > 0 {
+				failed[sensor] = fmt.Sprintf("%v of %v values quarantined: %v", len(rejected), len(values), rejected[len(rejected)-1].Err)
+			}
+			if len(accepted) == 0 {
+				continue
+			}
+			api.lastValues[sensor] = accepted[len(accepted)-1]
+
+			calibrations, err := s.Calibrations()
+			if err != nil {
+				failed[sensor] = "could not load calibrations"
+				continue
+			}
+
+			if strings.HasSuffix(sensor, "/wh") {
+				if err := api.postValuesToOldMSG(sensor[0:len(sensor)-3], accepted); err != nil {
+					metrics.LegacyMirrorFailures.Inc()
+					failed[sensor] = err.Code + ": " + err.Extra
+					continue
 				}
 			}
 
-			s := device.Sensor(sensor)
-			for _, value := range values {
+			for _, value := range accepted {
 				err := api.ctx.Db.AddReading(s, value.Time, value.Value)
 				if err != nil {
-					return &msg2api.Error{Code: "could not add readings"}
+					failed[sensor] = "could not add readings"
+					continue sensorLoop
 				}
+				stored++
+				metrics.ValuesReceived.WithLabelValues("stored").Inc()
 
-				if time.Now().Sub(api.lastRealtimeUpdateRequest) < 40*time.Second {
-					api.ctx.Hub.Publish(api.User, measurementWithMetadata{device.ID(), s.ID(), value.Time, value.Value * s.Factor(), "raw"})
+				// values are corrected with the factor valid at their time, like values read from the database
+				factor := s.Factor()
+				if c, ok := db.CalibrationAt(calibrations, value.Time); ok {
+					factor = c.Factor
+				}
+				corrected := msg2api.Measurement{value.Time, value.Value * factor}
+
+				if realtime {
+					api.ctx.Hub.Publish(api.User, measurementWithMetadata{device.ID(), s.ID(), corrected.Time, corrected.Value, "raw"})
+				}
+				if api.ctx.MQTT != nil {
+					api.ctx.MQTT.PublishValue(api.User, device.ID(), s.ID(), corrected)
+				}
+				if api.ctx.Alerts != nil {
+					api.ctx.Alerts.Observe(api.User, device.ID(), s.ID(), corrected)
+				}
+				if api.ctx.Webhooks != nil {
+					api.ctx.Webhooks.Measurement(api.User, device.ID(), s.ID(), corrected)
 				}
 			}
 		}
 
-		return nil
+		if len(failed) == 0 {
+			return nil
+		}
+
+		code := "partial failure"
+		if stored == 0 {
+			code = "update failed"
+		}
+		extra, _ := json.Marshal(failed)
+		return &msg2api.Error{Code: code, Extra: string(extra)}
 	})
 }
 
 func (api *WsDevAPI) doAddSensor(name, unit string, port int32, factor float64) *msg2api.Error {
-	return api.updateDevice(func(tx db.Tx, user db.User, device db.Device) *msg2api.Error {
+	err := api.updateDevice(func(tx db.Tx, user db.User, device db.Device) *msg2api.Error {
 		_, err := device.AddSensor(name, unit, port, factor)
 		if err != nil {
 			return &msg2api.Error{Code: "operation failed", Extra: err.Error()}
@@ -309,10 +469,14 @@ func (api *WsDevAPI) doAddSensor(name, unit string, port int32, factor float64)
 		})
 		return nil
 	})
+	if err == nil && api.ctx.Webhooks != nil {
+		api.ctx.Webhooks.Emit(api.User, db.WebhookSensorAdded, webhook.SensorEvent{api.Device, name})
+	}
+	return err
 }
 
 func (api *WsDevAPI) doRemoveSensor(name string) *msg2api.Error {
-	return api.updateDevice(func(tx db.Tx, user db.User, device db.Device) *msg2api.Error {
+	err := api.updateDevice(func(tx db.Tx, user db.User, device db.Device) *msg2api.Error {
 		if err := device.RemoveSensor(name); err != nil {
 			return &msg2api.Error{Code: "operation failed", Extra: err.Error()}
 		}
@@ -327,6 +491,10 @@ func (api *WsDevAPI) doRemoveSensor(name string) *msg2api.Error {
 		})
 		return nil
 	})
+	if err == nil && api.ctx.Webhooks != nil {
+		api.ctx.Webhooks.Emit(api.User, db.WebhookSensorRemoved, webhook.SensorEvent{api.Device, name})
+	}
+	return err
 }
 
 func (api *WsDevAPI) doUpdateMetadata(metadata *msg2api.DeviceMetadata) *msg2api.Error {
@@ -345,15 +513,21 @@ func (api *WsDevAPI) doUpdateMetadata(metadata *msg2api.DeviceMetadata) *msg2api
 					return &msg2api.Error{Code: "failed", Extra: err.Error()}
 				}
 			}
-			if sd.Unit != nil {
-				return &msg2api.Error{Code: "failed", Extra: "unit may not be changed"}
-			}
-			if sd.Port != nil {
-				return &msg2api.Error{Code: "failed", Extra: "port may not be changed"}
-			}
-
-			if sd.Factor != nil {
-				return &msg2api.Error{Code: "failed", Extra: "factor may nor be changed"}
+			if sd.Unit != nil || sd.Port != nil || sd.Factor != nil {
+				// changes reported by the device apply to values measured from now on
+				c := db.Calibration{time.Now(), dbs.Unit(), dbs.Port(), dbs.Factor()}
+				if sd.Unit != nil {
+					c.Unit = *sd.Unit
+				}
+				if sd.Port != nil {
+					c.Port = *sd.Port
+				}
+				if sd.Factor != nil {
+					c.Factor = *sd.Factor
+				}
+				if err := dbs.Calibrate(c); err != nil {
+					return &msg2api.Error{Code: "failed", Extra: err.Error()}
+				}
 			}
 		}
 
@@ -372,9 +546,16 @@ func (api *WsDevAPI) doUpdateMetadata(metadata *msg2api.DeviceMetadata) *msg2api
 type WsUserAPI struct {
 	Ctx    *WsAPIContext
 	server *msg2api.UserServer
+	mtx    sync.Mutex
+	closed bool
 
 	// User id associated with the API.
 	User string
+	// ReadOnly is set for clients viewing the data of another user. Read only clients cannot request realtime
+	// updates from devices.
+	ReadOnly bool
+	// Session is the login session the websocket was opened with, see WsAPIContext.CloseUserSessions.
+	Session UserSession
 
 	// HTTP connection to communicate with the client.
 	Writer  http.ResponseWriter
@@ -409,6 +590,22 @@ func (api *WsUserAPI) Run() error {
 			case msg2api.UserEventMetadataArgs:
 				api.server.SendMetadata(v)
 
+			case alert.Event:
+				resolution, at := alertFiredResolution, v.Alert.Fired
+				if v.Alert.Resolved != nil {
+					resolution, at = alertResolvedResolution, *v.Alert.Resolved
+				}
+				api.server.SendUpdate(msg2api.UserEventUpdateArgs{
+					Resolution: resolution,
+					Values: map[string]map[string][]msg2api.Measurement{
+						v.Alert.Device: {
+							v.Alert.Sensor: {
+								{at, float64(v.Alert.ID)},
+							},
+						},
+					},
+				})
+
 			default:
 				log.Printf("bad hub value type %T\n", val.Data)
 			}
@@ -420,15 +617,33 @@ func (api *WsUserAPI) Run() error {
 		return err
 	}
 
+	server.GetMetadata = api.doGetMetadata
+	server.GetValues = api.doGetValues
+	server.RequestRealtimeUpdates = api.doRequestRealtimeUpdates
+
+	api.Ctx.registerUser(api)
+	defer api.Ctx.removeUser(api)
+
+	api.mtx.Lock()
+	if api.closed {
+		api.mtx.Unlock()
+		server.Close()
+		return nil
+	}
 	api.server = server
-	api.server.GetMetadata = api.doGetMetadata
-	api.server.GetValues = api.doGetValues
-	api.server.RequestRealtimeUpdates = api.doRequestRealtimeUpdates
+	api.mtx.Unlock()
+
+	metrics.Sessions.WithLabelValues("user").Inc()
+	defer metrics.Sessions.WithLabelValues("user").Dec()
 	return api.server.Run()
 }
 
 // Close closes the user server connections.
 func (api *WsUserAPI) Close() {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+
+	api.closed = true
 	if api.server != nil {
 		api.server.Close()
 	}
@@ -472,45 +687,87 @@ func (api *WsUserAPI) doGetMetadata() error {
 }
 
 func (api *WsUserAPI) doGetValues(since, until time.Time, resolution string, sensors map[string][]string) error {
-	return api.Ctx.Db.View(func(tx db.Tx) error {
-		user := tx.User(api.User)
-		if user == nil {
-			return errNotAuthorized
-		}
+	if resolution == summaryResolution {
+		return api.sendSummary()
+	}
 
-		readings, err := user.LoadReadings(since, until, resolution, sensors)
+	// Values are sent as they are loaded. If the client has gone away, sending fails and loading stops.
+	err := api.Ctx.Db.StreamReadings(api.User, since, until, resolution, sensors, getValuesChunkSize, func(chunk db.ReadingsChunk) error {
+		err := api.server.SendUpdate(msg2api.UserEventUpdateArgs{
+			Resolution: resolution,
+			Values:     chunk.Values,
+		})
 		if err != nil {
 			return err
 		}
+		return api.server.SendUpdate(msg2api.UserEventUpdateArgs{
+			Resolution: progressResolutionPrefix + resolution,
+			Values: map[string]map[string][]msg2api.Measurement{
+				"": {"": {{chunk.Last, chunk.Progress}}},
+			},
+		})
+	})
+	if err == db.ErrNoUser {
+		return errNotAuthorized
+	}
+	return err
+}
 
-		update := msg2api.UserEventUpdateArgs{
-			Resolution: resolution,
-			Values:     readings,
+func (api *WsUserAPI) sendSummary() error {
+	var summary map[string]*db.ConsumptionSummary
+	err := api.Ctx.Db.View(func(tx db.Tx) error {
+		user := tx.User(api.User)
+		if user == nil {
+			return errNotAuthorized
 		}
+		var err error
+		summary, err = user.ConsumptionSummary()
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-		// Also send already aggregated second values as 'raw'
-		if resolution == "raw" {
-			secondReadings, err := user.LoadReadings(since, until, "second", sensors)
-			if err != nil {
-				return err
+	for period, s := range summary {
+		energy := make(map[string]map[string][]msg2api.Measurement)
+		peak := make(map[string]map[string][]msg2api.Measurement)
+		add := func(device, sensor string, c db.Consumption) {
+			if energy[device] == nil {
+				energy[device] = make(map[string][]msg2api.Measurement)
+				peak[device] = make(map[string][]msg2api.Measurement)
 			}
-
-			secondUpdate := msg2api.UserEventUpdateArgs{
-				Resolution: resolution,
-				Values:     secondReadings,
+			energy[device][sensor] = []msg2api.Measurement{{s.Updated, c.Energy}}
+			if c.Peak != nil {
+				peak[device][sensor] = []msg2api.Measurement{{s.Updated, *c.Peak}}
 			}
+		}
 
-			err = api.server.SendUpdate(secondUpdate)
-			if err != nil {
-				return err
+		add("", "", s.Total)
+		for device, c := range s.Devices {
+			add(device, "", c)
+		}
+		for device, sensors := range s.Sensors {
+			for sensor, c := range sensors {
+				add(device, sensor, c)
 			}
 		}
 
-		return api.server.SendUpdate(update)
-	})
+		err := api.server.SendUpdate(msg2api.UserEventUpdateArgs{Resolution: "summary-energy-" + period, Values: energy})
+		if err != nil {
+			return err
+		}
+		err = api.server.SendUpdate(msg2api.UserEventUpdateArgs{Resolution: "summary-peak-" + period, Values: peak})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (api *WsUserAPI) doRequestRealtimeUpdates(sensors map[string][]string) error {
+	if api.ReadOnly {
+		return errNotAuthorized
+	}
 	for dev, sensors := range sensors {
 		err := api.Ctx.WithDevice(dev, func(dev *WsDevAPI) error {
 			dev.RequestRealtimeUpdates(sensors)